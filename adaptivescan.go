@@ -0,0 +1,187 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// AdaptiveScanOptions tunes ScanAdaptive. Zero values select the defaults in brackets.
+type AdaptiveScanOptions struct {
+	// Count is the initial SCAN COUNT hint [100], kept between MinCount [10] and MaxCount [1000].
+	Count    int
+	MinCount int
+	MaxCount int
+	// TargetLatency is the p99 PING round trip [5ms] above which the scan backs off.
+	TargetLatency time.Duration
+	// Window is the number of latency samples the p99 is computed over [50].
+	Window int
+	// MaxPause caps the pause inserted between batches while backing off [1s].
+	MaxPause time.Duration
+	// CheckpointKey, when set, stores the cursor after every batch, so a scan stopped
+	// through its context resumes where it left off. The key is deleted once the scan
+	// completes.
+	CheckpointKey string
+}
+
+func (o *AdaptiveScanOptions) defaults() {
+	if o.Count <= 0 {
+		o.Count = 100
+	}
+	if o.MinCount <= 0 {
+		o.MinCount = 10
+	}
+	if o.MaxCount <= 0 {
+		o.MaxCount = 1000
+	}
+	if o.TargetLatency <= 0 {
+		o.TargetLatency = 5 * time.Millisecond
+	}
+	if o.Window <= 0 {
+		o.Window = 50
+	}
+	if o.MaxPause <= 0 {
+		o.MaxPause = time.Second
+	}
+}
+
+// ScanAdaptive SCANs keys matching pattern and passes every batch to fn, for maintenance
+// jobs running against production. After each batch it measures a PING round trip as a
+// signal of server load: while the p99 is above the target it shrinks COUNT and pauses
+// between batches, and it speeds back up once latency recovers. Returning an error from
+// fn stops the scan with that error.
+func (d *RedisDatabase) ScanAdaptive(pattern string, opts AdaptiveScanOptions, fn func(keys []string) error) error {
+	return d.ScanAdaptiveContext(context.Background(), pattern, opts, fn)
+}
+
+// ScanAdaptiveContext is ScanAdaptive that stops between batches once ctx is done,
+// returning ctx.Err() with the checkpoint left in place.
+func (d *RedisDatabase) ScanAdaptiveContext(ctx context.Context, pattern string, opts AdaptiveScanOptions, fn func(keys []string) error) error {
+	opts.defaults()
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close scanning '%s' keys: %v", pattern, err)
+		}
+	}(conn)
+
+	latencies := newLatencyWindow(opts.Window)
+	count := opts.Count
+	var pause time.Duration
+	cursor := 0
+	if opts.CheckpointKey != "" {
+		saved, err := redis.Int(d.do(conn, "GET", opts.CheckpointKey))
+		if err != nil && err != redis.ErrNil {
+			return fmt.Errorf("error loading scan checkpoint %s: %w", opts.CheckpointKey, err)
+		}
+		cursor = saved
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		arr, err := redis.Values(d.do(conn, "SCAN", cursor, "MATCH", pattern, "COUNT", count))
+		if err != nil {
+			return fmt.Errorf("error scanning '%s' keys: %w", pattern, err)
+		}
+		cursor, _ = redis.Int(arr[0], nil)
+		keys, _ := redis.Strings(arr[1], nil)
+
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if opts.CheckpointKey != "" {
+			if cursor == 0 {
+				_, err = d.do(conn, "DEL", opts.CheckpointKey)
+			} else {
+				_, err = d.do(conn, "SET", opts.CheckpointKey, cursor)
+			}
+			if err != nil {
+				return fmt.Errorf("error saving scan checkpoint %s: %w", opts.CheckpointKey, err)
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+
+		start := time.Now()
+		if _, err := d.do(conn, "PING"); err != nil {
+			return fmt.Errorf("error scanning '%s' keys: %w", pattern, err)
+		}
+		latencies.add(time.Since(start))
+
+		if p99 := latencies.percentile(0.99); p99 > opts.TargetLatency {
+			count = maxInt(count/2, opts.MinCount)
+			pause = minDuration(maxDuration(pause*2, 10*time.Millisecond), opts.MaxPause)
+		} else if p99 < opts.TargetLatency/2 {
+			count = minInt(count+count/4+1, opts.MaxCount)
+			pause /= 2
+		}
+		if pause > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pause):
+			}
+		}
+	}
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minDuration(a time.Duration, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,236 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math/big"
+	"time"
+)
+
+// ErrAliasExists is matched by errors.Is when a custom alias code is already taken.
+var ErrAliasExists = errors.New("redis: alias already exists")
+
+// aliasCreateScript stores target ARGV[1] in the alias hash KEYS[1] unless it exists,
+// expiring it after ARGV[2] milliseconds when positive.
+var aliasCreateScript = redis.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+  return 0
+end
+redis.call('HSET', KEYS[1], 'target', ARGV[1], 'hits', 0)
+if tonumber(ARGV[2]) > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1`)
+
+// aliasResolveScript returns the target of the alias hash KEYS[1] and counts the hit.
+var aliasResolveScript = redis.NewScript(1, `
+local target = redis.call('HGET', KEYS[1], 'target')
+if target then
+  redis.call('HINCRBY', KEYS[1], 'hits', 1)
+end
+return target`)
+
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// AliasStoreOptions configures an AliasStore. Zero values select the defaults in brackets.
+type AliasStoreOptions struct {
+	// Prefix is prepended to the codes to form the keys ["alias:"].
+	Prefix string
+	// CodeLength is the length of generated codes [7].
+	CodeLength int
+	// Alphabet generated codes are drawn from [0-9A-Za-z].
+	Alphabet string
+	// MaxAttempts is the number of generated codes tried before Create gives up [10].
+	MaxAttempts int
+}
+
+// Alias is a stored alias.
+type Alias struct {
+	Code   string
+	Target string
+	Hits   int64
+	// TTL is the remaining time to live, zero when the alias does not expire.
+	TTL time.Duration
+}
+
+// AliasStore maps short random codes to targets such as URLs, the core of a URL
+// shortener. Codes are claimed atomically, so concurrent creators never share a code,
+// and every Resolve counts a hit.
+type AliasStore struct {
+	d    *RedisDatabase
+	opts AliasStoreOptions
+}
+
+// NewAliasStore creates an alias store on d.
+func NewAliasStore(d *RedisDatabase, opts AliasStoreOptions) *AliasStore {
+	if opts.Prefix == "" {
+		opts.Prefix = "alias:"
+	}
+	if opts.CodeLength <= 0 {
+		opts.CodeLength = 7
+	}
+	if opts.Alphabet == "" {
+		opts.Alphabet = base62
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 10
+	}
+	return &AliasStore{d: d, opts: opts}
+}
+
+// Create stores target under a new random code and returns the code. A ttl of zero
+// keeps the alias until deleted.
+func (s *AliasStore) Create(target string, ttl time.Duration) (string, error) {
+	for i := 0; i < s.opts.MaxAttempts; i++ {
+		code, err := s.generate()
+		if err != nil {
+			return "", err
+		}
+		created, err := s.create(code, target, ttl)
+		if err != nil {
+			return "", err
+		}
+		if created {
+			return code, nil
+		}
+	}
+	return "", fmt.Errorf("redis: no free alias code after %d attempts, use longer codes", s.opts.MaxAttempts)
+}
+
+// CreateCustom stores target under code, failing with ErrAliasExists when it is taken.
+func (s *AliasStore) CreateCustom(code string, target string, ttl time.Duration) error {
+	created, err := s.create(code, target, ttl)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("error creating alias %s: %w", code, ErrAliasExists)
+	}
+	return nil
+}
+
+func (s *AliasStore) create(code string, target string, ttl time.Duration) (bool, error) {
+	conn := s.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close creating alias %s: %v", code, err)
+		}
+	}(conn)
+
+	created, err := redis.Bool(aliasCreateScript.Do(instrumentedConn{conn, s.d}, s.opts.Prefix+code, target, ttl.Milliseconds()))
+	if err != nil {
+		return false, fmt.Errorf("error creating alias %s: %w", code, err)
+	}
+	return created, nil
+}
+
+func (s *AliasStore) generate() (string, error) {
+	code := make([]byte, s.opts.CodeLength)
+	max := big.NewInt(int64(len(s.opts.Alphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("error generating alias code: %w", err)
+		}
+		code[i] = s.opts.Alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// Resolve returns the target of code and counts a hit, failing with ErrKeyNotFound
+// when the alias does not exist or expired.
+func (s *AliasStore) Resolve(code string) (string, error) {
+	conn := s.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close resolving alias %s: %v", code, err)
+		}
+	}(conn)
+
+	target, err := redis.String(aliasResolveScript.Do(instrumentedConn{conn, s.d}, s.opts.Prefix+code))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("error resolving alias %s: %w", code, ErrKeyNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error resolving alias %s: %w", code, err)
+	}
+	return target, nil
+}
+
+// Get returns the alias without counting a hit.
+func (s *AliasStore) Get(code string) (Alias, error) {
+	conn := s.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close getting alias %s: %v", code, err)
+		}
+	}(conn)
+
+	key := s.opts.Prefix + code
+	alias := Alias{Code: code}
+	if err := conn.Send("HMGET", key, "target", "hits"); err != nil {
+		return alias, fmt.Errorf("error getting alias %s: %w", code, err)
+	}
+	if err := conn.Send("PTTL", key); err != nil {
+		return alias, fmt.Errorf("error getting alias %s: %w", code, err)
+	}
+	if err := conn.Flush(); err != nil {
+		return alias, fmt.Errorf("error getting alias %s: %w", code, err)
+	}
+	fields, err := redis.Values(conn.Receive())
+	if err != nil {
+		return alias, fmt.Errorf("error getting alias %s: %w", code, err)
+	}
+	ttl, err := redis.Int64(conn.Receive())
+	if err != nil {
+		return alias, fmt.Errorf("error getting alias %s: %w", code, err)
+	}
+	if len(fields) != 2 || fields[0] == nil {
+		return alias, fmt.Errorf("error getting alias %s: %w", code, ErrKeyNotFound)
+	}
+	alias.Target, _ = redis.String(fields[0], nil)
+	alias.Hits, _ = redis.Int64(fields[1], nil)
+	if ttl > 0 {
+		alias.TTL = time.Duration(ttl) * time.Millisecond
+	}
+	return alias, nil
+}
+
+// Delete removes the alias.
+func (s *AliasStore) Delete(code string) error {
+	if err := s.d.Delete(s.opts.Prefix + code); err != nil {
+		return fmt.Errorf("error deleting alias %s: %w", code, err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ttlBucketBounds are the upper bounds of the TTL histogram buckets; keys with a longer
+// TTL fall in a final open-ended bucket.
+var ttlBucketBounds = []time.Duration{
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// TTLBucket counts sampled keys whose TTL is below UpperBound. The last bucket of a
+// report has a zero UpperBound and holds everything longer than the previous bound.
+type TTLBucket struct {
+	UpperBound time.Duration
+	Count      int
+}
+
+// KeyReport summarizes TTLs and memory usage of a sample of keys under a prefix.
+type KeyReport struct {
+	Prefix     string
+	Sampled    int
+	NoExpiry   int
+	TTLBuckets []TTLBucket
+	// Size percentiles in bytes as reported by MEMORY USAGE.
+	SizeP50 int64
+	SizeP90 int64
+	SizeP99 int64
+	SizeMax int64
+}
+
+// sampleKeys SCANs for up to n keys matching pattern.
+func (d *RedisDatabase) sampleKeys(conn redis.Conn, pattern string, n int) ([]string, error) {
+	var keys []string
+	cursor := 0
+	for {
+		arr, err := redis.Values(d.do(conn, "SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return keys, fmt.Errorf("error sampling '%s' keys: %w", pattern, err)
+		}
+		cursor, _ = redis.Int(arr[0], nil)
+		k, _ := redis.Strings(arr[1], nil)
+		keys = append(keys, k...)
+
+		if cursor == 0 || len(keys) >= n {
+			break
+		}
+	}
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys, nil
+}
+
+// AnalyzeKeys samples up to sampleSize keys for every prefix and reports their TTL
+// distribution and size percentiles.
+func (d *RedisDatabase) AnalyzeKeys(prefixes []string, sampleSize int) ([]KeyReport, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close analyzing keys: %v", err)
+		}
+	}(conn)
+
+	reports := make([]KeyReport, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		keys, err := d.sampleKeys(conn, prefix+"*", sampleSize)
+		if err != nil {
+			return reports, err
+		}
+
+		for _, key := range keys {
+			if err := conn.Send("PTTL", key); err != nil {
+				return reports, err
+			}
+			if err := conn.Send("MEMORY", "USAGE", key); err != nil {
+				return reports, err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return reports, fmt.Errorf("error analyzing '%s' keys: %w", prefix, err)
+		}
+
+		report := KeyReport{Prefix: prefix, TTLBuckets: make([]TTLBucket, len(ttlBucketBounds)+1)}
+		for i, bound := range ttlBucketBounds {
+			report.TTLBuckets[i].UpperBound = bound
+		}
+		var sizes []int64
+		for _, key := range keys {
+			ttl, err := redis.Int64(conn.Receive())
+			if err != nil {
+				return reports, fmt.Errorf("error reading ttl of key %s: %w", key, err)
+			}
+			size, err := redis.Int64(conn.Receive())
+			if err != nil && err != redis.ErrNil {
+				return reports, fmt.Errorf("error reading memory usage of key %s: %w", key, err)
+			}
+			if ttl == -2 {
+				// expired or deleted since it was scanned
+				continue
+			}
+
+			report.Sampled++
+			sizes = append(sizes, size)
+			if ttl == -1 {
+				report.NoExpiry++
+				continue
+			}
+			report.TTLBuckets[ttlBucket(time.Duration(ttl)*time.Millisecond)].Count++
+		}
+
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+		report.SizeP50 = percentile(sizes, 0.50)
+		report.SizeP90 = percentile(sizes, 0.90)
+		report.SizeP99 = percentile(sizes, 0.99)
+		if len(sizes) > 0 {
+			report.SizeMax = sizes[len(sizes)-1]
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func ttlBucket(ttl time.Duration) int {
+	for i, bound := range ttlBucketBounds {
+		if ttl < bound {
+			return i
+		}
+	}
+	return len(ttlBucketBounds)
+}
+
+// percentile returns the p-th percentile of sorted values using nearest rank.
+func percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// WriteTo prints the report as a text histogram.
+func (r KeyReport) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s* (%d keys sampled)\n", r.Prefix, r.Sampled)
+	fmt.Fprintf(&b, "  size bytes: p50=%d p90=%d p99=%d max=%d\n", r.SizeP50, r.SizeP90, r.SizeP99, r.SizeMax)
+	fmt.Fprintf(&b, "  ttl:\n")
+	line := func(label string, count int) {
+		bar := ""
+		if r.Sampled > 0 {
+			bar = strings.Repeat("#", count*40/r.Sampled)
+		}
+		fmt.Fprintf(&b, "    %-10s %6d %s\n", label, count, bar)
+	}
+	for i, bucket := range r.TTLBuckets {
+		if i < len(r.TTLBuckets)-1 {
+			line("< "+bucket.UpperBound.String(), bucket.Count)
+		} else {
+			line(">= "+r.TTLBuckets[i-1].UpperBound.String(), bucket.Count)
+		}
+	}
+	line("none", r.NoExpiry)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,188 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrAsyncQueueFull is returned when a write can not be queued without blocking.
+	ErrAsyncQueueFull = errors.New("redis: async write queue is full")
+	// ErrAsyncWriterClosed is returned for writes queued after Close.
+	ErrAsyncWriterClosed = errors.New("redis: async writer is closed")
+)
+
+type asyncWrite struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+// AsyncWriter performs best-effort writes on a bounded pool of workers so latency
+// critical paths can populate the cache without waiting for Redis.
+type AsyncWriter struct {
+	d       *RedisDatabase
+	queue   chan asyncWrite
+	onError func(key string, err error)
+	workers sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	idle    *sync.Cond
+	pending int
+
+	abort     chan struct{}
+	abortOnce sync.Once
+	dropped   int
+}
+
+// NewAsyncWriter starts workers goroutines draining a queue of queueSize writes. Failed
+// writes are reported to onError, which may be nil.
+func NewAsyncWriter(d *RedisDatabase, workers int, queueSize int, onError func(key string, err error)) *AsyncWriter {
+	if workers <= 0 {
+		workers = 1
+	}
+	w := &AsyncWriter{
+		d:       d,
+		queue:   make(chan asyncWrite, queueSize),
+		onError: onError,
+		abort:   make(chan struct{}),
+	}
+	w.idle = sync.NewCond(&w.mu)
+	for i := 0; i < workers; i++ {
+		w.workers.Add(1)
+		go w.work()
+	}
+	return w
+}
+
+func (w *AsyncWriter) work() {
+	defer w.workers.Done()
+	for write := range w.queue {
+		select {
+		case <-w.abort:
+			w.mu.Lock()
+			w.dropped++
+			w.mu.Unlock()
+			w.attempted()
+			continue
+		default:
+		}
+
+		var err error
+		if write.delete {
+			err = w.d.Delete(write.key)
+		} else {
+			err = w.d.Set(write.key, write.value)
+		}
+		if err != nil && w.onError != nil {
+			_ = w.d.options().call("async writer error callback", func() error {
+				w.onError(write.key, err)
+				return nil
+			})
+		}
+		w.attempted()
+	}
+}
+
+func (w *AsyncWriter) attempted() {
+	w.mu.Lock()
+	w.pending--
+	if w.pending == 0 {
+		w.idle.Broadcast()
+	}
+	w.mu.Unlock()
+}
+
+func (w *AsyncWriter) enqueue(write asyncWrite) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrAsyncWriterClosed
+	}
+	select {
+	case w.queue <- write:
+		w.pending++
+		return nil
+	default:
+		return ErrAsyncQueueFull
+	}
+}
+
+// SetAsync queues a SET of key and returns immediately. It returns ErrAsyncQueueFull
+// rather than blocking when the workers fall behind.
+func (w *AsyncWriter) SetAsync(key string, value []byte) error {
+	return w.enqueue(asyncWrite{key: key, value: value})
+}
+
+// DeleteAsync queues a DEL of key and returns immediately.
+func (w *AsyncWriter) DeleteAsync(key string) error {
+	return w.enqueue(asyncWrite{key: key, delete: true})
+}
+
+// Flush blocks until every write queued so far has been attempted.
+func (w *AsyncWriter) Flush() {
+	w.mu.Lock()
+	for w.pending > 0 {
+		w.idle.Wait()
+	}
+	w.mu.Unlock()
+}
+
+// Close stops accepting writes, drains the queue and waits for the workers to exit.
+func (w *AsyncWriter) Close() {
+	_ = w.Stop(context.Background())
+}
+
+// Stop stops accepting writes and drains the queue until ctx is done. Writes still
+// queued then are skipped, and the error reports how many were lost.
+func (w *AsyncWriter) Stop(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.workers.Wait()
+		close(done)
+	}()
+	if err := waitDone(ctx, done); err != nil {
+		w.abortOnce.Do(func() { close(w.abort) })
+		<-done
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return fmt.Errorf("redis: async writer stopped with %d writes not attempted: %w", w.dropped, err)
+	}
+	return nil
+}
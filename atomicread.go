@@ -0,0 +1,165 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// getMultiScript reads strings and hashes in one script, so all of them are observed at
+// the same point in time.
+var getMultiScript = redis.NewScript(-1, `
+local out = {}
+for i, key in ipairs(KEYS) do
+  local t = redis.call('TYPE', key).ok
+  if t == 'string' then
+    out[i] = {t, redis.call('GET', key)}
+  elseif t == 'hash' then
+    out[i] = {t, redis.call('HGETALL', key)}
+  else
+    out[i] = {t}
+  end
+end
+return out`)
+
+// MultiSnapshot holds the keys read by GetMultiAtomic that exist, by type.
+type MultiSnapshot struct {
+	Strings map[string][]byte
+	Hashes  map[string]map[string]string
+}
+
+// GetMultiAtomic reads string and hash keys in a single Lua script, so related keys such
+// as a config and its checksum are mutually consistent. Missing keys and keys holding a
+// DeleteSoft tombstone are left out; keys of other types are an error. On a cluster all
+// keys must share a hash tag.
+func (d *RedisDatabase) GetMultiAtomic(keys ...string) (MultiSnapshot, error) {
+	snapshot := MultiSnapshot{Strings: map[string][]byte{}, Hashes: map[string]map[string]string{}}
+	if len(keys) == 0 {
+		return snapshot, nil
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reading %d keys: %v", len(keys), err)
+		}
+	}(conn)
+
+	replies, err := redis.Values(getMultiScript.Do(instrumentedConn{conn, d}, redis.Args{len(keys)}.AddFlat(keys)...))
+	if err != nil {
+		return snapshot, fmt.Errorf("error reading %d keys: %w", len(keys), err)
+	}
+	if len(replies) != len(keys) {
+		return snapshot, fmt.Errorf("redis: script returned %d values for %d keys", len(replies), len(keys))
+	}
+
+	for i, reply := range replies {
+		entry, err := redis.Values(reply, nil)
+		if err != nil || len(entry) == 0 {
+			return snapshot, fmt.Errorf("error reading key %s: unexpected reply %v", keys[i], reply)
+		}
+		kind, _ := redis.String(entry[0], nil)
+		switch {
+		case kind == "none":
+		case kind == "string" && len(entry) == 2:
+			value, _ := redis.Bytes(entry[1], nil)
+			if !IsTombstone(value) {
+				snapshot.Strings[keys[i]] = value
+			}
+		case kind == "hash" && len(entry) == 2:
+			snapshot.Hashes[keys[i]], _ = redis.StringMap(entry[1], nil)
+		default:
+			return snapshot, fmt.Errorf("redis: key %s is a %s, not a string or hash", keys[i], kind)
+		}
+	}
+	return snapshot, nil
+}
+
+// getWithTTLScript reads the value and remaining TTL in milliseconds of every key.
+var getWithTTLScript = redis.NewScript(-1, `
+local out = {}
+for i, key in ipairs(KEYS) do
+  out[i] = {redis.call('GET', key), redis.call('PTTL', key)}
+end
+return out`)
+
+// ValueWithTTL is a value read by GetWithTTL and its remaining time to live, which is 0
+// for keys without expiry.
+type ValueWithTTL struct {
+	Value []byte
+	TTL   time.Duration
+}
+
+// GetWithTTL reads string keys together with their remaining TTL in a single script call,
+// for callers that refresh entries proactively before they expire. Missing keys and keys
+// holding a DeleteSoft tombstone are left out. On a cluster all keys must share a hash
+// tag.
+func (d *RedisDatabase) GetWithTTL(keys ...string) (map[string]ValueWithTTL, error) {
+	values := map[string]ValueWithTTL{}
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reading %d keys: %v", len(keys), err)
+		}
+	}(conn)
+
+	replies, err := redis.Values(getWithTTLScript.Do(instrumentedConn{conn, d}, redis.Args{len(keys)}.AddFlat(keys)...))
+	if err != nil {
+		return values, fmt.Errorf("error reading %d keys: %w", len(keys), err)
+	}
+	if len(replies) != len(keys) {
+		return values, fmt.Errorf("redis: script returned %d values for %d keys", len(replies), len(keys))
+	}
+
+	for i, reply := range replies {
+		entry, err := redis.Values(reply, nil)
+		if err != nil || len(entry) != 2 {
+			return values, fmt.Errorf("error reading key %s: unexpected reply %v", keys[i], reply)
+		}
+		if entry[0] == nil {
+			continue
+		}
+		value, _ := redis.Bytes(entry[0], nil)
+		if IsTombstone(value) {
+			continue
+		}
+		ms, _ := redis.Int64(entry[1], nil)
+		if ms < 0 {
+			ms = 0
+		}
+		values[keys[i]] = ValueWithTTL{Value: value, TTL: time.Duration(ms) * time.Millisecond}
+	}
+	return values, nil
+}
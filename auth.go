@@ -0,0 +1,113 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net/url"
+	"strings"
+)
+
+// AuthFunc returns the credentials for a connection. It is called on every dial and again
+// when the server answers NOAUTH, for example after a password rotation, so new
+// credentials are picked up without restarting the service. An empty username
+// authenticates the default user.
+type AuthFunc func(ctx context.Context) (username string, password string, err error)
+
+// WithAuth authenticates connections with the credentials returned by fn instead of the
+// ones in the url or dial options.
+func WithAuth(fn AuthFunc) Option {
+	return func(o *options) {
+		o.auth = fn
+	}
+}
+
+// isAuthError reports whether err is a NOAUTH or WRONGPASS reply.
+func isAuthError(err error) bool {
+	var re redis.Error
+	if !errors.As(err, &re) {
+		return false
+	}
+	return strings.HasPrefix(string(re), "NOAUTH") || strings.HasPrefix(string(re), "WRONGPASS")
+}
+
+// dialURL dials with the credentials from WithAuth when set, asking for fresh ones once
+// when the server rejects them.
+func dialURL(ctx context.Context, redisURL string, dialOptions []redis.DialOption, o *options) (redis.Conn, error) {
+	if o.auth == nil {
+		return redis.DialURLContext(ctx, redisURL, dialOptions...)
+	}
+
+	redisURL = withoutUserInfo(redisURL)
+	for {
+		username, password, err := o.auth(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting redis credentials: %w", err)
+		}
+		authOptions := dialOptions[:len(dialOptions):len(dialOptions)]
+		if username != "" {
+			authOptions = append(authOptions, redis.DialUsername(username))
+		}
+		if password != "" {
+			authOptions = append(authOptions, redis.DialPassword(password))
+		}
+
+		c, err := redis.DialURLContext(ctx, redisURL, authOptions...)
+		if !isAuthError(err) || AuthRetry(ctx) {
+			return c, err
+		}
+		ctx = context.WithValue(ctx, authRetryKey{}, true)
+	}
+}
+
+// withoutUserInfo drops the credentials from redisURL, since redis.DialURL lets them
+// override the dial options.
+func withoutUserInfo(redisURL string) string {
+	u, err := url.Parse(redisURL)
+	if err != nil || u.User == nil {
+		return redisURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// reauth authenticates c again with fresh credentials.
+func reauth(c redis.Conn, fn AuthFunc) error {
+	username, password, err := fn(context.WithValue(context.Background(), authRetryKey{}, true))
+	if err != nil {
+		return fmt.Errorf("error getting redis credentials: %w", err)
+	}
+	if username != "" {
+		_, err = c.Do("AUTH", username, password)
+	} else {
+		_, err = c.Do("AUTH", password)
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backoffExtendScript sets the cooldown key KEYS[1] to expire after ARGV[1] milliseconds
+// unless it already expires later, and returns the remaining cooldown in milliseconds.
+var backoffExtendScript = redis.NewScript(1, `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < tonumber(ARGV[1]) then
+  redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[1])
+  return tonumber(ARGV[1])
+end
+return ttl`)
+
+// BackoffStateOptions configures a BackoffState. Zero values select the defaults in
+// brackets.
+type BackoffStateOptions struct {
+	// Prefix is prepended to the downstream name to form the key ["backoff:"].
+	Prefix string
+	// MaxCooldown caps a single cooldown, guarding against absurd Retry-After values [1h].
+	MaxCooldown time.Duration
+}
+
+// BackoffState shares cooldowns of rate limited downstream services between instances:
+// when one instance is told to back off, every instance checking Cooldown waits too.
+// Cooldowns only ever grow until they expire, so concurrent reports keep the longest.
+type BackoffState struct {
+	d    *RedisDatabase
+	opts BackoffStateOptions
+}
+
+// NewBackoffState creates a BackoffState on d.
+func NewBackoffState(d *RedisDatabase, opts BackoffStateOptions) *BackoffState {
+	if opts.Prefix == "" {
+		opts.Prefix = "backoff:"
+	}
+	if opts.MaxCooldown <= 0 {
+		opts.MaxCooldown = time.Hour
+	}
+	return &BackoffState{d: d, opts: opts}
+}
+
+// BackOff starts or extends the cooldown of downstream to at least cooldown and returns
+// the cooldown now in effect.
+func (b *BackoffState) BackOff(downstream string, cooldown time.Duration) (time.Duration, error) {
+	if cooldown > b.opts.MaxCooldown {
+		cooldown = b.opts.MaxCooldown
+	}
+	if cooldown < time.Millisecond {
+		return b.Cooldown(downstream)
+	}
+
+	conn := b.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close backing off %s: %v", downstream, err)
+		}
+	}(conn)
+
+	until := b.d.options().clock.Now().Add(cooldown).UnixMilli()
+	ms, err := redis.Int64(backoffExtendScript.Do(instrumentedConn{conn, b.d}, b.opts.Prefix+downstream, cooldown.Milliseconds(), until))
+	if err != nil {
+		return 0, fmt.Errorf("error backing off %s: %w", downstream, err)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// BackOffResponse backs off downstream when resp is a 429 or 503, for as long as its
+// Retry-After header asks or fallback when it has none, and returns the cooldown in
+// effect. Other responses leave the state alone and return 0.
+func (b *BackoffState) BackOffResponse(downstream string, resp *http.Response, fallback time.Duration) (time.Duration, error) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, nil
+	}
+	cooldown, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), b.d.options().clock.Now())
+	if !ok {
+		cooldown = fallback
+	}
+	return b.BackOff(downstream, cooldown)
+}
+
+// Cooldown returns how long calls to downstream should still wait, 0 when they may
+// proceed.
+func (b *BackoffState) Cooldown(downstream string) (time.Duration, error) {
+	ms, err := redis.Int64(b.d.Do("PTTL", b.opts.Prefix+downstream))
+	if err != nil {
+		return 0, fmt.Errorf("error getting cooldown of %s: %w", downstream, err)
+	}
+	if ms < 0 {
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Reset ends the cooldown of downstream, for example once it answered successfully.
+func (b *BackoffState) Reset(downstream string) error {
+	if _, err := b.d.Do("DEL", b.opts.Prefix+downstream); err != nil {
+		return fmt.Errorf("error resetting cooldown of %s: %w", downstream, err)
+	}
+	return nil
+}
+
+// ParseRetryAfter parses a Retry-After header given in seconds or as an HTTP date relative
+// to now. It reports false when the header is empty or invalid.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := at.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
@@ -0,0 +1,257 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+)
+
+// hydrateBatchSize bounds how many replies are buffered per pipeline round trip.
+const hydrateBatchSize = 500
+
+// Hydrate pipelines HGETALL for every key and calls each with the hash of every key that
+// exists, in the order of keys, decrypting fields covered by WithFieldEncryption. Keys
+// that do not exist are skipped.
+func (d *RedisDatabase) Hydrate(keys []string, each func(key string, data map[string]string)) error {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close hydrating %d keys: %v", len(keys), err)
+		}
+	}(conn)
+
+	for start := 0; start < len(keys); start += hydrateBatchSize {
+		end := start + hydrateBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		for _, key := range batch {
+			if err := conn.Send("HGETALL", key); err != nil {
+				return fmt.Errorf("error hydrating key %s: %w", key, err)
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("error hydrating %d keys: %w", len(batch), err)
+		}
+
+		for _, key := range batch {
+			data, err := redis.StringMap(conn.Receive())
+			if err != nil {
+				return fmt.Errorf("error hydrating key %s: %w", key, err)
+			}
+			if len(data) == 0 {
+				continue
+			}
+			if err := d.options().openFields(key, data); err != nil {
+				return fmt.Errorf("error hydrating key %s: %w", key, err)
+			}
+			each(key, data)
+		}
+	}
+	return nil
+}
+
+// MultiGetResult holds the outcome of GetMultiPartial per key.
+type MultiGetResult struct {
+	Found   map[string][]byte
+	Missing []string
+	Errors  map[string]error
+}
+
+// Err returns one of the per-key errors, or nil when every key was read.
+func (r MultiGetResult) Err() error {
+	for _, err := range r.Errors {
+		return err
+	}
+	return nil
+}
+
+// GetMultiPartial pipelines GET for every key and reports found values, keys that do not
+// exist and keys that could not be read separately, so one failing key or batch does not
+// fail the whole lookup. Keys deleted with DeleteSoft are reported with ErrDeleted.
+func (d *RedisDatabase) GetMultiPartial(keys []string) MultiGetResult {
+	result := MultiGetResult{Found: map[string][]byte{}, Errors: map[string]error{}}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close getting %d keys: %v", len(keys), err)
+		}
+	}(conn)
+
+	failed := func(batch []string, err error) {
+		for _, key := range batch {
+			result.Errors[key] = fmt.Errorf("error getting key %s: %w", key, err)
+		}
+	}
+
+	for start := 0; start < len(keys); start += hydrateBatchSize {
+		end := start + hydrateBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		if conn.Err() != nil {
+			failed(batch, conn.Err())
+			continue
+		}
+		for _, key := range batch {
+			_ = conn.Send("GET", key)
+		}
+		if err := conn.Flush(); err != nil {
+			failed(batch, err)
+			continue
+		}
+
+		for i, key := range batch {
+			data, err := redis.Bytes(conn.Receive())
+			switch {
+			case err == nil && IsTombstone(data):
+				result.Errors[key] = fmt.Errorf("error getting key %s: %w", key, ErrDeleted)
+			case err == nil:
+				result.Found[key] = data
+			case err == redis.ErrNil:
+				result.Missing = append(result.Missing, key)
+			case conn.Err() != nil:
+				// the connection is broken, no further replies of this batch will arrive
+				failed(batch[i:], err)
+			default:
+				result.Errors[key] = fmt.Errorf("error getting key %s: %w", key, err)
+			}
+			if conn.Err() != nil {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// multiKeyBatchSize bounds the keys of a single MGET or MSET.
+const multiKeyBatchSize = 1000
+
+// multiKeyBatches splits keys into batches of at most multiKeyBatchSize keys. On a
+// cluster every batch holds keys of a single slot, as multi-key commands require.
+func (d *RedisDatabase) multiKeyBatches(keys []string) [][]string {
+	groups := [][]string{keys}
+	if d.options().cluster != nil {
+		groups = nil
+		index := map[int]int{}
+		for _, key := range keys {
+			slot := keySlot(key)
+			i, ok := index[slot]
+			if !ok {
+				i = len(groups)
+				index[slot] = i
+				groups = append(groups, nil)
+			}
+			groups[i] = append(groups[i], key)
+		}
+	}
+
+	var batches [][]string
+	for _, group := range groups {
+		for start := 0; start < len(group); start += multiKeyBatchSize {
+			end := start + multiKeyBatchSize
+			if end > len(group) {
+				end = len(group)
+			}
+			batches = append(batches, group[start:end])
+		}
+	}
+	return batches
+}
+
+// MGet returns the values of the keys that exist, reading them with one MGET per batch
+// of keys instead of a round trip per key. Keys deleted with DeleteSoft are left out like
+// missing keys.
+func (d *RedisDatabase) MGet(keys ...string) (map[string][]byte, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close getting %d keys: %v", len(keys), err)
+		}
+	}(conn)
+
+	values := make(map[string][]byte, len(keys))
+	for _, batch := range d.multiKeyBatches(keys) {
+		replies, err := redis.ByteSlices(d.do(conn, "MGET", redis.Args{}.AddFlat(batch)...))
+		if err != nil {
+			return nil, fmt.Errorf("error getting %d keys: %w", len(batch), err)
+		}
+		if len(replies) != len(batch) {
+			return nil, fmt.Errorf("redis: MGET returned %d values for %d keys", len(replies), len(batch))
+		}
+		for i, data := range replies {
+			if data != nil && !IsTombstone(data) {
+				values[batch[i]] = data
+			}
+		}
+	}
+	return values, nil
+}
+
+// MSet sets every key to its value with one MSET per batch of keys. Each batch is
+// atomic, but with more keys than fit a batch, or keys in several slots of a cluster, a
+// failure can leave earlier batches written.
+func (d *RedisDatabase) MSet(values map[string][]byte) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close setting %d keys: %v", len(values), err)
+		}
+	}(conn)
+
+	for _, batch := range d.multiKeyBatches(keys) {
+		args := make(redis.Args, 0, 2*len(batch))
+		for _, key := range batch {
+			args = append(args, key, values[key])
+		}
+		if _, err := d.do(conn, "MSET", args...); err != nil {
+			return fmt.Errorf("error setting %d keys: %w", len(batch), err)
+		}
+	}
+	return nil
+}
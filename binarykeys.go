@@ -0,0 +1,294 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+// The B variants take raw []byte keys, such as binary hashes, that do not survive a
+// conversion to string and back in callers that treat strings as text. Keys are printed
+// quoted in errors.
+
+// GetB is Get for a binary key.
+func (d *RedisDatabase) GetB(key []byte) ([]byte, error) {
+	return d.GetBContext(context.Background(), key)
+}
+
+// GetBContext is GetB bounded by ctx.
+func (d *RedisDatabase) GetBContext(ctx context.Context, key []byte) ([]byte, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %q: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close getting key %q: %v", key, err)
+		}
+	}(conn)
+
+	data, err := redis.Bytes(d.doContext(ctx, conn, "GET", key))
+	if err == redis.ErrNil {
+		return data, fmt.Errorf("error getting key %q: %w", key, ErrKeyNotFound)
+	}
+	if err != nil {
+		return data, fmt.Errorf("error getting key %q: %w", key, err)
+	}
+	if IsTombstone(data) {
+		return nil, fmt.Errorf("error getting key %q: %w", key, ErrDeleted)
+	}
+	return data, nil
+}
+
+// SetB is Set for a binary key.
+func (d *RedisDatabase) SetB(key []byte, value []byte) error {
+	return d.SetBContext(context.Background(), key, value)
+}
+
+// SetBContext is SetB bounded by ctx.
+func (d *RedisDatabase) SetBContext(ctx context.Context, key []byte, value []byte) error {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error setting key %q: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close setting key %q: %v", key, err)
+		}
+	}(conn)
+
+	_, err = d.doContext(ctx, conn, "SET", key, value)
+	if err != nil {
+		return fmt.Errorf("error setting key %q to %s: %w", key, d.options().redact(value), err)
+	}
+	return nil
+}
+
+// ExistsB is Exists for a binary key.
+func (d *RedisDatabase) ExistsB(key []byte) (bool, error) {
+	return d.ExistsBContext(context.Background(), key)
+}
+
+// ExistsBContext is ExistsB bounded by ctx.
+func (d *RedisDatabase) ExistsBContext(ctx context.Context, key []byte) (bool, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error checking if key %q exists: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed closing if key %q exists: %v", key, err)
+		}
+	}(conn)
+
+	ok, err := redis.Bool(d.doContext(ctx, conn, "EXISTS", key))
+	if err != nil {
+		return ok, fmt.Errorf("error checking if key %q exists: %w", key, err)
+	}
+	return ok, nil
+}
+
+// DeleteB is Delete for a binary key.
+func (d *RedisDatabase) DeleteB(key []byte) error {
+	return d.DeleteBContext(context.Background(), key)
+}
+
+// DeleteBContext is DeleteB bounded by ctx.
+func (d *RedisDatabase) DeleteBContext(ctx context.Context, key []byte) error {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error deleting key %q: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close deleting key %q: %v", key, err)
+		}
+	}(conn)
+
+	_, err = d.doContext(ctx, conn, "DEL", key)
+	if err != nil {
+		return fmt.Errorf("error deleting key %q: %w", key, err)
+	}
+	return nil
+}
+
+// GetKeysB is GetKeys returning the matching keys as raw bytes.
+func (d *RedisDatabase) GetKeysB(pattern []byte) ([][]byte, error) {
+	return d.GetKeysBContext(context.Background(), pattern)
+}
+
+// GetKeysBContext is GetKeysB bounded by ctx.
+func (d *RedisDatabase) GetKeysBContext(ctx context.Context, pattern []byte) ([][]byte, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving %q keys: %w", pattern, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close retrieving %q keys: %v", pattern, err)
+		}
+	}(conn)
+
+	iter := 0
+	var keys [][]byte
+	for {
+		arr, err := redis.Values(d.doContext(ctx, conn, "SCAN", iter, "MATCH", pattern))
+		if err != nil {
+			return keys, fmt.Errorf("error retrieving %q keys: %w", pattern, err)
+		}
+
+		iter, _ = redis.Int(arr[0], nil)
+		k, _ := redis.ByteSlices(arr[1], nil)
+		keys = append(keys, k...)
+
+		if iter == 0 {
+			break
+		}
+	}
+	return keys, nil
+}
+
+// HMSetB is HMSet for a binary key and field.
+func (d *RedisDatabase) HMSetB(key []byte, hashKey []byte, value []byte) error {
+	return d.HMSetBContext(context.Background(), key, hashKey, value)
+}
+
+// HMSetBContext is HMSetB bounded by ctx.
+func (d *RedisDatabase) HMSetBContext(ctx context.Context, key []byte, hashKey []byte, value []byte) error {
+	value, err := d.options().sealField(string(key), string(hashKey), value)
+	if err != nil {
+		return fmt.Errorf("error setting key %q:%q: %w", key, hashKey, err)
+	}
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error setting key %q:%q: %w", key, hashKey, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed closing setting key %q:%q: %v", key, hashKey, err)
+		}
+	}(conn)
+
+	_, err = d.doContext(ctx, conn, "HSET", key, hashKey, value)
+	if err != nil {
+		return fmt.Errorf("error setting key %q:%q to %s: %w", key, hashKey, d.options().redact(value), err)
+	}
+	return nil
+}
+
+// HGetB returns one field of the hash at a binary key.
+func (d *RedisDatabase) HGetB(key []byte, hashKey []byte) ([]byte, error) {
+	return d.HGetBContext(context.Background(), key, hashKey)
+}
+
+// HGetBContext is HGetB bounded by ctx.
+func (d *RedisDatabase) HGetBContext(ctx context.Context, key []byte, hashKey []byte) ([]byte, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %q:%q: %w", key, hashKey, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed closing getting key %q:%q: %v", key, hashKey, err)
+		}
+	}(conn)
+
+	data, err := redis.Bytes(d.doContext(ctx, conn, "HGET", key, hashKey))
+	if err != nil {
+		return data, fmt.Errorf("error getting key %q:%q: %w", key, hashKey, err)
+	}
+	return d.options().openField(string(key), string(hashKey), data)
+}
+
+// HMGetAllB is HMGetAll for a binary key. Fields are map keys, so they are converted to
+// strings without loss; use []byte(field) to recover the raw bytes.
+func (d *RedisDatabase) HMGetAllB(key []byte) (map[string][]byte, error) {
+	return d.HMGetAllBContext(context.Background(), key)
+}
+
+// HMGetAllBContext is HMGetAllB bounded by ctx.
+func (d *RedisDatabase) HMGetAllBContext(ctx context.Context, key []byte) (map[string][]byte, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %q: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close HMGetAll %q, %v", key, err)
+		}
+	}(conn)
+
+	flat, err := redis.ByteSlices(d.doContext(ctx, conn, "HGETALL", key))
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %q: %w", key, err)
+	}
+	o := d.options()
+	values := make(map[string][]byte, len(flat)/2)
+	for i := 0; i+1 < len(flat); i += 2 {
+		field := string(flat[i])
+		if values[field], err = o.openField(string(key), field, flat[i+1]); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// HDeleteB is HDelete for a binary key and field.
+func (d *RedisDatabase) HDeleteB(key []byte, hashKey []byte) (int, error) {
+	return d.HDeleteBContext(context.Background(), key, hashKey)
+}
+
+// HDeleteBContext is HDeleteB bounded by ctx.
+func (d *RedisDatabase) HDeleteBContext(ctx context.Context, key []byte, hashKey []byte) (int, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting key %q:%q: %w", key, hashKey, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed closing deleting key %q:%q: %v", key, hashKey, err)
+		}
+	}(conn)
+
+	number, err := redis.Int(d.doContext(ctx, conn, "HDEL", key, hashKey))
+	if err != nil {
+		return number, fmt.Errorf("error deleting key %q:%q: %w", key, hashKey, err)
+	}
+	return number, nil
+}
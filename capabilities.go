@@ -0,0 +1,247 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrUnsupportedServer is matched by errors.Is when a feature needs a newer server or a
+// module that is not loaded.
+var ErrUnsupportedServer = errors.New("redis: feature not supported by server")
+
+// Feature names a server capability that higher level APIs depend on.
+type Feature string
+
+// Features are named after the command or option that introduced them.
+const (
+	FeatureUnlink         Feature = "UNLINK"
+	FeatureStreams        Feature = "XADD"
+	FeatureACL            Feature = "ACL"
+	FeatureScanType       Feature = "SCAN TYPE"
+	FeatureClientTracking Feature = "CLIENT TRACKING"
+	FeatureGetEx          Feature = "GETEX"
+	FeatureGetDel         Feature = "GETDEL"
+	FeatureSetGet         Feature = "SET GET"
+	FeatureCopy           Feature = "COPY"
+	FeatureHRandField     Feature = "HRANDFIELD"
+	FeatureXAutoClaim     Feature = "XAUTOCLAIM"
+	FeatureLMPop          Feature = "LMPOP"
+	FeatureLCS            Feature = "LCS"
+	FeatureClientSetInfo  Feature = "CLIENT SETINFO"
+)
+
+var featureVersions = map[Feature]ServerVersion{
+	FeatureUnlink:         {4, 0, 0},
+	FeatureStreams:        {5, 0, 0},
+	FeatureACL:            {6, 0, 0},
+	FeatureScanType:       {6, 0, 0},
+	FeatureClientTracking: {6, 0, 0},
+	FeatureGetEx:          {6, 2, 0},
+	FeatureGetDel:         {6, 2, 0},
+	FeatureSetGet:         {6, 2, 0},
+	FeatureCopy:           {6, 2, 0},
+	FeatureHRandField:     {6, 2, 0},
+	FeatureXAutoClaim:     {6, 2, 0},
+	FeatureLMPop:          {7, 0, 0},
+	FeatureLCS:            {7, 0, 0},
+	FeatureClientSetInfo:  {7, 2, 0},
+}
+
+// UnsupportedServerError reports the feature or module that the server lacks.
+type UnsupportedServerError struct {
+	Feature Feature
+	Module  string
+	Version ServerVersion
+}
+
+func (e *UnsupportedServerError) Error() string {
+	if e.Module != "" {
+		return fmt.Sprintf("redis: module %s is not loaded on server %s", e.Module, e.Version)
+	}
+	return fmt.Sprintf("redis: %s needs server %s or later, server is %s", e.Feature, featureVersions[e.Feature], e.Version)
+}
+
+func (e *UnsupportedServerError) Is(target error) bool {
+	return target == ErrUnsupportedServer
+}
+
+// ServerVersion is a parsed redis_version.
+type ServerVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseServerVersion parses versions such as "7.2.4".
+func ParseServerVersion(s string) (ServerVersion, error) {
+	var v ServerVersion
+	parts := strings.SplitN(strings.TrimSpace(s), ".", 3)
+	fields := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return v, fmt.Errorf("invalid server version '%s'", s)
+		}
+		*fields[i] = n
+	}
+	return v, nil
+}
+
+// AtLeast reports whether v is o or later.
+func (v ServerVersion) AtLeast(o ServerVersion) bool {
+	if v.Major != o.Major {
+		return v.Major > o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor > o.Minor
+	}
+	return v.Patch >= o.Patch
+}
+
+func (v ServerVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Capabilities describes what the server behind a pool supports.
+type Capabilities struct {
+	Version ServerVersion
+	// Modules maps loaded module names to their versions.
+	Modules map[string]int
+}
+
+// Supports reports whether the server version provides f.
+func (c *Capabilities) Supports(f Feature) bool {
+	min, ok := featureVersions[f]
+	return ok && c.Version.AtLeast(min)
+}
+
+// Require returns an UnsupportedServerError when the server does not provide f.
+func (c *Capabilities) Require(f Feature) error {
+	if !c.Supports(f) {
+		return &UnsupportedServerError{Feature: f, Version: c.Version}
+	}
+	return nil
+}
+
+// RequireModule returns an UnsupportedServerError when module name is not loaded.
+func (c *Capabilities) RequireModule(name string) error {
+	if _, ok := c.Modules[strings.ToLower(name)]; !ok {
+		return &UnsupportedServerError{Module: name, Version: c.Version}
+	}
+	return nil
+}
+
+// capabilityCache holds the probed Capabilities per pool.
+var capabilityCache sync.Map
+
+// Capabilities probes the server with INFO server and MODULE LIST on first use and caches
+// the result for the pool.
+func (d *RedisDatabase) Capabilities() (*Capabilities, error) {
+	if c, ok := capabilityCache.Load(d.redisPool); ok {
+		return c.(*Capabilities), nil
+	}
+
+	c, err := d.probeCapabilities()
+	if err != nil {
+		return nil, err
+	}
+	capabilityCache.Store(d.redisPool, c)
+	return c, nil
+}
+
+// RefreshCapabilities drops the cached Capabilities, for example after a failover to a
+// server running a different version.
+func (d *RedisDatabase) RefreshCapabilities() {
+	capabilityCache.Delete(d.redisPool)
+}
+
+func (d *RedisDatabase) probeCapabilities() (*Capabilities, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close probing capabilities: %v", err)
+		}
+	}(conn)
+
+	info, err := redis.String(d.do(conn, "INFO", "server"))
+	if err != nil {
+		return nil, fmt.Errorf("error probing server version: %w", err)
+	}
+	version, err := ParseServerVersion(parseInfo(info)["redis_version"])
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Capabilities{Version: version, Modules: map[string]int{}}
+	modules, err := redis.Values(d.do(conn, "MODULE", "LIST"))
+	if err != nil {
+		// MODULE is commonly renamed or denied on managed offerings
+		return c, nil
+	}
+	for _, m := range modules {
+		fields, err := redis.Values(m, nil)
+		if err != nil {
+			continue
+		}
+		var name string
+		var ver int
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch k, _ := redis.String(fields[i], nil); k {
+			case "name":
+				name, _ = redis.String(fields[i+1], nil)
+			case "ver":
+				ver, _ = redis.Int(fields[i+1], nil)
+			}
+		}
+		if name != "" {
+			c.Modules[strings.ToLower(name)] = ver
+		}
+	}
+	return c, nil
+}
+
+// parseInfo parses the key:value lines of an INFO reply.
+func parseInfo(info string) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			values[line[:i]] = line[i+1:]
+		}
+	}
+	return values
+}
@@ -0,0 +1,182 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"time"
+)
+
+// cartUpdateScript changes the quantity of item ARGV[1] in the cart KEYS[1]: ARGV[2] is
+// 'incr' to add ARGV[3], 'set' to set it to ARGV[3] or 'del' to remove the item. Items
+// dropping to zero are removed and the cart TTL is reset to ARGV[4] milliseconds.
+var cartUpdateScript = redis.NewScript(1, `
+local q = 0
+if ARGV[2] == 'incr' then
+  q = redis.call('HINCRBY', KEYS[1], ARGV[1], ARGV[3])
+elseif ARGV[2] == 'set' then
+  q = tonumber(ARGV[3])
+  if q > 0 then
+    redis.call('HSET', KEYS[1], ARGV[1], q)
+  end
+end
+if q <= 0 then
+  redis.call('HDEL', KEYS[1], ARGV[1])
+  q = 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return q`)
+
+// cartItemsScript returns the cart KEYS[1] and resets its TTL to ARGV[1] milliseconds, or
+// deletes it after reading when ARGV[1] is 0.
+var cartItemsScript = redis.NewScript(1, `
+local flat = redis.call('HGETALL', KEYS[1])
+if ARGV[1] == '0' then
+  redis.call('DEL', KEYS[1])
+elseif #flat > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return flat`)
+
+// CartStoreOptions configures a CartStore. Zero values select the defaults in brackets.
+type CartStoreOptions struct {
+	// Prefix is prepended to the user id to form the cart key ["cart:"].
+	Prefix string
+	// TTL is how long a cart lives after it was last read or changed [7 days].
+	TTL time.Duration
+}
+
+// Cart is the content of a cart, item ids mapped to quantities.
+type Cart struct {
+	User  string
+	Items map[string]int64
+	// Taken is when the cart was read, for a checkout when it was emptied.
+	Taken time.Time
+}
+
+// CartStore keeps a shopping cart per user in a hash of item quantities. Every change is
+// a single script, so concurrent requests of the same user can not lose updates, and
+// every read or change extends the TTL so abandoned carts expire on their own. Checkout
+// takes the cart and empties it atomically, so items added while an order is placed end
+// up in the next cart instead of being lost or ordered twice.
+type CartStore struct {
+	d    *RedisDatabase
+	opts CartStoreOptions
+}
+
+// NewCartStore creates a cart store on d.
+func NewCartStore(d *RedisDatabase, opts CartStoreOptions) *CartStore {
+	if opts.Prefix == "" {
+		opts.Prefix = "cart:"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 7 * 24 * time.Hour
+	}
+	return &CartStore{d: d, opts: opts}
+}
+
+func (s *CartStore) key(user string) string {
+	return s.opts.Prefix + user
+}
+
+// Add adds quantity, which may be negative, to item and returns the new quantity.
+// Items reaching zero are removed.
+func (s *CartStore) Add(user string, item string, quantity int64) (int64, error) {
+	return s.update(user, item, "incr", quantity)
+}
+
+// SetQuantity sets the quantity of item, removing it when quantity is not positive.
+func (s *CartStore) SetQuantity(user string, item string, quantity int64) error {
+	_, err := s.update(user, item, "set", quantity)
+	return err
+}
+
+// Remove removes item from the cart.
+func (s *CartStore) Remove(user string, item string) error {
+	_, err := s.update(user, item, "del", 0)
+	return err
+}
+
+func (s *CartStore) update(user string, item string, mode string, quantity int64) (int64, error) {
+	conn := s.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close updating cart %s: %v", user, err)
+		}
+	}(conn)
+
+	q, err := redis.Int64(cartUpdateScript.Do(instrumentedConn{conn, s.d}, s.key(user), item, mode, quantity, s.opts.TTL.Milliseconds()))
+	if err != nil {
+		return 0, fmt.Errorf("error updating item %s in cart %s: %w", item, user, err)
+	}
+	return q, nil
+}
+
+// Items returns the cart of user, empty when there is none.
+func (s *CartStore) Items(user string) (Cart, error) {
+	return s.read(user, s.opts.TTL.Milliseconds())
+}
+
+// Checkout returns the cart of user and empties it.
+func (s *CartStore) Checkout(user string) (Cart, error) {
+	return s.read(user, 0)
+}
+
+// Clear empties the cart of user.
+func (s *CartStore) Clear(user string) error {
+	if err := s.d.Delete(s.key(user)); err != nil {
+		return fmt.Errorf("error clearing cart %s: %w", user, err)
+	}
+	return nil
+}
+
+func (s *CartStore) read(user string, ttlMs int64) (Cart, error) {
+	conn := s.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reading cart %s: %v", user, err)
+		}
+	}(conn)
+
+	cart := Cart{User: user, Items: map[string]int64{}, Taken: s.d.options().clock.Now()}
+	flat, err := redis.Strings(cartItemsScript.Do(instrumentedConn{conn, s.d}, s.key(user), ttlMs))
+	if err != nil {
+		return cart, fmt.Errorf("error reading cart %s: %w", user, err)
+	}
+	for i := 0; i+1 < len(flat); i += 2 {
+		q, err := strconv.ParseInt(flat[i+1], 10, 64)
+		if err != nil {
+			return cart, fmt.Errorf("error reading item %s in cart %s: %w", flat[i], user, err)
+		}
+		cart.Items[flat[i]] = q
+	}
+	return cart, nil
+}
@@ -0,0 +1,202 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb_test
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/henryse/go-redisdb"
+	"github.com/henryse/go-redisdb/redisdbtest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newCartStore(t *testing.T, ttl time.Duration) (*redisdb.CartStore, *redisdb.RedisDatabase) {
+	t.Helper()
+	c := redisdbtest.StartContainer(t, "7.2")
+	return redisdb.NewCartStore(c.DB, redisdb.CartStoreOptions{TTL: ttl}), c.DB
+}
+
+func pttl(t *testing.T, d *redisdb.RedisDatabase, key string) time.Duration {
+	t.Helper()
+	ms, err := redis.Int64(d.Do("PTTL", key))
+	if err != nil {
+		t.Fatalf("PTTL %s: %v", key, err)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func TestCartAdd(t *testing.T) {
+	carts, _ := newCartStore(t, time.Hour)
+
+	if q, err := carts.Add("alice", "apple", 2); err != nil || q != 2 {
+		t.Fatalf("Add = %d, %v, want 2", q, err)
+	}
+	if q, err := carts.Add("alice", "apple", 3); err != nil || q != 5 {
+		t.Fatalf("Add = %d, %v, want 5", q, err)
+	}
+	if _, err := carts.Add("alice", "pear", 1); err != nil {
+		t.Fatal(err)
+	}
+	// a negative quantity reaching zero removes the item
+	if q, err := carts.Add("alice", "pear", -1); err != nil || q != 0 {
+		t.Fatalf("Add = %d, %v, want 0", q, err)
+	}
+
+	cart, err := carts.Items("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"apple": 5}; !reflect.DeepEqual(cart.Items, want) {
+		t.Fatalf("Items = %v, want %v", cart.Items, want)
+	}
+	if cart.User != "alice" {
+		t.Fatalf("User = %q, want alice", cart.User)
+	}
+}
+
+func TestCartSetQuantity(t *testing.T) {
+	carts, _ := newCartStore(t, time.Hour)
+
+	if err := carts.SetQuantity("bob", "apple", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := carts.SetQuantity("bob", "apple", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := carts.SetQuantity("bob", "pear", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := carts.SetQuantity("bob", "pear", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cart, err := carts.Items("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"apple": 1}; !reflect.DeepEqual(cart.Items, want) {
+		t.Fatalf("Items = %v, want %v", cart.Items, want)
+	}
+}
+
+func TestCartRemove(t *testing.T) {
+	carts, _ := newCartStore(t, time.Hour)
+
+	if _, err := carts.Add("carol", "apple", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := carts.Add("carol", "pear", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := carts.Remove("carol", "apple"); err != nil {
+		t.Fatal(err)
+	}
+	// removing an item that is not in the cart is not an error
+	if err := carts.Remove("carol", "plum"); err != nil {
+		t.Fatal(err)
+	}
+
+	cart, err := carts.Items("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"pear": 2}; !reflect.DeepEqual(cart.Items, want) {
+		t.Fatalf("Items = %v, want %v", cart.Items, want)
+	}
+}
+
+func TestCartSlidingTTL(t *testing.T) {
+	ttl := 10 * time.Second
+	carts, d := newCartStore(t, ttl)
+
+	if _, err := carts.Add("dave", "apple", 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if left := pttl(t, d, "cart:dave"); left <= 0 || left > ttl-200*time.Millisecond {
+		t.Fatalf("TTL after waiting = %v, want below %v", left, ttl-200*time.Millisecond)
+	}
+
+	// reading the cart extends it again
+	if _, err := carts.Items("dave"); err != nil {
+		t.Fatal(err)
+	}
+	if left := pttl(t, d, "cart:dave"); left <= ttl-200*time.Millisecond {
+		t.Fatalf("TTL after Items = %v, want about %v", left, ttl)
+	}
+
+	short := redisdb.NewCartStore(d, redisdb.CartStoreOptions{Prefix: "short:", TTL: 200 * time.Millisecond})
+	if _, err := short.Add("erin", "apple", 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	cart, err := short.Items("erin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 0 {
+		t.Fatalf("Items of an expired cart = %v, want none", cart.Items)
+	}
+}
+
+func TestCartCheckout(t *testing.T) {
+	carts, d := newCartStore(t, time.Hour)
+
+	if _, err := carts.Add("frank", "apple", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := carts.Add("frank", "pear", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	cart, err := carts.Checkout("frank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"apple": 2, "pear": 1}; !reflect.DeepEqual(cart.Items, want) {
+		t.Fatalf("Checkout = %v, want %v", cart.Items, want)
+	}
+	if cart.Taken.IsZero() {
+		t.Fatal("Checkout did not set Taken")
+	}
+	if exists, err := d.Exists("cart:frank"); err != nil || exists {
+		t.Fatalf("cart exists after Checkout: %v, %v", exists, err)
+	}
+
+	// items added after the checkout start the next cart
+	if _, err := carts.Add("frank", "plum", 1); err != nil {
+		t.Fatal(err)
+	}
+	cart, err = carts.Checkout("frank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"plum": 1}; !reflect.DeepEqual(cart.Items, want) {
+		t.Fatalf("second Checkout = %v, want %v", cart.Items, want)
+	}
+}
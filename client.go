@@ -0,0 +1,104 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// LibraryName is reported to the server with CLIENT SETINFO LIB-NAME.
+	LibraryName = "go-redisdb"
+	// LibraryVersion is reported to the server with CLIENT SETINFO LIB-VER.
+	LibraryVersion = "0.2.0"
+)
+
+// WithClientName sets the CLIENT SETNAME issued on every new connection so that
+// CLIENT LIST on the server attributes connections to the application.
+func WithClientName(name string) Option {
+	return func(o *options) {
+		o.clientName = name
+	}
+}
+
+// WithLibraryInfo overrides the library name and version reported with CLIENT SETINFO.
+// Passing two empty strings disables the SETINFO calls.
+func WithLibraryInfo(name string, version string) Option {
+	return func(o *options) {
+		o.libName = name
+		o.libVersion = version
+	}
+}
+
+// identify names a freshly dialed connection. A bad client name is an error, while
+// SETINFO failures are ignored because servers before 7.2 do not know the command. The
+// replies are awaited until ctx is done, so a hung server does not block the dial.
+func identify(ctx context.Context, c redis.Conn, o *options) error {
+	pending := 0
+	if o.clientName != "" {
+		if err := c.Send("CLIENT", "SETNAME", o.clientName); err != nil {
+			return err
+		}
+		pending++
+	}
+	if o.libName != "" {
+		if err := c.Send("CLIENT", "SETINFO", "LIB-NAME", o.libName); err != nil {
+			return err
+		}
+		pending++
+	}
+	if o.libVersion != "" {
+		if err := c.Send("CLIENT", "SETINFO", "LIB-VER", o.libVersion); err != nil {
+			return err
+		}
+		pending++
+	}
+	if pending == 0 {
+		return nil
+	}
+
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < pending; i++ {
+		var err error
+		if ctx.Done() != nil {
+			_, err = redis.ReceiveContext(c, ctx)
+		} else {
+			_, err = c.Receive()
+		}
+		if i == 0 && o.clientName != "" && err != nil {
+			return fmt.Errorf("error setting client name %s: %w", o.clientName, err)
+		}
+		if err != nil && c.Err() != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+// CloneOptions tunes CloneKeys.
+type CloneOptions struct {
+	// Replace overwrites keys that already exist on the destination, otherwise they are skipped.
+	Replace bool
+	// KeysPerSecond throttles the copy; zero copies as fast as possible.
+	KeysPerSecond int
+	// BatchSize is the SCAN COUNT hint and the pipeline depth, 100 when zero.
+	BatchSize int
+	// Progress is called after every batch with the running totals.
+	Progress func(stats CloneStats)
+}
+
+// CloneStats reports the outcome of CloneKeys.
+type CloneStats struct {
+	Scanned int
+	Copied  int
+	// Skipped counts keys that expired before they could be copied or already existed
+	// on the destination.
+	Skipped int
+	Failed  int
+	Elapsed time.Duration
+}
+
+// CloneKeys copies every key matching pattern from src to dst with DUMP and RESTORE,
+// preserving the remaining time to live of each key.
+// noinspection GoUnusedExportedFunction
+func CloneKeys(src *RedisDatabase, dst *RedisDatabase, pattern string, opts CloneOptions) (CloneStats, error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	srcConn := src.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close cloning '%s' keys: %v", pattern, err)
+		}
+	}(srcConn)
+	dstConn := dst.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close cloning '%s' keys: %v", pattern, err)
+		}
+	}(dstConn)
+
+	var stats CloneStats
+	start := time.Now()
+	cursor := 0
+	for {
+		arr, err := redis.Values(src.do(srcConn, "SCAN", cursor, "MATCH", pattern, "COUNT", batchSize))
+		if err != nil {
+			return stats, fmt.Errorf("error scanning '%s' keys: %w", pattern, err)
+		}
+		cursor, _ = redis.Int(arr[0], nil)
+		keys, _ := redis.Strings(arr[1], nil)
+		stats.Scanned += len(keys)
+
+		if err := cloneBatch(srcConn, dstConn, keys, opts.Replace, &stats); err != nil {
+			return stats, err
+		}
+
+		stats.Elapsed = time.Since(start)
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+		if cursor == 0 {
+			break
+		}
+		if opts.KeysPerSecond > 0 {
+			expected := time.Duration(stats.Scanned) * time.Second / time.Duration(opts.KeysPerSecond)
+			if ahead := expected - time.Since(start); ahead > 0 {
+				time.Sleep(ahead)
+			}
+		}
+	}
+
+	stats.Elapsed = time.Since(start)
+	return stats, nil
+}
+
+func cloneBatch(srcConn redis.Conn, dstConn redis.Conn, keys []string, replace bool, stats *CloneStats) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for _, key := range keys {
+		if err := srcConn.Send("PTTL", key); err != nil {
+			return err
+		}
+		if err := srcConn.Send("DUMP", key); err != nil {
+			return err
+		}
+	}
+	if err := srcConn.Flush(); err != nil {
+		return fmt.Errorf("error dumping keys: %w", err)
+	}
+
+	restored := 0
+	for _, key := range keys {
+		ttl, err := redis.Int64(srcConn.Receive())
+		if err != nil {
+			return fmt.Errorf("error reading ttl of key %s: %w", key, err)
+		}
+		dump, err := redis.Bytes(srcConn.Receive())
+		if err == redis.ErrNil || ttl == -2 {
+			stats.Skipped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error dumping key %s: %w", key, err)
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+
+		args := redis.Args{key, ttl, dump}
+		if replace {
+			args = args.Add("REPLACE")
+		}
+		if err := dstConn.Send("RESTORE", args...); err != nil {
+			return err
+		}
+		restored++
+	}
+	if err := dstConn.Flush(); err != nil {
+		return fmt.Errorf("error restoring keys: %w", err)
+	}
+
+	for i := 0; i < restored; i++ {
+		_, err := dstConn.Receive()
+		switch {
+		case err == nil:
+			stats.Copied++
+		case strings.HasPrefix(err.Error(), "BUSYKEY"):
+			stats.Skipped++
+		case dstConn.Err() != nil:
+			return fmt.Errorf("error restoring keys: %w", err)
+		default:
+			stats.Failed++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,669 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/sync/singleflight"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterSlots is the number of hash slots of a Redis Cluster.
+const clusterSlots = 16384
+
+// maxClusterRedirects bounds the MOVED and ASK redirects followed for one command.
+const maxClusterRedirects = 5
+
+// SetupCluster is SetupDatabaseE for a Redis Cluster reachable through the seed
+// addresses. The returned database has the same methods as one for a single server:
+// every command is sent to the master serving the slot of its key, MOVED and ASK
+// redirects are followed and the slot map is reloaded after a resharding or failover.
+// Commands without a key go to any master, and a transaction is sent to the node of its
+// first key, so all keys of a transaction or multi key command must share a hash tag.
+// GetKeys scans every master. Subscriptions use a connection to one master, which
+// receives the messages published on any node, and Monitor reports the commands of one
+// master. Options apply to the pool of every node.
+// noinspection GoUnusedExportedFunction
+func SetupCluster(seedAddrs []string, opts ...Option) (*RedisDatabase, error) {
+	if len(seedAddrs) == 0 {
+		return nil, fmt.Errorf("redis: at least one cluster seed address is required")
+	}
+
+	o := newOptions(append([]Option{WithConnectMode(ConnectEager)}, opts...))
+	c := &cluster{o: o, seeds: seedAddrs, slots: make([]string, clusterSlots), pools: map[string]*redis.Pool{}}
+	o.cluster = c
+	if o.connectMode == ConnectEager {
+		if err := c.refresh(context.Background()); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	pool := &redis.Pool{
+		MaxIdle:     o.pool.maxIdle,
+		MaxActive:   o.pool.maxActive,
+		IdleTimeout: o.pool.idleTimeout,
+		Wait:        o.pool.wait,
+		// cluster connections borrow node connections per command, so dialing one is free
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return &clusterConn{c: c, conns: map[string]redis.Conn{}}, nil
+		},
+	}
+	cleanupHook(pool, c.close)
+	return &RedisDatabase{redisPool: pool, opts: o}, nil
+}
+
+// cluster tracks the slot map of a Redis Cluster and a pool per node.
+type cluster struct {
+	o     *options
+	seeds []string
+
+	mu      sync.RWMutex
+	slots   []string
+	masters []string
+	pools   map[string]*redis.Pool
+
+	loads   singleflight.Group
+	changes changeSignal
+}
+
+// pool returns the pool of the node at addr, creating it on first use.
+func (c *cluster) pool(addr string) *redis.Pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pools[addr]
+	if !ok {
+		p = newPool("redis://"+addr, c.o)
+		c.pools[addr] = p
+	}
+	return p
+}
+
+// nodeFor returns the master serving the slot of key.
+func (c *cluster) nodeFor(key string) string {
+	c.mu.RLock()
+	addr := c.slots[keySlot(key)]
+	c.mu.RUnlock()
+	if addr == "" {
+		return c.anyNode()
+	}
+	return addr
+}
+
+// anyNode returns a random master, or the first seed before the slots are known.
+func (c *cluster) anyNode() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.masters) == 0 {
+		return c.seeds[0]
+	}
+	return c.masters[rand.Intn(len(c.masters))]
+}
+
+// nodes returns the current master addresses.
+func (c *cluster) nodes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.masters...)
+}
+
+// moved records a MOVED redirect and reloads the slot map in the background, since a
+// single moved slot usually means a resharding or failover moved many.
+func (c *cluster) moved(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+	go func() {
+		_ = c.refresh(context.Background())
+	}()
+}
+
+// refresh reloads the slot map, sharing a load in progress.
+func (c *cluster) refresh(ctx context.Context) error {
+	_, err, _ := c.loads.Do("slots", func() (interface{}, error) {
+		return nil, c.loadSlots(ctx)
+	})
+	return err
+}
+
+type slotRange struct {
+	start, end int
+	master     string
+}
+
+func (c *cluster) loadSlots(ctx context.Context) error {
+	candidates := append(c.nodes(), c.seeds...)
+	err := errors.New("no nodes")
+	for _, addr := range candidates {
+		var ranges []slotRange
+		if ranges, err = c.querySlots(ctx, addr); err == nil {
+			c.apply(ranges)
+			return nil
+		}
+	}
+	return fmt.Errorf("error loading cluster slots: %w", err)
+}
+
+func (c *cluster) querySlots(ctx context.Context, addr string) ([]slotRange, error) {
+	conn, err := c.pool(addr).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close loading cluster slots from %s: %v", addr, err)
+		}
+	}(conn)
+
+	entries, err := redis.Values(redis.DoContext(conn, ctx, "CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	var ranges []slotRange
+	for _, entry := range entries {
+		fields, err := redis.Values(entry, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, fmt.Errorf("redis: unexpected CLUSTER SLOTS entry from %s", addr)
+		}
+		node, err := redis.Values(fields[2], nil)
+		if err != nil || len(node) < 2 {
+			return nil, fmt.Errorf("redis: unexpected CLUSTER SLOTS node from %s", addr)
+		}
+		r := slotRange{}
+		r.start, _ = redis.Int(fields[0], nil)
+		r.end, _ = redis.Int(fields[1], nil)
+		ip, _ := redis.String(node[0], nil)
+		port, _ := redis.Int(node[1], nil)
+		if ip == "" {
+			// a node that does not know its own address reports it empty
+			ip = host
+		}
+		r.master = net.JoinHostPort(ip, strconv.Itoa(port))
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// apply replaces the slot map and closes the pools of nodes that are no longer masters.
+func (c *cluster) apply(ranges []slotRange) {
+	slots := make([]string, clusterSlots)
+	masters := map[string]bool{}
+	for _, r := range ranges {
+		for slot := r.start; slot <= r.end && slot < clusterSlots; slot++ {
+			slots[slot] = r.master
+		}
+		masters[r.master] = true
+	}
+
+	sorted := make([]string, 0, len(masters))
+	for addr := range masters {
+		sorted = append(sorted, addr)
+	}
+	sort.Strings(sorted)
+
+	c.mu.Lock()
+	c.slots = slots
+	changed := len(c.masters) > 0 && !equalStrings(c.masters, sorted)
+	c.masters = sorted
+	var stale []*redis.Pool
+	for addr, p := range c.pools {
+		if !masters[addr] {
+			stale = append(stale, p)
+			delete(c.pools, addr)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, p := range stale {
+		_ = p.Close()
+	}
+	if changed {
+		c.changes.notify()
+	}
+}
+
+func (c *cluster) close() {
+	c.mu.Lock()
+	pools := c.pools
+	c.pools = map[string]*redis.Pool{}
+	c.mu.Unlock()
+	for _, p := range pools {
+		_ = p.Close()
+	}
+}
+
+// keys SCANs every master for keys matching pattern.
+func (c *cluster) keys(ctx context.Context, d *RedisDatabase, pattern string) ([]string, error) {
+	masters := c.nodes()
+	if len(masters) == 0 {
+		if err := c.refresh(ctx); err != nil {
+			return nil, err
+		}
+		masters = c.nodes()
+	}
+
+	var keys []string
+	for _, addr := range masters {
+		conn, err := c.pool(addr).GetContext(ctx)
+		if err != nil {
+			return keys, fmt.Errorf("error retrieving '%s' keys from %s: %w", pattern, addr, err)
+		}
+		iter := 0
+		for {
+			arr, err := redis.Values(d.doContext(ctx, conn, "SCAN", iter, "MATCH", pattern))
+			if err != nil {
+				_ = conn.Close()
+				return keys, fmt.Errorf("error retrieving '%s' keys from %s: %w", pattern, addr, err)
+			}
+			iter, _ = redis.Int(arr[0], nil)
+			k, _ := redis.Strings(arr[1], nil)
+			keys = append(keys, k...)
+			if iter == 0 {
+				break
+			}
+		}
+		if err := conn.Close(); err != nil {
+			fmt.Printf("failed to close retrieving '%s' keys from %s: %v", pattern, addr, err)
+		}
+	}
+	return keys, nil
+}
+
+// keySlot returns the cluster slot of key, hashing only its hash tag when it has one.
+func keySlot(key string) int {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if end := strings.IndexByte(key[open+1:], '}'); end > 0 {
+			key = key[open+1 : open+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum that Redis Cluster hashes keys with.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// clusterKey returns the key that routes a command, empty for commands without one.
+func clusterKey(commandName string, args []interface{}) string {
+	switch strings.ToUpper(commandName) {
+	case "CLUSTER", "ASKING", "UNWATCH", "FLUSHALL", "FLUSHDB", "TIME", "SELECT", "ACL", "HELLO", "AUTH", "LASTSAVE":
+		return ""
+	}
+	return commandKey(commandName, args)
+}
+
+type clusterCommand struct {
+	name string
+	args []interface{}
+}
+
+type clusterReply struct {
+	reply interface{}
+	err   error
+}
+
+// clusterConn is the redis.Conn handed out by the pool of a cluster database. It sends
+// every command to the node serving its key over a connection borrowed from that node's
+// pool. Pipelined commands are sent one after the other when flushed.
+//
+// A WATCH pins the connection to the node of the watched key and a MULTI to the node of
+// the first key in the transaction, until EXEC, DISCARD or UNWATCH.
+//
+// SUBSCRIBE, PSUBSCRIBE and MONITOR switch the connection to a single node connection
+// that every later command and Receive is forwarded to until the connection is closed.
+// Messages published anywhere in the cluster reach subscribers on every node, MONITOR
+// only reports the commands of the node it was sent to.
+type clusterConn struct {
+	c       *cluster
+	conns   map[string]redis.Conn
+	pending []clusterCommand
+	replies []clusterReply
+	pinned  string
+	multi   bool
+	closed  bool
+
+	streaming redis.Conn
+}
+
+// streamingCommands switch a connection to pushing replies without further commands.
+var streamingCommands = map[string]bool{"SUBSCRIBE": true, "PSUBSCRIBE": true, "MONITOR": true}
+
+// stream borrows the node connection that the commands and replies of a subscribed or
+// monitoring connection are forwarded to.
+func (cc *clusterConn) stream(ctx context.Context) (redis.Conn, error) {
+	if cc.streaming == nil {
+		conn, err := cc.c.pool(cc.c.anyNode()).GetContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cc.streaming = conn
+	}
+	return cc.streaming, nil
+}
+
+// streams reports whether commandName is forwarded to the streaming connection.
+func (cc *clusterConn) streams(commandName string) bool {
+	return cc.streaming != nil || streamingCommands[strings.ToUpper(commandName)]
+}
+
+var errClusterConnClosed = errors.New("redis: cluster connection closed")
+
+func (cc *clusterConn) Close() error {
+	if cc.streaming != nil {
+		if err := cc.streaming.Close(); err != nil {
+			fmt.Printf("failed to close cluster streaming connection: %v", err)
+		}
+		cc.streaming = nil
+	}
+	cc.closed = true
+	cc.pending, cc.replies = nil, nil
+	cc.pinned, cc.multi = "", false
+	cc.release()
+	return nil
+}
+
+func (cc *clusterConn) Err() error {
+	if cc.closed {
+		return errClusterConnClosed
+	}
+	if cc.streaming != nil {
+		return cc.streaming.Err()
+	}
+	return nil
+}
+
+func (cc *clusterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return cc.do(context.Background(), 0, commandName, args)
+}
+
+func (cc *clusterConn) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	return cc.do(ctx, 0, commandName, args)
+}
+
+func (cc *clusterConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	return cc.do(context.Background(), timeout, commandName, args)
+}
+
+func (cc *clusterConn) Send(commandName string, args ...interface{}) error {
+	if cc.closed {
+		return errClusterConnClosed
+	}
+	if cc.streams(commandName) && len(cc.pending) == 0 {
+		conn, err := cc.stream(context.Background())
+		if err != nil {
+			return err
+		}
+		return conn.Send(commandName, args...)
+	}
+	cc.pending = append(cc.pending, clusterCommand{name: commandName, args: args})
+	return nil
+}
+
+func (cc *clusterConn) Flush() error {
+	if cc.streaming != nil && !cc.closed {
+		return cc.streaming.Flush()
+	}
+	return cc.flush(context.Background(), 0)
+}
+
+func (cc *clusterConn) Receive() (interface{}, error) {
+	if cc.streaming != nil && len(cc.replies) == 0 {
+		return cc.streaming.Receive()
+	}
+	return cc.receive()
+}
+
+func (cc *clusterConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	if cc.streaming != nil && len(cc.replies) == 0 {
+		return redis.ReceiveContext(cc.streaming, ctx)
+	}
+	return cc.receive()
+}
+
+func (cc *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	if cc.streaming != nil && len(cc.replies) == 0 {
+		return redis.ReceiveWithTimeout(cc.streaming, timeout)
+	}
+	return cc.receive()
+}
+
+// do follows the redigo semantics of Do: it flushes the pending commands, receives all
+// replies and returns the last one.
+func (cc *clusterConn) do(ctx context.Context, timeout time.Duration, commandName string, args []interface{}) (interface{}, error) {
+	if cc.closed {
+		return nil, errClusterConnClosed
+	}
+	if cc.streams(commandName) && len(cc.pending) == 0 {
+		conn, err := cc.stream(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return doOn(ctx, timeout, conn, commandName, args)
+	}
+	if commandName != "" {
+		cc.pending = append(cc.pending, clusterCommand{name: commandName, args: args})
+	}
+	if err := cc.flush(ctx, timeout); err != nil {
+		return nil, err
+	}
+	var last clusterReply
+	for _, r := range cc.replies {
+		last = r
+	}
+	cc.replies = nil
+	return last.reply, last.err
+}
+
+func (cc *clusterConn) flush(ctx context.Context, timeout time.Duration) error {
+	if cc.closed {
+		return errClusterConnClosed
+	}
+	pending := cc.pending
+	cc.pending = nil
+	for _, cmd := range pending {
+		reply, err := cc.execute(ctx, timeout, cmd)
+		cc.replies = append(cc.replies, clusterReply{reply: reply, err: err})
+	}
+	if cc.pinned == "" && !cc.multi {
+		cc.release()
+	}
+	return nil
+}
+
+func (cc *clusterConn) receive() (interface{}, error) {
+	if len(cc.replies) == 0 {
+		return nil, fmt.Errorf("redis: no pending reply on cluster connection")
+	}
+	r := cc.replies[0]
+	cc.replies = cc.replies[1:]
+	return r.reply, r.err
+}
+
+// release returns the borrowed node connections to their pools.
+func (cc *clusterConn) release() {
+	for addr, conn := range cc.conns {
+		if err := conn.Close(); err != nil {
+			fmt.Printf("failed to close cluster node %s: %v", addr, err)
+		}
+		delete(cc.conns, addr)
+	}
+}
+
+// node returns the borrowed connection to addr, borrowing one on first use.
+func (cc *clusterConn) node(ctx context.Context, addr string) (redis.Conn, error) {
+	if conn, ok := cc.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := cc.c.pool(addr).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cc.conns[addr] = conn
+	return conn, nil
+}
+
+func (cc *clusterConn) execute(ctx context.Context, timeout time.Duration, cmd clusterCommand) (interface{}, error) {
+	name := strings.ToUpper(cmd.name)
+	key := clusterKey(name, cmd.args)
+
+	if cc.pinned == "" {
+		switch {
+		case name == "MULTI":
+			// sent to the node of the first key of the transaction
+			cc.multi = true
+			return "OK", nil
+		case cc.multi && name == "EXEC":
+			cc.multi = false
+			return []interface{}{}, nil
+		case cc.multi && name == "DISCARD":
+			cc.multi = false
+			return "OK", nil
+		case cc.multi:
+			addr := cc.c.anyNode()
+			if key != "" {
+				addr = cc.c.nodeFor(key)
+			}
+			conn, err := cc.node(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := doOn(ctx, timeout, conn, "MULTI", nil); err != nil {
+				return nil, err
+			}
+			cc.pinned = addr
+		}
+	}
+
+	pinned := cc.pinned != ""
+	addr := cc.pinned
+	if !pinned {
+		addr = cc.c.anyNode()
+		if key != "" {
+			addr = cc.c.nodeFor(key)
+		}
+	}
+
+	var reply interface{}
+	var err error
+	for redirects := 0; ; redirects++ {
+		var conn redis.Conn
+		if conn, err = cc.node(ctx, addr); err != nil {
+			break
+		}
+		reply, err = doOn(ctx, timeout, conn, cmd.name, cmd.args)
+		if pinned || redirects >= maxClusterRedirects {
+			break
+		}
+		kind, slot, target := parseRedirect(err)
+		if kind == "" {
+			if err != nil && IsNetworkError(err) {
+				go func() {
+					_ = cc.c.refresh(context.Background())
+				}()
+			}
+			break
+		}
+		if kind == "MOVED" {
+			cc.c.moved(slot, target)
+			addr = target
+			continue
+		}
+		// ASK redirects only this command, after ASKING on the target node
+		if conn, err = cc.node(ctx, target); err != nil {
+			break
+		}
+		if _, err = doOn(ctx, timeout, conn, "ASKING", nil); err != nil {
+			break
+		}
+		reply, err = doOn(ctx, timeout, conn, cmd.name, cmd.args)
+		break
+	}
+
+	switch name {
+	case "WATCH":
+		if err == nil {
+			cc.pinned = addr
+		}
+	case "EXEC", "DISCARD":
+		cc.pinned, cc.multi = "", false
+	case "UNWATCH":
+		if !cc.multi {
+			cc.pinned = ""
+		}
+	}
+	return reply, err
+}
+
+func doOn(ctx context.Context, timeout time.Duration, conn redis.Conn, commandName string, args []interface{}) (interface{}, error) {
+	switch {
+	case timeout > 0:
+		return redis.DoWithTimeout(conn, timeout, commandName, args...)
+	case ctx.Done() != nil:
+		return redis.DoContext(conn, ctx, commandName, args...)
+	}
+	return conn.Do(commandName, args...)
+}
+
+// parseRedirect parses MOVED and ASK errors, returning an empty kind for other errors.
+func parseRedirect(err error) (kind string, slot int, addr string) {
+	var re redis.Error
+	if !errors.As(err, &re) {
+		return "", 0, ""
+	}
+	fields := strings.Fields(string(re))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, ""
+	}
+	slot, convErr := strconv.Atoi(fields[1])
+	if convErr != nil {
+		return "", 0, ""
+	}
+	return fields[0], slot, fields[2]
+}
@@ -0,0 +1,357 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+// Command redisdb-cli is an operator tool for inspecting and moving keys with the same
+// connection profiles and key prefixes that services configure through redisdb.
+//
+// Usage:
+//
+//	redisdb-cli [-url URL | -profile NAME [-profiles FILE]] [-prefix PREFIX] <command> [args]
+//
+// Commands:
+//
+//	get KEY                 print the value of a string key
+//	set KEY VALUE           set a string key
+//	scan PATTERN            list keys matching PATTERN
+//	ttl KEY                 print the remaining time to live of a key
+//	export PATTERN          write matching keys as JSON lines (DUMP payload and TTL) to stdout
+//	import                  restore keys written by export from stdin
+//	stats [SECTION]         print the server INFO section (default section when omitted)
+//	report [-samples N] PREFIX...
+//	                        print TTL histograms and size percentiles of sampled keys
+//	expiry [-horizon D] PREFIX...
+//	                        print keys expiring within the horizon per minute
+//	verify [-version V] [-modules M,...] [-policies P,...] [-events FLAGS]
+//	                        check the server against requirements, exit 1 when one fails
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/henryse/go-redisdb"
+	"os"
+	"strings"
+	"time"
+)
+
+type dumpRecord struct {
+	Key   string `json:"key"`
+	TTLMs int64  `json:"ttl_ms"`
+	Dump  string `json:"dump"`
+}
+
+func main() {
+	redisURL := flag.String("url", os.Getenv("REDIS_URL"), "redis url, defaults to $REDIS_URL")
+	profile := flag.String("profile", "", "connection profile name")
+	profilesFile := flag.String("profiles", "", "profiles JSON file, profiles are read from REDISDB_* variables when empty")
+	prefix := flag.String("prefix", "", "key prefix prepended to every key and pattern")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: redisdb-cli [flags] get|set|scan|ttl|export|import|stats|report|expiry|verify [args]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	d, err := open(*redisURL, *profile, *profilesFile)
+	if err != nil {
+		fail(err)
+	}
+
+	c := cli{d: d, prefix: *prefix}
+	if err := c.run(flag.Arg(0), flag.Args()[1:]); err != nil {
+		fail(err)
+	}
+}
+
+func open(redisURL string, profile string, profilesFile string) (*redisdb.RedisDatabase, error) {
+	if profile == "" {
+		if redisURL == "" {
+			return nil, fmt.Errorf("either -url, $REDIS_URL or -profile is required")
+		}
+		return redisdb.SetupDatabaseE(redisURL, redisdb.WithClientName("redisdb-cli"))
+	}
+
+	var profiles redisdb.Profiles
+	var err error
+	if profilesFile != "" {
+		profiles, err = redisdb.LoadProfilesFile(profilesFile)
+	} else {
+		profiles, err = redisdb.LoadProfilesFromEnv("REDISDB")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return profiles.Open(profile, redisdb.WithClientName("redisdb-cli"), redisdb.WithConnectMode(redisdb.ConnectEager))
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "redisdb-cli: %v\n", err)
+	os.Exit(1)
+}
+
+type cli struct {
+	d      *redisdb.RedisDatabase
+	prefix string
+}
+
+func (c *cli) run(command string, args []string) error {
+	switch command {
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: get KEY")
+		}
+		value, err := c.d.Get(c.prefix + args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(value))
+	case "set":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: set KEY VALUE")
+		}
+		return c.d.Set(c.prefix+args[0], []byte(args[1]))
+	case "scan":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: scan PATTERN")
+		}
+		keys, err := c.d.GetKeys(c.prefix + args[0])
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Println(strings.TrimPrefix(key, c.prefix))
+		}
+	case "ttl":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: ttl KEY")
+		}
+		return c.ttl(args[0])
+	case "export":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: export PATTERN")
+		}
+		return c.export(args[0])
+	case "import":
+		return c.importKeys()
+	case "stats":
+		section := "default"
+		if len(args) > 0 {
+			section = args[0]
+		}
+		return c.stats(section)
+	case "report":
+		return c.report(args)
+	case "expiry":
+		return c.expiry(args)
+	case "verify":
+		return c.verify(args)
+	default:
+		return fmt.Errorf("unknown command '%s'", command)
+	}
+	return nil
+}
+
+func (c *cli) ttl(key string) error {
+	ms, err := redis.Int64(c.d.Do("PTTL", c.prefix+key))
+	if err != nil {
+		return err
+	}
+	switch ms {
+	case -2:
+		return fmt.Errorf("key %s does not exist", key)
+	case -1:
+		fmt.Println("no expiry")
+	default:
+		fmt.Println(time.Duration(ms) * time.Millisecond)
+	}
+	return nil
+}
+
+func (c *cli) export(pattern string) error {
+	keys, err := c.d.GetKeys(c.prefix + pattern)
+	if err != nil {
+		return err
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	for _, key := range keys {
+		dump, err := redis.Bytes(c.d.Do("DUMP", key))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error dumping key %s: %v", key, err)
+		}
+		ttl, err := redis.Int64(c.d.Do("PTTL", key))
+		if err != nil {
+			return fmt.Errorf("error reading ttl of key %s: %v", key, err)
+		}
+		if ttl < -1 {
+			// expired or deleted after DUMP
+			continue
+		}
+		if ttl == -1 {
+			// RESTORE takes 0 for no expiry
+			ttl = 0
+		}
+		record := dumpRecord{
+			Key:   strings.TrimPrefix(key, c.prefix),
+			TTLMs: ttl,
+			Dump:  base64.StdEncoding.EncodeToString(dump),
+		}
+		if err := out.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) importKeys() error {
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), 512*1024*1024)
+	count := 0
+	for scanner.Scan() {
+		var record dumpRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("error parsing line %d: %v", count+1, err)
+		}
+		dump, err := base64.StdEncoding.DecodeString(record.Dump)
+		if err != nil {
+			return fmt.Errorf("error decoding key %s: %v", record.Key, err)
+		}
+		if _, err := c.d.Do("RESTORE", c.prefix+record.Key, record.TTLMs, dump, "REPLACE"); err != nil {
+			return fmt.Errorf("error restoring key %s: %v", record.Key, err)
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d keys\n", count)
+	return nil
+}
+
+func (c *cli) stats(section string) error {
+	info, err := redis.String(c.d.Do("INFO", section))
+	if err != nil {
+		return err
+	}
+	fmt.Print(strings.ReplaceAll(info, "\r\n", "\n"))
+	return nil
+}
+
+func (c *cli) report(args []string) error {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	samples := flags.Int("samples", 1000, "keys sampled per prefix")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: report [-samples N] PREFIX...")
+	}
+
+	prefixes := make([]string, flags.NArg())
+	for i, prefix := range flags.Args() {
+		prefixes[i] = c.prefix + prefix
+	}
+	reports, err := c.d.AnalyzeKeys(prefixes, *samples)
+	if err != nil {
+		return err
+	}
+	for _, report := range reports {
+		if _, err := report.WriteTo(os.Stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) expiry(args []string) error {
+	flags := flag.NewFlagSet("expiry", flag.ContinueOnError)
+	horizon := flags.Duration("horizon", 10*time.Minute, "report keys expiring within this duration")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: expiry [-horizon D] PREFIX...")
+	}
+
+	prefixes := make([]string, flags.NArg())
+	for i, prefix := range flags.Args() {
+		prefixes[i] = c.prefix + prefix
+	}
+	reports, err := c.d.ExpiryAudit(prefixes, redisdb.ExpiryAuditOptions{Horizon: *horizon})
+	if err != nil {
+		return err
+	}
+	for _, report := range reports {
+		if _, err := report.WriteTo(os.Stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	version := flags.String("version", "", "minimum server version")
+	modules := flags.String("modules", "", "comma separated modules that must be loaded")
+	policies := flags.String("policies", "", "comma separated acceptable maxmemory policies")
+	events := flags.String("events", "", "notify-keyspace-events flags that must be enabled")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var req redisdb.Requirements
+	if *version != "" {
+		v, err := redisdb.ParseServerVersion(*version)
+		if err != nil {
+			return err
+		}
+		req.MinVersion = v
+	}
+	if *modules != "" {
+		req.Modules = strings.Split(*modules, ",")
+	}
+	if *policies != "" {
+		req.MaxMemoryPolicies = strings.Split(*policies, ",")
+	}
+	req.KeyspaceEvents = *events
+
+	report, err := c.d.VerifyRequirements(req)
+	if report != nil {
+		fmt.Print(report)
+	}
+	return err
+}
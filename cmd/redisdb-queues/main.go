@@ -0,0 +1,409 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+// Command redisdb-queues is an on-call tool for the streams and lists services use as
+// queues, with the same connection profiles and key prefixes as redisdb-cli.
+//
+// Usage:
+//
+//	redisdb-queues [-url URL | -profile NAME [-profiles FILE]] [-prefix PREFIX] <command> [args]
+//
+// Commands:
+//
+//	list [PATTERN]          list streams and lists matching PATTERN (default *) with their depth
+//	depth QUEUE             print the number of entries of a stream or list
+//	lag STREAM              print the consumer groups of a stream with pending entries and lag
+//	peek [-n N] QUEUE       print the oldest N entries of a stream, or the first N elements of a list
+//	requeue [-n N] [-to STREAM] DLQ
+//	                        move the oldest N dead letters back to STREAM (default DLQ without :dlq)
+//	purge [-yes] QUEUE      remove all entries of a stream, keeping its groups, or delete a list
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/henryse/go-redisdb"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+func main() {
+	redisURL := flag.String("url", os.Getenv("REDIS_URL"), "redis url, defaults to $REDIS_URL")
+	profile := flag.String("profile", "", "connection profile name")
+	profilesFile := flag.String("profiles", "", "profiles JSON file, profiles are read from REDISDB_* variables when empty")
+	prefix := flag.String("prefix", "", "key prefix prepended to every queue and pattern")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: redisdb-queues [flags] list|depth|lag|peek|requeue|purge [args]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	d, err := open(*redisURL, *profile, *profilesFile)
+	if err != nil {
+		fail(err)
+	}
+
+	q := queues{d: d, prefix: *prefix}
+	if err := q.run(flag.Arg(0), flag.Args()[1:]); err != nil {
+		fail(err)
+	}
+}
+
+func open(redisURL string, profile string, profilesFile string) (*redisdb.RedisDatabase, error) {
+	if profile == "" {
+		if redisURL == "" {
+			return nil, fmt.Errorf("either -url, $REDIS_URL or -profile is required")
+		}
+		return redisdb.SetupDatabaseE(redisURL, redisdb.WithClientName("redisdb-queues"))
+	}
+
+	var profiles redisdb.Profiles
+	var err error
+	if profilesFile != "" {
+		profiles, err = redisdb.LoadProfilesFile(profilesFile)
+	} else {
+		profiles, err = redisdb.LoadProfilesFromEnv("REDISDB")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return profiles.Open(profile, redisdb.WithClientName("redisdb-queues"), redisdb.WithConnectMode(redisdb.ConnectEager))
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "redisdb-queues: %v\n", err)
+	os.Exit(1)
+}
+
+type queues struct {
+	d      *redisdb.RedisDatabase
+	prefix string
+}
+
+func (q *queues) run(command string, args []string) error {
+	switch command {
+	case "list":
+		pattern := "*"
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+		return q.list(pattern)
+	case "depth":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: depth QUEUE")
+		}
+		kind, err := q.kind(args[0])
+		if err != nil {
+			return err
+		}
+		depth, err := q.depth(q.prefix+args[0], kind)
+		if err != nil {
+			return err
+		}
+		fmt.Println(depth)
+	case "lag":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: lag STREAM")
+		}
+		return q.lag(args[0])
+	case "peek":
+		return q.peek(args)
+	case "requeue":
+		return q.requeue(args)
+	case "purge":
+		return q.purge(args)
+	default:
+		return fmt.Errorf("unknown command '%s'", command)
+	}
+	return nil
+}
+
+// kind returns "stream" or "list" for queue, failing for missing keys and other types.
+func (q *queues) kind(queue string) (string, error) {
+	kind, err := redis.String(q.d.Do("TYPE", q.prefix+queue))
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case "stream", "list":
+		return kind, nil
+	case "none":
+		return "", fmt.Errorf("queue %s does not exist", queue)
+	default:
+		return "", fmt.Errorf("%s is a %s, not a stream or list", queue, kind)
+	}
+}
+
+func (q *queues) depth(key string, kind string) (int64, error) {
+	if kind == "stream" {
+		return q.d.XLen(key)
+	}
+	n, err := q.d.LLen(key)
+	return int64(n), err
+}
+
+func (q *queues) list(pattern string) error {
+	kinds, err := q.scanQueues(q.prefix + pattern)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(kinds))
+	for key := range kinds {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	p := q.d.Pipeline()
+	for _, key := range keys {
+		if kinds[key] == "stream" {
+			p.Do("XLEN", key)
+		} else {
+			p.Do("LLEN", key)
+		}
+	}
+	results, err := p.Exec()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tTYPE\tDEPTH")
+	for i, key := range keys {
+		depth, err := redis.Int64(results[i].Reply, results[i].Err)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", strings.TrimPrefix(key, q.prefix), kinds[key], depth)
+	}
+	return w.Flush()
+}
+
+// scanQueues returns the streams and lists matching pattern with their type. Servers
+// supporting SCAN TYPE filter the keys themselves, older ones get the TYPE of every
+// scanned batch in one pipeline.
+func (q *queues) scanQueues(pattern string) (map[string]string, error) {
+	kinds := map[string]string{}
+	if c, err := q.d.Capabilities(); err == nil && c.Supports(redisdb.FeatureScanType) {
+		for _, kind := range []string{"stream", "list"} {
+			err := q.scan(pattern, []interface{}{"TYPE", kind}, func(keys []string) error {
+				for _, key := range keys {
+					kinds[key] = kind
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return kinds, nil
+	}
+
+	err := q.scan(pattern, nil, func(keys []string) error {
+		p := q.d.Pipeline()
+		for _, key := range keys {
+			p.Do("TYPE", key)
+		}
+		results, err := p.Exec()
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			kind, err := redis.String(results[i].Reply, results[i].Err)
+			if err != nil {
+				return err
+			}
+			if kind == "stream" || kind == "list" {
+				kinds[key] = kind
+			}
+		}
+		return nil
+	})
+	return kinds, err
+}
+
+// scan calls fn with every batch of keys matching pattern, passing extra to SCAN.
+func (q *queues) scan(pattern string, extra []interface{}, fn func(keys []string) error) error {
+	cursor := 0
+	for {
+		args := append([]interface{}{cursor, "MATCH", pattern, "COUNT", 500}, extra...)
+		arr, err := redis.Values(q.d.Do("SCAN", args...))
+		if err != nil {
+			return fmt.Errorf("error scanning '%s': %w", pattern, err)
+		}
+		cursor, _ = redis.Int(arr[0], nil)
+		keys, _ := redis.Strings(arr[1], nil)
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (q *queues) lag(stream string) error {
+	if kind, err := q.kind(stream); err != nil {
+		return err
+	} else if kind != "stream" {
+		return fmt.Errorf("%s is a list, only streams have consumer groups", stream)
+	}
+	groups, err := q.d.XInfoGroups(q.prefix + stream)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tCONSUMERS\tPENDING\tLAG\tLAST DELIVERED")
+	for _, g := range groups {
+		lag := "?"
+		if g.Lag >= 0 {
+			lag = fmt.Sprint(g.Lag)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", g.Name, g.Consumers, g.Pending, lag, g.LastDeliveredID)
+	}
+	return w.Flush()
+}
+
+func (q *queues) peek(args []string) error {
+	flags := flag.NewFlagSet("peek", flag.ContinueOnError)
+	n := flags.Int("n", 10, "number of entries")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *n <= 0 {
+		return fmt.Errorf("usage: peek [-n N] QUEUE")
+	}
+	queue := flags.Arg(0)
+	kind, err := q.kind(queue)
+	if err != nil {
+		return err
+	}
+
+	if kind == "list" {
+		values, err := q.d.LRange(q.prefix+queue, 0, *n-1)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			fmt.Println(string(value))
+		}
+		return nil
+	}
+
+	entries, err := q.d.XRange(q.prefix+queue, "-", "+", *n)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fields := make([]string, 0, len(entry.Fields))
+		for field, value := range entry.Fields {
+			fields = append(fields, field+"="+value)
+		}
+		sort.Strings(fields)
+		fmt.Printf("%s %s\n", entry.ID, strings.Join(fields, " "))
+	}
+	return nil
+}
+
+func (q *queues) requeue(args []string) error {
+	flags := flag.NewFlagSet("requeue", flag.ContinueOnError)
+	n := flags.Int("n", 100, "number of dead letters")
+	to := flags.String("to", "", "stream receiving the entries, the dead letter stream without :dlq when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *n <= 0 {
+		return fmt.Errorf("usage: requeue [-n N] [-to STREAM] DLQ")
+	}
+	dlq := flags.Arg(0)
+	target := *to
+	if target == "" {
+		if !strings.HasSuffix(dlq, ":dlq") {
+			return fmt.Errorf("-to is required when %s does not end in :dlq", dlq)
+		}
+		target = strings.TrimSuffix(dlq, ":dlq")
+	}
+	if kind, err := q.kind(dlq); err != nil {
+		return err
+	} else if kind != "stream" {
+		return fmt.Errorf("%s is a list, dead letters are kept in streams", dlq)
+	}
+
+	moved, err := q.d.RequeueDeadLetters(q.prefix+dlq, q.prefix+target, *n)
+	fmt.Fprintf(os.Stderr, "requeued %d entries to %s\n", moved, target)
+	return err
+}
+
+func (q *queues) purge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "remove the entries, only report what would be removed otherwise")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: purge [-yes] QUEUE")
+	}
+	queue := flags.Arg(0)
+	kind, err := q.kind(queue)
+	if err != nil {
+		return err
+	}
+
+	key := q.prefix + queue
+	if !*yes {
+		depth, err := q.depth(key, kind)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "would remove %d entries of %s %s, pass -yes to purge\n", depth, kind, queue)
+		return nil
+	}
+
+	var removed int64
+	if kind == "stream" {
+		removed, err = q.d.XTrim(key, 0)
+	} else {
+		removed, err = q.depth(key, kind)
+		if err == nil {
+			err = q.d.Delete(key)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "removed %d entries of %s %s\n", removed, kind, queue)
+	return nil
+}
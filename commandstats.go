@@ -0,0 +1,136 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommandStat holds the server side counters of one command from INFO commandstats.
+type CommandStat struct {
+	Calls         int64
+	Usec          int64
+	UsecPerCall   float64
+	RejectedCalls int64
+	FailedCalls   int64
+}
+
+// CommandStatsSnapshot is the INFO commandstats section at one point in time, keyed by
+// upper case command name; subcommands are separated by a space, as in "CLIENT SETNAME".
+type CommandStatsSnapshot struct {
+	Taken    time.Time
+	Commands map[string]CommandStat
+}
+
+// CommandStats reads the server's per command call counts and execution times.
+func (d *RedisDatabase) CommandStats() (CommandStatsSnapshot, error) {
+	snapshot := CommandStatsSnapshot{Commands: map[string]CommandStat{}}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reading command stats: %v", err)
+		}
+	}(conn)
+
+	info, err := redis.String(d.do(conn, "INFO", "commandstats"))
+	if err != nil {
+		return snapshot, fmt.Errorf("error reading command stats: %w", err)
+	}
+	snapshot.Taken = time.Now()
+
+	for key, value := range parseInfo(info) {
+		if !strings.HasPrefix(key, "cmdstat_") {
+			continue
+		}
+		name := strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(key, "cmdstat_"), "|", " "))
+
+		var stat CommandStat
+		for _, field := range strings.Split(value, ",") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "calls":
+				stat.Calls, _ = strconv.ParseInt(kv[1], 10, 64)
+			case "usec":
+				stat.Usec, _ = strconv.ParseInt(kv[1], 10, 64)
+			case "usec_per_call":
+				stat.UsecPerCall, _ = strconv.ParseFloat(kv[1], 64)
+			case "rejected_calls":
+				stat.RejectedCalls, _ = strconv.ParseInt(kv[1], 10, 64)
+			case "failed_calls":
+				stat.FailedCalls, _ = strconv.ParseInt(kv[1], 10, 64)
+			}
+		}
+		snapshot.Commands[name] = stat
+	}
+	return snapshot, nil
+}
+
+// Delta returns the activity between prev and s. Commands whose counters went down since
+// prev, after CONFIG RESETSTAT or a restart, report their counters since the reset.
+func (s CommandStatsSnapshot) Delta(prev CommandStatsSnapshot) CommandStatsSnapshot {
+	delta := CommandStatsSnapshot{Taken: s.Taken, Commands: map[string]CommandStat{}}
+	for name, cur := range s.Commands {
+		old, ok := prev.Commands[name]
+		if !ok || cur.Calls < old.Calls {
+			delta.Commands[name] = cur
+			continue
+		}
+		d := CommandStat{
+			Calls:         cur.Calls - old.Calls,
+			Usec:          cur.Usec - old.Usec,
+			RejectedCalls: cur.RejectedCalls - old.RejectedCalls,
+			FailedCalls:   cur.FailedCalls - old.FailedCalls,
+		}
+		if d.Calls > 0 {
+			d.UsecPerCall = float64(d.Usec) / float64(d.Calls)
+		}
+		if d.Calls > 0 || d.RejectedCalls > 0 || d.FailedCalls > 0 {
+			delta.Commands[name] = d
+		}
+	}
+	return delta
+}
+
+// Observe reports every command of the snapshot to g as the "server_command_calls",
+// "server_command_usec" and "server_command_failed_calls" gauges labelled with the
+// command name. Pass a Delta to export rates per interval.
+func (s CommandStatsSnapshot) Observe(g GaugeMetrics) {
+	for name, stat := range s.Commands {
+		g.ObserveGauge("server_command_calls", name, float64(stat.Calls))
+		g.ObserveGauge("server_command_usec", name, float64(stat.Usec))
+		g.ObserveGauge("server_command_failed_calls", name, float64(stat.FailedCalls+stat.RejectedCalls))
+	}
+}
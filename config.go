@@ -0,0 +1,124 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// Default pool limits used when Config leaves them zero and by SetupDatabase.
+const (
+	DefaultMaxIdle   = 80
+	DefaultMaxActive = 12000
+)
+
+// Config tunes the pool and dialing of a database created with SetupDatabaseWithConfig.
+// Zero values select the defaults in brackets.
+type Config struct {
+	URL string
+	// MaxIdle is the number of idle connections kept in the pool [DefaultMaxIdle].
+	MaxIdle int
+	// MaxActive limits the connections open at once [DefaultMaxActive], negative for no
+	// limit.
+	MaxActive int
+	// IdleTimeout closes connections idle for longer [0, never].
+	IdleTimeout time.Duration
+	// Wait makes commands wait for a connection when MaxActive is reached instead of
+	// failing with redis.ErrPoolExhausted.
+	Wait bool
+	// MaxConnLifetime retires connections older than this [0, never], see
+	// WithMaxConnLifetime for spreading the retirement with jitter.
+	MaxConnLifetime time.Duration
+	// TestOnBorrow checks an idle connection before it is handed out, after the
+	// package's own lifetime and endpoint checks. A returned error closes the connection.
+	TestOnBorrow func(c redis.Conn, lastUsed time.Time) error
+	// ConnectTimeout, ReadTimeout and WriteTimeout bound dialing and every read and
+	// write on a connection [30s for connecting, no timeout for reads and writes].
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+}
+
+// defaultConnectTimeout bounds dialing when Config.ConnectTimeout is not set.
+const defaultConnectTimeout = 30 * time.Second
+
+// poolConfig holds the redis.Pool settings of a Config.
+type poolConfig struct {
+	maxIdle      int
+	maxActive    int
+	idleTimeout  time.Duration
+	wait         bool
+	testOnBorrow func(c redis.Conn, lastUsed time.Time) error
+}
+
+func defaultPoolConfig() poolConfig {
+	return poolConfig{maxIdle: DefaultMaxIdle, maxActive: DefaultMaxActive}
+}
+
+func (c Config) options() []Option {
+	var opts []Option
+	opts = append(opts, func(o *options) {
+		if c.MaxIdle > 0 {
+			o.pool.maxIdle = c.MaxIdle
+		}
+		switch {
+		case c.MaxActive > 0:
+			o.pool.maxActive = c.MaxActive
+		case c.MaxActive < 0:
+			o.pool.maxActive = 0
+		}
+		o.pool.idleTimeout = c.IdleTimeout
+		o.pool.wait = c.Wait
+		o.pool.testOnBorrow = c.TestOnBorrow
+		if c.ConnectTimeout > 0 {
+			o.connectTimeout = c.ConnectTimeout
+		}
+	})
+	if c.MaxConnLifetime > 0 {
+		opts = append(opts, WithMaxConnLifetime(c.MaxConnLifetime, 0))
+	}
+
+	var dialOptions []redis.DialOption
+	if c.ReadTimeout > 0 {
+		dialOptions = append(dialOptions, redis.DialReadTimeout(c.ReadTimeout))
+	}
+	if c.WriteTimeout > 0 {
+		dialOptions = append(dialOptions, redis.DialWriteTimeout(c.WriteTimeout))
+	}
+	if len(dialOptions) > 0 {
+		opts = append(opts, WithDialOptions(dialOptions...))
+	}
+	return opts
+}
+
+// SetupDatabaseWithConfig is SetupDatabaseE with the pool tuned by config. Options are
+// applied after the ones derived from config.
+// noinspection GoUnusedExportedFunction
+func SetupDatabaseWithConfig(config Config, opts ...Option) (*RedisDatabase, error) {
+	return SetupDatabaseE(config.URL, append(config.options(), opts...)...)
+}
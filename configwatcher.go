@@ -0,0 +1,310 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"sync"
+	"time"
+)
+
+// ConfigChange is the old and new value of a changed config field.
+type ConfigChange struct {
+	Old string
+	New string
+}
+
+// ConfigDiff describes how the watched config hash changed since the previous snapshot.
+type ConfigDiff struct {
+	Added   map[string]string
+	Changed map[string]ConfigChange
+	Removed map[string]string
+}
+
+// Empty reports whether the diff holds no changes.
+func (d ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+func diffConfig(old map[string]string, current map[string]string) ConfigDiff {
+	diff := ConfigDiff{Added: map[string]string{}, Changed: map[string]ConfigChange{}, Removed: map[string]string{}}
+	for field, value := range current {
+		previous, ok := old[field]
+		if !ok {
+			diff.Added[field] = value
+		} else if previous != value {
+			diff.Changed[field] = ConfigChange{Old: previous, New: value}
+		}
+	}
+	for field, value := range old {
+		if _, ok := current[field]; !ok {
+			diff.Removed[field] = value
+		}
+	}
+	return diff
+}
+
+// ConfigWatcher keeps a local copy of application config stored in a hash and notifies
+// listeners when it changes. Writers go through Set and Delete, which publish a
+// notification on "<key>:changes" in the same transaction as the hash update.
+type ConfigWatcher struct {
+	d       *RedisDatabase
+	key     string
+	channel string
+
+	mu        sync.Mutex
+	current   map[string]string
+	listeners []func(diff ConfigDiff)
+	psc       *redis.PubSubConn
+	started   bool
+	stopped   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewConfigWatcher creates a watcher for the config hash at key. Call Start to load the
+// config and begin watching.
+func NewConfigWatcher(d *RedisDatabase, key string) *ConfigWatcher {
+	return &ConfigWatcher{
+		d:       d,
+		key:     key,
+		channel: key + ":changes",
+		current: map[string]string{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// OnChange registers fn to be called with every non-empty diff. Listeners run on the
+// watcher goroutine and should return quickly.
+func (w *ConfigWatcher) OnChange(fn func(diff ConfigDiff)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.listeners = append(w.listeners, fn)
+}
+
+// Start loads the current config and starts watching for changes.
+func (w *ConfigWatcher) Start() error {
+	if err := w.reload(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.started && !w.stopped {
+		w.started = true
+		go w.run()
+	}
+	return nil
+}
+
+// Get returns the current value of field.
+func (w *ConfigWatcher) Get(field string) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	value, ok := w.current[field]
+	return value, ok
+}
+
+// Snapshot returns a copy of the current config.
+func (w *ConfigWatcher) Snapshot() map[string]string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	snapshot := make(map[string]string, len(w.current))
+	for field, value := range w.current {
+		snapshot[field] = value
+	}
+	return snapshot
+}
+
+// Set writes field and notifies all watchers of the hash.
+func (w *ConfigWatcher) Set(field string, value string) error {
+	return w.write("HSET", field, value)
+}
+
+// Delete removes field and notifies all watchers of the hash.
+func (w *ConfigWatcher) Delete(field string) error {
+	return w.write("HDEL", field)
+}
+
+func (w *ConfigWatcher) write(command string, args ...interface{}) error {
+	conn := w.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close writing config %s: %v", w.key, err)
+		}
+	}(conn)
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := conn.Send(command, append([]interface{}{w.key}, args...)...); err != nil {
+		return err
+	}
+	if err := conn.Send("PUBLISH", w.channel, args[0]); err != nil {
+		return err
+	}
+	if _, err := w.d.do(conn, "EXEC"); err != nil {
+		return fmt.Errorf("error writing config %s: %w", w.key, err)
+	}
+	return nil
+}
+
+func (w *ConfigWatcher) reload() error {
+	conn := w.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close loading config %s: %v", w.key, err)
+		}
+	}(conn)
+
+	current, err := redis.StringMap(w.d.do(conn, "HGETALL", w.key))
+	if err != nil {
+		return fmt.Errorf("error loading config %s: %w", w.key, err)
+	}
+
+	w.mu.Lock()
+	diff := diffConfig(w.current, current)
+	w.current = current
+	listeners := append([]func(diff ConfigDiff){}, w.listeners...)
+	w.mu.Unlock()
+
+	if !diff.Empty() {
+		for _, listener := range listeners {
+			_ = w.d.options().call("config watcher listener", func() error {
+				listener(diff)
+				return nil
+			})
+		}
+	}
+	return nil
+}
+
+func (w *ConfigWatcher) run() {
+	defer close(w.done)
+
+	backoff := 100 * time.Millisecond
+	for {
+		subscribed, err := w.watch()
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		if subscribed {
+			backoff = 100 * time.Millisecond
+		}
+		if err != nil {
+			w.d.options().logger.Printf("config watcher %s lost subscription: %v", w.key, err)
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-w.d.options().clock.After(backoff):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// watch subscribes to the change channel and reloads on every notification until the
+// subscription fails or the watcher is closed. It reports whether the subscription was
+// confirmed, so run only backs off further when subscribing keeps failing.
+func (w *ConfigWatcher) watch() (bool, error) {
+	psc := redis.PubSubConn{Conn: w.d.redisPool.Get()}
+	defer func() {
+		w.mu.Lock()
+		w.psc = nil
+		w.mu.Unlock()
+		_ = psc.Close()
+	}()
+
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return false, nil
+	}
+	w.psc = &psc
+	w.mu.Unlock()
+
+	if err := psc.Subscribe(w.channel); err != nil {
+		return false, err
+	}
+	subscribed := false
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			if v.Count == 0 {
+				return subscribed, nil
+			}
+			subscribed = true
+			// changes made while we were not subscribed
+			if err := w.reload(); err != nil {
+				return subscribed, err
+			}
+		case redis.Message:
+			if err := w.reload(); err != nil {
+				return subscribed, err
+			}
+		case error:
+			return subscribed, v
+		}
+	}
+}
+
+// Close stops watching. The local snapshot stays readable.
+func (w *ConfigWatcher) Close() {
+	_ = w.Stop(context.Background())
+}
+
+// Stop stops watching, waiting for listeners in progress until ctx is done.
+func (w *ConfigWatcher) Stop(ctx context.Context) error {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return nil
+	}
+	w.stopped = true
+	close(w.stop)
+	if w.psc != nil {
+		_ = w.psc.Unsubscribe()
+	}
+	started := w.started
+	w.mu.Unlock()
+
+	if started {
+		return waitDone(ctx, w.done)
+	}
+	return nil
+}
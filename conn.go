@@ -0,0 +1,282 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ConnectionHooks are invoked over the lifetime of pooled connections. The addr
+// argument is the remote address of the connection, or the configured address when
+// the dial did not get far enough to resolve one.
+type ConnectionHooks struct {
+	// OnConnect is called after a new connection has been established.
+	OnConnect func(addr string)
+	// OnClose is called when the pool closes a connection, with the error from closing it.
+	OnClose func(addr string, err error)
+	// OnError is called when a dial fails or a connection becomes unusable.
+	OnError func(addr string, err error)
+}
+
+// WithMaxConnLifetime closes pooled connections once they are older than lifetime plus a
+// random share of jitter, so connections dialed together, for example after a failover
+// or deploy, do not all expire and re-dial at the same moment.
+func WithMaxConnLifetime(lifetime time.Duration, jitter time.Duration) Option {
+	return func(o *options) {
+		o.maxConnLifetime = lifetime
+		o.connLifetimeJitter = jitter
+	}
+}
+
+// connExpiry returns when a connection dialed now should be retired, zero for never.
+func connExpiry(o *options) time.Time {
+	if o.maxConnLifetime <= 0 {
+		return time.Time{}
+	}
+	lifetime := o.maxConnLifetime
+	if o.connLifetimeJitter > 0 {
+		lifetime += time.Duration(rand.Int63n(int64(o.connLifetimeJitter)))
+	}
+	return time.Now().Add(lifetime)
+}
+
+// testOnBorrow retires connections past their lifetime or to endpoints that the
+// EndpointResolver no longer lists.
+func testOnBorrow(c redis.Conn, _ time.Time) error {
+	hc, ok := c.(*hookedConn)
+	if !ok {
+		return nil
+	}
+	if !hc.expires.IsZero() && time.Now().After(hc.expires) {
+		return errConnExpired
+	}
+	if hc.resolver != nil && !hc.resolver.listed(hc.target) {
+		return errEndpointRemoved
+	}
+	return nil
+}
+
+var (
+	errConnExpired     = errors.New("redis: connection reached its maximum lifetime")
+	errEndpointRemoved = errors.New("redis: connection endpoint was removed")
+)
+
+// WithConnectionHooks registers connection lifecycle callbacks.
+func WithConnectionHooks(hooks ConnectionHooks) Option {
+	return func(o *options) {
+		o.hooks = hooks
+	}
+}
+
+func dial(ctx context.Context, redisURL string, o *options) (redis.Conn, error) {
+	addr := urlAddress(redisURL)
+	var target string
+	dialOptions := append(o.dialOptions[:len(o.dialOptions):len(o.dialOptions)],
+		redis.DialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			if o.resolver != nil {
+				address = o.resolver.pick(address)
+				target = address
+			}
+			dialer := net.Dialer{Timeout: o.connectTimeout, KeepAlive: 5 * time.Minute}
+			c, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				addr = address
+				return nil, err
+			}
+			addr = c.RemoteAddr().String()
+			return c, nil
+		}))
+
+	c, err := dialURL(ctx, tlsURL(redisURL, o), dialOptions, o)
+	if err == nil {
+		if err = identify(ctx, c, o); err != nil {
+			_ = c.Close()
+		}
+	}
+	if err != nil {
+		if o.hooks.OnError != nil {
+			o.hooks.OnError(addr, err)
+		}
+		return nil, err
+	}
+
+	if o.hooks.OnConnect != nil {
+		o.hooks.OnConnect(addr)
+	}
+	return &hookedConn{
+		Conn:     c,
+		addr:     addr,
+		hooks:    &o.hooks,
+		auth:     o.auth,
+		expires:  connExpiry(o),
+		resolver: o.resolver,
+		target:   target,
+
+		residency: &o.residency,
+	}, nil
+}
+
+func urlAddress(redisURL string) string {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// hookedConn reports connection level failures and closes to the ConnectionHooks.
+// It forwards the timeout and context variants so redis.DoWithTimeout and
+// redis.DoContext keep working through the pool.
+//
+// With WithAuth a command rejected with NOAUTH is retried once after authenticating
+// again. When that fails the connection reports the error from Err, so the pool drops it
+// and the next connection is dialed with fresh credentials.
+//
+// Writes that break a WithResidency rule are rejected before they are sent.
+type hookedConn struct {
+	redis.Conn
+	addr    string
+	hooks   *ConnectionHooks
+	auth    AuthFunc
+	authErr error
+	failed  bool
+	expires time.Time
+
+	resolver *EndpointResolver
+	target   string
+
+	residency *residencyPolicy
+}
+
+func (c *hookedConn) Err() error {
+	if err := c.Conn.Err(); err != nil {
+		return err
+	}
+	return c.authErr
+}
+
+// retryAuth runs do and runs it again after authenticating when it fails with NOAUTH.
+func (c *hookedConn) retryAuth(do func() (interface{}, error)) (interface{}, error) {
+	reply, err := do()
+	if !isAuthError(err) {
+		return reply, err
+	}
+	if c.auth == nil || c.authErr != nil || strings.HasPrefix(err.Error(), "WRONGPASS") {
+		c.authErr = err
+		return reply, err
+	}
+	if authErr := reauth(c.Conn, c.auth); authErr != nil {
+		c.authErr = authErr
+		return reply, err
+	}
+	reply, err = do()
+	if isAuthError(err) {
+		c.authErr = err
+	}
+	return reply, err
+}
+
+func (c *hookedConn) check(err error) error {
+	if err != nil && !c.failed && c.Conn.Err() != nil {
+		c.failed = true
+		if c.hooks.OnError != nil {
+			c.hooks.OnError(c.addr, err)
+		}
+	}
+	return err
+}
+
+func (c *hookedConn) Close() error {
+	err := c.Conn.Close()
+	if c.hooks.OnClose != nil {
+		c.hooks.OnClose(c.addr, err)
+	}
+	return err
+}
+
+func (c *hookedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if err := c.residency.check(commandName, args); err != nil {
+		return nil, err
+	}
+	reply, err := c.retryAuth(func() (interface{}, error) {
+		return c.Conn.Do(commandName, args...)
+	})
+	return reply, c.check(err)
+}
+
+func (c *hookedConn) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	if err := c.residency.check(commandName, args); err != nil {
+		return nil, err
+	}
+	reply, err := c.retryAuth(func() (interface{}, error) {
+		return redis.DoContext(c.Conn, ctx, commandName, args...)
+	})
+	return reply, c.check(err)
+}
+
+func (c *hookedConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	if err := c.residency.check(commandName, args); err != nil {
+		return nil, err
+	}
+	reply, err := c.retryAuth(func() (interface{}, error) {
+		return redis.DoWithTimeout(c.Conn, timeout, commandName, args...)
+	})
+	return reply, c.check(err)
+}
+
+func (c *hookedConn) Send(commandName string, args ...interface{}) error {
+	if err := c.residency.check(commandName, args); err != nil {
+		return err
+	}
+	return c.check(c.Conn.Send(commandName, args...))
+}
+
+func (c *hookedConn) Flush() error {
+	return c.check(c.Conn.Flush())
+}
+
+func (c *hookedConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	return reply, c.check(err)
+}
+
+func (c *hookedConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	reply, err := redis.ReceiveContext(c.Conn, ctx)
+	return reply, c.check(err)
+}
+
+func (c *hookedConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redis.ReceiveWithTimeout(c.Conn, timeout)
+	return reply, c.check(err)
+}
@@ -0,0 +1,147 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WriteToken records the replication offset of the primary after a write. Reads that
+// present the token are served by the replica only once it has replicated that far.
+// The zero token places no constraint on reads.
+type WriteToken struct {
+	Offset int64
+}
+
+// String encodes the token, for example to carry it in a session cookie.
+func (t WriteToken) String() string {
+	return strconv.FormatInt(t.Offset, 10)
+}
+
+// ParseWriteToken decodes a token produced by WriteToken.String.
+func ParseWriteToken(s string) (WriteToken, error) {
+	offset, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return WriteToken{}, fmt.Errorf("invalid write token '%s'", s)
+	}
+	return WriteToken{Offset: offset}, nil
+}
+
+// Max returns the later of t and o.
+func (t WriteToken) Max(o WriteToken) WriteToken {
+	if o.Offset > t.Offset {
+		return o
+	}
+	return t
+}
+
+// ReplicaRouter gives read-your-writes consistency across a primary and a replica. Writes
+// go to the primary and return a WriteToken; reads with a token go to the replica when
+// its replication offset has caught up and to the primary otherwise.
+type ReplicaRouter struct {
+	primary *RedisDatabase
+	replica *RedisDatabase
+	// MaxOffsetAge bounds how long a replica offset is reused before INFO is queried again.
+	MaxOffsetAge time.Duration
+
+	mu        sync.Mutex
+	offset    int64
+	checkedAt time.Time
+}
+
+// NewReplicaRouter routes between primary and replica.
+func NewReplicaRouter(primary *RedisDatabase, replica *RedisDatabase) *ReplicaRouter {
+	return &ReplicaRouter{primary: primary, replica: replica, MaxOffsetAge: 100 * time.Millisecond}
+}
+
+// Write runs fn against the primary and returns a token covering its writes.
+func (r *ReplicaRouter) Write(fn func(primary *RedisDatabase) error) (WriteToken, error) {
+	if err := fn(r.primary); err != nil {
+		return WriteToken{}, err
+	}
+	offset, err := replicationOffset(r.primary, "master_repl_offset")
+	if err != nil {
+		return WriteToken{}, err
+	}
+	return WriteToken{Offset: offset}, nil
+}
+
+// Reader returns the replica when it has replicated everything covered by token, else
+// the primary. It also falls back to the primary when the replica can not be queried.
+func (r *ReplicaRouter) Reader(token WriteToken) *RedisDatabase {
+	if token.Offset <= 0 {
+		return r.replica
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.offset >= token.Offset {
+		return r.replica
+	}
+	if r.primary.options().clock.Now().Sub(r.checkedAt) < r.MaxOffsetAge {
+		return r.primary
+	}
+	offset, err := replicationOffset(r.replica, "slave_repl_offset")
+	if err != nil {
+		return r.primary
+	}
+	r.offset, r.checkedAt = offset, r.primary.options().clock.Now()
+	if r.offset >= token.Offset {
+		return r.replica
+	}
+	return r.primary
+}
+
+// replicationOffset reads field from INFO replication.
+func replicationOffset(d *RedisDatabase, field string) (int64, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reading replication offset: %v", err)
+		}
+	}(conn)
+
+	info, err := redis.String(d.do(conn, "INFO", "replication"))
+	if err != nil {
+		return 0, fmt.Errorf("error reading replication offset: %w", err)
+	}
+	value, ok := parseInfo(info)[field]
+	if !ok {
+		return 0, fmt.Errorf("redis: INFO replication has no %s", field)
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error reading replication offset: %w", err)
+	}
+	return offset, nil
+}
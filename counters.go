@@ -0,0 +1,282 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"path"
+	"sync"
+	"time"
+)
+
+// ErrCounterBatcherClosed is returned for increments after Stop or Close.
+var ErrCounterBatcherClosed = errors.New("redis: counter batcher is closed")
+
+type counterWindow struct {
+	pattern string
+	window  time.Duration
+}
+
+type pendingCounter struct {
+	delta int64
+	due   time.Time
+}
+
+// CounterBatcher aggregates INCRBY calls in process and flushes them in one pipeline per
+// window, trading a little staleness for far fewer writes on hot counters.
+type CounterBatcher struct {
+	d       *RedisDatabase
+	window  time.Duration
+	windows []counterWindow
+	onError func(err error)
+
+	mu      sync.Mutex
+	pending map[string]*pendingCounter
+	closed  bool
+
+	// reset tells the flusher that SetWindow changed the shortest window
+	reset    chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewCounterBatcher starts a batcher that flushes counters window after their first
+// increment. Flush failures are passed to onError, which may be nil.
+func NewCounterBatcher(d *RedisDatabase, window time.Duration, onError func(err error)) *CounterBatcher {
+	b := &CounterBatcher{
+		d:       d,
+		window:  window,
+		onError: onError,
+		pending: map[string]*pendingCounter{},
+		reset:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// SetWindow overrides the flush window for keys matching the path.Match pattern, such as
+// "stats:views:*". A zero window writes matching keys through immediately. Patterns are
+// checked in the order they were added.
+func (b *CounterBatcher) SetWindow(pattern string, window time.Duration) {
+	b.mu.Lock()
+	b.windows = append(b.windows, counterWindow{pattern: pattern, window: window})
+	b.mu.Unlock()
+	select {
+	case b.reset <- struct{}{}:
+	default:
+	}
+}
+
+func (b *CounterBatcher) windowFor(key string) time.Duration {
+	for _, w := range b.windows {
+		if ok, _ := path.Match(w.pattern, key); ok {
+			return w.window
+		}
+	}
+	return b.window
+}
+
+// IncrBy adds delta to key. The increment is written on the next flush of its window.
+func (b *CounterBatcher) IncrBy(key string, delta int64) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrCounterBatcherClosed
+	}
+	window := b.windowFor(key)
+	if window <= 0 {
+		b.mu.Unlock()
+		_, err := redis.Int64(b.d.Do("INCRBY", key, delta))
+		return err
+	}
+
+	p, ok := b.pending[key]
+	if !ok {
+		p = &pendingCounter{due: b.d.options().clock.Now().Add(window)}
+		b.pending[key] = p
+	}
+	p.delta += delta
+	b.mu.Unlock()
+	return nil
+}
+
+// Incr adds one to key.
+func (b *CounterBatcher) Incr(key string) error {
+	return b.IncrBy(key, 1)
+}
+
+// tick returns the flush interval, half the shortest window.
+func (b *CounterBatcher) tick() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tick := b.window
+	for _, w := range b.windows {
+		if w.window > 0 && (tick <= 0 || w.window < tick) {
+			tick = w.window
+		}
+	}
+	if tick <= 0 {
+		tick = 50 * time.Millisecond
+	}
+	return tick / 2
+}
+
+func (b *CounterBatcher) run() {
+	defer close(b.done)
+
+	clock := b.d.options().clock
+	ticker := clock.NewTicker(b.tick())
+	defer func() {
+		ticker.Stop()
+	}()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-b.reset:
+			ticker.Stop()
+			ticker = clock.NewTicker(b.tick())
+		case now := <-ticker.C():
+			if err := b.flush(now); err != nil && b.onError != nil {
+				_ = b.d.options().call("counter batcher error callback", func() error {
+					b.onError(err)
+					return nil
+				})
+			}
+		}
+	}
+}
+
+// Flush writes all pending increments now, regardless of their windows.
+func (b *CounterBatcher) Flush() error {
+	return b.flush(time.Time{})
+}
+
+// flush writes the counters due at now, or all counters when now is zero. Increments lost
+// to connection failures are put back so the next flush retries them.
+func (b *CounterBatcher) flush(now time.Time) error {
+	b.mu.Lock()
+	due := map[string]int64{}
+	for key, p := range b.pending {
+		if now.IsZero() || !p.due.After(now) {
+			due[key] = p.delta
+			delete(b.pending, key)
+		}
+	}
+	b.mu.Unlock()
+	if len(due) == 0 {
+		return nil
+	}
+
+	failed, err := b.write(due)
+	if len(failed) > 0 {
+		b.mu.Lock()
+		for key, delta := range failed {
+			p, ok := b.pending[key]
+			if !ok {
+				p = &pendingCounter{due: b.d.options().clock.Now()}
+				b.pending[key] = p
+			}
+			p.delta += delta
+		}
+		b.mu.Unlock()
+	}
+	return err
+}
+
+func (b *CounterBatcher) write(counters map[string]int64) (map[string]int64, error) {
+	conn := b.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close flushing counters: %v", err)
+		}
+	}(conn)
+
+	keys := make([]string, 0, len(counters))
+	for key, delta := range counters {
+		if err := conn.Send("INCRBY", key, delta); err != nil {
+			return counters, fmt.Errorf("error flushing counters: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := conn.Flush(); err != nil {
+		return counters, fmt.Errorf("error flushing counters: %w", err)
+	}
+
+	failed := map[string]int64{}
+	var firstErr error
+	for _, key := range keys {
+		if _, err := conn.Receive(); err != nil {
+			// retry after connection failures, server errors such as WRONGTYPE would repeat
+			if conn.Err() != nil {
+				failed[key] = counters[key]
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error flushing counter %s: %w", key, err)
+			}
+		}
+	}
+	return failed, firstErr
+}
+
+// Close stops the background flusher and writes the remaining increments.
+func (b *CounterBatcher) Close() error {
+	return b.Stop(context.Background())
+}
+
+// Stop stops the background flusher and writes the remaining increments, giving up
+// when ctx is done first. Increments that could not be written are kept, so a later
+// Flush can retry them. Further increments fail with ErrCounterBatcherClosed.
+func (b *CounterBatcher) Stop(ctx context.Context) error {
+	b.stopOnce.Do(func() {
+		b.mu.Lock()
+		b.closed = true
+		b.mu.Unlock()
+		close(b.stop)
+	})
+	if err := waitDone(ctx, b.done); err != nil {
+		return err
+	}
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- b.Flush()
+	}()
+	select {
+	case err := <-flushed:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("redis: counter batcher stopped before flushing: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,223 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials authenticate a connection. An empty Username authenticates the default user.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialsProvider supplies the credentials for new connections. It is called on every
+// dial and again when the server rejects a connection, see AuthRetry.
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// WithCredentialsProvider authenticates connections with the credentials from p.
+func WithCredentialsProvider(p CredentialsProvider) Option {
+	return WithAuth(func(ctx context.Context) (string, string, error) {
+		c, err := p.Credentials(ctx)
+		return c.Username, c.Password, err
+	})
+}
+
+type authRetryKey struct{}
+
+// AuthRetry reports whether credentials are requested because the server rejected the
+// previous ones, in which case cached credentials should not be returned again.
+func AuthRetry(ctx context.Context) bool {
+	retry, _ := ctx.Value(authRetryKey{}).(bool)
+	return retry
+}
+
+// EnvCredentials reads the credentials from environment variables on every call, so a
+// sidecar or init process rewriting them is picked up by the next dial.
+type EnvCredentials struct {
+	// UsernameVar may be empty for the default user.
+	UsernameVar string
+	PasswordVar string
+}
+
+func (e EnvCredentials) Credentials(context.Context) (Credentials, error) {
+	var c Credentials
+	if e.UsernameVar != "" {
+		c.Username = os.Getenv(e.UsernameVar)
+	}
+	password, ok := os.LookupEnv(e.PasswordVar)
+	if !ok {
+		return c, fmt.Errorf("redis: environment variable %s is not set", e.PasswordVar)
+	}
+	c.Password = password
+	return c, nil
+}
+
+// VaultCredentials reads the credentials from a HashiCorp Vault secret over the HTTP API.
+// It works with KV version 1 and 2 secrets as well as dynamic database credentials, and
+// caches the result for the lease duration, or CacheFor when the secret has no lease.
+type VaultCredentials struct {
+	// Address defaults to $VAULT_ADDR.
+	Address string
+	// Token defaults to the contents of TokenFile, then to $VAULT_TOKEN.
+	Token     string
+	TokenFile string
+	Namespace string
+	// Path is the API path below /v1/, such as "secret/data/redis" for a KV version 2
+	// secret or "database/creds/app" for dynamic credentials.
+	Path string
+	// UsernameKey and PasswordKey name the secret fields, "username" and "password"
+	// by default.
+	UsernameKey string
+	PasswordKey string
+	CacheFor    time.Duration
+	Client      *http.Client
+
+	mu      sync.Mutex
+	cached  Credentials
+	expires time.Time
+}
+
+type vaultSecret struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+}
+
+func (v *VaultCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !AuthRetry(ctx) && time.Now().Before(v.expires) {
+		return v.cached, nil
+	}
+
+	secret, err := v.read(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		// KV version 2 wraps the fields next to the version metadata
+		data = nested
+	}
+
+	usernameKey, passwordKey := v.UsernameKey, v.PasswordKey
+	if usernameKey == "" {
+		usernameKey = "username"
+	}
+	if passwordKey == "" {
+		passwordKey = "password"
+	}
+	password, ok := data[passwordKey].(string)
+	if !ok {
+		return Credentials{}, fmt.Errorf("redis: vault secret %s has no field %s", v.Path, passwordKey)
+	}
+	username, _ := data[usernameKey].(string)
+
+	cacheFor := v.CacheFor
+	if cacheFor == 0 {
+		cacheFor = time.Minute
+	}
+	if secret.LeaseDuration > 0 {
+		cacheFor = time.Duration(secret.LeaseDuration) * time.Second / 2
+	}
+	v.cached = Credentials{Username: username, Password: password}
+	v.expires = time.Now().Add(cacheFor)
+	return v.cached, nil
+}
+
+func (v *VaultCredentials) read(ctx context.Context) (*vaultSecret, error) {
+	address := v.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, fmt.Errorf("redis: vault address is not configured")
+	}
+	token, err := v.token()
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimSuffix(address, "/") + "/v1/" + strings.TrimPrefix(v.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault secret %s: %w", v.Path, err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault secret %s: %w", v.Path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("error reading vault secret %s: %s %s", v.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var secret vaultSecret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("error decoding vault secret %s: %w", v.Path, err)
+	}
+	return &secret, nil
+}
+
+func (v *VaultCredentials) token() (string, error) {
+	if v.Token != "" {
+		return v.Token, nil
+	}
+	if v.TokenFile != "" {
+		token, err := os.ReadFile(v.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading vault token: %w", err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("redis: vault token is not configured")
+}
@@ -0,0 +1,117 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CursorStoreOptions configures a CursorStore. Zero values select the defaults in
+// brackets.
+type CursorStoreOptions struct {
+	// Prefix is prepended to the token to form the key ["cursor:"].
+	Prefix string
+	// TTL is how long a cursor can be used [15m].
+	TTL time.Duration
+}
+
+// Cursor is the server side state behind a pagination token.
+type Cursor struct {
+	// Query identifies the result set, such as the serialized filter and the ids or
+	// version of the snapshot being paged through.
+	Query []byte `json:"query"`
+	// Offset is the position of the next page.
+	Offset int64 `json:"offset"`
+}
+
+// CursorStore keeps pagination cursors in Redis and hands out opaque random tokens for
+// them, so APIs can offer stable cursors without encoding state into the token. Tokens
+// are single use: Consume returns and deletes a cursor atomically, and the next page
+// comes with a new token from Save.
+type CursorStore struct {
+	d    *RedisDatabase
+	opts CursorStoreOptions
+}
+
+// NewCursorStore creates a store on d.
+func NewCursorStore(d *RedisDatabase, opts CursorStoreOptions) *CursorStore {
+	if opts.Prefix == "" {
+		opts.Prefix = "cursor:"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 15 * time.Minute
+	}
+	return &CursorStore{d: d, opts: opts}
+}
+
+// Save stores c and returns the token to fetch it with.
+func (s *CursorStore) Save(c Cursor) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating cursor token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	if _, err := s.d.Do("SET", s.opts.Prefix+token, data, "PX", s.opts.TTL.Milliseconds()); err != nil {
+		return "", fmt.Errorf("error saving cursor: %w", err)
+	}
+	return token, nil
+}
+
+// Consume returns the cursor of token and deletes it, failing with ErrKeyNotFound when
+// the token expired, was used already or never existed.
+func (s *CursorStore) Consume(token string) (Cursor, error) {
+	var c Cursor
+	data, err := s.d.GetDel(s.opts.Prefix + token)
+	if errors.Is(err, ErrKeyNotFound) {
+		return c, fmt.Errorf("error consuming cursor %s: %w", token, ErrKeyNotFound)
+	}
+	if err != nil {
+		return c, fmt.Errorf("error consuming cursor %s: %w", token, err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("error parsing cursor %s: %w", token, err)
+	}
+	return c, nil
+}
+
+// Delete discards the cursor of token without using it.
+func (s *CursorStore) Delete(token string) error {
+	if _, err := s.d.Do("DEL", s.opts.Prefix+token); err != nil {
+		return fmt.Errorf("error deleting cursor %s: %w", token, err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EndpointSource reports the ready "host:port" addresses behind a Kubernetes Service.
+// Implementations typically wrap an EndpointSlice informer from the application's own
+// client, sending the full address list on every change until ctx is done, so this
+// package does not depend on a Kubernetes client.
+type EndpointSource interface {
+	Endpoints(ctx context.Context) (<-chan []string, error)
+}
+
+// EndpointsFunc lists the current ready addresses, for example from the EndpointSlices
+// of a Service.
+type EndpointsFunc func(ctx context.Context) ([]string, error)
+
+// PollEndpoints turns fn into an EndpointSource that lists the addresses every interval.
+// Failed lists are skipped, keeping the last known addresses.
+func PollEndpoints(fn EndpointsFunc, interval time.Duration) EndpointSource {
+	return pollSource{fn: fn, interval: interval}
+}
+
+type pollSource struct {
+	fn       EndpointsFunc
+	interval time.Duration
+}
+
+func (p pollSource) Endpoints(ctx context.Context) (<-chan []string, error) {
+	addrs, err := p.fn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing endpoints: %w", err)
+	}
+	interval := p.interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	updates := make(chan []string, 1)
+	updates <- addrs
+	go func() {
+		defer close(updates)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			addrs, err := p.fn(ctx)
+			if err != nil {
+				continue
+			}
+			select {
+			case updates <- addrs:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// EndpointResolver tracks the addresses from an EndpointSource. Pools configured with
+// WithEndpointResolver dial these addresses instead of resolving the url host through
+// DNS, and drop idle connections to addresses that are no longer listed, so a failover
+// is followed as soon as the endpoints change.
+type EndpointResolver struct {
+	mu    sync.Mutex
+	addrs []string
+	next  int
+
+	changes changeSignal
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewEndpointResolver starts watching source. The addresses of the first update are
+// available when it returns.
+func NewEndpointResolver(source EndpointSource) (*EndpointResolver, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := source.Endpoints(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	r := &EndpointResolver{cancel: cancel, done: make(chan struct{})}
+	select {
+	case addrs, ok := <-updates:
+		if ok {
+			r.update(addrs)
+		}
+	case <-time.After(10 * time.Second):
+	}
+
+	go func() {
+		defer close(r.done)
+		for addrs := range updates {
+			r.update(addrs)
+		}
+	}()
+	return r, nil
+}
+
+// Close stops watching the source.
+func (r *EndpointResolver) Close() {
+	r.cancel()
+	<-r.done
+}
+
+// Addresses returns the current addresses.
+func (r *EndpointResolver) Addresses() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.addrs...)
+}
+
+func (r *EndpointResolver) update(addrs []string) {
+	r.mu.Lock()
+	changed := !equalStrings(r.addrs, addrs)
+	r.addrs = append(r.addrs[:0], addrs...)
+	r.mu.Unlock()
+	if changed {
+		r.changes.notify()
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// changeSignal lets any number of goroutines wait for the next change.
+type changeSignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel that is closed by the next notify.
+func (c *changeSignal) wait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch == nil {
+		c.ch = make(chan struct{})
+	}
+	return c.ch
+}
+
+func (c *changeSignal) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch != nil {
+		close(c.ch)
+		c.ch = nil
+	}
+}
+
+// topologyChanged returns a channel that is closed when the servers behind d change, nil
+// when d talks to a fixed address.
+func (d *RedisDatabase) topologyChanged() <-chan struct{} {
+	o := d.options()
+	switch {
+	case o.cluster != nil:
+		return o.cluster.changes.wait()
+	case o.resolver != nil:
+		return o.resolver.changes.wait()
+	}
+	return nil
+}
+
+// pick returns the next address round robin, or fallback when there is none.
+func (r *EndpointResolver) pick(fallback string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.addrs) == 0 {
+		return fallback
+	}
+	r.next = (r.next + 1) % len(r.addrs)
+	return r.addrs[r.next]
+}
+
+// listed reports whether addr is a current address. Everything is listed while the
+// source reports no addresses, since the pool falls back to the url host then.
+func (r *EndpointResolver) listed(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.addrs) == 0 {
+		return true
+	}
+	for _, a := range r.addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// WithEndpointResolver dials the addresses tracked by r instead of the url host.
+func WithEndpointResolver(r *EndpointResolver) Option {
+	return func(o *options) {
+		o.resolver = r
+	}
+}
@@ -0,0 +1,174 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ErrorKind is the broad class of an error returned by this package.
+type ErrorKind int
+
+const (
+	// ErrorNone is the kind of a nil error.
+	ErrorNone ErrorKind = iota
+	// ErrorNetwork covers dial failures, broken connections and timeouts.
+	ErrorNetwork
+	// ErrorServer is an error reply from the server, such as WRONGTYPE or READONLY.
+	ErrorServer
+	// ErrorScript is an error reply raised by or about a Lua script.
+	ErrorScript
+	// ErrorApplication covers errors raised by this package, such as ErrKeyNotFound or
+	// ErrResponseTooLarge, and context cancellation.
+	ErrorApplication
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorNone:
+		return "none"
+	case ErrorNetwork:
+		return "network"
+	case ErrorServer:
+		return "server"
+	case ErrorScript:
+		return "script"
+	}
+	return "application"
+}
+
+// Classify returns the kind of err.
+func Classify(err error) ErrorKind {
+	switch {
+	case err == nil:
+		return ErrorNone
+	case IsScriptError(err):
+		return ErrorScript
+	case IsServerError(err):
+		return ErrorServer
+	case IsNetworkError(err):
+		return ErrorNetwork
+	}
+	return ErrorApplication
+}
+
+// ServerErrorCode returns the code that starts an error reply, such as "WRONGTYPE" or
+// "ERR", or an empty string when err is not an error reply.
+func ServerErrorCode(err error) string {
+	var re redis.Error
+	if !errors.As(err, &re) {
+		return ""
+	}
+	code, _, _ := strings.Cut(string(re), " ")
+	return code
+}
+
+// IsServerError reports whether err is an error reply from the server, including script
+// errors.
+func IsServerError(err error) bool {
+	var re redis.Error
+	return errors.As(err, &re)
+}
+
+// IsScriptError reports whether err is an error reply about a Lua script: a missing
+// script, a script that failed to compile or raised an error, or a busy server running
+// a slow script.
+func IsScriptError(err error) bool {
+	var re redis.Error
+	if !errors.As(err, &re) {
+		return false
+	}
+	msg := string(re)
+	switch ServerErrorCode(err) {
+	case "NOSCRIPT", "BUSY":
+		return true
+	case "ERR":
+		return strings.Contains(msg, "user_script:") ||
+			strings.Contains(msg, "Error running script") ||
+			strings.Contains(msg, "Error compiling script")
+	}
+	return false
+}
+
+// IsTimeout reports whether err is a dial, read or write timeout, or an expired context
+// deadline.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// IsNetworkError reports whether err is a connection level failure, after which the
+// connection is not reused.
+func IsNetworkError(err error) bool {
+	if err == nil || IsServerError(err) {
+		return false
+	}
+	if IsTimeout(err) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// retryableCodes are error replies for transient server states.
+var retryableCodes = map[string]bool{
+	"LOADING":     true,
+	"BUSY":        true,
+	"TRYAGAIN":    true,
+	"CLUSTERDOWN": true,
+	"MASTERDOWN":  true,
+	"READONLY":    true,
+	"NOAUTH":      true,
+}
+
+// IsRetryable reports whether running the same command again may succeed: network
+// failures and timeouts, an exhausted pool or concurrency limit, and server states such
+// as LOADING, READONLY after a failover or BUSY scripts. Commands that are not
+// idempotent may have been applied before a network failure was detected.
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, redis.ErrPoolExhausted), errors.Is(err, ErrConcurrencyLimit):
+		return true
+	case IsServerError(err):
+		return retryableCodes[ServerErrorCode(err)]
+	}
+	return IsNetworkError(err)
+}
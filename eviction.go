@@ -0,0 +1,211 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EvictionSample is one reading of the server's memory and eviction counters.
+type EvictionSample struct {
+	Taken           time.Time
+	EvictedKeys     int64
+	UsedMemory      int64
+	MaxMemory       int64
+	MaxMemoryPolicy string
+	// EvictionsPerSecond is the eviction rate since the previous sample.
+	EvictionsPerSecond float64
+}
+
+// MemoryRatio is UsedMemory relative to MaxMemory, zero when maxmemory is not set.
+func (s EvictionSample) MemoryRatio() float64 {
+	if s.MaxMemory <= 0 {
+		return 0
+	}
+	return float64(s.UsedMemory) / float64(s.MaxMemory)
+}
+
+// EvictionMonitorOptions configures an EvictionMonitor. Zero values select the defaults in
+// brackets.
+type EvictionMonitorOptions struct {
+	// Interval between samples [30s].
+	Interval time.Duration
+	// MaxEvictionRate is the evictions per second above which the server is under
+	// pressure [0, any eviction].
+	MaxEvictionRate float64
+	// MaxMemoryRatio is the used to max memory ratio above which the server is under
+	// pressure [0.9].
+	MaxMemoryRatio float64
+	// OnPressure is called when a sample crosses a threshold after one that did not.
+	OnPressure func(sample EvictionSample)
+	// OnRecover is called when a sample is back below the thresholds.
+	OnRecover func(sample EvictionSample)
+	// OnError receives sampling errors and may be nil.
+	OnError func(err error)
+}
+
+// EvictionMonitor samples INFO memory and stats in the background, reports the eviction
+// rate and memory use as gauges to a GaugeMetrics implementation and calls back when
+// eviction pressure starts and ends, so keys silently evicted from a cache show up in
+// dashboards and alerts.
+type EvictionMonitor struct {
+	d    *RedisDatabase
+	opts EvictionMonitorOptions
+
+	mu       sync.Mutex
+	last     *EvictionSample
+	pressure bool
+
+	stop func()
+}
+
+// NewEvictionMonitor creates a monitor for d, sampling once started.
+func NewEvictionMonitor(d *RedisDatabase, opts EvictionMonitorOptions) *EvictionMonitor {
+	if opts.Interval <= 0 {
+		opts.Interval = 30 * time.Second
+	}
+	if opts.MaxMemoryRatio <= 0 {
+		opts.MaxMemoryRatio = 0.9
+	}
+	return &EvictionMonitor{d: d, opts: opts}
+}
+
+// Start samples every Interval until Close or Stop.
+func (m *EvictionMonitor) Start() {
+	m.stop = startLoop(m.d.options().clock.NewTicker(m.opts.Interval), func() {
+		if _, err := m.Sample(); err != nil && m.opts.OnError != nil {
+			_ = m.d.options().call("eviction monitor error callback", func() error {
+				m.opts.OnError(err)
+				return nil
+			})
+		}
+	})
+}
+
+// Close stops sampling.
+func (m *EvictionMonitor) Close() {
+	_ = m.Stop(context.Background())
+}
+
+// Stop stops sampling, waiting for a sample in progress until ctx is done.
+func (m *EvictionMonitor) Stop(ctx context.Context) error {
+	if m.stop == nil {
+		return nil
+	}
+	stop := m.stop
+	m.stop = nil
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+	return waitDone(ctx, done)
+}
+
+// Last returns the latest sample, false before the first one.
+func (m *EvictionMonitor) Last() (EvictionSample, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last == nil {
+		return EvictionSample{}, false
+	}
+	return *m.last, true
+}
+
+// Sample reads the counters now, updates the gauges and runs the callbacks.
+func (m *EvictionMonitor) Sample() (EvictionSample, error) {
+	sample, err := m.d.evictionSample()
+	if err != nil {
+		return sample, err
+	}
+	sample.Taken = m.d.options().clock.Now()
+
+	m.mu.Lock()
+	if m.last != nil {
+		if elapsed := sample.Taken.Sub(m.last.Taken).Seconds(); elapsed > 0 && sample.EvictedKeys >= m.last.EvictedKeys {
+			sample.EvictionsPerSecond = float64(sample.EvictedKeys-m.last.EvictedKeys) / elapsed
+		}
+	}
+	first := m.last == nil
+	m.last = &sample
+	pressure := sample.MemoryRatio() > m.opts.MaxMemoryRatio ||
+		(!first && sample.EvictionsPerSecond > m.opts.MaxEvictionRate)
+	changed := pressure != m.pressure
+	m.pressure = pressure
+	m.mu.Unlock()
+
+	o := m.d.options()
+	if g, ok := o.metrics.(GaugeMetrics); ok {
+		g.ObserveGauge("evictions_per_second", sample.MaxMemoryPolicy, sample.EvictionsPerSecond)
+		g.ObserveGauge("memory_used_ratio", sample.MaxMemoryPolicy, sample.MemoryRatio())
+	}
+	if changed && pressure && m.opts.OnPressure != nil {
+		_ = o.call("eviction monitor pressure callback", func() error {
+			m.opts.OnPressure(sample)
+			return nil
+		})
+	}
+	if changed && !pressure && m.opts.OnRecover != nil {
+		_ = o.call("eviction monitor recover callback", func() error {
+			m.opts.OnRecover(sample)
+			return nil
+		})
+	}
+	return sample, nil
+}
+
+func (d *RedisDatabase) evictionSample() (EvictionSample, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close sampling evictions: %v", err)
+		}
+	}(conn)
+
+	var sample EvictionSample
+	memory, err := redis.String(d.do(conn, "INFO", "memory"))
+	if err != nil {
+		return sample, fmt.Errorf("error reading memory info: %w", err)
+	}
+	stats, err := redis.String(d.do(conn, "INFO", "stats"))
+	if err != nil {
+		return sample, fmt.Errorf("error reading stats info: %w", err)
+	}
+
+	info := parseInfo(memory)
+	sample.UsedMemory, _ = strconv.ParseInt(info["used_memory"], 10, 64)
+	sample.MaxMemory, _ = strconv.ParseInt(info["maxmemory"], 10, 64)
+	sample.MaxMemoryPolicy = info["maxmemory_policy"]
+	sample.EvictedKeys, _ = strconv.ParseInt(parseInfo(stats)["evicted_keys"], 10, 64)
+	return sample, nil
+}
@@ -0,0 +1,161 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"strings"
+	"time"
+)
+
+// ExpiryAuditOptions tunes ExpiryAudit. Zero values select the defaults in brackets.
+type ExpiryAuditOptions struct {
+	// Horizon is how far ahead expiries are reported [10m].
+	Horizon time.Duration
+	// BucketWidth is the width of the expiry histogram buckets [1m].
+	BucketWidth time.Duration
+	// Scan paces the SCAN of every prefix, see ScanAdaptive.
+	Scan AdaptiveScanOptions
+}
+
+// ExpiryReport counts the keys under a prefix that expire within the horizon.
+type ExpiryReport struct {
+	Prefix      string
+	Scanned     int
+	Expiring    int
+	BucketWidth time.Duration
+	// Buckets counts expiring keys per BucketWidth, starting now.
+	Buckets []int
+	// PeakBucket is the index of the busiest bucket and PeakRefillPerSecond the rate at
+	// which keys expire in it, the load to expect if they are all read and refilled.
+	PeakBucket          int
+	PeakRefillPerSecond float64
+}
+
+// ExpiryAudit scans every prefix and reports the keys expiring within the horizon, to
+// anticipate refill stampedes after mass TTL events such as cache version flips. The
+// SCAN backs off under server load like ScanAdaptive.
+func (d *RedisDatabase) ExpiryAudit(prefixes []string, opts ExpiryAuditOptions) ([]ExpiryReport, error) {
+	if opts.Horizon <= 0 {
+		opts.Horizon = 10 * time.Minute
+	}
+	if opts.BucketWidth <= 0 {
+		opts.BucketWidth = time.Minute
+	}
+
+	reports := make([]ExpiryReport, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		report, err := d.auditPrefix(prefix, opts)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func (d *RedisDatabase) auditPrefix(prefix string, opts ExpiryAuditOptions) (ExpiryReport, error) {
+	buckets := int((opts.Horizon + opts.BucketWidth - 1) / opts.BucketWidth)
+	report := ExpiryReport{Prefix: prefix, BucketWidth: opts.BucketWidth, Buckets: make([]int, buckets)}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close auditing '%s' keys: %v", prefix, err)
+		}
+	}(conn)
+
+	err := d.ScanAdaptive(prefix+"*", opts.Scan, func(keys []string) error {
+		for _, key := range keys {
+			if err := conn.Send("PTTL", key); err != nil {
+				return fmt.Errorf("error auditing key %s: %w", key, err)
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("error auditing '%s' keys: %w", prefix, err)
+		}
+		for _, key := range keys {
+			ms, err := redis.Int64(conn.Receive())
+			if err != nil {
+				return fmt.Errorf("error reading ttl of key %s: %w", key, err)
+			}
+			if ms == -2 {
+				continue
+			}
+			report.Scanned++
+			ttl := time.Duration(ms) * time.Millisecond
+			if ms >= 0 && ttl < opts.Horizon {
+				report.Expiring++
+				report.Buckets[int(ttl/opts.BucketWidth)]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for i, count := range report.Buckets {
+		if count > report.Buckets[report.PeakBucket] {
+			report.PeakBucket = i
+		}
+	}
+	report.PeakRefillPerSecond = float64(report.Buckets[report.PeakBucket]) / opts.BucketWidth.Seconds()
+	return report, nil
+}
+
+// ScheduleExpiryAudit runs ExpiryAudit every interval and passes the result to fn until
+// the returned stop function is called, which waits for an audit in progress.
+func (d *RedisDatabase) ScheduleExpiryAudit(interval time.Duration, prefixes []string, opts ExpiryAuditOptions, fn func(reports []ExpiryReport, err error)) (stop func()) {
+	return startLoop(d.options().clock.NewTicker(interval), func() {
+		reports, err := d.ExpiryAudit(prefixes, opts)
+		_ = d.options().call("expiry audit callback", func() error {
+			fn(reports, err)
+			return nil
+		})
+	})
+}
+
+// WriteTo prints the report as a text histogram.
+func (r ExpiryReport) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s* (%d keys scanned, %d expiring)\n", r.Prefix, r.Scanned, r.Expiring)
+	for i, count := range r.Buckets {
+		bar := ""
+		if r.Expiring > 0 {
+			bar = strings.Repeat("#", count*40/r.Expiring)
+		}
+		fmt.Fprintf(&b, "  < %-10s %6d %s\n", (time.Duration(i+1) * r.BucketWidth).String(), count, bar)
+	}
+	fmt.Fprintf(&b, "  peak refill: %.1f keys/s\n", r.PeakRefillPerSecond)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
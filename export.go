@@ -0,0 +1,199 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// ExportFormat selects how ExportTo writes keys.
+type ExportFormat int
+
+const (
+	// ExportCSV writes a key,type,ttl_seconds,field,value header and one row per string
+	// key or hash field.
+	ExportCSV ExportFormat = iota
+	// ExportJSONLines writes one object per key with its type, ttl and value, where the
+	// value of a hash is an object of its fields.
+	ExportJSONLines
+)
+
+type exportRecord struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	TTL   int64       `json:"ttl_seconds"`
+	Value interface{} `json:"value"`
+}
+
+// ExportTo writes every string and hash key matching pattern to w and returns the number
+// of keys written. Keys of other types are skipped. A ttl of -1 means no expiry.
+func (d *RedisDatabase) ExportTo(w io.Writer, pattern string, format ExportFormat) (int, error) {
+	var write func(r exportRecord) error
+	var flush func() error
+	switch format {
+	case ExportCSV:
+		out := csv.NewWriter(w)
+		if err := out.Write([]string{"key", "type", "ttl_seconds", "field", "value"}); err != nil {
+			return 0, err
+		}
+		write = func(r exportRecord) error {
+			ttl := strconv.FormatInt(r.TTL, 10)
+			if value, ok := r.Value.(string); ok {
+				return out.Write([]string{r.Key, r.Type, ttl, "", value})
+			}
+			fields := r.Value.(map[string]string)
+			names := make([]string, 0, len(fields))
+			for name := range fields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if err := out.Write([]string{r.Key, r.Type, ttl, name, fields[name]}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		flush = func() error {
+			out.Flush()
+			return out.Error()
+		}
+	case ExportJSONLines:
+		out := json.NewEncoder(w)
+		write = func(r exportRecord) error { return out.Encode(r) }
+		flush = func() error { return nil }
+	default:
+		return 0, fmt.Errorf("redis: unknown export format %d", format)
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close exporting '%s' keys: %v", pattern, err)
+		}
+	}(conn)
+
+	written := 0
+	cursor := 0
+	for {
+		arr, err := redis.Values(d.do(conn, "SCAN", cursor, "MATCH", pattern, "COUNT", 500))
+		if err != nil {
+			return written, fmt.Errorf("error exporting '%s' keys: %w", pattern, err)
+		}
+		cursor, _ = redis.Int(arr[0], nil)
+		keys, _ := redis.Strings(arr[1], nil)
+
+		records, err := exportBatch(conn, keys)
+		if err != nil {
+			return written, err
+		}
+		for _, r := range records {
+			if err := write(r); err != nil {
+				return written, err
+			}
+			written++
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+	return written, flush()
+}
+
+func exportBatch(conn redis.Conn, keys []string) ([]exportRecord, error) {
+	for _, key := range keys {
+		if err := conn.Send("TYPE", key); err != nil {
+			return nil, err
+		}
+		if err := conn.Send("TTL", key); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("error exporting keys: %w", err)
+	}
+
+	var records []exportRecord
+	for _, key := range keys {
+		keyType, err := redis.String(conn.Receive())
+		if err != nil {
+			return nil, fmt.Errorf("error exporting key %s: %w", key, err)
+		}
+		ttl, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return nil, fmt.Errorf("error exporting key %s: %w", key, err)
+		}
+		if keyType == "string" || keyType == "hash" {
+			records = append(records, exportRecord{Key: key, Type: keyType, TTL: ttl})
+		}
+	}
+
+	for _, r := range records {
+		command := "GET"
+		if r.Type == "hash" {
+			command = "HGETALL"
+		}
+		if err := conn.Send(command, r.Key); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("error exporting keys: %w", err)
+	}
+
+	exported := records[:0]
+	for _, r := range records {
+		var err error
+		if r.Type == "hash" {
+			var fields map[string]string
+			fields, err = redis.StringMap(conn.Receive())
+			if err == nil && len(fields) == 0 {
+				err = redis.ErrNil
+			}
+			r.Value = fields
+		} else {
+			r.Value, err = redis.String(conn.Receive())
+		}
+		if err == redis.ErrNil {
+			// expired between TYPE and GET
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error exporting key %s: %w", r.Key, err)
+		}
+		exported = append(exported, r)
+	}
+	return exported, nil
+}
@@ -0,0 +1,173 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldEncryption is a policy encrypting selected fields of hashes with AES-GCM while the
+// remaining fields stay plaintext, so they can still be indexed and queried. Each value
+// is authenticated with its key and field, so a ciphertext copied to another field or
+// hash does not decrypt.
+type FieldEncryption struct {
+	sealer *sealer
+	fields map[string]bool
+}
+
+// NewFieldEncryption creates a policy encrypting fields with the 16, 24 or 32 byte AES
+// encryptionKey.
+func NewFieldEncryption(encryptionKey []byte, fields ...string) (*FieldEncryption, error) {
+	sealer, err := newSealer(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	e := &FieldEncryption{sealer: sealer, fields: map[string]bool{}}
+	for _, field := range fields {
+		e.fields[field] = true
+	}
+	return e, nil
+}
+
+// Encrypts reports whether the policy encrypts field.
+func (e *FieldEncryption) Encrypts(field string) bool {
+	return e != nil && e.fields[field]
+}
+
+func fieldData(key string, field string) string {
+	return key + "\x00" + field
+}
+
+type fieldEncryptionRule struct {
+	prefix string
+	policy *FieldEncryption
+}
+
+// WithFieldEncryption applies policy to the hashes whose key starts with prefix. HMSet,
+// HMSetB, SaveWithIndexes and Ingest encrypt the policy's fields and HMGet, HMGetFields,
+// HMGetAll, HGetB, HMGetAllB and Hydrate decrypt them, failing with ErrDecrypt for values
+// that were not written through the policy. When several prefixes match a key the
+// longest one decides. Pipelines, transactions, raw commands, ExportTo and
+// SnapshotPrefix read and write the stored ciphertext, so exports and snapshots restored
+// to the same keys still decrypt. HashSnapshot decrypts with the policy of the
+// snapshotted hash, but values moved to another key in any other way, such as with
+// RENAME or COPY, no longer decrypt.
+func WithFieldEncryption(prefix string, policy *FieldEncryption) Option {
+	return func(o *options) {
+		o.fieldEncryption = append(o.fieldEncryption, fieldEncryptionRule{prefix: prefix, policy: policy})
+	}
+}
+
+// fieldPolicy returns the policy with the longest prefix matching key, nil when none does.
+func (o *options) fieldPolicy(key string) *FieldEncryption {
+	var match *fieldEncryptionRule
+	for i := range o.fieldEncryption {
+		r := &o.fieldEncryption[i]
+		if strings.HasPrefix(key, r.prefix) && (match == nil || len(r.prefix) > len(match.prefix)) {
+			match = r
+		}
+	}
+	if match == nil {
+		return nil
+	}
+	return match.policy
+}
+
+// sealField encrypts value when the policy of key covers field.
+func (o *options) sealField(key string, field string, value []byte) ([]byte, error) {
+	policy := o.fieldPolicy(key)
+	if !policy.Encrypts(field) {
+		return value, nil
+	}
+	sealed, err := policy.sealer.seal(fieldData(key, field), value)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting field %s of key %s: %w", field, key, err)
+	}
+	return sealed, nil
+}
+
+// sealFields returns fields with the values that the policy of key covers encrypted. The
+// map of the caller is not changed.
+func (o *options) sealFields(key string, fields map[string][]byte) (map[string][]byte, error) {
+	if o.fieldPolicy(key) == nil {
+		return fields, nil
+	}
+	sealed := make(map[string][]byte, len(fields))
+	for field, value := range fields {
+		var err error
+		if sealed[field], err = o.sealField(key, field, value); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
+
+// sealStringFields is sealFields for string values.
+func (o *options) sealStringFields(key string, fields map[string]string) (map[string]string, error) {
+	if o.fieldPolicy(key) == nil {
+		return fields, nil
+	}
+	sealed := make(map[string]string, len(fields))
+	for field, value := range fields {
+		v, err := o.sealField(key, field, []byte(value))
+		if err != nil {
+			return nil, err
+		}
+		sealed[field] = string(v)
+	}
+	return sealed, nil
+}
+
+// openField decrypts value when the policy of key covers field. Empty values are missing
+// fields, a sealed value is never empty.
+func (o *options) openField(key string, field string, value []byte) ([]byte, error) {
+	policy := o.fieldPolicy(key)
+	if !policy.Encrypts(field) || len(value) == 0 {
+		return value, nil
+	}
+	plaintext, err := policy.sealer.open(fieldData(key, field), value)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting field %s of key %s: %w", field, key, err)
+	}
+	return plaintext, nil
+}
+
+// openFields decrypts the values of the fields that the policy of key covers in place.
+func (o *options) openFields(key string, values map[string]string) error {
+	if o.fieldPolicy(key) == nil {
+		return nil
+	}
+	for field, value := range values {
+		plaintext, err := o.openField(key, field, []byte(value))
+		if err != nil {
+			return err
+		}
+		values[field] = string(plaintext)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb_test
+
+import (
+	"bytes"
+	"github.com/gomodule/redigo/redis"
+	"github.com/henryse/go-redisdb"
+	"github.com/henryse/go-redisdb/redisdbtest"
+	"strings"
+	"testing"
+)
+
+const ssn = "078-05-1120"
+
+func newEncryptedDB(t *testing.T) *redisdb.RedisDatabase {
+	t.Helper()
+	policy, err := redisdb.NewFieldEncryption(bytes.Repeat([]byte("k"), 32), "ssn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := redisdbtest.StartContainer(t, "7.2", redisdbtest.WithOptions(redisdb.WithFieldEncryption("user:", policy)))
+	return c.DB
+}
+
+// checkSealed fails when the stored ssn of key is plaintext or name is stored in clear.
+func checkSealed(t *testing.T, d *redisdb.RedisDatabase, key string) {
+	t.Helper()
+	stored, err := redis.Bytes(d.Do("HGET", key, "ssn"))
+	if err != nil {
+		t.Fatalf("HGET %s ssn: %v", key, err)
+	}
+	if bytes.Contains(stored, []byte(ssn)) {
+		t.Fatalf("%s ssn is stored in plaintext", key)
+	}
+	name, err := redis.String(d.Do("HGET", key, "name"))
+	if err != nil || name != "alice" {
+		t.Fatalf("%s name = %q, %v, want it stored in plaintext", key, name, err)
+	}
+}
+
+func TestFieldEncryptionHMSet(t *testing.T) {
+	d := newEncryptedDB(t)
+
+	if err := d.HMSet("user:1", "ssn", []byte(ssn)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.HMSet("user:1", "name", []byte("alice")); err != nil {
+		t.Fatal(err)
+	}
+	checkSealed(t, d, "user:1")
+
+	values := d.HMGetAll("user:1")
+	if values["ssn"] != ssn {
+		t.Fatalf("HMGetAll ssn = %q, want %q", values["ssn"], ssn)
+	}
+	values, err := d.HMGet("user:1", "ssn")
+	if err != nil || values["ssn"] != ssn {
+		t.Fatalf("HMGet ssn = %q, %v, want %q", values["ssn"], err, ssn)
+	}
+}
+
+func TestFieldEncryptionSaveWithIndexes(t *testing.T) {
+	d := newEncryptedDB(t)
+
+	fields := map[string][]byte{"ssn": []byte(ssn), "name": []byte("alice")}
+	if err := d.SaveWithIndexes("user:2", fields, redisdb.AddToIndex("users", "2")); err != nil {
+		t.Fatal(err)
+	}
+	checkSealed(t, d, "user:2")
+	if string(fields["ssn"]) != ssn {
+		t.Fatal("SaveWithIndexes changed the fields of the caller")
+	}
+
+	var hydrated map[string]string
+	err := d.Hydrate([]string{"user:2"}, func(key string, data map[string]string) {
+		hydrated = data
+	})
+	if err != nil || hydrated["ssn"] != ssn {
+		t.Fatalf("Hydrate ssn = %q, %v, want %q", hydrated["ssn"], err, ssn)
+	}
+}
+
+func TestFieldEncryptionBinaryKeys(t *testing.T) {
+	d := newEncryptedDB(t)
+
+	if err := d.HMSetB([]byte("user:3"), []byte("ssn"), []byte(ssn)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.HMSetB([]byte("user:3"), []byte("name"), []byte("alice")); err != nil {
+		t.Fatal(err)
+	}
+	checkSealed(t, d, "user:3")
+
+	value, err := d.HGetB([]byte("user:3"), []byte("ssn"))
+	if err != nil || string(value) != ssn {
+		t.Fatalf("HGetB ssn = %q, %v, want %q", value, err, ssn)
+	}
+	values, err := d.HMGetAllB([]byte("user:3"))
+	if err != nil || string(values["ssn"]) != ssn {
+		t.Fatalf("HMGetAllB ssn = %q, %v, want %q", values["ssn"], err, ssn)
+	}
+}
+
+func TestFieldEncryptionIngest(t *testing.T) {
+	d := newEncryptedDB(t)
+
+	rows := "id,name,ssn\n4,alice," + ssn + "\n"
+	n, err := d.Ingest(strings.NewReader(rows), redisdb.IngestOptions{Format: redisdb.IngestCSV, KeyTemplate: "user:{id}"})
+	if err != nil || n != 1 {
+		t.Fatalf("Ingest = %d, %v, want 1 row", n, err)
+	}
+	checkSealed(t, d, "user:4")
+
+	if values := d.HMGetAll("user:4"); values["ssn"] != ssn {
+		t.Fatalf("HMGetAll ssn = %q, want %q", values["ssn"], ssn)
+	}
+}
@@ -0,0 +1,215 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// pruneStaleScript removes up to ARGV[2] members from the geo set KEYS[1] whose expiry
+// in KEYS[2] is before ARGV[1].
+var pruneStaleScript = redis.NewScript(2, `
+local stale = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #stale > 0 then
+  redis.call('ZREM', KEYS[1], unpack(stale))
+  redis.call('ZREM', KEYS[2], unpack(stale))
+end
+return #stale`)
+
+// pruneBatchSize bounds the members removed per script call.
+const pruneBatchSize = 1000
+
+// GeoPresence tracks the location of members that are online for a limited time, such
+// as drivers reporting their position. Locations live in a geo set at key and the time
+// each member goes stale in a sorted set next to it.
+type GeoPresence struct {
+	d       *RedisDatabase
+	key     string
+	seenKey string
+}
+
+// NearbyMember is an online member found by Nearby.
+type NearbyMember struct {
+	Member    string
+	Distance  float64
+	Latitude  float64
+	Longitude float64
+}
+
+// NewGeoPresence tracks presence in the geo set at key.
+func NewGeoPresence(d *RedisDatabase, key string) *GeoPresence {
+	return &GeoPresence{d: d, key: key, seenKey: sameSlotKey(key, ":seen")}
+}
+
+// UpdateLocation records the location of member, who is considered online for ttl.
+func (p *GeoPresence) UpdateLocation(member string, lat float64, lon float64, ttl time.Duration) error {
+	conn := p.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close updating location of %s: %v", member, err)
+		}
+	}(conn)
+
+	expires := p.d.options().clock.Now().Add(ttl).UnixMilli()
+	if err := conn.Send("MULTI"); err != nil {
+		return fmt.Errorf("error updating location of %s: %w", member, err)
+	}
+	if err := conn.Send("GEOADD", p.key, lon, lat, member); err != nil {
+		return fmt.Errorf("error updating location of %s: %w", member, err)
+	}
+	if err := conn.Send("ZADD", p.seenKey, expires, member); err != nil {
+		return fmt.Errorf("error updating location of %s: %w", member, err)
+	}
+	replies, err := redis.Values(p.d.do(conn, "EXEC"))
+	if err != nil {
+		return fmt.Errorf("error updating location of %s: %w", member, err)
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(redis.Error); ok {
+			return fmt.Errorf("error updating location of %s: %v", member, e)
+		}
+	}
+	return nil
+}
+
+// Remove takes member offline immediately.
+func (p *GeoPresence) Remove(member string) error {
+	conn := p.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close removing %s: %v", member, err)
+		}
+	}(conn)
+
+	if _, err := p.d.do(conn, "ZREM", p.key, member); err != nil {
+		return fmt.Errorf("error removing %s: %w", member, err)
+	}
+	if _, err := p.d.do(conn, "ZREM", p.seenKey, member); err != nil {
+		return fmt.Errorf("error removing %s: %w", member, err)
+	}
+	return nil
+}
+
+// Nearby returns up to limit online members within radius meters of the location,
+// nearest first. Members whose ttl has passed are left out even before they are pruned.
+// A limit of zero returns all of them.
+func (p *GeoPresence) Nearby(lat float64, lon float64, radius float64, limit int) ([]NearbyMember, error) {
+	conn := p.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close searching %s: %v", p.key, err)
+		}
+	}(conn)
+
+	args := []interface{}{p.key, lon, lat, radius, "m", "WITHDIST", "WITHCOORD", "ASC"}
+	if limit > 0 {
+		// over-fetch so stale members do not shrink the result
+		args = append(args, "COUNT", limit*2)
+	}
+	replies, err := redis.Values(p.d.do(conn, "GEORADIUS", args...))
+	if err != nil {
+		return nil, fmt.Errorf("error searching %s: %w", p.key, err)
+	}
+
+	candidates := make([]NearbyMember, 0, len(replies))
+	for _, reply := range replies {
+		fields, err := redis.Values(reply, nil)
+		if err != nil || len(fields) < 3 {
+			continue
+		}
+		var m NearbyMember
+		m.Member, _ = redis.String(fields[0], nil)
+		m.Distance, _ = redis.Float64(fields[1], nil)
+		if coord, err := redis.Float64s(fields[2], nil); err == nil && len(coord) == 2 {
+			m.Longitude, m.Latitude = coord[0], coord[1]
+		}
+		candidates = append(candidates, m)
+	}
+
+	for _, m := range candidates {
+		if err := conn.Send("ZSCORE", p.seenKey, m.Member); err != nil {
+			return nil, fmt.Errorf("error searching %s: %w", p.key, err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("error searching %s: %w", p.key, err)
+	}
+	now := p.d.options().clock.Now().UnixMilli()
+	online := make([]NearbyMember, 0, len(candidates))
+	for _, m := range candidates {
+		expires, err := redis.Int64(conn.Receive())
+		if err != nil && err != redis.ErrNil {
+			return nil, fmt.Errorf("error searching %s: %w", p.key, err)
+		}
+		if err == nil && expires > now && (limit <= 0 || len(online) < limit) {
+			online = append(online, m)
+		}
+	}
+	return online, nil
+}
+
+// Prune removes members whose ttl has passed and returns how many were removed.
+func (p *GeoPresence) Prune() (int, error) {
+	conn := p.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close pruning %s: %v", p.key, err)
+		}
+	}(conn)
+
+	now := p.d.options().clock.Now().UnixMilli()
+	total := 0
+	for {
+		n, err := redis.Int(pruneStaleScript.Do(instrumentedConn{conn, p.d}, p.key, p.seenKey, now, pruneBatchSize))
+		if err != nil {
+			return total, fmt.Errorf("error pruning %s: %w", p.key, err)
+		}
+		total += n
+		if n < pruneBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// StartPruner runs Prune every interval until the returned stop function is called,
+// which waits for a pass in progress. Errors are passed to onError, which may be nil.
+func (p *GeoPresence) StartPruner(interval time.Duration, onError func(err error)) (stop func()) {
+	return startLoop(p.d.options().clock.NewTicker(interval), func() {
+		if _, err := p.Prune(); err != nil && onError != nil {
+			_ = p.d.options().call("geo presence pruner error callback", func() error {
+				onError(err)
+				return nil
+			})
+		}
+	})
+}
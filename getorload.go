@@ -0,0 +1,223 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/sync/singleflight"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// xfetchHeader starts values stored with the time it took to load them, followed by that
+// time in milliseconds as a big-endian uint64.
+var xfetchHeader = []byte("\x00redisdb:xfetch\x00")
+
+// negativeMarker is the value GetOrLoad caches for keys its loader did not find.
+var negativeMarker = []byte("\x00redisdb:missing\x00")
+
+// ErrNegativeCached is matched by errors.Is when GetOrLoad answers from a cached miss.
+var ErrNegativeCached = errors.New("redis: key cached as missing")
+
+// NegativeCachedError reports a key whose loader recently did not find it. It matches
+// both ErrNegativeCached and ErrKeyNotFound.
+type NegativeCachedError struct {
+	Key string
+	// TTL is how long the miss stays cached.
+	TTL time.Duration
+}
+
+func (e *NegativeCachedError) Error() string {
+	return fmt.Sprintf("redis: key %s is cached as missing for another %s", e.Key, e.TTL)
+}
+
+func (e *NegativeCachedError) Is(target error) bool {
+	return target == ErrNegativeCached || target == ErrKeyNotFound
+}
+
+// loads deduplicates concurrent loads of the same key per pool.
+var loads singleflight.Group
+
+// LoadOptions configures GetOrLoad. Zero values select the defaults in brackets.
+type LoadOptions struct {
+	// TTL is how long a loaded value is cached [1m].
+	TTL time.Duration
+	// Beta enables probabilistic early refresh (XFetch) when positive: a reader refreshes
+	// the value before it expires with a probability that grows as expiry nears and with
+	// the time the value took to load, so a popular key is reloaded by one caller ahead of
+	// time instead of by all of them once it expired. 1 is the usual choice, larger values
+	// refresh earlier [0, disabled]. Values are then stored with a small header and must
+	// be read through GetOrLoad.
+	Beta float64
+	// NegativeTTL caches a miss, reported by load with an error matching ErrKeyNotFound,
+	// for this long, so lookups of nonexistent entities do not reach load every time.
+	// Until it expires GetOrLoad fails with a NegativeCachedError. The miss is stored as a
+	// marker value that only GetOrLoad understands [0, disabled].
+	NegativeTTL time.Duration
+}
+
+// GetOrLoad returns the cached value of key, or calls load and caches its result for
+// opts.TTL when the key does not exist. Concurrent misses of the same key in this process
+// share one load. Keys holding a DeleteSoft tombstone fail with ErrDeleted. When an early
+// refresh chosen by Beta fails, the cached value is returned and the error is logged.
+func (d *RedisDatabase) GetOrLoad(key string, opts LoadOptions, load func() ([]byte, error)) ([]byte, error) {
+	return d.GetOrLoadContext(context.Background(), key, opts, func(context.Context) ([]byte, error) {
+		return load()
+	})
+}
+
+// GetOrLoadContext is GetOrLoad bounded by ctx, which is passed on to load.
+func (d *RedisDatabase) GetOrLoadContext(ctx context.Context, key string, opts LoadOptions, load func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if opts.TTL <= 0 {
+		opts.TTL = time.Minute
+	}
+
+	value, delta, ttl, err := d.getCached(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(value, negativeMarker) {
+		return nil, &NegativeCachedError{Key: key, TTL: ttl}
+	}
+	if value != nil && !refreshEarly(opts.Beta, delta, ttl) {
+		return value, nil
+	}
+
+	v, err, _ := loads.Do(fmt.Sprintf("%p:%s", d.redisPool, key), func() (interface{}, error) {
+		return d.load(ctx, key, opts, load)
+	})
+	if err != nil && value != nil {
+		// a failed early refresh keeps serving the value, which has not expired yet
+		d.options().logger.Printf("early refresh of key %s failed: %v", key, err)
+		return value, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// getCached reads key and its remaining TTL, and the load time stored with it. The value
+// is nil when the key does not exist.
+func (d *RedisDatabase) getCached(ctx context.Context, key string) ([]byte, time.Duration, time.Duration, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("error getting key %s: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close getting key %s: %v", key, err)
+		}
+	}(conn)
+
+	replies, err := redis.Values(getWithTTLScript.Do(instrumentedConn{conn, d}, 1, key))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("error getting key %s: %w", key, err)
+	}
+	var entry []interface{}
+	if _, err := redis.Scan(replies, &entry); err != nil {
+		return nil, 0, 0, fmt.Errorf("error getting key %s: %w", key, err)
+	}
+	var value []byte
+	var ms int64
+	if _, err := redis.Scan(entry, &value, &ms); err != nil {
+		return nil, 0, 0, fmt.Errorf("error getting key %s: %w", key, err)
+	}
+	if value == nil {
+		return nil, 0, 0, nil
+	}
+	if IsTombstone(value) {
+		return nil, 0, 0, fmt.Errorf("error getting key %s: %w", key, ErrDeleted)
+	}
+
+	var delta time.Duration
+	if bytes.HasPrefix(value, xfetchHeader) && len(value) >= len(xfetchHeader)+8 {
+		delta = time.Duration(binary.BigEndian.Uint64(value[len(xfetchHeader):])) * time.Millisecond
+		value = value[len(xfetchHeader)+8:]
+	}
+	return value, delta, time.Duration(ms) * time.Millisecond, nil
+}
+
+// refreshEarly decides with XFetch whether a value that took delta to load and expires in
+// ttl is refreshed now.
+func refreshEarly(beta float64, delta time.Duration, ttl time.Duration) bool {
+	if beta <= 0 || delta <= 0 || ttl <= 0 {
+		return false
+	}
+	return -float64(delta)*beta*math.Log(1-rand.Float64()) >= float64(ttl)
+}
+
+func (d *RedisDatabase) load(ctx context.Context, key string, opts LoadOptions, load func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	start := time.Now()
+	value, err := load(ctx)
+	if err != nil {
+		if opts.NegativeTTL > 0 && errors.Is(err, ErrKeyNotFound) {
+			d.cache(ctx, key, negativeMarker, opts.NegativeTTL)
+		}
+		return nil, fmt.Errorf("error loading key %s: %w", key, err)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+
+	stored := value
+	if opts.Beta > 0 {
+		stored = make([]byte, len(xfetchHeader)+8+len(value))
+		copy(stored, xfetchHeader)
+		binary.BigEndian.PutUint64(stored[len(xfetchHeader):], uint64(time.Since(start).Milliseconds()))
+		copy(stored[len(xfetchHeader)+8:], value)
+	}
+	d.cache(ctx, key, stored, opts.TTL)
+	return value, nil
+}
+
+// cache stores a loaded value. Failures are only logged: the value is still good and the
+// next reader loads it again.
+func (d *RedisDatabase) cache(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		d.options().logger.Printf("failed to cache key %s: %v", key, err)
+		return
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close caching key %s: %v", key, err)
+		}
+	}(conn)
+
+	if _, err := d.doContext(ctx, conn, "SET", key, value, "PX", ttl.Milliseconds()); err != nil {
+		d.options().logger.Printf("failed to cache key %s: %v", key, err)
+	}
+}
@@ -2,4 +2,19 @@ module github.com/henryse/go-redisdb
 
 go 1.20
 
-require github.com/gomodule/redigo v1.8.9
+require (
+	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da
+	github.com/gomodule/redigo v1.8.9
+	golang.org/x/sync v0.6.0
+	google.golang.org/grpc v1.56.3
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.9.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
+)
@@ -0,0 +1,75 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+// Package groupcacheadapter lets a redisdb database back a groupcache group, so Redis
+// acts as the shared layer between groupcache's in-process caches and the source of truth.
+package groupcacheadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/groupcache"
+	"github.com/henryse/go-redisdb"
+	"time"
+)
+
+// Loader reads a value from the source of truth.
+type Loader func(ctx context.Context, key string) ([]byte, error)
+
+// Getter returns a groupcache.Getter serving keys from d. When load is not nil, keys
+// missing from Redis are loaded with it and written back to Redis with ttl, zero for no
+// expiry; otherwise a missing key is an error wrapping redisdb.ErrKeyNotFound.
+func Getter(d *redisdb.RedisDatabase, ttl time.Duration, load Loader) groupcache.Getter {
+	return groupcache.GetterFunc(func(ctx context.Context, key string, dest groupcache.Sink) error {
+		value, err := d.Get(key)
+		if err == nil {
+			return dest.SetBytes(value)
+		}
+		if load == nil || !errors.Is(err, redisdb.ErrKeyNotFound) {
+			return err
+		}
+
+		value, err = load(ctx, key)
+		if err != nil {
+			return err
+		}
+		args := []interface{}{key, value}
+		if ttl > 0 {
+			args = append(args, "PX", ttl.Milliseconds())
+		}
+		if _, err := d.Do("SET", args...); err != nil {
+			// the value is still good, it is just not shared through Redis
+			fmt.Printf("failed writing key %s back to redis: %v", key, err)
+		}
+		return dest.SetBytes(value)
+	})
+}
+
+// NewGroup creates a groupcache group of cacheBytes backed by d, see Getter.
+func NewGroup(name string, cacheBytes int64, d *redisdb.RedisDatabase, ttl time.Duration, load Loader) *groupcache.Group {
+	return groupcache.NewGroup(name, cacheBytes, Getter(d, ttl, load))
+}
@@ -0,0 +1,117 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+// Package grpchealth reports the health of a redisdb database through the standard gRPC
+// health checking protocol.
+package grpchealth
+
+import (
+	"context"
+	"github.com/henryse/go-redisdb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func servingStatus(s redisdb.HealthStatus) healthpb.HealthCheckResponse_ServingStatus {
+	switch s {
+	case redisdb.HealthServing:
+		return healthpb.HealthCheckResponse_SERVING
+	case redisdb.HealthNotServing:
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return healthpb.HealthCheckResponse_UNKNOWN
+}
+
+// Bind keeps the status of service in an existing grpc health.Server in sync with
+// checker, for services that already register one. It returns a function that stops
+// the updates.
+func Bind(checker *redisdb.HealthChecker, server *health.Server, service string) (stop func()) {
+	updates, unsubscribe := checker.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case s := <-updates:
+				server.SetServingStatus(service, servingStatus(s))
+			}
+		}
+	}()
+	return func() {
+		unsubscribe()
+		close(done)
+	}
+}
+
+// Server is a grpc_health_v1 HealthServer answering for a single service name, and for
+// the empty name that stands for the whole server, from a HealthChecker.
+type Server struct {
+	healthpb.UnimplementedHealthServer
+	checker *redisdb.HealthChecker
+	service string
+}
+
+// NewServer returns a health service for service backed by checker. Register it with
+// healthpb.RegisterHealthServer.
+func NewServer(checker *redisdb.HealthChecker, service string) *Server {
+	return &Server{checker: checker, service: service}
+}
+
+func (s *Server) known(service string) bool {
+	return service == "" || service == s.service
+}
+
+// Check implements healthpb.HealthServer.
+func (s *Server) Check(_ context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if !s.known(req.GetService()) {
+		return nil, status.Errorf(codes.NotFound, "unknown service %s", req.GetService())
+	}
+	current, _ := s.checker.Status()
+	return &healthpb.HealthCheckResponse{Status: servingStatus(current)}, nil
+}
+
+// Watch implements healthpb.HealthServer, sending the current status and every change.
+func (s *Server) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if !s.known(req.GetService()) {
+		return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN})
+	}
+
+	updates, unsubscribe := s.checker.Subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case current := <-updates:
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: servingStatus(current)}); err != nil {
+				return err
+			}
+		}
+	}
+}
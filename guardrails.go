@@ -0,0 +1,200 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+)
+
+// ErrResponseTooLarge is matched by errors.Is when a reply exceeds the configured size limit.
+var ErrResponseTooLarge = errors.New("redis: response too large")
+
+// ResponseTooLargeError reports a reply that was discarded because it exceeded its limit.
+type ResponseTooLargeError struct {
+	Command string
+	Key     string
+	Size    int
+	Limit   int
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("redis: %s %s response of %d bytes exceeds limit of %d bytes", e.Command, e.Key, e.Size, e.Limit)
+}
+
+func (e *ResponseTooLargeError) Is(target error) bool {
+	return target == ErrResponseTooLarge
+}
+
+// WithMaxResponseSize limits the size in bytes of any reply. For GET, HGETALL and LRANGE
+// the size is checked before the command, with STRLEN or a script summing the lengths on
+// the server that stops once the limit is exceeded, so a huge value is never transferred
+// at the cost of one more round trip.
+// Other replies have already been read from the connection when they are checked, but
+// they are discarded instead of being handed to the caller, so an accidentally huge key
+// can not propagate into the service. Pipelines and transactions are only checked after
+// reading.
+func WithMaxResponseSize(limit int) Option {
+	return func(o *options) {
+		o.maxResponseSize = limit
+	}
+}
+
+// WithCommandResponseLimit limits the reply size of a single command such as GET or
+// LRANGE, overriding WithMaxResponseSize for that command.
+func WithCommandResponseLimit(command string, limit int) Option {
+	return func(o *options) {
+		if o.commandResponseLimits == nil {
+			o.commandResponseLimits = map[string]int{}
+		}
+		o.commandResponseLimits[strings.ToUpper(command)] = limit
+	}
+}
+
+// replySizeScript returns the size of the reply of HGETALL KEYS[1], or of LRANGE KEYS[1]
+// ARGV[3] ARGV[4] when ARGV[2] is 'LRANGE', reading in chunks and returning as soon as
+// the size exceeds ARGV[1].
+var replySizeScript = redis.NewScript(1, `
+local limit = tonumber(ARGV[1])
+local size = 0
+if ARGV[2] == 'HGETALL' then
+  local cursor = '0'
+  repeat
+    local page = redis.call('HSCAN', KEYS[1], cursor, 'COUNT', 100)
+    cursor = page[1]
+    for _, v in ipairs(page[2]) do size = size + #v end
+    if size > limit then return size end
+  until cursor == '0'
+  return size
+end
+local len = redis.call('LLEN', KEYS[1])
+local first, last = tonumber(ARGV[3]), tonumber(ARGV[4])
+if first < 0 then first = math.max(len + first, 0) end
+if last < 0 then last = len + last end
+last = math.min(last, len - 1)
+while first <= last do
+  local chunk = math.min(first + 99, last)
+  for _, v in ipairs(redis.call('LRANGE', KEYS[1], first, chunk)) do size = size + #v end
+  if size > limit then return size end
+  first = chunk + 1
+end
+return size`)
+
+func (o *options) responseLimit(commandName string) int {
+	limit, ok := o.commandResponseLimits[strings.ToUpper(commandName)]
+	if !ok {
+		limit = o.maxResponseSize
+	}
+	return limit
+}
+
+// precheckResponseSize fails GET, HGETALL and LRANGE whose reply would exceed the limit
+// before they are sent. When the size can not be determined, for example for a key of
+// another type, the command runs and its reply is checked after reading.
+func (o *options) precheckResponseSize(ctx context.Context, conn redis.Conn, commandName string, args []interface{}) error {
+	name := strings.ToUpper(commandName)
+	if name != "GET" && name != "HGETALL" && name != "LRANGE" {
+		return nil
+	}
+	limit := o.responseLimit(name)
+	if limit <= 0 || len(args) == 0 {
+		return nil
+	}
+
+	if ctx.Done() == nil {
+		// plain Do for connections without context support, like doContext
+		ctx = nil
+	}
+	var size int
+	var err error
+	switch name {
+	case "GET":
+		if ctx != nil {
+			size, err = redis.Int(redis.DoContext(conn, ctx, "STRLEN", args[0]))
+		} else {
+			size, err = redis.Int(conn.Do("STRLEN", args[0]))
+		}
+	case "HGETALL", "LRANGE":
+		keysAndArgs := []interface{}{args[0], limit, name}
+		if name == "LRANGE" {
+			if len(args) < 3 {
+				return nil
+			}
+			keysAndArgs = append(keysAndArgs, args[1], args[2])
+		}
+		if ctx != nil {
+			size, err = redis.Int(replySizeScript.DoContext(ctx, conn, keysAndArgs...))
+		} else {
+			size, err = redis.Int(replySizeScript.Do(conn, keysAndArgs...))
+		}
+	}
+	if err != nil || size <= limit {
+		return nil
+	}
+	return &ResponseTooLargeError{
+		Command: commandName,
+		Key:     commandKey(commandName, args),
+		Size:    size,
+		Limit:   limit,
+	}
+}
+
+func (o *options) checkResponseSize(commandName string, args []interface{}, reply interface{}) error {
+	limit := o.responseLimit(commandName)
+	if limit <= 0 {
+		return nil
+	}
+
+	if size := replySize(reply); size > limit {
+		return &ResponseTooLargeError{
+			Command: commandName,
+			Key:     commandKey(commandName, args),
+			Size:    size,
+			Limit:   limit,
+		}
+	}
+	return nil
+}
+
+func replySize(reply interface{}) int {
+	switch v := reply.(type) {
+	case []byte:
+		return len(v)
+	case string:
+		return len(v)
+	case []interface{}:
+		size := 0
+		for _, e := range v {
+			size += replySize(e)
+		}
+		return size
+	}
+	return 0
+}
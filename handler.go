@@ -0,0 +1,198 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxSampledKeys caps the count parameter of /keys/sample.
+const maxSampledKeys = 1000
+
+// HandlerOptions configures the operational endpoints served by Handler.
+type HandlerOptions struct {
+	// Authorize guards /stats and /keys/sample, which may reveal key names. Requests are
+	// rejected with 403 when it returns false. Without it those endpoints are disabled.
+	Authorize func(r *http.Request) bool
+	// Recorder, when also installed with WithMetrics, adds per command totals to /stats.
+	Recorder *CommandRecorder
+	// Health serves /healthz from the checker's cached status instead of a PING per request.
+	Health *HealthChecker
+}
+
+type poolState struct {
+	Active       int   `json:"active"`
+	Idle         int   `json:"idle"`
+	WaitCount    int64 `json:"wait_count"`
+	WaitDuration int64 `json:"wait_duration_ns"`
+}
+
+type statsResponse struct {
+	Pool     poolState                `json:"pool"`
+	Commands map[string]CommandTotals `json:"commands,omitempty"`
+}
+
+type sampledKey struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	TTLMs int64  `json:"ttl_ms"`
+}
+
+// Handler returns operational endpoints to mount in a service's mux:
+//
+//	/healthz                          PINGs the server, 200 or 503
+//	/stats                            pool state and command totals as JSON
+//	/keys/sample?pattern=P&count=N    type and TTL of up to N keys matching P
+func (d *RedisDatabase) Handler(opts HandlerOptions) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if opts.Health != nil {
+			serveHealthStatus(w, opts.Health)
+			return
+		}
+		d.serveHealth(w, r)
+	})
+	mux.HandleFunc("/stats", authorized(opts.Authorize, func(w http.ResponseWriter, r *http.Request) {
+		stats := d.redisPool.Stats()
+		response := statsResponse{Pool: poolState{
+			Active:       stats.ActiveCount,
+			Idle:         stats.IdleCount,
+			WaitCount:    stats.WaitCount,
+			WaitDuration: int64(stats.WaitDuration),
+		}}
+		if opts.Recorder != nil {
+			response.Commands = opts.Recorder.Snapshot()
+		}
+		writeJSON(w, http.StatusOK, response)
+	}))
+	mux.HandleFunc("/keys/sample", authorized(opts.Authorize, d.serveKeySample))
+	return mux
+}
+
+func authorized(authorize func(r *http.Request) bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorize == nil || !authorize(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (d *RedisDatabase) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	start := time.Now()
+	if err := d.Ping(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "latency_ms": time.Since(start).Milliseconds()})
+}
+
+func serveHealthStatus(w http.ResponseWriter, h *HealthChecker) {
+	if err := h.Err(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	latency, _ := h.Latency()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "latency_ms": latency.Milliseconds()})
+}
+
+func (d *RedisDatabase) serveKeySample(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		pattern = "*"
+	}
+	count := 20
+	if c := r.URL.Query().Get("count"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	if count > maxSampledKeys {
+		count = maxSampledKeys
+	}
+
+	keys, err := d.describeKeys(pattern, count)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (d *RedisDatabase) describeKeys(pattern string, count int) ([]sampledKey, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close sampling '%s' keys: %v", pattern, err)
+		}
+	}(conn)
+
+	keys, err := d.sampleKeys(conn, pattern, count)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		_ = conn.Send("TYPE", key)
+		_ = conn.Send("PTTL", key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("error sampling '%s' keys: %w", pattern, err)
+	}
+
+	described := make([]sampledKey, 0, len(keys))
+	for _, key := range keys {
+		kind, err := redis.String(conn.Receive())
+		if err != nil {
+			return nil, fmt.Errorf("error reading type of key %s: %w", key, err)
+		}
+		ttl, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return nil, fmt.Errorf("error reading ttl of key %s: %w", key, err)
+		}
+		if kind == "none" {
+			continue
+		}
+		described = append(described, sampledKey{Key: key, Type: kind, TTLMs: ttl})
+	}
+	return described, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,214 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HealthStatus is the last known health of the server.
+type HealthStatus int
+
+const (
+	// HealthUnknown is reported until the first check completed.
+	HealthUnknown HealthStatus = iota
+	// HealthServing means the last PING succeeded.
+	HealthServing
+	// HealthNotServing means the last PING failed.
+	HealthNotServing
+)
+
+func (s HealthStatus) String() string {
+	switch s {
+	case HealthServing:
+		return "serving"
+	case HealthNotServing:
+		return "not serving"
+	}
+	return "unknown"
+}
+
+// HealthChecker PINGs the server in the background and caches the result, so health
+// endpoints answer without a round trip and without piling up checks when the server
+// hangs. Subscribers are told about every change of status.
+type HealthChecker struct {
+	d        *RedisDatabase
+	interval time.Duration
+
+	mu          sync.Mutex
+	status      HealthStatus
+	err         error
+	latency     time.Duration
+	checked     time.Time
+	subscribers map[chan HealthStatus]struct{}
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// NewHealthChecker checks d every interval once started.
+func NewHealthChecker(d *RedisDatabase, interval time.Duration) *HealthChecker {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &HealthChecker{d: d, interval: interval, subscribers: map[chan HealthStatus]struct{}{}}
+}
+
+// Start checks right away and then every interval until Close. Starting a running
+// checker does nothing.
+func (h *HealthChecker) Start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	h.stop, h.done = stop, done
+	go func() {
+		defer close(done)
+		_ = h.Check()
+		ticker := h.d.options().clock.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C():
+				_ = h.Check()
+			}
+		}
+	}()
+}
+
+// Close stops the background checks.
+func (h *HealthChecker) Close() {
+	_ = h.Stop(context.Background())
+}
+
+// Stop stops the background checks, waiting for a check in progress until ctx is done.
+func (h *HealthChecker) Stop(ctx context.Context) error {
+	h.mu.Lock()
+	stop, done := h.stop, h.done
+	if stop == nil {
+		h.mu.Unlock()
+		return nil
+	}
+	select {
+	case <-stop:
+		// a previous Stop timed out and is still waiting for the goroutine
+	default:
+		close(stop)
+	}
+	h.mu.Unlock()
+
+	if err := waitDone(ctx, done); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	if h.stop == stop {
+		h.stop = nil
+	}
+	h.mu.Unlock()
+	return nil
+}
+
+// Check PINGs the server now and updates the status. A PING that does not answer within
+// the check interval marks the server as not serving.
+func (h *HealthChecker) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	start := time.Now()
+	err := h.d.PingContext(ctx)
+	latency := time.Since(start)
+
+	status := HealthServing
+	if err != nil {
+		status = HealthNotServing
+	}
+
+	h.mu.Lock()
+	changed := status != h.status
+	h.status, h.err, h.latency, h.checked = status, err, latency, h.d.options().clock.Now()
+	if changed {
+		for ch := range h.subscribers {
+			// subscribers only need the latest status, drop a stale one
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- status
+		}
+	}
+	h.mu.Unlock()
+	return err
+}
+
+// Status returns the last status and the error of the last failed check.
+func (h *HealthChecker) Status() (HealthStatus, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status, h.err
+}
+
+// Latency returns the duration of the last check and when it ran.
+func (h *HealthChecker) Latency() (time.Duration, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.latency, h.checked
+}
+
+// Subscribe returns a channel receiving the current status and then every change, and a
+// function to unsubscribe. Slow receivers only get the latest status.
+func (h *HealthChecker) Subscribe() (<-chan HealthStatus, func()) {
+	ch := make(chan HealthStatus, 1)
+
+	h.mu.Lock()
+	ch <- h.status
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		h.mu.Unlock()
+	}
+}
+
+// Err returns nil when serving and an error describing the failure otherwise.
+func (h *HealthChecker) Err() error {
+	status, err := h.Status()
+	switch {
+	case status == HealthServing:
+		return nil
+	case err != nil:
+		return err
+	}
+	return fmt.Errorf("redis: health %s", status)
+}
@@ -0,0 +1,273 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheStatusHeader is set to "HIT" on responses served from the cache.
+const CacheStatusHeader = "X-Cache"
+
+// HTTPCacheOptions configures a CachingTransport. Zero values select the defaults in
+// brackets.
+type HTTPCacheOptions struct {
+	// Prefix is prepended to the cache keys ["httpcache:"].
+	Prefix string
+	// DefaultTTL caches responses without a max-age for this long [0, not cached].
+	DefaultTTL time.Duration
+	// MaxTTL caps the TTL taken from Cache-Control [0, no cap].
+	MaxTTL time.Duration
+	// MaxBodySize is the largest body that is cached [1MB].
+	MaxBodySize int64
+	// OnError receives cache read and write errors, the request is then served by the
+	// underlying transport. It may be nil.
+	OnError func(err error)
+}
+
+// CachingTransport is an http.RoundTripper caching GET responses in Redis, so internal
+// API clients share one cache across instances. Responses are keyed by URL and the
+// request headers named in their Vary header and expire after the s-maxage or max-age of
+// their Cache-Control. As a shared cache it does not store private or no-store
+// responses, responses setting cookies, nor responses to requests with an Authorization
+// header unless they are public. Failures talking to Redis fall through to the underlying transport.
+type CachingTransport struct {
+	d    *RedisDatabase
+	next http.RoundTripper
+	opts HTTPCacheOptions
+}
+
+// NewCachingTransport wraps next, http.DefaultTransport when nil.
+func NewCachingTransport(d *RedisDatabase, next http.RoundTripper, opts HTTPCacheOptions) *CachingTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "httpcache:"
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = 1 << 20
+	}
+	return &CachingTransport{d: d, next: next, opts: opts}
+}
+
+// RoundTrip serves req from the cache when possible.
+func (t *CachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+	requestDirectives := cacheControl(req.Header)
+	if _, ok := requestDirectives["no-store"]; ok {
+		return t.next.RoundTrip(req)
+	}
+
+	url := req.URL.String()
+	if _, ok := requestDirectives["no-cache"]; !ok {
+		if resp := t.lookup(req, url); resp != nil {
+			return resp, nil
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	ttl, ok := t.cacheable(req, resp)
+	if !ok {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.opts.MaxBodySize+1))
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > t.opts.MaxBodySize {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.store(req, resp, url, ttl)
+	return resp, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// lookup returns the cached response for req, nil on a miss.
+func (t *CachingTransport) lookup(req *http.Request, url string) *http.Response {
+	ctx := req.Context()
+	vary, err := t.d.GetContext(ctx, t.opts.Prefix+"vary:"+url)
+	if err != nil {
+		t.cacheError(err)
+		return nil
+	}
+	data, err := t.d.GetContext(ctx, t.responseKey(req, url, strings.Split(string(vary), ",")))
+	if err != nil {
+		t.cacheError(err)
+		return nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		t.cacheError(err)
+		return nil
+	}
+	resp.Header.Set(CacheStatusHeader, "HIT")
+	return resp
+}
+
+// store saves resp, whose body has been buffered, DumpResponse leaves it readable.
+func (t *CachingTransport) store(req *http.Request, resp *http.Response, url string, ttl time.Duration) {
+	vary := varyHeaders(resp.Header)
+	data, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		t.cacheError(err)
+		return
+	}
+
+	ctx := req.Context()
+	ms := ttl.Milliseconds()
+	if _, err := t.d.DoContext(ctx, "SET", t.opts.Prefix+"vary:"+url, strings.Join(vary, ","), "PX", ms); err != nil {
+		t.cacheError(err)
+		return
+	}
+	if _, err := t.d.DoContext(ctx, "SET", t.responseKey(req, url, vary), data, "PX", ms); err != nil {
+		t.cacheError(err)
+	}
+}
+
+// responseKey hashes the URL with the values of the vary request headers.
+func (t *CachingTransport) responseKey(req *http.Request, url string, vary []string) string {
+	h := sha256.New()
+	_, _ = io.WriteString(h, url)
+	for _, name := range vary {
+		if name == "" {
+			continue
+		}
+		_, _ = io.WriteString(h, "\n"+name+":"+strings.Join(req.Header.Values(name), ","))
+	}
+	return t.opts.Prefix + "response:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheable returns the TTL of resp, false when it must not be stored.
+func (t *CachingTransport) cacheable(req *http.Request, resp *http.Response) (time.Duration, bool) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return 0, false
+	}
+	directives := cacheControl(resp.Header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0, false
+		}
+	}
+	// a cookie set for one client must not be replayed to the others
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		return 0, false
+	}
+	_, public := directives["public"]
+	_, shared := directives["s-maxage"]
+	if req.Header.Get("Authorization") != "" && !public && !shared {
+		return 0, false
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if name == "*" {
+			return 0, false
+		}
+	}
+
+	ttl := t.opts.DefaultTTL
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, false
+			}
+			ttl = time.Duration(seconds) * time.Second
+			break
+		}
+	}
+	if t.opts.MaxTTL > 0 && ttl > t.opts.MaxTTL {
+		ttl = t.opts.MaxTTL
+	}
+	return ttl, ttl > 0
+}
+
+func (t *CachingTransport) cacheError(err error) {
+	if errors.Is(err, ErrKeyNotFound) || t.opts.OnError == nil {
+		return
+	}
+	_ = t.d.options().call("http cache error callback", func() error {
+		t.opts.OnError(err)
+		return nil
+	})
+}
+
+// cacheControl parses the Cache-Control header into lower cased directives.
+func cacheControl(h http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// varyHeaders returns the sorted, canonical header names of the Vary header.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
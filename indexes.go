@@ -0,0 +1,119 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+// IndexOp is a secondary index mutation applied together with an entity write.
+// Indexes are sets of entity keys, or sorted sets when Sorted is true.
+type IndexOp struct {
+	Key    string
+	Member string
+	Score  float64
+	Sorted bool
+	Remove bool
+}
+
+// AddToIndex adds member to the set index at key.
+func AddToIndex(key string, member string) IndexOp {
+	return IndexOp{Key: key, Member: member}
+}
+
+// RemoveFromIndex removes member from the set index at key.
+func RemoveFromIndex(key string, member string) IndexOp {
+	return IndexOp{Key: key, Member: member, Remove: true}
+}
+
+// AddToSortedIndex adds member with score to the sorted set index at key.
+func AddToSortedIndex(key string, member string, score float64) IndexOp {
+	return IndexOp{Key: key, Member: member, Score: score, Sorted: true}
+}
+
+// RemoveFromSortedIndex removes member from the sorted set index at key.
+func RemoveFromSortedIndex(key string, member string) IndexOp {
+	return IndexOp{Key: key, Member: member, Sorted: true, Remove: true}
+}
+
+func (op IndexOp) send(conn redis.Conn) error {
+	switch {
+	case op.Sorted && op.Remove:
+		return conn.Send("ZREM", op.Key, op.Member)
+	case op.Sorted:
+		return conn.Send("ZADD", op.Key, op.Score, op.Member)
+	case op.Remove:
+		return conn.Send("SREM", op.Key, op.Member)
+	default:
+		return conn.Send("SADD", op.Key, op.Member)
+	}
+}
+
+// SaveWithIndexes writes the hash fields of entityKey and applies all index mutations in a
+// single MULTI/EXEC, so an entity and its indexes can not diverge if the caller dies mid-way.
+func (d *RedisDatabase) SaveWithIndexes(entityKey string, fields map[string][]byte, indexOps ...IndexOp) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("redis: at least one field is required")
+	}
+
+	fields, err := d.options().sealFields(entityKey, fields)
+	if err != nil {
+		return fmt.Errorf("error saving key %s: %w", entityKey, err)
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed closing saving key %s: %v", entityKey, err)
+		}
+	}(conn)
+
+	if err := conn.Send("MULTI"); err != nil {
+		return fmt.Errorf("error saving key %s: %w", entityKey, err)
+	}
+	if err := conn.Send("HSET", redis.Args{entityKey}.AddFlat(fields)...); err != nil {
+		return fmt.Errorf("error saving key %s: %w", entityKey, err)
+	}
+	for _, op := range indexOps {
+		if err := op.send(conn); err != nil {
+			return fmt.Errorf("error saving key %s: %w", entityKey, err)
+		}
+	}
+
+	replies, err := redis.Values(d.do(conn, "EXEC"))
+	if err != nil {
+		return fmt.Errorf("error saving key %s: %w", entityKey, err)
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(redis.Error); ok {
+			return fmt.Errorf("error saving key %s: %v", entityKey, e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math/rand"
+	"time"
+)
+
+// removeOrphansScript removes the members KEYS[2..] from the index KEYS[1] whose entity
+// key does not exist, checking and removing atomically so an entity created meanwhile
+// keeps its entry. ARGV[1] is the index type and ARGV[2] is 1 for a dry run.
+var removeOrphansScript = redis.NewScript(-1, `
+local orphans = 0
+for i = 2, #KEYS do
+  if redis.call('EXISTS', KEYS[i]) == 0 then
+    orphans = orphans + 1
+    if ARGV[2] ~= '1' then
+      if ARGV[1] == 'zset' then
+        redis.call('ZREM', KEYS[1], KEYS[i])
+      else
+        redis.call('SREM', KEYS[1], KEYS[i])
+      end
+    end
+  end
+end
+return orphans`)
+
+// IndexDrift reports one reconciliation pass over an index.
+type IndexDrift struct {
+	Index   string
+	Size    int
+	Sampled int
+	Orphans int
+	// Removed is zero in dry runs.
+	Removed int
+}
+
+// IndexReconcilerOptions tunes an IndexReconciler. Zero values select the defaults in brackets.
+type IndexReconcilerOptions struct {
+	// SampleSize is the number of members checked per index and pass [100].
+	SampleSize int
+	// Interval is the time between passes once started [1m].
+	Interval time.Duration
+	// DryRun only counts orphans.
+	DryRun bool
+	// OnReport receives the drift of every index after every pass and may be nil.
+	OnReport func(drift IndexDrift)
+	// OnError receives errors of background passes and may be nil.
+	OnError func(err error)
+}
+
+// IndexReconciler samples members of secondary indexes written with SaveWithIndexes and
+// removes members whose entity key no longer exists. Indexes and entities drift when
+// entities expire or are deleted without their index updates. When the Metrics implement
+// GaugeMetrics the orphans found per index are reported as the "index_orphans" gauge.
+//
+// Entity keys are touched from a script, so on a cluster an index and its entities must
+// share a hash tag.
+type IndexReconciler struct {
+	d       *RedisDatabase
+	indexes []string
+	opts    IndexReconcilerOptions
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewIndexReconciler returns a reconciler for the set or sorted set indexes.
+func NewIndexReconciler(d *RedisDatabase, opts IndexReconcilerOptions, indexes ...string) *IndexReconciler {
+	if opts.SampleSize <= 0 {
+		opts.SampleSize = 100
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	return &IndexReconciler{d: d, indexes: indexes, opts: opts}
+}
+
+// Start runs a pass every Interval in the background until Close.
+func (r *IndexReconciler) Start() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	r.stop, r.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := r.d.options().clock.NewTicker(r.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C():
+				if _, err := r.ReconcileOnce(); err != nil && r.opts.OnError != nil {
+					_ = r.d.options().call("index reconciler error callback", func() error {
+						r.opts.OnError(err)
+						return nil
+					})
+				}
+			}
+		}
+	}()
+}
+
+// Close stops background passes started with Start.
+func (r *IndexReconciler) Close() {
+	_ = r.Stop(context.Background())
+}
+
+// Stop stops background passes, waiting for a pass in progress until ctx is done.
+func (r *IndexReconciler) Stop(ctx context.Context) error {
+	if r.stop == nil {
+		return nil
+	}
+	select {
+	case <-r.stop:
+		// a previous Stop timed out and is still waiting for the goroutine
+	default:
+		close(r.stop)
+	}
+	if err := waitDone(ctx, r.done); err != nil {
+		return err
+	}
+	r.stop = nil
+	return nil
+}
+
+// ReconcileOnce checks a sample of every index and returns the drift found. It continues
+// with the remaining indexes when one fails and returns the first error.
+func (r *IndexReconciler) ReconcileOnce() ([]IndexDrift, error) {
+	var drifts []IndexDrift
+	var firstErr error
+	for _, index := range r.indexes {
+		drift, err := r.reconcile(index)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		drifts = append(drifts, drift)
+
+		if r.opts.OnReport != nil {
+			_ = r.d.options().call("index reconciler report callback", func() error {
+				r.opts.OnReport(drift)
+				return nil
+			})
+		}
+		o := r.d.options()
+		if g, ok := o.metrics.(GaugeMetrics); ok {
+			g.ObserveGauge("index_orphans", index, float64(drift.Orphans))
+		}
+	}
+	return drifts, firstErr
+}
+
+func (r *IndexReconciler) reconcile(index string) (IndexDrift, error) {
+	drift := IndexDrift{Index: index}
+
+	conn := r.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reconciling index %s: %v", index, err)
+		}
+	}(conn)
+
+	kind, err := redis.String(r.d.do(conn, "TYPE", index))
+	if err != nil {
+		return drift, fmt.Errorf("error reconciling index %s: %w", index, err)
+	}
+
+	var members []string
+	switch kind {
+	case "none":
+		return drift, nil
+	case "set":
+		drift.Size, err = redis.Int(r.d.do(conn, "SCARD", index))
+		if err == nil {
+			members, err = redis.Strings(r.d.do(conn, "SRANDMEMBER", index, r.opts.SampleSize))
+		}
+	case "zset":
+		drift.Size, err = redis.Int(r.d.do(conn, "ZCARD", index))
+		if err == nil && drift.Size > 0 {
+			// a random window keeps this working on servers without ZRANDMEMBER
+			start := 0
+			if drift.Size > r.opts.SampleSize {
+				start = rand.Intn(drift.Size - r.opts.SampleSize + 1)
+			}
+			members, err = redis.Strings(r.d.do(conn, "ZRANGE", index, start, start+r.opts.SampleSize-1))
+		}
+	default:
+		return drift, fmt.Errorf("redis: index %s is a %s, not a set or sorted set", index, kind)
+	}
+	if err != nil {
+		return drift, fmt.Errorf("error sampling index %s: %w", index, err)
+	}
+	drift.Sampled = len(members)
+	if len(members) == 0 {
+		return drift, nil
+	}
+
+	dryRun := 0
+	if r.opts.DryRun {
+		dryRun = 1
+	}
+	args := redis.Args{len(members) + 1, index}.AddFlat(members).Add(kind, dryRun)
+	drift.Orphans, err = redis.Int(removeOrphansScript.Do(instrumentedConn{conn, r.d}, args...))
+	if err != nil {
+		return drift, fmt.Errorf("error removing orphans of index %s: %w", index, err)
+	}
+	if !r.opts.DryRun {
+		drift.Removed = drift.Orphans
+	}
+	return drift, nil
+}
@@ -0,0 +1,263 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"strings"
+	"time"
+)
+
+// IngestFormat selects how Ingest parses its input.
+type IngestFormat int
+
+const (
+	// IngestCSV reads comma separated rows with a header row naming the columns.
+	IngestCSV IngestFormat = iota
+	// IngestJSONLines reads one flat JSON object per line.
+	IngestJSONLines
+)
+
+// IngestOptions configures Ingest.
+type IngestOptions struct {
+	Format IngestFormat
+	// KeyTemplate builds the hash key of each row from its columns, for example
+	// "user:{tenant}:{id}".
+	KeyTemplate string
+	// TTL sets an expiry on every written hash when positive.
+	TTL time.Duration
+	// BatchSize is the number of rows per pipeline round trip, 500 when zero.
+	BatchSize int
+	// Progress is called after every batch with the number of rows written so far.
+	Progress func(rows int)
+}
+
+type ingestRow struct {
+	key    string
+	fields map[string]string
+}
+
+// Ingest loads CSV or JSON lines from r into one hash per row and returns the number of
+// rows written.
+func (d *RedisDatabase) Ingest(r io.Reader, opts IngestOptions) (int, error) {
+	if opts.KeyTemplate == "" {
+		return 0, fmt.Errorf("redis: ingest needs a key template")
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	var next func() (map[string]string, error)
+	switch opts.Format {
+	case IngestCSV:
+		next = csvRows(r)
+	case IngestJSONLines:
+		next = jsonRows(r)
+	default:
+		return 0, fmt.Errorf("redis: unknown ingest format %d", opts.Format)
+	}
+
+	written := 0
+	batch := make([]ingestRow, 0, batchSize)
+	for line := 1; ; line++ {
+		fields, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, fmt.Errorf("error reading row %d: %w", line, err)
+		}
+		key, err := expandKeyTemplate(opts.KeyTemplate, fields)
+		if err != nil {
+			return written, fmt.Errorf("error in row %d: %w", line, err)
+		}
+
+		batch = append(batch, ingestRow{key: key, fields: fields})
+		if len(batch) == batchSize {
+			if err := d.writeIngestBatch(batch, opts.TTL); err != nil {
+				return written, err
+			}
+			written += len(batch)
+			batch = batch[:0]
+			if opts.Progress != nil {
+				opts.Progress(written)
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := d.writeIngestBatch(batch, opts.TTL); err != nil {
+			return written, err
+		}
+		written += len(batch)
+		if opts.Progress != nil {
+			opts.Progress(written)
+		}
+	}
+	return written, nil
+}
+
+func (d *RedisDatabase) writeIngestBatch(batch []ingestRow, ttl time.Duration) error {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close ingesting rows: %v", err)
+		}
+	}(conn)
+
+	o := d.options()
+	pending := 0
+	for _, row := range batch {
+		if len(row.fields) == 0 {
+			continue
+		}
+		fields, err := o.sealStringFields(row.key, row.fields)
+		if err != nil {
+			return fmt.Errorf("error ingesting key %s: %w", row.key, err)
+		}
+		if err := conn.Send("HSET", redis.Args{row.key}.AddFlat(fields)...); err != nil {
+			return fmt.Errorf("error ingesting key %s: %w", row.key, err)
+		}
+		pending++
+		if ttl > 0 {
+			if err := conn.Send("PEXPIRE", row.key, ttl.Milliseconds()); err != nil {
+				return fmt.Errorf("error ingesting key %s: %w", row.key, err)
+			}
+			pending++
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("error ingesting rows: %w", err)
+	}
+	for i := 0; i < pending; i++ {
+		if _, err := conn.Receive(); err != nil {
+			return fmt.Errorf("error ingesting rows: %w", err)
+		}
+	}
+	return nil
+}
+
+// expandKeyTemplate replaces every {column} in template with the column value.
+func expandKeyTemplate(template string, fields map[string]string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			b.WriteString(template)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated column in key template")
+		}
+		column := template[start+1 : start+end]
+		value, ok := fields[column]
+		if !ok || value == "" {
+			return "", fmt.Errorf("key column '%s' is missing", column)
+		}
+		b.WriteString(template[:start])
+		b.WriteString(value)
+		template = template[start+end+1:]
+	}
+}
+
+func csvRows(r io.Reader) func() (map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	var header []string
+	return func() (map[string]string, error) {
+		if header == nil {
+			h, err := reader.Read()
+			if err != nil {
+				return nil, err
+			}
+			header = append([]string(nil), h...)
+		}
+		record, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				fields[column] = record[i]
+			}
+		}
+		return fields, nil
+	}
+}
+
+func jsonRows(r io.Reader) func() (map[string]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	return func() (map[string]string, error) {
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			decoder := json.NewDecoder(bytes.NewReader(line))
+			decoder.UseNumber()
+			var object map[string]interface{}
+			if err := decoder.Decode(&object); err != nil {
+				return nil, err
+			}
+			fields := make(map[string]string, len(object))
+			for column, value := range object {
+				switch v := value.(type) {
+				case nil:
+				case string:
+					fields[column] = v
+				case json.Number:
+					fields[column] = v.String()
+				case bool:
+					fields[column] = fmt.Sprint(v)
+				default:
+					nested, err := json.Marshal(v)
+					if err != nil {
+						return nil, err
+					}
+					fields[column] = string(nested)
+				}
+			}
+			return fields, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
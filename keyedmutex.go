@@ -0,0 +1,119 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"sync"
+)
+
+type keyedLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// KeyedMutex serializes goroutines of this process per key, so local writers can queue up
+// cheaply before any Redis round trip. The zero value is ready to use. Entries are removed
+// once no goroutine holds or waits for their key.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+func (m *KeyedMutex) acquire(key string) *keyedLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.locks == nil {
+		m.locks = map[string]*keyedLock{}
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{ch: make(chan struct{}, 1)}
+		m.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (m *KeyedMutex) release(key string, l *keyedLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(m.locks, key)
+	}
+}
+
+func (m *KeyedMutex) unlocker(key string, l *keyedLock) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.ch
+			m.release(key, l)
+		})
+	}
+}
+
+// Lock blocks until key is free and returns the function that unlocks it.
+func (m *KeyedMutex) Lock(key string) func() {
+	l := m.acquire(key)
+	l.ch <- struct{}{}
+	return m.unlocker(key, l)
+}
+
+// LockContext is Lock that gives up when ctx is done.
+func (m *KeyedMutex) LockContext(ctx context.Context, key string) (func(), error) {
+	l := m.acquire(key)
+	select {
+	case l.ch <- struct{}{}:
+		return m.unlocker(key, l), nil
+	case <-ctx.Done():
+		m.release(key, l)
+		return nil, ctx.Err()
+	}
+}
+
+// TryLock locks key only when it is free, reporting whether it did.
+func (m *KeyedMutex) TryLock(key string) (func(), bool) {
+	l := m.acquire(key)
+	select {
+	case l.ch <- struct{}{}:
+		return m.unlocker(key, l), true
+	default:
+		m.release(key, l)
+		return nil, false
+	}
+}
+
+// WithLock runs fn while holding key.
+func (m *KeyedMutex) WithLock(key string, fn func() error) error {
+	unlock := m.Lock(key)
+	defer unlock()
+	return fn()
+}
@@ -0,0 +1,157 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyBuilder composes structured keys such as "app:user:42:sessions" from a namespace,
+// an entity, an id and optional sub-parts. Parts containing the separator, the escape
+// character or SCAN glob characters are escaped, so any part round-trips through Parse
+// and can not widen a generated pattern.
+type KeyBuilder struct {
+	Namespace string
+	Separator string
+}
+
+// NewKeyBuilder returns a builder for keys under namespace separated by ":".
+func NewKeyBuilder(namespace string) KeyBuilder {
+	return KeyBuilder{Namespace: namespace, Separator: ":"}
+}
+
+func (b KeyBuilder) separator() string {
+	if b.Separator == "" {
+		return ":"
+	}
+	return b.Separator
+}
+
+// Key composes namespace, entity, id and parts.
+func (b KeyBuilder) Key(entity string, id string, parts ...string) string {
+	all := append([]string{entity, id}, parts...)
+	return b.join(all, false)
+}
+
+// Pattern returns a SCAN pattern matching every key of entity, optionally narrowed by
+// leading id and parts. Escaped literal parts are followed by a "*" wildcard.
+func (b KeyBuilder) Pattern(entity string, parts ...string) string {
+	all := append([]string{entity}, parts...)
+	return b.join(all, true) + b.separator() + "*"
+}
+
+func (b KeyBuilder) join(parts []string, pattern bool) string {
+	escaped := make([]string, 0, len(parts)+1)
+	if b.Namespace != "" {
+		escaped = append(escaped, b.escape(b.Namespace, pattern))
+	}
+	for _, part := range parts {
+		escaped = append(escaped, b.escape(part, pattern))
+	}
+	return strings.Join(escaped, b.separator())
+}
+
+// escape prefixes the separator and '\' with '\'. In patterns the glob characters are
+// escaped too, since SCAN MATCH treats '\' as its escape.
+func (b KeyBuilder) escape(part string, pattern bool) string {
+	sep := b.separator()
+	var sb strings.Builder
+	for i := 0; i < len(part); i++ {
+		switch {
+		case part[i] == '\\':
+			sb.WriteString(`\\`)
+			if pattern {
+				sb.WriteString(`\\`)
+			}
+		case strings.HasPrefix(part[i:], sep):
+			if pattern {
+				sb.WriteString(`\\`)
+			}
+			sb.WriteString(`\` + sep)
+			i += len(sep) - 1
+		case pattern && strings.IndexByte("*?[]", part[i]) >= 0:
+			sb.WriteByte('\\')
+			sb.WriteByte(part[i])
+		default:
+			sb.WriteByte(part[i])
+		}
+	}
+	return sb.String()
+}
+
+// ParsedKey is a key split by KeyBuilder.Parse.
+type ParsedKey struct {
+	Namespace string
+	Entity    string
+	ID        string
+	Parts     []string
+}
+
+// Parse splits a key built by Key back into its unescaped parts. It fails when the key
+// is not under the builder's namespace or lacks an entity and id.
+func (b KeyBuilder) Parse(key string) (ParsedKey, error) {
+	var parsed ParsedKey
+	sep := b.separator()
+
+	var parts []string
+	var sb strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch {
+		case key[i] == '\\' && i+1 < len(key):
+			i++
+			if strings.HasPrefix(key[i:], sep) {
+				sb.WriteString(sep)
+				i += len(sep) - 1
+			} else {
+				sb.WriteByte(key[i])
+			}
+		case strings.HasPrefix(key[i:], sep):
+			parts = append(parts, sb.String())
+			sb.Reset()
+			i += len(sep) - 1
+		default:
+			sb.WriteByte(key[i])
+		}
+	}
+	parts = append(parts, sb.String())
+
+	if b.Namespace != "" {
+		if parts[0] != b.Namespace {
+			return parsed, fmt.Errorf("redis: key %s is not in namespace %s", key, b.Namespace)
+		}
+		parsed.Namespace, parts = parts[0], parts[1:]
+	}
+	if len(parts) < 2 {
+		return parsed, fmt.Errorf("redis: key %s has no entity and id", key)
+	}
+	parsed.Entity, parsed.ID = parts[0], parts[1]
+	if len(parts) > 2 {
+		parsed.Parts = parts[2:]
+	}
+	return parsed, nil
+}
@@ -0,0 +1,202 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+// LCSRange is an inclusive range of byte offsets in a string.
+type LCSRange struct {
+	Start int
+	End   int
+}
+
+// LCSMatch is one matching run of the longest common subsequence.
+type LCSMatch struct {
+	A   LCSRange
+	B   LCSRange
+	Len int
+}
+
+// LCSResult is the reply of LCS with IDX: the matches from last to first as returned by
+// the server, and the length of the whole subsequence.
+type LCSResult struct {
+	Matches []LCSMatch
+	Len     int
+}
+
+// requireLCS fails early on servers known to predate LCS; when the server can not be
+// probed the command is sent and the server decides.
+func (d *RedisDatabase) requireLCS() error {
+	c, err := d.Capabilities()
+	if err != nil {
+		return nil
+	}
+	return c.Require(FeatureLCS)
+}
+
+// LCS returns the longest common subsequence of the strings at key1 and key2. Needs
+// Redis 7.0.
+func (d *RedisDatabase) LCS(key1 string, key2 string) (string, error) {
+	if err := d.requireLCS(); err != nil {
+		return "", err
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close LCS %s %s: %v", key1, key2, err)
+		}
+	}(conn)
+
+	lcs, err := redis.String(d.do(conn, "LCS", key1, key2))
+	if err != nil {
+		return "", fmt.Errorf("error computing LCS of keys %s and %s: %w", key1, key2, err)
+	}
+	return lcs, nil
+}
+
+// LCSLen returns the length of the longest common subsequence of key1 and key2.
+func (d *RedisDatabase) LCSLen(key1 string, key2 string) (int, error) {
+	if err := d.requireLCS(); err != nil {
+		return 0, err
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close LCS %s %s: %v", key1, key2, err)
+		}
+	}(conn)
+
+	n, err := redis.Int(d.do(conn, "LCS", key1, key2, "LEN"))
+	if err != nil {
+		return 0, fmt.Errorf("error computing LCS of keys %s and %s: %w", key1, key2, err)
+	}
+	return n, nil
+}
+
+// LCSIdx returns the positions of the matching runs of key1 and key2 that are at least
+// minMatchLen long; zero returns every run.
+func (d *RedisDatabase) LCSIdx(key1 string, key2 string, minMatchLen int) (LCSResult, error) {
+	var result LCSResult
+	if err := d.requireLCS(); err != nil {
+		return result, err
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close LCS %s %s: %v", key1, key2, err)
+		}
+	}(conn)
+
+	args := []interface{}{key1, key2, "IDX", "WITHMATCHLEN"}
+	if minMatchLen > 0 {
+		args = append(args, "MINMATCHLEN", minMatchLen)
+	}
+	reply, err := redis.Values(d.do(conn, "LCS", args...))
+	if err != nil {
+		return result, fmt.Errorf("error computing LCS of keys %s and %s: %w", key1, key2, err)
+	}
+
+	for i := 0; i+1 < len(reply); i += 2 {
+		name, _ := redis.String(reply[i], nil)
+		switch name {
+		case "len":
+			result.Len, _ = redis.Int(reply[i+1], nil)
+		case "matches":
+			matches, _ := redis.Values(reply[i+1], nil)
+			for _, m := range matches {
+				match, err := parseLCSMatch(m)
+				if err != nil {
+					return result, fmt.Errorf("error parsing LCS of keys %s and %s: %w", key1, key2, err)
+				}
+				result.Matches = append(result.Matches, match)
+			}
+		}
+	}
+	return result, nil
+}
+
+func parseLCSMatch(reply interface{}) (LCSMatch, error) {
+	var match LCSMatch
+	parts, err := redis.Values(reply, nil)
+	if err != nil || len(parts) < 2 {
+		return match, fmt.Errorf("unexpected match %v", reply)
+	}
+	for i, r := range []*LCSRange{&match.A, &match.B} {
+		bounds, err := redis.Ints(parts[i], nil)
+		if err != nil || len(bounds) != 2 {
+			return match, fmt.Errorf("unexpected match range %v", parts[i])
+		}
+		r.Start, r.End = bounds[0], bounds[1]
+	}
+	if len(parts) > 2 {
+		match.Len, _ = redis.Int(parts[2], nil)
+	}
+	return match, nil
+}
+
+// Similarity scores the strings at key1 and key2 between 0 and 1 as twice the LCS length
+// divided by their combined length, computed on the server without fetching the values.
+// Two empty or missing strings score 1.
+func (d *RedisDatabase) Similarity(key1 string, key2 string) (float64, error) {
+	if err := d.requireLCS(); err != nil {
+		return 0, err
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close LCS %s %s: %v", key1, key2, err)
+		}
+	}(conn)
+
+	lcs, err := redis.Int(d.do(conn, "LCS", key1, key2, "LEN"))
+	if err != nil {
+		return 0, fmt.Errorf("error computing LCS of keys %s and %s: %w", key1, key2, err)
+	}
+	len1, err := redis.Int(d.do(conn, "STRLEN", key1))
+	if err != nil {
+		return 0, fmt.Errorf("error getting length of key %s: %w", key1, err)
+	}
+	len2, err := redis.Int(d.do(conn, "STRLEN", key2))
+	if err != nil {
+		return 0, fmt.Errorf("error getting length of key %s: %w", key2, err)
+	}
+	if len1+len2 == 0 {
+		return 1, nil
+	}
+	return 2 * float64(lcs) / float64(len1+len2), nil
+}
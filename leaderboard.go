@@ -0,0 +1,178 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+// LeaderboardOptions configures a Leaderboard. Zero values select the defaults in
+// brackets.
+type LeaderboardOptions struct {
+	// Ascending ranks the lowest score first, for example for race times [false].
+	Ascending bool
+	// MaxSize keeps only the best entries, dropping the rest on every update [0, all].
+	MaxSize int
+}
+
+// LeaderboardEntry is a member of a leaderboard with its 1 based rank.
+type LeaderboardEntry struct {
+	Member string
+	Score  float64
+	Rank   int64
+}
+
+// Leaderboard ranks members by score in the sorted set at key, the highest score first
+// unless Ascending is set. Ties are broken by member name, in the same direction as
+// the scores.
+type Leaderboard struct {
+	d    *RedisDatabase
+	key  string
+	opts LeaderboardOptions
+}
+
+// NewLeaderboard returns the leaderboard stored at key.
+func NewLeaderboard(d *RedisDatabase, key string, opts LeaderboardOptions) *Leaderboard {
+	return &Leaderboard{d: d, key: key, opts: opts}
+}
+
+// AddScore adds delta to the score of member and returns the new score.
+func (l *Leaderboard) AddScore(member string, delta float64) (float64, error) {
+	results, err := l.update(func(tx *Tx) {
+		tx.Do("ZINCRBY", l.key, delta, member)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error adding score of %s to leaderboard %s: %w", member, l.key, err)
+	}
+	score, err := redis.Float64(results[0].Reply, results[0].Err)
+	if err != nil {
+		return 0, fmt.Errorf("error adding score of %s to leaderboard %s: %w", member, l.key, err)
+	}
+	return score, nil
+}
+
+// SetScore replaces the score of member.
+func (l *Leaderboard) SetScore(member string, score float64) error {
+	results, err := l.update(func(tx *Tx) {
+		tx.Do("ZADD", l.key, score, member)
+	})
+	if err == nil {
+		err = results[0].Err
+	}
+	if err != nil {
+		return fmt.Errorf("error setting score of %s in leaderboard %s: %w", member, l.key, err)
+	}
+	return nil
+}
+
+// update runs queue and trims the leaderboard to MaxSize in one transaction.
+func (l *Leaderboard) update(queue func(tx *Tx)) ([]PipelineResult, error) {
+	return l.d.Transaction(func(tx *Tx) error {
+		queue(tx)
+		switch {
+		case l.opts.MaxSize <= 0:
+		case l.opts.Ascending:
+			tx.Do("ZREMRANGEBYRANK", l.key, l.opts.MaxSize, -1)
+		default:
+			tx.Do("ZREMRANGEBYRANK", l.key, 0, -l.opts.MaxSize-1)
+		}
+		return nil
+	})
+}
+
+// Remove removes member from the leaderboard.
+func (l *Leaderboard) Remove(member string) error {
+	if _, err := l.d.Do("ZREM", l.key, member); err != nil {
+		return fmt.Errorf("error removing %s from leaderboard %s: %w", member, l.key, err)
+	}
+	return nil
+}
+
+// TopN returns the n best entries.
+func (l *Leaderboard) TopN(n int) ([]LeaderboardEntry, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	return l.entries(0, int64(n-1))
+}
+
+// RankOf returns the entry of member, failing with ErrMemberNotFound when it is not on the
+// leaderboard.
+func (l *Leaderboard) RankOf(member string) (LeaderboardEntry, error) {
+	entry := LeaderboardEntry{Member: member}
+	rank, err := l.rank(member)
+	if err != nil {
+		return entry, err
+	}
+	entry.Score, err = l.d.ZScore(l.key, member)
+	if err != nil {
+		return entry, err
+	}
+	entry.Rank = rank + 1
+	return entry, nil
+}
+
+// Around returns member with up to n entries ranked directly above and below it, failing
+// with ErrMemberNotFound when it is not on the leaderboard.
+func (l *Leaderboard) Around(member string, n int) ([]LeaderboardEntry, error) {
+	rank, err := l.rank(member)
+	if err != nil {
+		return nil, err
+	}
+	start := rank - int64(n)
+	if start < 0 {
+		start = 0
+	}
+	return l.entries(start, rank+int64(n))
+}
+
+func (l *Leaderboard) rank(member string) (int64, error) {
+	if l.opts.Ascending {
+		return l.d.ZRank(l.key, member)
+	}
+	return l.d.ZRevRank(l.key, member)
+}
+
+// entries returns the entries ranked start to stop, 0 based.
+func (l *Leaderboard) entries(start int64, stop int64) ([]LeaderboardEntry, error) {
+	var members []ScoredMember
+	var err error
+	if l.opts.Ascending {
+		members, err = l.d.ZRangeWithScores(l.key, int(start), int(stop))
+	} else {
+		members, err = l.d.ZRevRangeWithScores(l.key, int(start), int(stop))
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LeaderboardEntry, len(members))
+	for i, m := range members {
+		entries[i] = LeaderboardEntry{Member: m.Member, Score: m.Score, Rank: start + int64(i) + 1}
+	}
+	return entries, nil
+}
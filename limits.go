@@ -0,0 +1,145 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrConcurrencyLimit is matched by errors.Is when a command could not start within its
+// queue timeout because its concurrency limit was reached.
+var ErrConcurrencyLimit = errors.New("redis: concurrency limit reached")
+
+// ConcurrencyLimitError reports the limit that rejected a command.
+type ConcurrencyLimitError struct {
+	Command string
+	// Prefix is set when the limit is per key prefix.
+	Prefix string
+	Limit  int
+}
+
+func (e *ConcurrencyLimitError) Error() string {
+	if e.Prefix != "" {
+		return fmt.Sprintf("redis: more than %d concurrent commands on keys %s*", e.Limit, e.Prefix)
+	}
+	return fmt.Sprintf("redis: more than %d concurrent %s commands", e.Limit, e.Command)
+}
+
+func (e *ConcurrencyLimitError) Is(target error) bool {
+	return target == ErrConcurrencyLimit
+}
+
+type concurrencyLimiter struct {
+	command string
+	prefix  string
+	limit   int
+	wait    time.Duration
+	slots   chan struct{}
+}
+
+// WithConcurrencyLimit allows at most limit concurrent executions of command, such as
+// ZRANGEBYSCORE, so one runaway caller can not monopolize the server. Further calls queue
+// for up to wait, zero rejects them immediately, and then fail with ErrConcurrencyLimit.
+// Queued calls hold their pooled connection while they wait.
+func WithConcurrencyLimit(command string, limit int, wait time.Duration) Option {
+	return func(o *options) {
+		o.limiters = append(o.limiters, &concurrencyLimiter{
+			command: strings.ToUpper(command),
+			limit:   limit,
+			wait:    wait,
+			slots:   make(chan struct{}, limit),
+		})
+	}
+}
+
+// WithPrefixConcurrencyLimit is WithConcurrencyLimit for all commands whose first key
+// starts with prefix.
+func WithPrefixConcurrencyLimit(prefix string, limit int, wait time.Duration) Option {
+	return func(o *options) {
+		o.limiters = append(o.limiters, &concurrencyLimiter{
+			prefix: prefix,
+			limit:  limit,
+			wait:   wait,
+			slots:  make(chan struct{}, limit),
+		})
+	}
+}
+
+func (l *concurrencyLimiter) matches(commandName string, key string) bool {
+	if l.prefix != "" {
+		return key != "" && strings.HasPrefix(key, l.prefix)
+	}
+	return strings.EqualFold(l.command, commandName)
+}
+
+func (l *concurrencyLimiter) acquire(commandName string) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.wait > 0 {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			return nil
+		case <-timer.C:
+		}
+	}
+	return &ConcurrencyLimitError{Command: commandName, Prefix: l.prefix, Limit: l.limit}
+}
+
+// acquire takes a slot from every limiter matching the command and returns the function
+// releasing them.
+func (o *options) acquire(commandName string, args []interface{}) (func(), error) {
+	if len(o.limiters) == 0 {
+		return func() {}, nil
+	}
+
+	key := commandKey(commandName, args)
+	var held []*concurrencyLimiter
+	release := func() {
+		for _, l := range held {
+			<-l.slots
+		}
+	}
+	for _, l := range o.limiters {
+		if !l.matches(commandName, key) {
+			continue
+		}
+		if err := l.acquire(commandName); err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	return release, nil
+}
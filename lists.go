@@ -0,0 +1,214 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math"
+	"time"
+)
+
+// ErrPopTimeout is matched by errors.Is when a blocking pop timed out without an element.
+var ErrPopTimeout = errors.New("redis: blocking pop timed out")
+
+// blockingReadMargin is added to the server side timeout of a blocking pop to get the
+// read deadline, so the reply to an expired wait is not cut off by the client.
+const blockingReadMargin = 5 * time.Second
+
+// LPush prepends values to the list at key and returns its new length.
+func (d *RedisDatabase) LPush(key string, values ...[]byte) (int, error) {
+	return d.push("LPUSH", key, values)
+}
+
+// RPush appends values to the list at key and returns its new length.
+func (d *RedisDatabase) RPush(key string, values ...[]byte) (int, error) {
+	return d.push("RPUSH", key, values)
+}
+
+func (d *RedisDatabase) push(command string, key string, values [][]byte) (int, error) {
+	if len(values) == 0 {
+		return 0, fmt.Errorf("redis: at least one value is required")
+	}
+	length, err := redis.Int(d.Do(command, redis.Args{key}.AddFlat(values)...))
+	if err != nil {
+		return 0, fmt.Errorf("error pushing to list %s: %w", key, err)
+	}
+	return length, nil
+}
+
+// LPop removes and returns the first element of the list at key, failing with
+// ErrKeyNotFound when the list is empty.
+func (d *RedisDatabase) LPop(key string) ([]byte, error) {
+	return d.pop("LPOP", key)
+}
+
+// RPop removes and returns the last element of the list at key, failing with
+// ErrKeyNotFound when the list is empty.
+func (d *RedisDatabase) RPop(key string) ([]byte, error) {
+	return d.pop("RPOP", key)
+}
+
+func (d *RedisDatabase) pop(command string, key string) ([]byte, error) {
+	value, err := redis.Bytes(d.Do(command, key))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("error popping from list %s: %w", key, ErrKeyNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error popping from list %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// LRange returns the elements from start to stop of the list at key. Negative indexes
+// count from the end, so 0 and -1 return the whole list.
+func (d *RedisDatabase) LRange(key string, start int, stop int) ([][]byte, error) {
+	values, err := redis.ByteSlices(d.Do("LRANGE", key, start, stop))
+	if err != nil {
+		return nil, fmt.Errorf("error getting range of list %s: %w", key, err)
+	}
+	return values, nil
+}
+
+// LLen returns the length of the list at key.
+func (d *RedisDatabase) LLen(key string) (int, error) {
+	length, err := redis.Int(d.Do("LLEN", key))
+	if err != nil {
+		return 0, fmt.Errorf("error getting length of list %s: %w", key, err)
+	}
+	return length, nil
+}
+
+// BLPop is BlockingConn.BLPop on a connection dialed for this call. Workers popping in a
+// loop should keep a BlockingConn instead.
+func (d *RedisDatabase) BLPop(ctx context.Context, timeout time.Duration, keys ...string) (string, []byte, error) {
+	b := d.NewBlockingConn()
+	defer b.Close()
+	return b.BLPop(ctx, timeout, keys...)
+}
+
+// BRPop is BlockingConn.BRPop on a connection dialed for this call.
+func (d *RedisDatabase) BRPop(ctx context.Context, timeout time.Duration, keys ...string) (string, []byte, error) {
+	b := d.NewBlockingConn()
+	defer b.Close()
+	return b.BRPop(ctx, timeout, keys...)
+}
+
+// BlockingConn runs blocking pops on a connection of its own, outside the pool, so
+// waiting workers neither hold pool connections nor are cut off by the read timeout of
+// the pool. The connection is dialed on first use and again after it broke. A
+// BlockingConn is not safe for concurrent use.
+type BlockingConn struct {
+	d    *RedisDatabase
+	conn redis.Conn
+}
+
+// NewBlockingConn returns a BlockingConn on d. Close it when done.
+func (d *RedisDatabase) NewBlockingConn() *BlockingConn {
+	return &BlockingConn{d: d}
+}
+
+// BLPop removes and returns the first element of the first non-empty list of keys and
+// the key it came from, waiting up to timeout for an element to arrive. A timeout of 0
+// waits until ctx is done. It fails with ErrPopTimeout when the wait expired.
+func (b *BlockingConn) BLPop(ctx context.Context, timeout time.Duration, keys ...string) (string, []byte, error) {
+	return b.pop(ctx, "BLPOP", timeout, keys)
+}
+
+// BRPop is BLPop removing the last element.
+func (b *BlockingConn) BRPop(ctx context.Context, timeout time.Duration, keys ...string) (string, []byte, error) {
+	return b.pop(ctx, "BRPOP", timeout, keys)
+}
+
+func (b *BlockingConn) pop(ctx context.Context, command string, timeout time.Duration, keys []string) (string, []byte, error) {
+	if len(keys) == 0 {
+		return "", nil, fmt.Errorf("redis: at least one key is required")
+	}
+	if b.conn != nil && b.conn.Err() != nil {
+		_ = b.conn.Close()
+		b.conn = nil
+	}
+	if b.conn == nil {
+		conn, err := b.d.redisPool.DialContext(ctx)
+		if err != nil {
+			return "", nil, fmt.Errorf("error popping from %v: %w", keys, err)
+		}
+		b.conn = conn
+	}
+
+	// whole seconds work on every server version, 0 blocks forever
+	seconds := int64(math.Ceil(timeout.Seconds()))
+	var readTimeout time.Duration
+	if seconds > 0 {
+		readTimeout = time.Duration(seconds)*time.Second + blockingReadMargin
+	}
+	args := redis.Args{}.AddFlat(keys).Add(seconds)
+
+	start := time.Now()
+	var reply interface{}
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reply, err = redis.DoWithTimeout(b.conn, readTimeout, command, args...)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// closing the connection ends the wait, it is dialed again on the next pop
+		_ = b.conn.Close()
+		<-done
+		b.conn = nil
+		reply, err = nil, ctx.Err()
+	}
+	b.d.options().observe(command, args, reply, time.Since(start), err)
+
+	values, err := redis.ByteSlices(reply, err)
+	if err == redis.ErrNil {
+		return "", nil, fmt.Errorf("error popping from %v: %w", keys, ErrPopTimeout)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("error popping from %v: %w", keys, err)
+	}
+	if len(values) != 2 {
+		return "", nil, fmt.Errorf("error popping from %v: unexpected reply %v", keys, reply)
+	}
+	return string(values[0]), values[1], nil
+}
+
+// Close closes the connection.
+func (b *BlockingConn) Close() {
+	if b.conn != nil {
+		err := b.conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close blocking connection: %v", err)
+		}
+		b.conn = nil
+	}
+}
@@ -0,0 +1,227 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// valueHashScript returns the SHA1 of a string value, so a local copy can be verified
+// without transferring the value.
+var valueHashScript = redis.NewScript(1, `
+local v = redis.call('GET', KEYS[1])
+if not v then
+  return false
+end
+return redis.sha1hex(v)`)
+
+type localEntry struct {
+	value []byte
+	sum   string
+}
+
+// LocalCacheOptions tunes a LocalCache. Zero values select the defaults in brackets.
+type LocalCacheOptions struct {
+	// Size is the maximum number of values kept in process by the built-in LRU [10000].
+	Size int
+	// Store replaces the built-in LRU, for example with a *ristretto.Cache.
+	Store LocalStore
+	// TTL bounds how long a value is served from process memory [1m].
+	TTL time.Duration
+	// VerifyRate is the fraction of local hits compared against Redis [0.01]; a negative
+	// rate disables verification.
+	VerifyRate float64
+	// OnDivergence is called with the key whenever a local value differed from Redis and
+	// was repaired. It may be nil.
+	OnDivergence func(key string)
+}
+
+// LocalCacheStats counts LocalCache activity since it was created.
+type LocalCacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Verified    uint64
+	Divergences uint64
+}
+
+// LocalCache is a two-level cache with an in-process LRU in front of Redis string keys.
+// A sample of local hits is checked against a hash of the Redis value; when they disagree
+// the local copy is repaired and a divergence is counted, which quantifies invalidation
+// bugs in the callers. When the Metrics implement GaugeMetrics the total number of
+// divergences is reported as the "local_cache_divergences" gauge.
+type LocalCache struct {
+	d     *RedisDatabase
+	store LocalStore
+	opts  LocalCacheOptions
+
+	hits        uint64
+	misses      uint64
+	verified    uint64
+	divergences uint64
+}
+
+// NewLocalCache returns a two-level cache over d.
+func NewLocalCache(d *RedisDatabase, opts LocalCacheOptions) *LocalCache {
+	if opts.Size <= 0 {
+		opts.Size = 10000
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = time.Minute
+	}
+	if opts.VerifyRate == 0 {
+		opts.VerifyRate = 0.01
+	}
+	store := opts.Store
+	if store == nil {
+		lru := newLRUCache(opts.Size)
+		lru.clock = d.options().clock
+		store = lruStore{lru}
+	}
+	return &LocalCache{d: d, store: store, opts: opts}
+}
+
+func (c *LocalCache) keep(key string, value []byte) {
+	sum := sha1.Sum(value)
+	c.store.SetWithTTL(key, &localEntry{value: value, sum: hex.EncodeToString(sum[:])}, int64(len(value)), c.opts.TTL)
+}
+
+// Get returns the value of key from process memory or Redis. The returned slice is shared
+// with the cache and must not be modified.
+func (c *LocalCache) Get(key string) ([]byte, error) {
+	if v, ok := c.store.Get(key); ok {
+		atomic.AddUint64(&c.hits, 1)
+		entry := v.(*localEntry)
+		if c.opts.VerifyRate > 0 && rand.Float64() < c.opts.VerifyRate {
+			return c.verify(key, entry)
+		}
+		return entry.value, nil
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	value, err := c.d.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	c.keep(key, value)
+	return value, nil
+}
+
+// verify compares entry with Redis and repairs it on divergence.
+func (c *LocalCache) verify(key string, entry *localEntry) ([]byte, error) {
+	atomic.AddUint64(&c.verified, 1)
+
+	sum, err := c.remoteSum(key)
+	if err != nil {
+		// serve the local copy, verification is best effort
+		return entry.value, nil
+	}
+	if sum == entry.sum {
+		return entry.value, nil
+	}
+
+	n := atomic.AddUint64(&c.divergences, 1)
+	if c.opts.OnDivergence != nil {
+		_ = c.d.options().call("local cache divergence callback", func() error {
+			c.opts.OnDivergence(key)
+			return nil
+		})
+	}
+	o := c.d.options()
+	if g, ok := o.metrics.(GaugeMetrics); ok {
+		g.ObserveGauge("local_cache_divergences", "", float64(n))
+	}
+
+	c.store.Del(key)
+	value, err := c.d.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	c.keep(key, value)
+	return value, nil
+}
+
+func (c *LocalCache) remoteSum(key string) (string, error) {
+	conn := c.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close verifying key %s: %v", key, err)
+		}
+	}(conn)
+
+	sum, err := redis.String(valueHashScript.Do(instrumentedConn{conn, c.d}, key))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return sum, err
+}
+
+// Set writes value to Redis and process memory.
+func (c *LocalCache) Set(key string, value []byte) error {
+	if err := c.d.Set(key, value); err != nil {
+		c.store.Del(key)
+		return err
+	}
+	c.keep(key, value)
+	return nil
+}
+
+// Delete removes key from Redis and process memory.
+func (c *LocalCache) Delete(key string) error {
+	c.store.Del(key)
+	return c.d.Delete(key)
+}
+
+// Invalidate drops the local copy of key, for example on an invalidation message.
+func (c *LocalCache) Invalidate(key string) {
+	c.store.Del(key)
+}
+
+// Len returns the number of values held in process memory, or -1 when the Store can not
+// tell.
+func (c *LocalCache) Len() int {
+	if l, ok := c.store.(interface{ Len() int }); ok {
+		return l.Len()
+	}
+	return -1
+}
+
+// Stats returns the activity counters of the cache.
+func (c *LocalCache) Stats() LocalCacheStats {
+	return LocalCacheStats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Verified:    atomic.LoadUint64(&c.verified),
+		Divergences: atomic.LoadUint64(&c.divergences),
+	}
+}
@@ -0,0 +1,122 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"time"
+)
+
+// LocalStore is an in-process cache that LocalCache and LayeredCache keep values in. Its
+// method set matches *ristretto.Cache, so one can be passed directly; cost is the size
+// of the value in bytes. Keys are always strings.
+type LocalStore interface {
+	Get(key interface{}) (interface{}, bool)
+	SetWithTTL(key interface{}, value interface{}, cost int64, ttl time.Duration) bool
+	Del(key interface{})
+}
+
+// lruStore adapts the built-in LRU to LocalStore.
+type lruStore struct {
+	lru *lruCache
+}
+
+func (s lruStore) Get(key interface{}) (interface{}, bool) {
+	k, ok := key.(string)
+	if !ok {
+		return nil, false
+	}
+	return s.lru.get(k)
+}
+
+func (s lruStore) SetWithTTL(key interface{}, value interface{}, _ int64, ttl time.Duration) bool {
+	k, ok := key.(string)
+	if ok {
+		s.lru.add(k, value, ttl)
+	}
+	return ok
+}
+
+func (s lruStore) Del(key interface{}) {
+	if k, ok := key.(string); ok {
+		s.lru.remove(k)
+	}
+}
+
+func (s lruStore) Len() int {
+	return s.lru.len()
+}
+
+// NewLRUStore returns the size bounded LRU used by default, for use as a LocalStore.
+func NewLRUStore(size int) LocalStore {
+	return lruStore{newLRUCache(size)}
+}
+
+// LayeredCache reads through a LocalStore to Redis string keys and fills the store on
+// misses, for services that already run an in-process cache library and want Redis as
+// its shared second level. Unlike LocalCache it does not verify local copies.
+type LayeredCache struct {
+	d     *RedisDatabase
+	store LocalStore
+	ttl   time.Duration
+}
+
+// NewLayeredCache keeps values read from d in store for ttl.
+func NewLayeredCache(d *RedisDatabase, store LocalStore, ttl time.Duration) *LayeredCache {
+	return &LayeredCache{d: d, store: store, ttl: ttl}
+}
+
+// Get returns the value of key from the store or Redis. Errors wrap ErrKeyNotFound or
+// ErrDeleted like Get.
+func (c *LayeredCache) Get(key string) ([]byte, error) {
+	if v, ok := c.store.Get(key); ok {
+		if value, ok := v.([]byte); ok {
+			return value, nil
+		}
+	}
+	value, err := c.d.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	c.store.SetWithTTL(key, value, int64(len(value)), c.ttl)
+	return value, nil
+}
+
+// Set writes value to Redis and the store.
+func (c *LayeredCache) Set(key string, value []byte) error {
+	if err := c.d.Set(key, value); err != nil {
+		c.store.Del(key)
+		return err
+	}
+	c.store.SetWithTTL(key, value, int64(len(value)), c.ttl)
+	return nil
+}
+
+// Delete removes key from the store and Redis.
+func (c *LayeredCache) Delete(key string) error {
+	c.store.Del(key)
+	return c.d.Delete(key)
+}
@@ -0,0 +1,186 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math"
+	"strings"
+)
+
+// memorySampleBatch is the number of RANDOMKEY calls pipelined at once.
+const memorySampleBatch = 200
+
+// MemoryEstimate is the estimated memory held by the keys under a prefix.
+type MemoryEstimate struct {
+	Prefix string
+	// Samples is the number of sampled keys that fell under the prefix.
+	Samples int
+	// Keys is the estimated number of keys under the prefix.
+	Keys int64
+	// Bytes is the estimated total MEMORY USAGE, with Low and High bounding its 95%
+	// confidence interval.
+	Bytes int64
+	Low   int64
+	High  int64
+}
+
+// SampleMemoryByPrefix estimates the memory used by the keys under every prefix from
+// sampleSize random keys, without scanning the keyspace. Each sampled key contributes
+// its MEMORY USAGE to the prefixes it falls under and zero to the others, so the total
+// per prefix is the database size times the mean contribution, and the confidence
+// interval follows from the variance of the contributions. Small prefixes need large
+// samples to be estimated well.
+func (d *RedisDatabase) SampleMemoryByPrefix(prefixes []string, sampleSize int) ([]MemoryEstimate, error) {
+	return d.sampleMemory(prefixes, sampleSize, func(key string, j int) bool {
+		return strings.HasPrefix(key, prefixes[j])
+	})
+}
+
+// sampleMemory estimates the memory per group from sampleSize random keys, match reports
+// whether key belongs to groups[j].
+func (d *RedisDatabase) sampleMemory(groups []string, sampleSize int, match func(key string, j int) bool) ([]MemoryEstimate, error) {
+	if sampleSize <= 0 {
+		return nil, fmt.Errorf("redis: sample size must be positive")
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close sampling memory: %v", err)
+		}
+	}(conn)
+
+	dbSize, err := redis.Int64(d.do(conn, "DBSIZE"))
+	if err != nil {
+		return nil, fmt.Errorf("error sampling memory: %w", err)
+	}
+
+	sums := make([]float64, len(groups))
+	squares := make([]float64, len(groups))
+	hits := make([]int, len(groups))
+	sampled := 0
+	for sampled < sampleSize && dbSize > 0 {
+		batch := minInt(memorySampleBatch, sampleSize-sampled)
+		keys, err := d.randomKeys(conn, batch)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			// the database was emptied while sampling
+			break
+		}
+		sizes, err := d.memoryUsage(conn, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, key := range keys {
+			if sizes[i] < 0 {
+				// expired between RANDOMKEY and MEMORY USAGE, count it as an empty draw
+				continue
+			}
+			for j := range groups {
+				if match(key, j) {
+					size := float64(sizes[i])
+					sums[j] += size
+					squares[j] += size * size
+					hits[j]++
+				}
+			}
+		}
+		sampled += len(keys)
+	}
+
+	estimates := make([]MemoryEstimate, len(groups))
+	for j, group := range groups {
+		e := MemoryEstimate{Prefix: group, Samples: hits[j]}
+		if sampled > 0 {
+			n := float64(sampled)
+			mean := sums[j] / n
+			variance := math.Max(squares[j]/n-mean*mean, 0)
+			margin := 1.96 * math.Sqrt(variance/n) * float64(dbSize)
+
+			e.Keys = int64(math.Round(float64(hits[j]) / n * float64(dbSize)))
+			e.Bytes = int64(math.Round(mean * float64(dbSize)))
+			e.Low = maxInt64(int64(math.Round(float64(e.Bytes)-margin)), 0)
+			e.High = int64(math.Round(float64(e.Bytes) + margin))
+		}
+		estimates[j] = e
+	}
+	return estimates, nil
+}
+
+// randomKeys returns up to n keys drawn with RANDOMKEY.
+func (d *RedisDatabase) randomKeys(conn redis.Conn, n int) ([]string, error) {
+	for i := 0; i < n; i++ {
+		if err := conn.Send("RANDOMKEY"); err != nil {
+			return nil, fmt.Errorf("error sampling keys: %w", err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("error sampling keys: %w", err)
+	}
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		key, err := redis.String(conn.Receive())
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error sampling keys: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// memoryUsage returns the MEMORY USAGE of every key, -1 for keys that no longer exist.
+func (d *RedisDatabase) memoryUsage(conn redis.Conn, keys []string) ([]int64, error) {
+	for _, key := range keys {
+		if err := conn.Send("MEMORY", "USAGE", key); err != nil {
+			return nil, fmt.Errorf("error reading memory usage: %w", err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("error reading memory usage: %w", err)
+	}
+	sizes := make([]int64, len(keys))
+	for i, key := range keys {
+		size, err := redis.Int64(conn.Receive())
+		if err == redis.ErrNil {
+			size, err = -1, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading memory usage of key %s: %w", key, err)
+		}
+		sizes[i] = size
+	}
+	return sizes, nil
+}
@@ -0,0 +1,322 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandEvent describes one command executed through a RedisDatabase.
+type CommandEvent struct {
+	Command string
+	// Key is the first key of the command after normalization, empty for commands
+	// without keys or when key reporting is disabled.
+	Key     string
+	Elapsed time.Duration
+	Err     error
+	// Sent and Received are the payload bytes of the command and its arguments and of
+	// the reply, without protocol framing.
+	Sent     int
+	Received int
+}
+
+// Metrics receives an event for every command executed through a RedisDatabase.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	ObserveCommand(event CommandEvent)
+}
+
+// WithMetrics reports every command to m.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// WithKeyNormalizer replaces the normalizer applied to keys before they are reported to
+// Metrics. A nil normalizer drops keys from events altogether.
+func WithKeyNormalizer(n *KeyNormalizer) Option {
+	return func(o *options) {
+		o.keyNormalizer = n
+	}
+}
+
+// CommandTotals aggregates the events of one command.
+type CommandTotals struct {
+	Calls   int64         `json:"calls"`
+	Errors  int64         `json:"errors"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+	Max     time.Duration `json:"max_ns"`
+}
+
+// CommandRecorder is a Metrics implementation keeping totals per command in memory, for
+// services without a metrics pipeline and for the Handler's /stats endpoint.
+type CommandRecorder struct {
+	mu       sync.Mutex
+	commands map[string]*CommandTotals
+}
+
+// NewCommandRecorder returns an empty recorder.
+func NewCommandRecorder() *CommandRecorder {
+	return &CommandRecorder{commands: map[string]*CommandTotals{}}
+}
+
+// ObserveCommand implements Metrics.
+func (r *CommandRecorder) ObserveCommand(event CommandEvent) {
+	name := strings.ToUpper(event.Command)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.commands[name]
+	if !ok {
+		t = &CommandTotals{}
+		r.commands[name] = t
+	}
+	t.Calls++
+	if event.Err != nil {
+		t.Errors++
+	}
+	t.Elapsed += event.Elapsed
+	if event.Elapsed > t.Max {
+		t.Max = event.Elapsed
+	}
+}
+
+// Snapshot returns a copy of the totals per command.
+func (r *CommandRecorder) Snapshot() map[string]CommandTotals {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	totals := make(map[string]CommandTotals, len(r.commands))
+	for name, t := range r.commands {
+		totals[name] = *t
+	}
+	return totals
+}
+
+type keyRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// KeyNormalizer bounds the cardinality of keys used as metric labels or span attributes.
+// Rules are applied in order, then keys still longer than MaxLength are replaced by a
+// short hash.
+type KeyNormalizer struct {
+	rules     []keyRule
+	MaxLength int
+}
+
+// NewKeyNormalizer returns a normalizer without rules that hashes keys over maxLength
+// bytes; zero disables hashing.
+func NewKeyNormalizer(maxLength int) *KeyNormalizer {
+	return &KeyNormalizer{MaxLength: maxLength}
+}
+
+// DefaultKeyNormalizer replaces UUIDs, long hex strings and numeric IDs with placeholders
+// and hashes keys longer than 128 bytes.
+func DefaultKeyNormalizer() *KeyNormalizer {
+	return NewKeyNormalizer(128).
+		AddRule(regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`), "{uuid}").
+		AddRule(regexp.MustCompile(`\b[0-9a-fA-F]{16,}\b`), "{hex}").
+		AddRule(regexp.MustCompile(`\b[0-9]+\b`), "{id}")
+}
+
+// AddRule appends a rule replacing every match of pattern with replacement, which may
+// use regexp expansion such as $1.
+func (n *KeyNormalizer) AddRule(pattern *regexp.Regexp, replacement string) *KeyNormalizer {
+	n.rules = append(n.rules, keyRule{pattern: pattern, replacement: replacement})
+	return n
+}
+
+// Normalize applies the rules to key.
+func (n *KeyNormalizer) Normalize(key string) string {
+	if n == nil || key == "" {
+		return ""
+	}
+	for _, rule := range n.rules {
+		key = rule.pattern.ReplaceAllString(key, rule.replacement)
+	}
+	if n.MaxLength > 0 && len(key) > n.MaxLength {
+		sum := sha1.Sum([]byte(key))
+		key = strings.ToValidUTF8(key[:n.MaxLength/2], "") + "...{" + hex.EncodeToString(sum[:4]) + "}"
+	}
+	return key
+}
+
+// commandKey returns the first key of a command, or "" when it has none.
+func commandKey(commandName string, args []interface{}) string {
+	switch strings.ToUpper(commandName) {
+	case "PING", "INFO", "SCAN", "MULTI", "EXEC", "DISCARD", "CLIENT", "CONFIG", "DBSIZE",
+		"PUBLISH", "PUBSUB", "SCRIPT", "MEMORY", "OBJECT", "COMMAND", "MODULE", "RANDOMKEY":
+		return ""
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return ""
+		}
+		if fmt.Sprint(args[1]) == "0" {
+			return ""
+		}
+		return argString(args[2])
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	return argString(args[0])
+}
+
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// do executes a command on conn within the concurrency limits and with the adaptive
+// deadline if configured, applies the response size limits and reports the command to
+// the configured Metrics.
+func (d *RedisDatabase) do(conn redis.Conn, commandName string, args ...interface{}) (interface{}, error) {
+	return d.doContext(context.Background(), conn, commandName, args...)
+}
+
+// doContext is do bounded by ctx. Contexts that can not be canceled, such as
+// context.Background, take the plain Do path.
+func (d *RedisDatabase) doContext(ctx context.Context, conn redis.Conn, commandName string, args ...interface{}) (interface{}, error) {
+	o := d.options()
+
+	release, err := o.acquire(commandName, args)
+	if err != nil {
+		o.observe(commandName, args, nil, 0, err)
+		return nil, err
+	}
+	defer release()
+
+	if err := o.precheckResponseSize(ctx, conn, commandName, args); err != nil {
+		o.observe(commandName, args, nil, 0, err)
+		return nil, err
+	}
+
+	var timeout time.Duration
+	if o.timeouts != nil {
+		timeout = o.timeouts.timeout(commandName)
+	}
+
+	start := time.Now()
+	var reply interface{}
+	if ctx.Done() != nil {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		reply, err = redis.DoContext(conn, ctx, commandName, args...)
+	} else if cwt, ok := conn.(redis.ConnWithTimeout); ok && timeout > 0 {
+		reply, err = cwt.DoWithTimeout(timeout, commandName, args...)
+	} else {
+		reply, err = conn.Do(commandName, args...)
+	}
+	elapsed := time.Since(start)
+	if err == nil && o.timeouts != nil {
+		o.timeouts.observe(commandName, elapsed)
+	}
+	observed := reply
+	if err == nil {
+		if err = o.checkResponseSize(commandName, args, reply); err != nil {
+			reply = nil
+		}
+	}
+
+	o.observe(commandName, args, observed, elapsed, err)
+	return reply, err
+}
+
+func (o *options) observe(commandName string, args []interface{}, reply interface{}, elapsed time.Duration, err error) {
+	if o.metrics == nil && o.usage == nil {
+		return
+	}
+	key := commandKey(commandName, args)
+	sent, received := len(commandName)+argsSize(args), replySize(reply)
+	if o.metrics != nil {
+		o.metrics.ObserveCommand(CommandEvent{
+			Command:  commandName,
+			Key:      o.keyNormalizer.Normalize(key),
+			Elapsed:  elapsed,
+			Err:      err,
+			Sent:     sent,
+			Received: received,
+		})
+	}
+	if o.usage != nil {
+		o.usage.observe(o.clock, key, sent, received)
+	}
+}
+
+func argsSize(args []interface{}) int {
+	size := 0
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			size += len(v)
+		case []byte:
+			size += len(v)
+		default:
+			size += len(fmt.Sprint(v))
+		}
+	}
+	return size
+}
+
+// instrumentedConn routes Do and DoContext through RedisDatabase.do so helpers that take
+// a redis.Conn, such as redis.Script, are measured and guarded like every other command.
+type instrumentedConn struct {
+	redis.Conn
+	d *RedisDatabase
+}
+
+func (c instrumentedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return c.d.do(c.Conn, commandName, args...)
+}
+
+func (c instrumentedConn) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	return c.d.doContext(ctx, c.Conn, commandName, args...)
+}
+
+func (c instrumentedConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
@@ -0,0 +1,190 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMonitorDuration caps every Monitor session.
+const maxMonitorDuration = 10 * time.Minute
+
+// MonitorEvent is one command reported by MONITOR.
+type MonitorEvent struct {
+	Time    time.Time
+	DB      int
+	Client  string
+	Command string
+	Args    []string
+}
+
+// MonitorOptions bounds a Monitor session.
+type MonitorOptions struct {
+	// Duration ends the session, defaults to 30s and is capped at 10 minutes.
+	Duration time.Duration
+	// SampleRate is the fraction of commands passed to the handler, all when zero.
+	SampleRate float64
+	// MaxEvents ends the session after that many handled events, unlimited when zero.
+	MaxEvents int
+	// RedactArgs renders every argument after the first with the redaction policy of
+	// the database, since MONITOR shows values in full.
+	RedactArgs bool
+}
+
+// Monitor streams the commands the server executes to handler as parsed events until
+// the session's Duration elapses, MaxEvents are handled or ctx is done.
+//
+// MONITOR is dangerous: it can cut server throughput in half and exposes every value
+// written by every client. Only use it for short debugging sessions. The session runs on
+// a dedicated connection that is closed when it ends. Monitor returns nil when the
+// session ends by its own limits and ctx.Err() when ctx ends it.
+func (d *RedisDatabase) Monitor(ctx context.Context, opts MonitorOptions, handler func(event MonitorEvent)) error {
+	if opts.Duration <= 0 {
+		opts.Duration = 30 * time.Second
+	}
+	if opts.Duration > maxMonitorDuration {
+		opts.Duration = maxMonitorDuration
+	}
+	session, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	conn, err := d.redisPool.DialContext(session)
+	if err != nil {
+		return fmt.Errorf("error starting monitor: %w", err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close monitor: %v", err)
+		}
+	}(conn)
+
+	if _, err := redis.String(d.do(conn, "MONITOR")); err != nil {
+		return fmt.Errorf("error starting monitor: %w", err)
+	}
+
+	o := d.options()
+	handled := 0
+	for {
+		line, err := redis.String(redis.ReceiveContext(conn, session))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if session.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error reading monitor: %w", err)
+		}
+		if opts.SampleRate > 0 && opts.SampleRate < 1 && rand.Float64() >= opts.SampleRate {
+			continue
+		}
+
+		event, err := parseMonitorLine(line)
+		if err != nil {
+			continue
+		}
+		if opts.RedactArgs {
+			for i := 1; i < len(event.Args); i++ {
+				event.Args[i] = o.redact([]byte(event.Args[i]))
+			}
+		}
+		_ = o.call("monitor handler", func() error {
+			handler(event)
+			return nil
+		})
+
+		handled++
+		if opts.MaxEvents > 0 && handled >= opts.MaxEvents {
+			return nil
+		}
+	}
+}
+
+// parseMonitorLine parses lines such as:
+//
+//	1339518083.107412 [0 127.0.0.1:60866] "set" "key" "value"
+func parseMonitorLine(line string) (MonitorEvent, error) {
+	var event MonitorEvent
+	open := strings.IndexByte(line, '[')
+	end := strings.IndexByte(line, ']')
+	if open < 0 || end < open {
+		return event, fmt.Errorf("unexpected monitor line '%s'", line)
+	}
+
+	ts, err := strconv.ParseFloat(strings.TrimSpace(line[:open]), 64)
+	if err != nil {
+		return event, fmt.Errorf("unexpected monitor line '%s'", line)
+	}
+	sec := int64(ts)
+	event.Time = time.Unix(sec, int64((ts-float64(sec))*1e9))
+
+	origin := strings.Fields(line[open+1 : end])
+	if len(origin) > 0 {
+		event.DB, _ = strconv.Atoi(origin[0])
+	}
+	if len(origin) > 1 {
+		event.Client = origin[1]
+	}
+
+	rest := line[end+1:]
+	var parts []string
+	for {
+		start := strings.IndexByte(rest, '"')
+		if start < 0 {
+			break
+		}
+		i := start + 1
+		for i < len(rest) && rest[i] != '"' {
+			if rest[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(rest) {
+			return event, fmt.Errorf("unterminated argument in monitor line '%s'", line)
+		}
+		part, err := strconv.Unquote(rest[start : i+1])
+		if err != nil {
+			part = rest[start+1 : i]
+		}
+		parts = append(parts, part)
+		rest = rest[i+1:]
+	}
+	if len(parts) == 0 {
+		return event, fmt.Errorf("monitor line without command '%s'", line)
+	}
+	event.Command = strings.ToUpper(parts[0])
+	event.Args = parts[1:]
+	return event, nil
+}
@@ -0,0 +1,125 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// Option configures the pool and the RedisDatabase handle built by the Setup functions,
+// NewRedisDatabase and the profile loader. Pools returned by SetupDatabase and
+// Profiles.Setup remember their options, so GetDatabase applies handle options such as
+// WithMetrics or WithFieldEncryption as well.
+type Option func(*options)
+
+type options struct {
+	dialOptions []redis.DialOption
+	auth        AuthFunc
+	resolver    *EndpointResolver
+	hooks       ConnectionHooks
+	clientName  string
+	libName     string
+	libVersion  string
+	connectMode ConnectMode
+
+	metrics       Metrics
+	keyNormalizer *KeyNormalizer
+
+	maxResponseSize       int
+	commandResponseLimits map[string]int
+
+	redaction RedactionPolicy
+
+	timeouts *adaptiveTimeouts
+
+	minIdle            int
+	maxConnLifetime    time.Duration
+	connLifetimeJitter time.Duration
+
+	limiters []*concurrencyLimiter
+
+	residency       residencyPolicy
+	fieldEncryption []fieldEncryptionRule
+
+	clock  Clock
+	logger Logger
+
+	usage *UsageAccountant
+
+	pool           poolConfig
+	connectTimeout time.Duration
+	useTLS         bool
+
+	sentinelDialOptions []redis.DialOption
+	ownsResolver        bool
+	cluster             *cluster
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		libName:    LibraryName,
+		libVersion: LibraryVersion,
+
+		keyNormalizer: DefaultKeyNormalizer(),
+		clock:         SystemClock,
+		logger:        stdoutLogger{},
+
+		pool:           defaultPoolConfig(),
+		connectTimeout: defaultConnectTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithDialOptions appends redigo dial options that are applied to every new connection.
+func WithDialOptions(dialOptions ...redis.DialOption) Option {
+	return func(o *options) {
+		o.dialOptions = append(o.dialOptions, dialOptions...)
+	}
+}
+
+// ConnectMode selects when a new pool first talks to the server.
+type ConnectMode int
+
+const (
+	// ConnectLazy dials on first use; a bad URL or unreachable server surfaces as a
+	// command error.
+	ConnectLazy ConnectMode = iota
+	// ConnectEager dials and PINGs while setting up, so misconfiguration fails at boot.
+	ConnectEager
+)
+
+// WithConnectMode selects lazy (default) or eager connection validation at setup.
+// SetupDatabase can not report errors and always connects lazily.
+func WithConnectMode(mode ConnectMode) Option {
+	return func(o *options) {
+		o.connectMode = mode
+	}
+}
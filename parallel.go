@@ -0,0 +1,95 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/sync/errgroup"
+	"sync"
+)
+
+// fetchChunkSize is the number of keys one worker reads per pipeline.
+const fetchChunkSize = 100
+
+// FetchParallel reads keys on up to workers goroutines, each pipelining GETs on its own
+// connection, and calls fn for every key that exists. fn may be called concurrently. An
+// error returned by fn cancels the remaining work and is returned as is; keys that could
+// not be read do not stop the others and are returned joined into one error. Keys that
+// do not exist are skipped.
+func (d *RedisDatabase) FetchParallel(ctx context.Context, keys []string, workers int, fn func(key string, value []byte) error) error {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
+
+	var mu sync.Mutex
+	var fetchErrs []error
+	for start := 0; start < len(keys); start += fetchChunkSize {
+		end := start + fetchChunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		chunk := keys[start:end]
+
+		if ctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			result := d.GetMultiPartial(chunk)
+			if len(result.Errors) > 0 {
+				mu.Lock()
+				for _, key := range chunk {
+					if err, ok := result.Errors[key]; ok {
+						fetchErrs = append(fetchErrs, err)
+					}
+				}
+				mu.Unlock()
+			}
+			for _, key := range chunk {
+				if value, ok := result.Found[key]; ok {
+					err := d.options().call("fetch callback", func() error {
+						return fn(key, value)
+					})
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return errors.Join(fetchErrs...)
+}
@@ -0,0 +1,242 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PinnerOptions configures a Pinner. Zero values select the defaults in brackets.
+type PinnerOptions struct {
+	// Interval between refresh passes [10s].
+	Interval time.Duration
+	// OnRestore is called with every key the Pinner restored after it disappeared.
+	OnRestore func(key string)
+	// OnError receives errors of background passes and may be nil.
+	OnError func(err error)
+}
+
+type pinnedKey struct {
+	dump    []byte
+	expires time.Time
+}
+
+// Pinner keeps critical keys such as configuration from being lost to eviction. Every
+// pass it TOUCHes the pinned keys, so LRU and LFU policies see them as hot, and keeps a
+// DUMP of each. A pinned key that disappeared before its own expiry is taken as evicted
+// and restored from the last dump, with its remaining TTL. Unpin a key before deleting
+// it on purpose, or the Pinner brings it back.
+type Pinner struct {
+	d    *RedisDatabase
+	opts PinnerOptions
+
+	mu   sync.Mutex
+	keys map[string]*pinnedKey
+
+	stop func()
+}
+
+// NewPinner creates a Pinner for d that refreshes once started.
+func NewPinner(d *RedisDatabase, opts PinnerOptions) *Pinner {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	return &Pinner{d: d, opts: opts, keys: map[string]*pinnedKey{}}
+}
+
+// Pin adds key and takes its first dump right away.
+func (p *Pinner) Pin(keys ...string) error {
+	p.mu.Lock()
+	for _, key := range keys {
+		if _, ok := p.keys[key]; !ok {
+			p.keys[key] = &pinnedKey{}
+		}
+	}
+	p.mu.Unlock()
+	return p.refresh(keys)
+}
+
+// Unpin stops refreshing key.
+func (p *Pinner) Unpin(keys ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		delete(p.keys, key)
+	}
+}
+
+// Pinned returns the pinned keys.
+func (p *Pinner) Pinned() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]string, 0, len(p.keys))
+	for key := range p.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Start refreshes every Interval until Close or Stop.
+func (p *Pinner) Start() {
+	p.stop = startLoop(p.d.options().clock.NewTicker(p.opts.Interval), func() {
+		if err := p.Refresh(); err != nil && p.opts.OnError != nil {
+			_ = p.d.options().call("pinner error callback", func() error {
+				p.opts.OnError(err)
+				return nil
+			})
+		}
+	})
+}
+
+// Close stops refreshing.
+func (p *Pinner) Close() {
+	_ = p.Stop(context.Background())
+}
+
+// Stop stops refreshing, waiting for a pass in progress until ctx is done.
+func (p *Pinner) Stop(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	stop := p.stop
+	p.stop = nil
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+	return waitDone(ctx, done)
+}
+
+// Refresh touches and dumps every pinned key now, restoring the evicted ones.
+func (p *Pinner) Refresh() error {
+	return p.refresh(p.Pinned())
+}
+
+func (p *Pinner) refresh(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	conn := p.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close refreshing pinned keys: %v", err)
+		}
+	}(conn)
+
+	for _, key := range keys {
+		if err := conn.Send("TOUCH", key); err != nil {
+			return fmt.Errorf("error refreshing pinned keys: %w", err)
+		}
+		if err := conn.Send("DUMP", key); err != nil {
+			return fmt.Errorf("error refreshing pinned keys: %w", err)
+		}
+		if err := conn.Send("PTTL", key); err != nil {
+			return fmt.Errorf("error refreshing pinned keys: %w", err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("error refreshing pinned keys: %w", err)
+	}
+
+	now := p.d.options().clock.Now()
+	var evicted []string
+	for _, key := range keys {
+		_, _ = conn.Receive()
+		dump, dumpErr := redis.Bytes(conn.Receive())
+		ttl, ttlErr := redis.Int64(conn.Receive())
+		if dumpErr != nil && dumpErr != redis.ErrNil {
+			return fmt.Errorf("error dumping pinned key %s: %w", key, dumpErr)
+		}
+		if ttlErr != nil {
+			return fmt.Errorf("error reading ttl of pinned key %s: %w", key, ttlErr)
+		}
+
+		p.mu.Lock()
+		pinned, ok := p.keys[key]
+		if ok && dumpErr == nil {
+			pinned.dump = dump
+			pinned.expires = time.Time{}
+			if ttl > 0 {
+				pinned.expires = now.Add(time.Duration(ttl) * time.Millisecond)
+			}
+		} else if ok && pinned.dump != nil && (pinned.expires.IsZero() || now.Before(pinned.expires)) {
+			evicted = append(evicted, key)
+		}
+		p.mu.Unlock()
+	}
+
+	for _, key := range evicted {
+		if err := p.restore(conn, key, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pinner) restore(conn redis.Conn, key string, now time.Time) error {
+	p.mu.Lock()
+	pinned, ok := p.keys[key]
+	if !ok {
+		p.mu.Unlock()
+		return nil
+	}
+	dump := pinned.dump
+	var ttl int64
+	if !pinned.expires.IsZero() {
+		ttl = maxInt64(pinned.expires.Sub(now).Milliseconds(), 1)
+	}
+	p.mu.Unlock()
+
+	// without REPLACE a key written again since the DUMP wins
+	_, err := p.d.do(conn, "RESTORE", key, ttl, dump)
+	if err != nil && ServerErrorCode(err) != "BUSYKEY" {
+		return fmt.Errorf("error restoring pinned key %s: %w", key, err)
+	}
+	if err == nil && p.opts.OnRestore != nil {
+		_ = p.d.options().call("pinner restore callback", func() error {
+			p.opts.OnRestore(key)
+			return nil
+		})
+	}
+	return nil
+}
+
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,179 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+type pipelineCommand struct {
+	name string
+	args []interface{}
+}
+
+// PipelineResult is the reply to one command of a Pipeline.
+type PipelineResult struct {
+	Command string
+	Key     string
+	Reply   interface{}
+	Err     error
+}
+
+// Pipeline buffers commands and sends them on one connection in a single round trip,
+// avoiding a pool checkout and a round trip per command. A Pipeline is not safe for
+// concurrent use.
+type Pipeline struct {
+	d        *RedisDatabase
+	commands []pipelineCommand
+}
+
+// Pipeline returns an empty Pipeline on d.
+func (d *RedisDatabase) Pipeline() *Pipeline {
+	return &Pipeline{d: d}
+}
+
+// Do queues an arbitrary command.
+func (p *Pipeline) Do(commandName string, args ...interface{}) {
+	p.commands = append(p.commands, pipelineCommand{name: commandName, args: args})
+}
+
+// Set queues a SET of key.
+func (p *Pipeline) Set(key string, value []byte) {
+	p.Do("SET", key, value)
+}
+
+// SetWithTTL queues a SET of key expiring after ttl.
+func (p *Pipeline) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	p.Do("SET", key, value, "PX", ttl.Milliseconds())
+}
+
+// HSet queues a HSET of field in the hash at key.
+func (p *Pipeline) HSet(key string, field string, value []byte) {
+	p.Do("HSET", key, field, value)
+}
+
+// Delete queues a DEL of key.
+func (p *Pipeline) Delete(key string) {
+	p.Do("DEL", key)
+}
+
+// Expire queues a PEXPIRE of key.
+func (p *Pipeline) Expire(key string, ttl time.Duration) {
+	p.Do("PEXPIRE", key, ttl.Milliseconds())
+}
+
+// Incr queues an INCR of key.
+func (p *Pipeline) Incr(key string) {
+	p.Do("INCR", key)
+}
+
+// Len returns the number of queued commands.
+func (p *Pipeline) Len() int {
+	return len(p.commands)
+}
+
+// Exec sends the queued commands and returns their results in the order they were
+// queued. Commands rejected by the server only fail their own result; the error reports
+// connection failures, in which case the results of commands without a reply carry it
+// too. A write breaking a WithResidency rule fails the whole batch before anything is
+// sent. The Pipeline is empty and reusable afterwards.
+func (p *Pipeline) Exec() ([]PipelineResult, error) {
+	return p.ExecContext(context.Background())
+}
+
+// ExecContext is Exec bounded by ctx.
+func (p *Pipeline) ExecContext(ctx context.Context) ([]PipelineResult, error) {
+	commands := p.commands
+	p.commands = nil
+	if len(commands) == 0 {
+		return nil, nil
+	}
+
+	results := make([]PipelineResult, len(commands))
+	for i, c := range commands {
+		results[i] = PipelineResult{Command: c.name, Key: commandKey(c.name, c.args)}
+	}
+	failed := func(from int, err error) ([]PipelineResult, error) {
+		err = fmt.Errorf("error executing pipeline of %d commands: %w", len(commands), err)
+		for i := from; i < len(results); i++ {
+			results[i].Err = err
+		}
+		return results, err
+	}
+
+	o := p.d.options()
+	for _, c := range commands {
+		// reject the whole batch, the commands before a rejected one would still be sent
+		if err := o.residency.check(c.name, c.args); err != nil {
+			o.observe(c.name, c.args, nil, 0, err)
+			return failed(0, err)
+		}
+	}
+
+	conn, err := p.d.redisPool.GetContext(ctx)
+	if err != nil {
+		return failed(0, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close pipeline: %v", err)
+		}
+	}(conn)
+
+	start := time.Now()
+	for _, c := range commands {
+		if err := conn.Send(c.name, c.args...); err != nil {
+			return failed(0, err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return failed(0, err)
+	}
+
+	for i, c := range commands {
+		reply, err := redis.ReceiveContext(conn, ctx)
+		if err != nil && conn.Err() != nil {
+			// the connection is broken, no further replies will arrive
+			o.observe(c.name, c.args, nil, time.Since(start), err)
+			return failed(i, err)
+		}
+		if err == nil {
+			err = o.checkResponseSize(c.name, c.args, reply)
+		}
+		o.observe(c.name, c.args, reply, time.Since(start), err)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Reply = reply
+	}
+	return results, nil
+}
@@ -0,0 +1,271 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io"
+)
+
+// prefixRecord is a line written by SnapshotPrefix. Values are base64 in JSON, so binary
+// values survive the round trip.
+type prefixRecord struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// ExpiresAt is the expiry as a Unix time in milliseconds, 0 for keys without expiry.
+	ExpiresAt int64             `json:"expires_at,omitempty"`
+	String    []byte            `json:"string,omitempty"`
+	Hash      map[string][]byte `json:"hash,omitempty"`
+	List      [][]byte          `json:"list,omitempty"`
+	Set       [][]byte          `json:"set,omitempty"`
+	ZSet      []prefixZMember   `json:"zset,omitempty"`
+}
+
+type prefixZMember struct {
+	Member []byte  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// SnapshotPrefix writes every string, hash, list, set and sorted set key under prefix to w
+// as JSON lines with its type and expiry, and returns the number of keys written. Unlike
+// DUMP payloads the output does not depend on the server version, so RestorePrefix can
+// rebuild the keys on any server, for example in disaster recovery drills. Keys of other
+// types are skipped. Every collection is read in one reply, so very large keys should be
+// snapshotted by other means.
+func (d *RedisDatabase) SnapshotPrefix(prefix string, w io.Writer) (int, error) {
+	keys, err := d.GetKeys(prefix + "*")
+	if err != nil {
+		return 0, fmt.Errorf("error snapshotting '%s' keys: %w", prefix, err)
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close snapshotting '%s' keys: %v", prefix, err)
+		}
+	}(conn)
+
+	out := json.NewEncoder(w)
+	written := 0
+	for start := 0; start < len(keys); start += hydrateBatchSize {
+		end := start + hydrateBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		records, err := d.snapshotBatch(conn, keys[start:end])
+		if err != nil {
+			return written, err
+		}
+		for _, r := range records {
+			if err := out.Encode(r); err != nil {
+				return written, err
+			}
+			written++
+		}
+	}
+	return written, nil
+}
+
+func (d *RedisDatabase) snapshotBatch(conn redis.Conn, keys []string) ([]prefixRecord, error) {
+	now := d.options().clock.Now().UnixMilli()
+	for _, key := range keys {
+		if err := conn.Send("TYPE", key); err != nil {
+			return nil, err
+		}
+		if err := conn.Send("PTTL", key); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("error snapshotting keys: %w", err)
+	}
+
+	var records []prefixRecord
+	for _, key := range keys {
+		keyType, err := redis.String(conn.Receive())
+		if err != nil {
+			return nil, fmt.Errorf("error snapshotting key %s: %w", key, err)
+		}
+		ttl, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return nil, fmt.Errorf("error snapshotting key %s: %w", key, err)
+		}
+		r := prefixRecord{Key: key, Type: keyType}
+		if ttl > 0 {
+			r.ExpiresAt = now + ttl
+		}
+		switch keyType {
+		case "string", "hash", "list", "set", "zset":
+			records = append(records, r)
+		}
+	}
+
+	for _, r := range records {
+		var err error
+		switch r.Type {
+		case "string":
+			err = conn.Send("GET", r.Key)
+		case "hash":
+			err = conn.Send("HGETALL", r.Key)
+		case "list":
+			err = conn.Send("LRANGE", r.Key, 0, -1)
+		case "set":
+			err = conn.Send("SMEMBERS", r.Key)
+		case "zset":
+			err = conn.Send("ZRANGE", r.Key, 0, -1, "WITHSCORES")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("error snapshotting keys: %w", err)
+	}
+
+	snapshotted := records[:0]
+	for _, r := range records {
+		reply, err := conn.Receive()
+		if err != nil {
+			return nil, fmt.Errorf("error snapshotting key %s: %w", r.Key, err)
+		}
+		if reply == nil {
+			// expired between TYPE and the read
+			continue
+		}
+		switch r.Type {
+		case "string":
+			r.String, err = redis.Bytes(reply, nil)
+		case "hash":
+			var values [][]byte
+			values, err = redis.ByteSlices(reply, nil)
+			r.Hash = make(map[string][]byte, len(values)/2)
+			for i := 0; i+1 < len(values); i += 2 {
+				r.Hash[string(values[i])] = values[i+1]
+			}
+		case "list":
+			r.List, err = redis.ByteSlices(reply, nil)
+		case "set":
+			r.Set, err = redis.ByteSlices(reply, nil)
+		case "zset":
+			var values [][]byte
+			values, err = redis.ByteSlices(reply, nil)
+			for i := 0; err == nil && i+1 < len(values); i += 2 {
+				var score float64
+				score, err = redis.Float64(values[i+1], nil)
+				r.ZSet = append(r.ZSet, prefixZMember{Member: values[i], Score: score})
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error snapshotting key %s: %w", r.Key, err)
+		}
+		snapshotted = append(snapshotted, r)
+	}
+	return snapshotted, nil
+}
+
+// RestorePrefix recreates the keys written by SnapshotPrefix, replacing existing keys of
+// the same name, and returns the number of keys restored. Keys whose expiry passed since
+// the snapshot are skipped, the others keep their original expiry time.
+func (d *RedisDatabase) RestorePrefix(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 512*1024*1024)
+	now := d.options().clock.Now().UnixMilli()
+
+	p := d.Pipeline()
+	restored, pending, line := 0, 0, 0
+	exec := func() error {
+		results, err := p.Exec()
+		if err != nil {
+			return fmt.Errorf("error restoring keys: %w", err)
+		}
+		for _, result := range results {
+			if result.Err != nil {
+				return fmt.Errorf("error restoring key %s: %w", result.Key, result.Err)
+			}
+		}
+		restored += pending
+		pending = 0
+		return nil
+	}
+
+	for scanner.Scan() {
+		line++
+		var rec prefixRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return restored, fmt.Errorf("error parsing line %d: %w", line, err)
+		}
+		if rec.ExpiresAt > 0 && rec.ExpiresAt <= now {
+			continue
+		}
+
+		p.Delete(rec.Key)
+		switch rec.Type {
+		case "string":
+			p.Set(rec.Key, rec.String)
+		case "hash":
+			if len(rec.Hash) > 0 {
+				p.Do("HSET", redis.Args{rec.Key}.AddFlat(rec.Hash)...)
+			}
+		case "list":
+			if len(rec.List) > 0 {
+				p.Do("RPUSH", redis.Args{rec.Key}.AddFlat(rec.List)...)
+			}
+		case "set":
+			if len(rec.Set) > 0 {
+				p.Do("SADD", redis.Args{rec.Key}.AddFlat(rec.Set)...)
+			}
+		case "zset":
+			args := redis.Args{rec.Key}
+			for _, m := range rec.ZSet {
+				args = args.Add(m.Score, m.Member)
+			}
+			if len(rec.ZSet) > 0 {
+				p.Do("ZADD", args...)
+			}
+		default:
+			return restored, fmt.Errorf("redis: unknown type %s of key %s on line %d", rec.Type, rec.Key, line)
+		}
+		if rec.ExpiresAt > 0 {
+			p.Do("PEXPIREAT", rec.Key, rec.ExpiresAt)
+		}
+		pending++
+
+		if p.Len() >= hydrateBatchSize {
+			if err := exec(); err != nil {
+				return restored, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return restored, err
+	}
+	return restored, exec()
+}
@@ -0,0 +1,220 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Profile is a named connection configuration such as "dev", "staging" or "prod".
+// The URL may reference environment variables as $VAR or ${VAR}; they are expanded
+// when the profile is opened, as are the passwords. Profiles with a sentinel master
+// connect through SetupSentinel and ignore the URL; the sentinels are dialed with the
+// sentinel credentials and the TLS settings of the profile.
+type Profile struct {
+	Name           string   `json:"name"`
+	URL            string   `json:"url"`
+	Username       string   `json:"username,omitempty"`
+	Password       string   `json:"password,omitempty"`
+	TLS            bool     `json:"tls,omitempty"`
+	TLSSkipVerify  bool     `json:"tls_skip_verify,omitempty"`
+	TLSCAFile      string   `json:"tls_ca_file,omitempty"`
+	TLSCertFile    string   `json:"tls_cert_file,omitempty"`
+	TLSKeyFile     string   `json:"tls_key_file,omitempty"`
+	TLSServerName  string   `json:"tls_server_name,omitempty"`
+	SentinelMaster string   `json:"sentinel_master,omitempty"`
+	SentinelAddrs  []string `json:"sentinel_addrs,omitempty"`
+	// SentinelUsername and SentinelPassword authenticate to the sentinels, which do not
+	// share the credentials of the master.
+	SentinelUsername string `json:"sentinel_username,omitempty"`
+	SentinelPassword string `json:"sentinel_password,omitempty"`
+}
+
+// Profiles is a set of connection profiles keyed by name.
+type Profiles map[string]Profile
+
+// LoadProfilesFile reads profiles from a JSON file holding an object keyed by profile name.
+// noinspection GoUnusedExportedFunction
+func LoadProfilesFile(path string) (Profiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading profiles %s: %w", path, err)
+	}
+
+	var profiles Profiles
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("error parsing profiles %s: %w", path, err)
+	}
+	for name, p := range profiles {
+		p.Name = name
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+// LoadProfilesFromEnv builds profiles from environment variables of the form
+// <prefix>_<NAME>_URL, with optional _USERNAME, _PASSWORD, _TLS, _TLS_SKIP_VERIFY,
+// _TLS_CA_FILE, _TLS_CERT_FILE, _TLS_KEY_FILE, _TLS_SERVER_NAME, _SENTINEL_MASTER,
+// _SENTINEL_ADDRS (comma separated), _SENTINEL_USERNAME and _SENTINEL_PASSWORD siblings.
+// Profile names are lower cased, so REDISDB_PROD_URL defines the "prod" profile.
+// noinspection GoUnusedExportedFunction
+func LoadProfilesFromEnv(prefix string) (Profiles, error) {
+	profiles := Profiles{}
+	for _, kv := range os.Environ() {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if !strings.HasPrefix(key, prefix+"_") || !strings.HasSuffix(key, "_URL") {
+			continue
+		}
+		envName := strings.TrimSuffix(strings.TrimPrefix(key, prefix+"_"), "_URL")
+		if envName == "" {
+			continue
+		}
+
+		base := prefix + "_" + envName + "_"
+		p := Profile{
+			Name:           strings.ToLower(envName),
+			URL:            os.Getenv(key),
+			Username:       os.Getenv(base + "USERNAME"),
+			Password:       os.Getenv(base + "PASSWORD"),
+			TLSCAFile:      os.Getenv(base + "TLS_CA_FILE"),
+			TLSCertFile:    os.Getenv(base + "TLS_CERT_FILE"),
+			TLSKeyFile:     os.Getenv(base + "TLS_KEY_FILE"),
+			TLSServerName:  os.Getenv(base + "TLS_SERVER_NAME"),
+			SentinelMaster: os.Getenv(base + "SENTINEL_MASTER"),
+
+			SentinelUsername: os.Getenv(base + "SENTINEL_USERNAME"),
+			SentinelPassword: os.Getenv(base + "SENTINEL_PASSWORD"),
+		}
+
+		var err error
+		if p.TLS, err = envBool(base + "TLS"); err != nil {
+			return nil, err
+		}
+		if p.TLSSkipVerify, err = envBool(base + "TLS_SKIP_VERIFY"); err != nil {
+			return nil, err
+		}
+		if addrs := os.Getenv(base + "SENTINEL_ADDRS"); addrs != "" {
+			for _, addr := range strings.Split(addrs, ",") {
+				p.SentinelAddrs = append(p.SentinelAddrs, strings.TrimSpace(addr))
+			}
+		}
+		profiles[p.Name] = p
+	}
+	return profiles, nil
+}
+
+func envBool(key string) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("error parsing %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// Setup creates a pool for the named profile, the profile equivalent of SetupDatabase.
+// GetDatabase on the pool applies the options of the profile and opts.
+func (p Profiles) Setup(name string, opts ...Option) (*redis.Pool, error) {
+	d, err := p.Open(name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	poolOptions.Store(d.redisPool, d.options())
+	return d.redisPool, nil
+}
+
+// Open creates a RedisDatabase for the named profile. Options are applied after the
+// ones derived from the profile.
+func (p Profiles) Open(name string, opts ...Option) (*RedisDatabase, error) {
+	profile, ok := p[name]
+	if !ok {
+		return nil, fmt.Errorf("redis: unknown profile '%s'", name)
+	}
+
+	url, profileOpts, err := profile.options()
+	if err != nil {
+		return nil, err
+	}
+	if profile.SentinelMaster != "" {
+		return SetupSentinel(profile.SentinelMaster, profile.SentinelAddrs, append(profileOpts, opts...)...)
+	}
+	return openDatabase(url, append(profileOpts, opts...)...)
+}
+
+func (p Profile) options() (string, []Option, error) {
+	if (p.SentinelMaster == "") != (len(p.SentinelAddrs) == 0) {
+		return "", nil, fmt.Errorf("redis: profile '%s' needs both a sentinel master and sentinel addresses", p.Name)
+	}
+
+	url := os.ExpandEnv(p.URL)
+	if url == "" && p.SentinelMaster == "" {
+		return "", nil, fmt.Errorf("redis: profile '%s' has no url", p.Name)
+	}
+
+	opts := []Option{WithCredentials(Credentials{
+		Username: os.ExpandEnv(p.Username),
+		Password: os.ExpandEnv(p.Password),
+	})}
+	t := TLSOptions{
+		CAFile:             p.TLSCAFile,
+		CertFile:           p.TLSCertFile,
+		KeyFile:            p.TLSKeyFile,
+		ServerName:         p.TLSServerName,
+		InsecureSkipVerify: p.TLSSkipVerify,
+	}
+	if (p.TLSCertFile == "") != (p.TLSKeyFile == "") {
+		return "", nil, fmt.Errorf("redis: profile '%s' needs both a tls cert file and key file", p.Name)
+	}
+
+	var sentinelDialOptions []redis.DialOption
+	if p.SentinelUsername != "" {
+		sentinelDialOptions = append(sentinelDialOptions, redis.DialUsername(os.ExpandEnv(p.SentinelUsername)))
+	}
+	if p.SentinelPassword != "" {
+		sentinelDialOptions = append(sentinelDialOptions, redis.DialPassword(os.ExpandEnv(p.SentinelPassword)))
+	}
+	if p.TLS || p.TLSSkipVerify || p.TLSCAFile != "" || p.TLSCertFile != "" || p.TLSKeyFile != "" || p.TLSServerName != "" {
+		config, err := t.Config()
+		if err != nil {
+			return "", nil, fmt.Errorf("error configuring TLS for profile '%s': %w", p.Name, err)
+		}
+		opts = append(opts, WithTLS(config))
+		sentinelDialOptions = append(sentinelDialOptions, redis.DialUseTLS(true), redis.DialTLSConfig(config))
+	}
+	if p.SentinelMaster != "" && len(sentinelDialOptions) > 0 {
+		opts = append(opts, WithSentinelDialOptions(sentinelDialOptions...))
+	}
+	return url, opts, nil
+}
@@ -0,0 +1,264 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// progressAdvanceScript adds ARGV[1] to the done count of the job hash KEYS[1], stamps it
+// with ARGV[2] and resets its TTL to ARGV[3] milliseconds. It returns total, done and
+// started, or nil when the job does not exist.
+var progressAdvanceScript = redis.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return nil
+end
+local done = redis.call('HINCRBY', KEYS[1], 'done', ARGV[1])
+redis.call('HSET', KEYS[1], 'updated', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {tonumber(redis.call('HGET', KEYS[1], 'total')), done, tonumber(redis.call('HGET', KEYS[1], 'started'))}`)
+
+// ProgressTrackerOptions configures a ProgressTracker. Zero values select the defaults in
+// brackets.
+type ProgressTrackerOptions struct {
+	// Prefix is prepended to the job id to form the key ["progress:"].
+	Prefix string
+	// TTL removes a job this long after its last update [24h].
+	TTL time.Duration
+	// Channel receives a ProgressStatus as JSON on every update ["progress:events"].
+	Channel string
+}
+
+// ProgressStatus is the progress of a job.
+type ProgressStatus struct {
+	JobID   string    `json:"job_id"`
+	Total   int64     `json:"total"`
+	Done    int64     `json:"done"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+	// ETA is the estimated time from Updated to completion at the average rate so far,
+	// zero before the first progress and once finished.
+	ETA time.Duration `json:"eta"`
+}
+
+// Fraction is the share of the job that is done, between 0 and 1.
+func (s ProgressStatus) Fraction() float64 {
+	if s.Total <= 0 {
+		return 0
+	}
+	if s.Done >= s.Total {
+		return 1
+	}
+	return float64(s.Done) / float64(s.Total)
+}
+
+// Finished reports whether all work is done.
+func (s ProgressStatus) Finished() bool {
+	return s.Total > 0 && s.Done >= s.Total
+}
+
+func (s *ProgressStatus) estimate() {
+	s.ETA = 0
+	elapsed := s.Updated.Sub(s.Started)
+	if s.Done <= 0 || s.Finished() || elapsed <= 0 {
+		return
+	}
+	s.ETA = time.Duration(float64(elapsed) / float64(s.Done) * float64(s.Total-s.Done))
+}
+
+// ProgressTracker records the progress of long running jobs, such as imports, for
+// progress bars in other processes. Every update is published, so a UI can follow jobs
+// with Subscribe instead of polling Status. Jobs expire TTL after their last update.
+type ProgressTracker struct {
+	d    *RedisDatabase
+	opts ProgressTrackerOptions
+}
+
+// NewProgressTracker creates a tracker on d.
+func NewProgressTracker(d *RedisDatabase, opts ProgressTrackerOptions) *ProgressTracker {
+	if opts.Prefix == "" {
+		opts.Prefix = "progress:"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	if opts.Channel == "" {
+		opts.Channel = "progress:events"
+	}
+	return &ProgressTracker{d: d, opts: opts}
+}
+
+// Init starts tracking jobID with total units of work, restarting it when it exists.
+func (t *ProgressTracker) Init(jobID string, total int64) (ProgressStatus, error) {
+	now := t.d.options().clock.Now()
+	status := ProgressStatus{JobID: jobID, Total: total, Started: now, Updated: now}
+
+	conn := t.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close initializing job %s: %v", jobID, err)
+		}
+	}(conn)
+
+	key := t.opts.Prefix + jobID
+	if err := conn.Send("MULTI"); err != nil {
+		return status, fmt.Errorf("error initializing job %s: %w", jobID, err)
+	}
+	if err := conn.Send("DEL", key); err != nil {
+		return status, fmt.Errorf("error initializing job %s: %w", jobID, err)
+	}
+	if err := conn.Send("HSET", key, "total", total, "done", 0, "started", now.UnixMilli(), "updated", now.UnixMilli()); err != nil {
+		return status, fmt.Errorf("error initializing job %s: %w", jobID, err)
+	}
+	if err := conn.Send("PEXPIRE", key, t.opts.TTL.Milliseconds()); err != nil {
+		return status, fmt.Errorf("error initializing job %s: %w", jobID, err)
+	}
+	if _, err := t.d.do(conn, "EXEC"); err != nil {
+		return status, fmt.Errorf("error initializing job %s: %w", jobID, err)
+	}
+	return status, t.publish(conn, status)
+}
+
+// Advance adds n units of done work to jobID, failing with ErrKeyNotFound when the job
+// was not initialized or expired.
+func (t *ProgressTracker) Advance(jobID string, n int64) (ProgressStatus, error) {
+	now := t.d.options().clock.Now()
+	status := ProgressStatus{JobID: jobID, Updated: now}
+
+	conn := t.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close advancing job %s: %v", jobID, err)
+		}
+	}(conn)
+
+	values, err := redis.Int64s(progressAdvanceScript.Do(instrumentedConn{conn, t.d}, t.opts.Prefix+jobID, n, now.UnixMilli(), t.opts.TTL.Milliseconds()))
+	if err == redis.ErrNil {
+		return status, fmt.Errorf("error advancing job %s: %w", jobID, ErrKeyNotFound)
+	}
+	if err != nil {
+		return status, fmt.Errorf("error advancing job %s: %w", jobID, err)
+	}
+	status.Total, status.Done, status.Started = values[0], values[1], time.UnixMilli(values[2])
+	status.estimate()
+	return status, t.publish(conn, status)
+}
+
+func (t *ProgressTracker) publish(conn redis.Conn, status ProgressStatus) error {
+	event, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if _, err := t.d.do(conn, "PUBLISH", t.opts.Channel, event); err != nil {
+		return fmt.Errorf("error publishing progress of job %s: %w", status.JobID, err)
+	}
+	return nil
+}
+
+// Status returns the progress of jobID, failing with ErrKeyNotFound when the job was not
+// initialized or expired.
+func (t *ProgressTracker) Status(jobID string) (ProgressStatus, error) {
+	status := ProgressStatus{JobID: jobID}
+	values, missing, err := t.d.HMGetFields(t.opts.Prefix+jobID, "total", "done", "started", "updated")
+	if err != nil {
+		return status, fmt.Errorf("error getting job %s: %w", jobID, err)
+	}
+	if len(missing) > 0 {
+		return status, fmt.Errorf("error getting job %s: %w", jobID, ErrKeyNotFound)
+	}
+
+	var started, updated int64
+	for field, target := range map[string]*int64{"total": &status.Total, "done": &status.Done, "started": &started, "updated": &updated} {
+		if _, err := fmt.Sscan(values[field], target); err != nil {
+			return status, fmt.Errorf("error parsing %s of job %s: %w", field, jobID, err)
+		}
+	}
+	status.Started, status.Updated = time.UnixMilli(started), time.UnixMilli(updated)
+	status.estimate()
+	return status, nil
+}
+
+// Subscribe calls fn with every published update until ctx is done, returning ctx.Err(),
+// or until the subscription fails. fn runs on the subscribing goroutine.
+func (t *ProgressTracker) Subscribe(ctx context.Context, fn func(status ProgressStatus)) error {
+	conn, err := t.d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error subscribing to %s: %w", t.opts.Channel, err)
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer func() {
+		_ = psc.Close()
+	}()
+	// unsubscribing ends the blocking Receive once ctx is done
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	defer func() {
+		close(done)
+		<-watched
+	}()
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			_ = psc.Unsubscribe()
+		case <-done:
+		}
+	}()
+
+	if err := psc.Subscribe(t.opts.Channel); err != nil {
+		return fmt.Errorf("error subscribing to %s: %w", t.opts.Channel, err)
+	}
+	o := t.d.options()
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			if v.Count == 0 {
+				return ctx.Err()
+			}
+		case redis.Message:
+			var status ProgressStatus
+			if err := json.Unmarshal(v.Data, &status); err != nil {
+				continue
+			}
+			_ = o.call("progress subscriber", func() error {
+				fn(status)
+				return nil
+			})
+		case error:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error receiving from %s: %w", t.opts.Channel, v)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+// GaugeMetrics is implemented by Metrics that also record gauges. Gauges are reported
+// with a name such as "pubsub_subscribers" and a label, for example the channel.
+type GaugeMetrics interface {
+	Metrics
+	ObserveGauge(name string, label string, value float64)
+}
+
+// PubSubChannels lists the channels with at least one subscriber that match pattern;
+// an empty pattern lists all of them.
+func (d *RedisDatabase) PubSubChannels(pattern string) ([]string, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close listing channels: %v", err)
+		}
+	}(conn)
+
+	args := []interface{}{"CHANNELS"}
+	if pattern != "" {
+		args = append(args, pattern)
+	}
+	channels, err := redis.Strings(d.do(conn, "PUBSUB", args...))
+	if err != nil {
+		return nil, fmt.Errorf("error listing channels '%s': %w", pattern, err)
+	}
+	return channels, nil
+}
+
+// PubSubNumSub returns the number of subscribers of every channel. Pattern subscriptions
+// are not included. When the configured Metrics implement GaugeMetrics the counts are also
+// reported as the "pubsub_subscribers" gauge.
+func (d *RedisDatabase) PubSubNumSub(channels ...string) (map[string]int, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close counting subscribers: %v", err)
+		}
+	}(conn)
+
+	reply, err := redis.Values(d.do(conn, "PUBSUB", redis.Args{"NUMSUB"}.AddFlat(channels)...))
+	if err != nil {
+		return nil, fmt.Errorf("error counting subscribers: %w", err)
+	}
+
+	counts := make(map[string]int, len(channels))
+	for i := 0; i+1 < len(reply); i += 2 {
+		channel, _ := redis.String(reply[i], nil)
+		counts[channel], _ = redis.Int(reply[i+1], nil)
+	}
+
+	o := d.options()
+	if g, ok := o.metrics.(GaugeMetrics); ok {
+		for channel, count := range counts {
+			g.ObserveGauge("pubsub_subscribers", o.keyNormalizer.Normalize(channel), float64(count))
+		}
+	}
+	return counts, nil
+}
+
+// HasSubscribers reports whether anybody is subscribed to channel, so expensive payloads
+// need not be built for channels nobody listens to.
+func (d *RedisDatabase) HasSubscribers(channel string) (bool, error) {
+	counts, err := d.PubSubNumSub(channel)
+	if err != nil {
+		return false, err
+	}
+	return counts[channel] > 0, nil
+}
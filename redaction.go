@@ -0,0 +1,78 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// RedactionPolicy controls how values are shown in error messages and logs.
+type RedactionPolicy int
+
+const (
+	// RedactTruncate shows the first 12 bytes of values longer than 15 bytes (default).
+	RedactTruncate RedactionPolicy = iota
+	// RedactLength shows only the length of values.
+	RedactLength
+	// RedactHash shows a short SHA-256 of values and their length, so the same value can
+	// be recognized across messages without being disclosed.
+	RedactHash
+	// RedactNone shows values in full.
+	RedactNone
+)
+
+// WithRedaction selects how values are rendered in errors and logs. Cached values often
+// contain tokens or personal data, so RedactLength or RedactHash are recommended.
+func WithRedaction(policy RedactionPolicy) Option {
+	return func(o *options) {
+		o.redaction = policy
+	}
+}
+
+// Redact renders value according to the policy.
+func (p RedactionPolicy) Redact(value []byte) string {
+	switch p {
+	case RedactLength:
+		return fmt.Sprintf("<%d bytes>", len(value))
+	case RedactHash:
+		sum := sha256.Sum256(value)
+		return fmt.Sprintf("<sha256:%s, %d bytes>", hex.EncodeToString(sum[:6]), len(value))
+	case RedactNone:
+		return string(value)
+	}
+	v := string(value)
+	if len(v) > 15 {
+		v = v[0:12] + "..."
+	}
+	return v
+}
+
+func (o *options) redact(value []byte) string {
+	return o.redaction.Redact(value)
+}
@@ -27,20 +27,41 @@
 package redisdb
 
 import (
+	"context"
 	"fmt"
 	"github.com/gomodule/redigo/redis"
+	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type RedisDatabase struct {
 	redisPool *redis.Pool
+	opts      *options
+}
+
+func (d *RedisDatabase) options() *options {
+	if d.opts == nil {
+		d.opts = newOptions(nil)
+	}
+	return d.opts
 }
 
 func (d *RedisDatabase) Ping() error {
+	return d.PingContext(context.Background())
+}
+
+// PingContext checks the server is reachable, giving up on waiting for a pooled
+// connection or for the reply once ctx is done.
+func (d *RedisDatabase) PingContext(ctx context.Context) error {
 
-	conn := d.redisPool.Get()
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot 'PING' db: %w", err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -48,16 +69,24 @@ func (d *RedisDatabase) Ping() error {
 		}
 	}(conn)
 
-	_, err := redis.String(conn.Do("PING"))
+	_, err = redis.String(d.doContext(ctx, conn, "PING"))
 	if err != nil {
-		return fmt.Errorf("cannot 'PING' db: %v", err)
+		return fmt.Errorf("cannot 'PING' db: %w", err)
 	}
 	return nil
 }
 
 func (d *RedisDatabase) Get(key string) ([]byte, error) {
+	return d.GetContext(context.Background(), key)
+}
 
-	conn := d.redisPool.Get()
+// GetContext is Get bounded by ctx.
+func (d *RedisDatabase) GetContext(ctx context.Context, key string) ([]byte, error) {
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %s: %w", key, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -65,17 +94,30 @@ func (d *RedisDatabase) Get(key string) ([]byte, error) {
 		}
 	}(conn)
 
-	var data []byte
-	data, err := redis.Bytes(conn.Do("GET", key))
+	data, err := redis.Bytes(d.doContext(ctx, conn, "GET", key))
+	if err == redis.ErrNil {
+		return data, fmt.Errorf("error getting key %s: %w", key, ErrKeyNotFound)
+	}
 	if err != nil {
-		return data, fmt.Errorf("error getting key %s: %v", key, err)
+		return data, fmt.Errorf("error getting key %s: %w", key, err)
+	}
+	if IsTombstone(data) {
+		return nil, fmt.Errorf("error getting key %s: %w", key, ErrDeleted)
 	}
 	return data, err
 }
 
 func (d *RedisDatabase) Set(key string, value []byte) error {
+	return d.SetContext(context.Background(), key, value)
+}
+
+// SetContext is Set bounded by ctx.
+func (d *RedisDatabase) SetContext(ctx context.Context, key string, value []byte) error {
 
-	conn := d.redisPool.Get()
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error setting key %s: %w", key, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -83,20 +125,24 @@ func (d *RedisDatabase) Set(key string, value []byte) error {
 		}
 	}(conn)
 
-	_, err := conn.Do("SET", key, value)
+	_, err = d.doContext(ctx, conn, "SET", key, value)
 	if err != nil {
-		v := string(value)
-		if len(v) > 15 {
-			v = v[0:12] + "..."
-		}
-		return fmt.Errorf("error setting key %s to %s: %v", key, v, err)
+		return fmt.Errorf("error setting key %s to %s: %w", key, d.options().redact(value), err)
 	}
 	return err
 }
 
 func (d *RedisDatabase) Exists(key string) (bool, error) {
+	return d.ExistsContext(context.Background(), key)
+}
+
+// ExistsContext is Exists bounded by ctx.
+func (d *RedisDatabase) ExistsContext(ctx context.Context, key string) (bool, error) {
 
-	conn := d.redisPool.Get()
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error checking if key %s exists: %w", key, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -104,16 +150,24 @@ func (d *RedisDatabase) Exists(key string) (bool, error) {
 		}
 	}(conn)
 
-	ok, err := redis.Bool(conn.Do("EXISTS", key))
+	ok, err := redis.Bool(d.doContext(ctx, conn, "EXISTS", key))
 	if err != nil {
-		return ok, fmt.Errorf("error checking if key %s exists: %v", key, err)
+		return ok, fmt.Errorf("error checking if key %s exists: %w", key, err)
 	}
 	return ok, err
 }
 
 func (d *RedisDatabase) Delete(key string) error {
+	return d.DeleteContext(context.Background(), key)
+}
 
-	conn := d.redisPool.Get()
+// DeleteContext is Delete bounded by ctx.
+func (d *RedisDatabase) DeleteContext(ctx context.Context, key string) error {
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error deleting key %s: %w", key, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -121,13 +175,24 @@ func (d *RedisDatabase) Delete(key string) error {
 		}
 	}(conn)
 
-	_, err := conn.Do("DEL", key)
+	_, err = d.doContext(ctx, conn, "DEL", key)
 	return err
 }
 
 func (d *RedisDatabase) GetKeys(pattern string) ([]string, error) {
+	return d.GetKeysContext(context.Background(), pattern)
+}
 
-	conn := d.redisPool.Get()
+// GetKeysContext is GetKeys bounded by ctx.
+func (d *RedisDatabase) GetKeysContext(ctx context.Context, pattern string) ([]string, error) {
+	if c := d.options().cluster; c != nil {
+		return c.keys(ctx, d, pattern)
+	}
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving '%s' keys: %w", pattern, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -138,9 +203,9 @@ func (d *RedisDatabase) GetKeys(pattern string) ([]string, error) {
 	iter := 0
 	var keys []string
 	for {
-		arr, err := redis.Values(conn.Do("SCAN", iter, "MATCH", pattern))
+		arr, err := redis.Values(d.doContext(ctx, conn, "SCAN", iter, "MATCH", pattern))
 		if err != nil {
-			return keys, fmt.Errorf("error retrieving '%s' keys", pattern)
+			return keys, fmt.Errorf("error retrieving '%s' keys: %w", pattern, err)
 		}
 
 		iter, _ = redis.Int(arr[0], nil)
@@ -184,12 +249,22 @@ func (d *RedisDatabase) spliceMap(keys []string, values []string, err error) (ma
 	return result, err
 }
 
+// HMGet returns the values of fields. Missing fields map to empty strings, use
+// HMGetFields to tell them apart from stored empty values.
 func (d *RedisDatabase) HMGet(key string, fields ...string) (map[string]string, error) {
+	return d.HMGetContext(context.Background(), key, fields...)
+}
+
+// HMGetContext is HMGet bounded by ctx.
+func (d *RedisDatabase) HMGetContext(ctx context.Context, key string, fields ...string) (map[string]string, error) {
 	if len(fields) == 0 {
 		return nil, fmt.Errorf("redis: at least once field is required")
 	}
 
-	conn := d.redisPool.Get()
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting fields of key %s: %w", key, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -197,12 +272,79 @@ func (d *RedisDatabase) HMGet(key string, fields ...string) (map[string]string,
 		}
 	}(conn)
 
-	values, err := redis.Strings(conn.Do("HMGET", redis.Args{key}.AddFlat(fields)...))
-	return d.spliceMap(fields, values, err)
+	values, err := redis.Strings(d.doContext(ctx, conn, "HMGET", redis.Args{key}.AddFlat(fields)...))
+	result, err := d.spliceMap(fields, values, err)
+	if err != nil {
+		return result, err
+	}
+	return result, d.options().openFields(key, result)
+}
+
+// HMGetFields returns the values of the fields that exist and, separately, the fields
+// that do not exist in the hash.
+func (d *RedisDatabase) HMGetFields(key string, fields ...string) (map[string]string, []string, error) {
+	return d.HMGetFieldsContext(context.Background(), key, fields...)
+}
+
+// HMGetFieldsContext is HMGetFields bounded by ctx.
+func (d *RedisDatabase) HMGetFieldsContext(ctx context.Context, key string, fields ...string) (map[string]string, []string, error) {
+	return d.hmGetFields(ctx, key, key, fields)
+}
+
+// hmGetFields is HMGetFieldsContext decrypting the fields as stored for source.
+func (d *RedisDatabase) hmGetFields(ctx context.Context, key string, source string, fields []string) (map[string]string, []string, error) {
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("redis: at least one field is required")
+	}
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting fields of key %s: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close HMGetFields %s: %v", key, err)
+		}
+	}(conn)
+
+	replies, err := redis.Values(d.doContext(ctx, conn, "HMGET", redis.Args{key}.AddFlat(fields)...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting fields of key %s: %w", key, err)
+	}
+	if len(replies) != len(fields) {
+		return nil, nil, fmt.Errorf("redis: HMGET returned %d values for %d fields", len(replies), len(fields))
+	}
+
+	values := map[string]string{}
+	var missing []string
+	for i, reply := range replies {
+		if reply == nil {
+			missing = append(missing, fields[i])
+			continue
+		}
+		values[fields[i]], err = redis.String(reply, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting field %s of key %s: %w", fields[i], key, err)
+		}
+	}
+	if err := d.options().openFields(source, values); err != nil {
+		return nil, nil, err
+	}
+	return values, missing, nil
 }
 
 func (d *RedisDatabase) HMGetKeys(key string) []string {
-	conn := d.redisPool.Get()
+	values, _ := d.HMGetKeysContext(context.Background(), key)
+	return values
+}
+
+// HMGetKeysContext is HMGetKeys bounded by ctx, returning the error that HMGetKeys drops.
+func (d *RedisDatabase) HMGetKeysContext(ctx context.Context, key string) ([]string, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting fields of key %s: %w", key, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -210,12 +352,29 @@ func (d *RedisDatabase) HMGetKeys(key string) []string {
 		}
 	}(conn)
 
-	values, _ := redis.Strings(conn.Do("HKEYS", key))
-	return values
+	values, err := redis.Strings(d.doContext(ctx, conn, "HKEYS", key))
+	if err != nil {
+		return nil, fmt.Errorf("error getting fields of key %s: %w", key, err)
+	}
+	return values, nil
 }
 
 func (d *RedisDatabase) HMGetAll(key string) map[string]string {
-	conn := d.redisPool.Get()
+	values, _ := d.HMGetAllContext(context.Background(), key)
+	return values
+}
+
+// HMGetAllContext is HMGetAll bounded by ctx, returning the error that HMGetAll drops.
+func (d *RedisDatabase) HMGetAllContext(ctx context.Context, key string) (map[string]string, error) {
+	return d.hmGetAll(ctx, key, key)
+}
+
+// hmGetAll is HMGetAllContext decrypting the fields as stored for source.
+func (d *RedisDatabase) hmGetAll(ctx context.Context, key string, source string) (map[string]string, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %s: %w", key, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -223,12 +382,31 @@ func (d *RedisDatabase) HMGetAll(key string) map[string]string {
 		}
 	}(conn)
 
-	values, _ := redis.StringMap(conn.Do("HGETALL", key))
-	return values
+	values, err := redis.StringMap(d.doContext(ctx, conn, "HGETALL", key))
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %s: %w", key, err)
+	}
+	if err := d.options().openFields(source, values); err != nil {
+		return nil, err
+	}
+	return values, nil
 }
 
 func (d *RedisDatabase) HMSet(key string, hashKey string, value []byte) error {
-	conn := d.redisPool.Get()
+	return d.HMSetContext(context.Background(), key, hashKey, value)
+}
+
+// HMSetContext is HMSet bounded by ctx.
+func (d *RedisDatabase) HMSetContext(ctx context.Context, key string, hashKey string, value []byte) error {
+	value, err := d.options().sealField(key, hashKey, value)
+	if err != nil {
+		return err
+	}
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error setting key %s:%s: %w", key, hashKey, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -236,19 +414,23 @@ func (d *RedisDatabase) HMSet(key string, hashKey string, value []byte) error {
 		}
 	}(conn)
 
-	_, err := conn.Do("HMSET", key, hashKey, value)
+	_, err = d.doContext(ctx, conn, "HMSET", key, hashKey, value)
 	if err != nil {
-		v := string(value)
-		if len(v) > 15 {
-			v = v[0:12] + "..."
-		}
-		return fmt.Errorf("error setting key %s:%s to %s: %v", key, hashKey, v, err)
+		return fmt.Errorf("error setting key %s:%s to %s: %w", key, hashKey, d.options().redact(value), err)
 	}
 	return err
 }
 
 func (d *RedisDatabase) HExists(key string, hashKey string) (bool, error) {
-	conn := d.redisPool.Get()
+	return d.HExistsContext(context.Background(), key, hashKey)
+}
+
+// HExistsContext is HExists bounded by ctx.
+func (d *RedisDatabase) HExistsContext(ctx context.Context, key string, hashKey string) (bool, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error checking if key %s, %s  exists: %w", key, hashKey, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -256,15 +438,23 @@ func (d *RedisDatabase) HExists(key string, hashKey string) (bool, error) {
 		}
 	}(conn)
 
-	ok, err := redis.Bool(conn.Do("HEXISTS", key, hashKey))
+	ok, err := redis.Bool(d.doContext(ctx, conn, "HEXISTS", key, hashKey))
 	if err != nil {
-		return ok, fmt.Errorf("error checking if key %s, %s  exists: %v", key, hashKey, err)
+		return ok, fmt.Errorf("error checking if key %s, %s  exists: %w", key, hashKey, err)
 	}
 	return ok, err
 }
 
 func (d *RedisDatabase) HDelete(key string, hashKey string) (int, error) {
-	conn := d.redisPool.Get()
+	return d.HDeleteContext(context.Background(), key, hashKey)
+}
+
+// HDeleteContext is HDelete bounded by ctx.
+func (d *RedisDatabase) HDeleteContext(ctx context.Context, key string, hashKey string) (int, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting key %s:%s: %w", key, hashKey, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -272,16 +462,24 @@ func (d *RedisDatabase) HDelete(key string, hashKey string) (int, error) {
 		}
 	}(conn)
 
-	number, err := redis.Int(conn.Do("HDEL", key, hashKey))
+	number, err := redis.Int(d.doContext(ctx, conn, "HDEL", key, hashKey))
 	if err != nil {
-		return number, fmt.Errorf("error checking if key %s, %s  exists: %v", key, hashKey, err)
+		return number, fmt.Errorf("error checking if key %s, %s  exists: %w", key, hashKey, err)
 	}
 	return number, err
 }
 
 func (d *RedisDatabase) Incr(counterKey string) (int, error) {
+	return d.IncrContext(context.Background(), counterKey)
+}
+
+// IncrContext is Incr bounded by ctx.
+func (d *RedisDatabase) IncrContext(ctx context.Context, counterKey string) (int, error) {
 
-	conn := d.redisPool.Get()
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error incrementing key %s: %w", counterKey, err)
+	}
 	defer func(conn redis.Conn) {
 		err := conn.Close()
 		if err != nil {
@@ -289,28 +487,65 @@ func (d *RedisDatabase) Incr(counterKey string) (int, error) {
 		}
 	}(conn)
 
-	return redis.Int(conn.Do("INCR", counterKey))
+	return redis.Int(d.doContext(ctx, conn, "INCR", counterKey))
+}
+
+// Do executes a command the package has no wrapper for and returns the raw reply, which
+// can be converted with the redigo reply helpers such as redis.String.
+func (d *RedisDatabase) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return d.DoContext(context.Background(), commandName, args...)
+}
+
+// DoContext is Do bounded by ctx.
+func (d *RedisDatabase) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error executing %s: %w", commandName, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed closing %s: %v", commandName, err)
+		}
+	}(conn)
+
+	return d.doContext(ctx, conn, commandName, args...)
 }
 
-func newPool(redisURL string) *redis.Pool {
-	return &redis.Pool{
+func newPool(redisURL string, o *options) *redis.Pool {
+	pool := &redis.Pool{
 		// Maximum number of idle connections in the redisPool.
-		MaxIdle: 80,
+		MaxIdle: o.pool.maxIdle,
 		// max number of connections
-		MaxActive: 12000,
-		// Dial is an application supplied function for creating and
-		// configuring a connection.
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.DialURL(redisURL)
-			if err != nil {
-				panic(err.Error())
+		MaxActive:   o.pool.maxActive,
+		IdleTimeout: o.pool.idleTimeout,
+		Wait:        o.pool.wait,
+		// DialContext is an application supplied function for creating and
+		// configuring a connection, bounded by the context passed to GetContext.
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return dial(ctx, redisURL, o)
+		},
+		// retires connections past the lifetime set with WithMaxConnLifetime, then
+		// runs Config.TestOnBorrow
+		TestOnBorrow: func(c redis.Conn, lastUsed time.Time) error {
+			if err := testOnBorrow(c, lastUsed); err != nil {
+				return err
+			}
+			if o.pool.testOnBorrow != nil {
+				return o.pool.testOnBorrow(c, lastUsed)
 			}
-			return c, err
+			return nil
 		},
 	}
+	if o.minIdle > 0 {
+		go warmPool(pool, o.minIdle)
+	}
+	return pool
 }
 
-func cleanupHook(pool *redis.Pool) {
+// cleanupHook closes pool, and then runs closers, when the process is interrupted.
+func cleanupHook(pool *redis.Pool, closers ...func()) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
@@ -318,18 +553,107 @@ func cleanupHook(pool *redis.Pool) {
 	go func() {
 		<-c
 		_ = pool.Close()
+		for _, c := range closers {
+			c()
+		}
 		os.Exit(0)
 	}()
 }
 
+// SetupDatabase creates the pool for redisURL. It always connects lazily, so dial errors
+// are returned by the first commands that need a connection; WithConnectMode(ConnectEager)
+// is ignored since there is no way to report the error, use SetupDatabaseE instead.
+//
+// Deprecated: use SetupDatabaseE, which reports a bad URL or unreachable server as an error.
 // noinspection GoUnusedExportedFunction
-func SetupDatabase(redisURL string) *redis.Pool {
-	pool := newPool(redisURL)
+func SetupDatabase(redisURL string, opts ...Option) *redis.Pool {
+	o := newOptions(opts)
+	if o.connectMode == ConnectEager {
+		o.logger.Printf("SetupDatabase ignores ConnectEager, use SetupDatabaseE to validate the connection at setup")
+	}
+	pool := newPool(redisURL, o)
+	poolOptions.Store(pool, o)
 	cleanupHook(pool)
 	return pool
 }
 
+// SetupDatabaseE validates redisURL, connects and PINGs the server before returning the
+// handle, so misconfiguration is reported at boot. Pass WithConnectMode(ConnectLazy) to
+// only validate the URL.
+// noinspection GoUnusedExportedFunction
+func SetupDatabaseE(redisURL string, opts ...Option) (*RedisDatabase, error) {
+	return openDatabase(redisURL, append([]Option{WithConnectMode(ConnectEager)}, opts...)...)
+}
+
+// NewRedisDatabase creates a database with its own pool for redisURL, so a process can
+// talk to several servers and tests can create and close databases freely. Unlike the
+// Setup functions it neither connects by default nor installs a signal handler; pass
+// WithConnectMode(ConnectEager) to PING at creation and call Close when done.
+func NewRedisDatabase(redisURL string, opts ...Option) (*RedisDatabase, error) {
+	if err := validateURL(redisURL); err != nil {
+		return nil, err
+	}
+
+	o := newOptions(opts)
+	pool := newPool(redisURL, o)
+	if o.connectMode == ConnectEager {
+		if err := validateConnection(pool); err != nil {
+			_ = pool.Close()
+			return nil, err
+		}
+	}
+	return &RedisDatabase{redisPool: pool, opts: o}, nil
+}
+
+// Close closes the pool, commands issued afterwards fail.
+func (d *RedisDatabase) Close() error {
+	capabilityCache.Delete(d.redisPool)
+	poolOptions.Delete(d.redisPool)
+	err := d.redisPool.Close()
+	if o := d.options(); o.ownsResolver {
+		o.resolver.Close()
+	}
+	if c := d.options().cluster; c != nil {
+		c.close()
+	}
+	return err
+}
+
+func openDatabase(redisURL string, opts ...Option) (*RedisDatabase, error) {
+	d, err := NewRedisDatabase(redisURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	cleanupHook(d.redisPool)
+	return d, nil
+}
+
+func validateURL(redisURL string) error {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return fmt.Errorf("invalid redis url: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return fmt.Errorf("invalid redis url scheme '%s'", u.Scheme)
+	}
+	return nil
+}
+
+func validateConnection(pool *redis.Pool) error {
+	d := RedisDatabase{redisPool: pool, opts: newOptions(nil)}
+	return d.Ping()
+}
+
+// poolOptions holds the options of the pools returned by SetupDatabase and
+// Profiles.Setup, so GetDatabase builds a handle with the same options.
+var poolOptions sync.Map
+
+// GetDatabase returns a handle for pool. Pools created by SetupDatabase or Profiles.Setup
+// keep the options they were created with; other pools get the defaults.
 // noinspection GoUnusedExportedFunction
 func GetDatabase(pool *redis.Pool) RedisDatabase {
-	return RedisDatabase{redisPool: pool}
+	if o, ok := poolOptions.Load(pool); ok {
+		return RedisDatabase{redisPool: pool, opts: o.(*options)}
+	}
+	return RedisDatabase{redisPool: pool, opts: newOptions(nil)}
 }
@@ -0,0 +1,237 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+// Package redisdbtest bootstraps Redis servers and data for integration tests of code
+// built on redisdb.
+package redisdbtest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/henryse/go-redisdb"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Topology selects the servers started by StartContainer.
+type Topology int
+
+const (
+	// Standalone runs a single server.
+	Standalone Topology = iota
+	// Sentinel runs a primary monitored by one sentinel under the name "mymaster".
+	Sentinel
+	// Cluster runs a three node cluster without replicas.
+	Cluster
+)
+
+// ContainerOption configures StartContainer.
+type ContainerOption func(*containerOptions)
+
+type containerOptions struct {
+	topology Topology
+	image    string
+	opts     []redisdb.Option
+}
+
+// WithTopology starts a sentinel or cluster setup instead of a single server.
+func WithTopology(topology Topology) ContainerOption {
+	return func(o *containerOptions) {
+		o.topology = topology
+	}
+}
+
+// WithImage replaces the redis image, for example with a valkey or redis-stack image
+// providing the same binaries. The version is used as the image tag.
+func WithImage(image string) ContainerOption {
+	return func(o *containerOptions) {
+		o.image = image
+	}
+}
+
+// WithOptions passes options to the handle returned in Container.DB.
+func WithOptions(opts ...redisdb.Option) ContainerOption {
+	return func(o *containerOptions) {
+		o.opts = append(o.opts, opts...)
+	}
+}
+
+// Container is a running test server.
+type Container struct {
+	ID string
+	// URL points to the standalone server, the sentinel primary or the first cluster node.
+	URL string
+	// DB is a handle for the topology: for URL on a standalone server, opened with
+	// SetupSentinel on MasterName and Addrs for Sentinel and with SetupCluster on Addrs
+	// for Cluster.
+	DB *redisdb.RedisDatabase
+	// Addrs are the cluster nodes, or the sentinel for the Sentinel topology.
+	Addrs []string
+	// MasterName is the name monitored by the sentinel.
+	MasterName string
+}
+
+// StartContainer runs redis:version in docker and removes it when the test ends. The
+// test is skipped when docker is not available. Servers bind to free host ports that
+// are published under the same number, so addresses announced by sentinel and cluster
+// nodes are reachable from the test.
+func StartContainer(t testing.TB, version string, opts ...ContainerOption) *Container {
+	t.Helper()
+
+	o := containerOptions{image: "redis"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("redisdbtest: docker is not available")
+	}
+
+	ports := freePorts(t, 3)
+	var script string
+	c := &Container{}
+	switch o.topology {
+	case Standalone:
+		script = fmt.Sprintf("exec redis-server --port %d --save ''", ports[0])
+	case Sentinel:
+		c.MasterName = "mymaster"
+		c.Addrs = []string{fmt.Sprintf("127.0.0.1:%d", ports[1])}
+		script = fmt.Sprintf("redis-server --port %d --save '' --daemonize yes && "+
+			"printf 'port %d\\nsentinel monitor mymaster 127.0.0.1 %d 1\\n"+
+			"sentinel down-after-milliseconds mymaster 1000\\nsentinel failover-timeout mymaster 2000\\n' > /tmp/sentinel.conf && "+
+			"exec redis-sentinel /tmp/sentinel.conf", ports[0], ports[1], ports[0])
+	case Cluster:
+		var nodes []string
+		var b strings.Builder
+		for _, port := range ports {
+			fmt.Fprintf(&b, "redis-server --port %d --save '' --cluster-enabled yes --cluster-config-file nodes-%d.conf "+
+				"--cluster-announce-ip 127.0.0.1 --daemonize yes && ", port, port)
+			nodes = append(nodes, fmt.Sprintf("127.0.0.1:%d", port))
+		}
+		fmt.Fprintf(&b, "sleep 1 && redis-cli --cluster create %s --cluster-yes && exec sleep infinity", strings.Join(nodes, " "))
+		script = b.String()
+		c.Addrs = nodes
+	default:
+		t.Fatalf("redisdbtest: unknown topology %d", o.topology)
+	}
+
+	args := []string{"run", "-d", "--rm"}
+	for _, port := range ports {
+		args = append(args, "-p", fmt.Sprintf("127.0.0.1:%d:%d", port, port))
+	}
+	args = append(args, "--entrypoint", "sh", o.image+":"+version, "-c", script)
+	out, err := docker(args...)
+	if err != nil {
+		t.Fatalf("redisdbtest: error starting container: %v", err)
+	}
+	c.ID = strings.TrimSpace(out)
+	t.Cleanup(func() {
+		if _, err := docker("rm", "-f", c.ID); err != nil {
+			t.Logf("redisdbtest: error removing container %s: %v", c.ID, err)
+		}
+	})
+
+	c.URL = fmt.Sprintf("redis://127.0.0.1:%d", ports[0])
+	c.DB, err = waitReady(c, o.topology, o.opts)
+	if err != nil {
+		logs, _ := docker("logs", c.ID)
+		t.Fatalf("redisdbtest: server did not become ready: %v\n%s", err, logs)
+	}
+	t.Cleanup(func() {
+		_ = c.DB.Close()
+	})
+	return c
+}
+
+// waitReady opens the database of c until the servers answer, for a sentinel until it
+// reports the primary and for a cluster until all slots are served.
+func waitReady(c *Container, topology Topology, opts []redisdb.Option) (*redisdb.RedisDatabase, error) {
+	opts = append([]redisdb.Option{redisdb.WithConnectMode(redisdb.ConnectEager)}, opts...)
+	deadline := time.Now().Add(30 * time.Second)
+	var err error
+	for time.Now().Before(deadline) {
+		var d *redisdb.RedisDatabase
+		switch topology {
+		case Sentinel:
+			d, err = redisdb.SetupSentinel(c.MasterName, c.Addrs, opts...)
+		case Cluster:
+			// the slot map is only complete once the cluster was created
+			if d, err = redisdb.NewRedisDatabase(c.URL, opts...); err == nil {
+				err = clusterReady(d)
+				_ = d.Close()
+			}
+			if err == nil {
+				d, err = redisdb.SetupCluster(c.Addrs, opts...)
+			}
+		default:
+			d, err = redisdb.NewRedisDatabase(c.URL, opts...)
+		}
+		if err == nil {
+			return d, nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return nil, err
+}
+
+func clusterReady(d *redisdb.RedisDatabase) error {
+	reply, err := d.Do("CLUSTER", "INFO")
+	if err != nil {
+		return err
+	}
+	info, _ := reply.([]byte)
+	if !bytes.Contains(info, []byte("cluster_state:ok")) {
+		return fmt.Errorf("cluster is not ready")
+	}
+	return nil
+}
+
+// freePorts returns n ports that are free on the loopback interface.
+func freePorts(t testing.TB, n int) []int {
+	ports := make([]int, n)
+	for i := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("redisdbtest: error finding a free port: %v", err)
+		}
+		ports[i] = l.Addr().(*net.TCPAddr).Port
+		defer func(l net.Listener) { _ = l.Close() }(l)
+	}
+	return ports
+}
+
+func docker(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("docker %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,294 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdbtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/henryse/go-redisdb"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fixture maps keys to their contents. It is read from and written to JSON, or YAML
+// when the file name ends in .yaml or .yml:
+//
+//	user:1:
+//	  string: alice
+//	  ttl: 10m
+//	user:1:roles:
+//	  set: [admin, dev]
+//	user:1:profile:
+//	  hash: {name: Alice}
+type Fixture map[string]FixtureKey
+
+// FixtureKey holds the value of one key, with exactly one of the value fields set.
+type FixtureKey struct {
+	String *string            `json:"string,omitempty" yaml:"string,omitempty"`
+	Hash   map[string]string  `json:"hash,omitempty" yaml:"hash,omitempty"`
+	Set    []string           `json:"set,omitempty" yaml:"set,omitempty"`
+	List   []string           `json:"list,omitempty" yaml:"list,omitempty"`
+	ZSet   map[string]float64 `json:"zset,omitempty" yaml:"zset,omitempty"`
+	// TTL is a duration such as "90s", empty for no expiry.
+	TTL string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+}
+
+// UpdateEnv names the environment variable that makes CompareFixture rewrite golden
+// files instead of comparing against them.
+const UpdateEnv = "REDISDBTEST_UPDATE"
+
+// ReadFixture reads a fixture file.
+func ReadFixture(path string) (Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f Fixture
+	if isYAML(path) {
+		err = yaml.Unmarshal(data, &f)
+	} else {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing fixture %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// WriteFile writes f to path.
+func (f Fixture) WriteFile(path string) error {
+	var data []byte
+	var err error
+	if isYAML(path) {
+		data, err = yaml.Marshal(f)
+	} else {
+		data, err = json.MarshalIndent(f, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// LoadFixture replaces the keys listed in the fixture at path with their fixture contents.
+func LoadFixture(t testing.TB, d *redisdb.RedisDatabase, path string) {
+	t.Helper()
+
+	f, err := ReadFixture(path)
+	if err != nil {
+		t.Fatalf("redisdbtest: %v", err)
+	}
+	if err := f.Load(d); err != nil {
+		t.Fatalf("redisdbtest: error loading fixture %s: %v", path, err)
+	}
+}
+
+// Load writes the fixture keys, replacing existing values.
+func (f Fixture) Load(d *redisdb.RedisDatabase) error {
+	for key, k := range f {
+		if _, err := d.Do("DEL", key); err != nil {
+			return err
+		}
+
+		var err error
+		switch {
+		case k.String != nil:
+			_, err = d.Do("SET", key, *k.String)
+		case k.Hash != nil:
+			_, err = d.Do("HSET", redis.Args{key}.AddFlat(k.Hash)...)
+		case k.Set != nil:
+			_, err = d.Do("SADD", redis.Args{key}.AddFlat(k.Set)...)
+		case k.List != nil:
+			_, err = d.Do("RPUSH", redis.Args{key}.AddFlat(k.List)...)
+		case k.ZSet != nil:
+			args := redis.Args{key}
+			for member, score := range k.ZSet {
+				args = args.Add(score, member)
+			}
+			_, err = d.Do("ZADD", args...)
+		default:
+			return fmt.Errorf("key %s has no value", key)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing key %s: %v", key, err)
+		}
+
+		if k.TTL != "" {
+			ttl, err := time.ParseDuration(k.TTL)
+			if err != nil {
+				return fmt.Errorf("invalid ttl of key %s: %v", key, err)
+			}
+			if _, err := d.Do("PEXPIRE", key, ttl.Milliseconds()); err != nil {
+				return fmt.Errorf("error setting ttl of key %s: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SnapshotFixture dumps the keys matching pattern. TTLs are rounded to whole seconds so
+// snapshots taken right after loading a fixture compare equal to it.
+func SnapshotFixture(t testing.TB, d *redisdb.RedisDatabase, pattern string) Fixture {
+	t.Helper()
+
+	f, err := Snapshot(d, pattern)
+	if err != nil {
+		t.Fatalf("redisdbtest: error taking snapshot of '%s': %v", pattern, err)
+	}
+	return f
+}
+
+// Snapshot dumps the keys matching pattern, see SnapshotFixture.
+func Snapshot(d *redisdb.RedisDatabase, pattern string) (Fixture, error) {
+	keys, err := d.GetKeys(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	f := Fixture{}
+	for _, key := range keys {
+		var k FixtureKey
+		kind, err := redis.String(d.Do("TYPE", key))
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "none":
+			continue
+		case "string":
+			s, err := redis.String(d.Do("GET", key))
+			if err != nil {
+				return nil, err
+			}
+			k.String = &s
+		case "hash":
+			k.Hash, err = redis.StringMap(d.Do("HGETALL", key))
+		case "set":
+			k.Set, err = redis.Strings(d.Do("SMEMBERS", key))
+			sort.Strings(k.Set)
+		case "list":
+			k.List, err = redis.Strings(d.Do("LRANGE", key, 0, -1))
+		case "zset":
+			k.ZSet, err = zsetMap(d, key)
+		default:
+			return nil, fmt.Errorf("key %s has unsupported type %s", key, kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading key %s: %v", key, err)
+		}
+
+		ms, err := redis.Int64(d.Do("PTTL", key))
+		if err != nil {
+			return nil, err
+		}
+		if ms > 0 {
+			k.TTL = (time.Duration(ms) * time.Millisecond).Round(time.Second).String()
+		}
+		f[key] = k
+	}
+	return f, nil
+}
+
+func zsetMap(d *redisdb.RedisDatabase, key string) (map[string]float64, error) {
+	values, err := redis.Strings(d.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	scores := map[string]float64{}
+	for i := 0; i+1 < len(values); i += 2 {
+		scores[values[i]], err = redis.Float64([]byte(values[i+1]), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scores, nil
+}
+
+// CompareFixture fails the test when the keys matching pattern differ from the golden
+// fixture at path. With UpdateEnv set it writes the current keys to path instead.
+func CompareFixture(t testing.TB, d *redisdb.RedisDatabase, pattern string, path string) {
+	t.Helper()
+
+	got := SnapshotFixture(t, d, pattern)
+	if os.Getenv(UpdateEnv) != "" {
+		if err := got.WriteFile(path); err != nil {
+			t.Fatalf("redisdbtest: error writing golden fixture %s: %v", path, err)
+		}
+		return
+	}
+
+	want, err := ReadFixture(path)
+	if err != nil {
+		t.Fatalf("redisdbtest: %v (set %s=1 to create it)", err, UpdateEnv)
+	}
+	for key, w := range want {
+		g, ok := got[key]
+		if !ok {
+			t.Errorf("redisdbtest: key %s is missing", key)
+			continue
+		}
+		if !reflect.DeepEqual(normalize(w), normalize(g)) {
+			t.Errorf("redisdbtest: key %s differs\nwant: %s\n got: %s", key, describe(w), describe(g))
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("redisdbtest: unexpected key %s", key)
+		}
+	}
+}
+
+// normalize sorts sets and parses the ttl, so hand written fixtures compare equal to
+// snapshots.
+func normalize(k FixtureKey) FixtureKey {
+	if k.Set != nil {
+		k.Set = append([]string(nil), k.Set...)
+		sort.Strings(k.Set)
+	}
+	if ttl, err := time.ParseDuration(k.TTL); err == nil {
+		k.TTL = ttl.Round(time.Second).String()
+	}
+	return k
+}
+
+func describe(k FixtureKey) string {
+	data, _ := json.Marshal(k)
+	return string(data)
+}
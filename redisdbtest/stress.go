@@ -0,0 +1,250 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdbtest
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/henryse/go-redisdb"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Workload is one kind of operation run by StressTest. Op is called concurrently from
+// all workers; Verify runs once after they stopped and checks the invariants of the
+// workload.
+type Workload struct {
+	Name string
+	// Weight is the relative share of operations, one when zero.
+	Weight int
+	Op     func(ctx context.Context, d *redisdb.RedisDatabase, worker int) error
+	Verify func(d *redisdb.RedisDatabase) error
+}
+
+// StressOptions configures StressTest.
+type StressOptions struct {
+	// Workers defaults to 16.
+	Workers int
+	// Duration defaults to two seconds.
+	Duration time.Duration
+	// Prefix of the keys used by the built in workloads, "redisdbtest:stress:" by default.
+	Prefix string
+	// Workloads default to CounterWorkload, LockWorkload and RoundTripWorkload.
+	Workloads []Workload
+}
+
+// StressReport counts the operations run per workload.
+type StressReport struct {
+	Ops    map[string]int64
+	Errors map[string]int64
+}
+
+// StressTest runs a mixed workload against d from many goroutines and fails the test
+// when an operation fails or an invariant does not hold afterwards. Run it with -race to
+// validate the pool and the subsystems exercised by the workloads.
+func StressTest(t testing.TB, d *redisdb.RedisDatabase, opts StressOptions) StressReport {
+	t.Helper()
+
+	if opts.Workers <= 0 {
+		opts.Workers = 16
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = 2 * time.Second
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "redisdbtest:stress:"
+	}
+	if len(opts.Workloads) == 0 {
+		opts.Workloads = []Workload{
+			CounterWorkload(opts.Prefix),
+			LockWorkload(opts.Prefix),
+			RoundTripWorkload(opts.Prefix),
+		}
+	}
+
+	var schedule []int
+	for i, w := range opts.Workloads {
+		weight := w.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		for j := 0; j < weight; j++ {
+			schedule = append(schedule, i)
+		}
+	}
+
+	ops := make([]int64, len(opts.Workloads))
+	errs := make([]int64, len(opts.Workloads))
+	var firstErr atomic.Value
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for worker := 0; worker < opts.Workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(worker)))
+			for ctx.Err() == nil {
+				i := schedule[rnd.Intn(len(schedule))]
+				w := opts.Workloads[i]
+				if err := w.Op(ctx, d, worker); err != nil && ctx.Err() == nil {
+					atomic.AddInt64(&errs[i], 1)
+					firstErr.CompareAndSwap(nil, fmt.Errorf("%s: %v", w.Name, err))
+					continue
+				}
+				atomic.AddInt64(&ops[i], 1)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	report := StressReport{Ops: map[string]int64{}, Errors: map[string]int64{}}
+	for i, w := range opts.Workloads {
+		report.Ops[w.Name] = ops[i]
+		report.Errors[w.Name] = errs[i]
+	}
+	if err, ok := firstErr.Load().(error); ok {
+		t.Errorf("redisdbtest: stress operation failed: %v (errors per workload: %v)", err, report.Errors)
+	}
+	for _, w := range opts.Workloads {
+		if w.Verify == nil {
+			continue
+		}
+		if err := w.Verify(d); err != nil {
+			t.Errorf("redisdbtest: stress invariant of %s does not hold: %v", w.Name, err)
+		}
+	}
+	return report
+}
+
+// CounterWorkload increments a shared counter and verifies that no increment was lost.
+func CounterWorkload(prefix string) Workload {
+	key := prefix + "counter"
+	var expected int64
+	var once sync.Once
+	return Workload{
+		Name:   "counter",
+		Weight: 3,
+		Op: func(ctx context.Context, d *redisdb.RedisDatabase, worker int) error {
+			once.Do(func() { _, _ = d.Do("DEL", key) })
+			if _, err := d.Incr(key); err != nil {
+				return err
+			}
+			atomic.AddInt64(&expected, 1)
+			return nil
+		},
+		Verify: func(d *redisdb.RedisDatabase) error {
+			total, err := redis.Int64(d.Do("GET", key))
+			if err == redis.ErrNil {
+				total, err = 0, nil
+			}
+			if err != nil {
+				return err
+			}
+			if want := atomic.LoadInt64(&expected); total != want {
+				return fmt.Errorf("counter is %d after %d increments", total, want)
+			}
+			return nil
+		},
+	}
+}
+
+const releaseLockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// LockWorkload takes a SET NX lock, checks that no other worker is inside the critical
+// section while holding it and releases it only when still the owner.
+func LockWorkload(prefix string) Workload {
+	lockKey := prefix + "lock"
+	holdersKey := prefix + "lock:holders"
+	var violations int64
+	return Workload{
+		Name: "lock",
+		Op: func(ctx context.Context, d *redisdb.RedisDatabase, worker int) error {
+			token := strconv.Itoa(worker) + ":" + strconv.FormatInt(rand.Int63(), 36)
+			ok, err := redis.String(d.Do("SET", lockKey, token, "NX", "PX", 5000))
+			if err == redis.ErrNil {
+				return nil
+			}
+			if err != nil || ok != "OK" {
+				return err
+			}
+
+			holders, err := redis.Int64(d.Do("INCR", holdersKey))
+			if err != nil {
+				return err
+			}
+			if holders != 1 {
+				atomic.AddInt64(&violations, 1)
+			}
+			if _, err := d.Do("DECR", holdersKey); err != nil {
+				return err
+			}
+			_, err = d.Do("EVAL", releaseLockScript, 1, lockKey, token)
+			return err
+		},
+		Verify: func(d *redisdb.RedisDatabase) error {
+			if n := atomic.LoadInt64(&violations); n > 0 {
+				return fmt.Errorf("%d times more than one worker held the lock", n)
+			}
+			return nil
+		},
+	}
+}
+
+// RoundTripWorkload writes a value unique to the worker and reads it back, catching
+// replies delivered to the wrong caller.
+func RoundTripWorkload(prefix string) Workload {
+	return Workload{
+		Name:   "roundtrip",
+		Weight: 3,
+		Op: func(ctx context.Context, d *redisdb.RedisDatabase, worker int) error {
+			key := prefix + "roundtrip:" + strconv.Itoa(worker)
+			value := strconv.FormatInt(rand.Int63(), 36)
+			if err := d.Set(key, []byte(value)); err != nil {
+				return err
+			}
+			got, err := d.Get(key)
+			if err != nil {
+				return err
+			}
+			if string(got) != value {
+				return fmt.Errorf("read %q back from key %s, wrote %q", got, key, value)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,199 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+)
+
+// Requirements lists what the application needs from the server. Zero fields are not
+// checked.
+type Requirements struct {
+	MinVersion ServerVersion
+	Features   []Feature
+	Modules    []string
+	// MaxMemoryPolicies are the acceptable maxmemory-policy values, such as "noeviction"
+	// for a primary store or "allkeys-lru" for a cache.
+	MaxMemoryPolicies []string
+	// KeyspaceEvents are the notify-keyspace-events flags that must be enabled, such as
+	// "Ex" for keyevent notifications of expired keys. The A alias is understood.
+	KeyspaceEvents string
+}
+
+// RequirementCheck is the outcome of checking one requirement. Skipped checks could not
+// be run, typically because CONFIG is disabled on managed servers, and do not fail the
+// report.
+type RequirementCheck struct {
+	Name    string
+	Want    string
+	Got     string
+	OK      bool
+	Skipped bool
+}
+
+// RequirementsReport lists every check made by VerifyRequirements.
+type RequirementsReport struct {
+	Checks []RequirementCheck
+}
+
+// OK reports whether no check failed.
+func (r *RequirementsReport) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK && !c.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RequirementsReport) String() string {
+	var b strings.Builder
+	for _, c := range r.Checks {
+		status := "ok"
+		if c.Skipped {
+			status = "skipped"
+		} else if !c.OK {
+			status = "FAILED"
+		}
+		fmt.Fprintf(&b, "%-8s %s: want %s, got %s\n", status, c.Name, c.Want, c.Got)
+	}
+	return b.String()
+}
+
+// RequirementsError is returned by VerifyRequirements when a requirement is not met.
+type RequirementsError struct {
+	Report *RequirementsReport
+}
+
+func (e *RequirementsError) Error() string {
+	var failed []string
+	for _, c := range e.Report.Checks {
+		if !c.OK && !c.Skipped {
+			failed = append(failed, fmt.Sprintf("%s (want %s, got %s)", c.Name, c.Want, c.Got))
+		}
+	}
+	return "redis: server does not meet requirements: " + strings.Join(failed, "; ")
+}
+
+func (e *RequirementsError) Is(target error) bool {
+	return target == ErrUnsupportedServer
+}
+
+// VerifyRequirements checks the server against req, meant to run at startup so a
+// misconfigured server fails the deploy instead of surfacing later as lost keys or
+// missing notifications. The report is returned in any case; the error is a
+// *RequirementsError when a check failed.
+func (d *RedisDatabase) VerifyRequirements(req Requirements) (*RequirementsReport, error) {
+	c, err := d.Capabilities()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RequirementsReport{}
+	if req.MinVersion != (ServerVersion{}) {
+		report.Checks = append(report.Checks, RequirementCheck{
+			Name: "server version",
+			Want: req.MinVersion.String() + " or later",
+			Got:  c.Version.String(),
+			OK:   c.Version.AtLeast(req.MinVersion),
+		})
+	}
+	for _, f := range req.Features {
+		report.Checks = append(report.Checks, RequirementCheck{
+			Name: "feature " + string(f),
+			Want: featureVersions[f].String() + " or later",
+			Got:  c.Version.String(),
+			OK:   c.Supports(f),
+		})
+	}
+	for _, m := range req.Modules {
+		check := RequirementCheck{Name: "module " + m, Want: "loaded", Got: "not loaded"}
+		if ver, ok := c.Modules[strings.ToLower(m)]; ok {
+			check.Got, check.OK = fmt.Sprintf("version %d", ver), true
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	if len(req.MaxMemoryPolicies) > 0 {
+		check := RequirementCheck{Name: "maxmemory-policy", Want: strings.Join(req.MaxMemoryPolicies, " or ")}
+		policy, err := d.configGet("maxmemory-policy")
+		if err != nil {
+			check.Got, check.Skipped = err.Error(), true
+		} else {
+			check.Got = policy
+			for _, p := range req.MaxMemoryPolicies {
+				check.OK = check.OK || strings.EqualFold(p, policy)
+			}
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	if req.KeyspaceEvents != "" {
+		check := RequirementCheck{Name: "notify-keyspace-events", Want: req.KeyspaceEvents}
+		flags, err := d.configGet("notify-keyspace-events")
+		if err != nil {
+			check.Got, check.Skipped = err.Error(), true
+		} else {
+			check.Got = flags
+			if flags == "" {
+				check.Got = "disabled"
+			}
+			check.OK = keyspaceEventsEnabled(flags, req.KeyspaceEvents)
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	if !report.OK() {
+		return report, &RequirementsError{Report: report}
+	}
+	return report, nil
+}
+
+// keyspaceEventsEnabled reports whether every flag of want is set in flags, expanding
+// the A alias for all event classes.
+func keyspaceEventsEnabled(flags string, want string) bool {
+	flags = strings.ReplaceAll(flags, "A", "g$lshzxetd")
+	for _, f := range strings.ReplaceAll(want, "A", "g$lshzxetd") {
+		if !strings.ContainsRune(flags, f) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *RedisDatabase) configGet(parameter string) (string, error) {
+	values, err := redis.Strings(d.Do("CONFIG", "GET", parameter))
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", parameter, err)
+	}
+	if len(values) < 2 {
+		return "", fmt.Errorf("redis: %s is not reported by CONFIG GET", parameter)
+	}
+	return values[1], nil
+}
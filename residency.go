@@ -0,0 +1,189 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrResidencyViolation is matched by errors.Is when a write was rejected because its key
+// must be stored in a different region than the one the handle is tagged with.
+var ErrResidencyViolation = errors.New("redis: data residency violation")
+
+// ResidencyViolationError reports the write and the regions its key is restricted to.
+type ResidencyViolationError struct {
+	Command string
+	Key     string
+	// Region is the region of the handle, empty when it was not tagged with WithRegion.
+	Region  string
+	Allowed []string
+}
+
+func (e *ResidencyViolationError) Error() string {
+	region := e.Region
+	if region == "" {
+		region = "untagged"
+	}
+	return fmt.Sprintf("redis: %s %s may only be written in region %s, handle region is %s",
+		e.Command, e.Key, strings.Join(e.Allowed, " or "), region)
+}
+
+func (e *ResidencyViolationError) Is(target error) bool {
+	return target == ErrResidencyViolation
+}
+
+// WithRegion tags the handle with the region its server runs in, such as "eu", for the
+// rules registered with WithResidency.
+func WithRegion(region string) Option {
+	return func(o *options) {
+		o.residency.region = region
+	}
+}
+
+// WithResidency restricts keys starting with prefix to handles tagged with one of
+// regions. Writes of such keys through any other handle, including untagged ones, fail
+// with ErrResidencyViolation before they are sent. When several prefixes match a key the
+// longest one decides. Reads and deletes are not restricted.
+//
+// The rules are checked on every connection of the handle, so they also cover
+// pipelines, transactions and the helpers built on them. Scripts are checked against the
+// keys they declare.
+func WithResidency(prefix string, regions ...string) Option {
+	return func(o *options) {
+		o.residency.rules = append(o.residency.rules, residencyRule{prefix: prefix, regions: regions})
+	}
+}
+
+// Region returns the region set with WithRegion.
+func (d *RedisDatabase) Region() string {
+	return d.options().residency.region
+}
+
+type residencyRule struct {
+	prefix  string
+	regions []string
+}
+
+type residencyPolicy struct {
+	region string
+	rules  []residencyRule
+}
+
+// check returns a ResidencyViolationError when the command writes a key that may not be
+// stored in the region of the handle.
+func (p *residencyPolicy) check(commandName string, args []interface{}) error {
+	if p == nil || len(p.rules) == 0 {
+		return nil
+	}
+	for _, key := range writtenKeys(commandName, args) {
+		rule := p.rule(key)
+		if rule == nil || containsString(rule.regions, p.region) {
+			continue
+		}
+		return &ResidencyViolationError{Command: commandName, Key: key, Region: p.region, Allowed: rule.regions}
+	}
+	return nil
+}
+
+// rule returns the rule with the longest prefix matching key, nil when none does.
+func (p *residencyPolicy) rule(key string) *residencyRule {
+	var match *residencyRule
+	for i := range p.rules {
+		r := &p.rules[i]
+		if strings.HasPrefix(key, r.prefix) && (match == nil || len(r.prefix) > len(match.prefix)) {
+			match = r
+		}
+	}
+	return match
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// residencyWrites are the commands whose first argument is the key they store.
+var residencyWrites = map[string]bool{
+	"SET": true, "SETEX": true, "PSETEX": true, "SETNX": true, "GETSET": true, "APPEND": true,
+	"SETRANGE": true, "SETBIT": true, "BITFIELD": true, "INCR": true, "INCRBY": true,
+	"INCRBYFLOAT": true, "DECR": true, "DECRBY": true, "RESTORE": true,
+	"HSET": true, "HSETNX": true, "HMSET": true, "HINCRBY": true, "HINCRBYFLOAT": true,
+	"LPUSH": true, "RPUSH": true, "LPUSHX": true, "RPUSHX": true, "LINSERT": true, "LSET": true,
+	"SADD": true, "ZADD": true, "ZINCRBY": true, "XADD": true, "PFADD": true, "GEOADD": true,
+	"SINTERSTORE": true, "SUNIONSTORE": true, "SDIFFSTORE": true, "ZINTERSTORE": true,
+	"ZUNIONSTORE": true, "ZDIFFSTORE": true, "ZRANGESTORE": true, "GEOSEARCHSTORE": true,
+	"PFMERGE": true,
+}
+
+// residencyDestinations are the commands whose second argument is the key they store.
+var residencyDestinations = map[string]bool{
+	"RENAME": true, "RENAMENX": true, "COPY": true, "SMOVE": true, "LMOVE": true,
+	"BLMOVE": true, "RPOPLPUSH": true, "BRPOPLPUSH": true, "BITOP": true,
+}
+
+// writtenKeys returns the keys a command stores data under, nil for reads, deletes and
+// commands without keys.
+func writtenKeys(commandName string, args []interface{}) []string {
+	name := strings.ToUpper(commandName)
+	switch {
+	case residencyWrites[name]:
+		if len(args) > 0 {
+			return []string{argString(args[0])}
+		}
+	case residencyDestinations[name]:
+		if len(args) > 1 {
+			return []string{argString(args[1])}
+		}
+	case name == "MSET" || name == "MSETNX":
+		var keys []string
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, argString(args[i]))
+		}
+		return keys
+	case name == "EVAL" || name == "EVALSHA" || name == "FCALL":
+		if len(args) < 2 {
+			return nil
+		}
+		n, err := strconv.Atoi(fmt.Sprint(args[1]))
+		if err != nil {
+			return nil
+		}
+		var keys []string
+		for i := 2; i < 2+n && i < len(args); i++ {
+			keys = append(keys, argString(args[i]))
+		}
+		return keys
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math/rand"
+)
+
+// hRandFieldScript emulates HRANDFIELD key count [WITHVALUES] on servers before 6.2.
+// Redis scripts get a fixed random seed, so the caller passes one in ARGV[3].
+var hRandFieldScript = redis.NewScript(1, `
+local count = tonumber(ARGV[1])
+local withvalues = ARGV[2] == '1'
+math.randomseed(tonumber(ARGV[3]))
+local flat = redis.call('HGETALL', KEYS[1])
+local n = #flat / 2
+local out = {}
+if n == 0 then
+  return out
+end
+local function push(i)
+  table.insert(out, flat[2 * i - 1])
+  if withvalues then
+    table.insert(out, flat[2 * i])
+  end
+end
+if count < 0 then
+  for _ = 1, -count do
+    push(math.random(n))
+  end
+else
+  local idx = {}
+  for i = 1, n do
+    idx[i] = i
+  end
+  for i = 1, math.min(count, n) do
+    local j = math.random(i, n)
+    idx[i], idx[j] = idx[j], idx[i]
+    push(idx[i])
+  end
+end
+return out`)
+
+// FieldValue is a hash field with its value.
+type FieldValue struct {
+	Field string
+	Value string
+}
+
+// HRandField returns up to count distinct random fields of the hash at key. A negative
+// count returns exactly -count fields that may repeat. Servers before 6.2 are served by
+// a Lua script.
+func (d *RedisDatabase) HRandField(key string, count int) ([]string, error) {
+	replies, err := d.hRandField(key, count, false)
+	if err != nil {
+		return nil, err
+	}
+	return redis.Strings(replies, nil)
+}
+
+// HRandFieldWithValues is HRandField returning the values along with the fields.
+func (d *RedisDatabase) HRandFieldWithValues(key string, count int) ([]FieldValue, error) {
+	replies, err := d.hRandField(key, count, true)
+	if err != nil {
+		return nil, err
+	}
+	flat, err := redis.Strings(replies, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error sampling fields of key %s: %w", key, err)
+	}
+	fields := make([]FieldValue, 0, len(flat)/2)
+	for i := 0; i+1 < len(flat); i += 2 {
+		fields = append(fields, FieldValue{Field: flat[i], Value: flat[i+1]})
+	}
+	return fields, nil
+}
+
+func (d *RedisDatabase) hRandField(key string, count int, withValues bool) ([]interface{}, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close sampling fields of key %s: %v", key, err)
+		}
+	}(conn)
+
+	var replies []interface{}
+	var err error
+	if d.supports(FeatureHRandField) {
+		args := []interface{}{key, count}
+		if withValues {
+			args = append(args, "WITHVALUES")
+		}
+		replies, err = redis.Values(d.do(conn, "HRANDFIELD", args...))
+	} else {
+		flag := 0
+		if withValues {
+			flag = 1
+		}
+		replies, err = redis.Values(hRandFieldScript.Do(instrumentedConn{conn, d}, key, count, flag, rand.Int31()))
+	}
+	if err != nil && err != redis.ErrNil {
+		return nil, fmt.Errorf("error sampling fields of key %s: %w", key, err)
+	}
+	return replies, nil
+}
+
+// SRandMember returns up to count distinct random members of the set at key. A negative
+// count returns exactly -count members that may repeat.
+func (d *RedisDatabase) SRandMember(key string, count int) ([]string, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close sampling members of key %s: %v", key, err)
+		}
+	}(conn)
+
+	members, err := redis.Strings(d.do(conn, "SRANDMEMBER", key, count))
+	if err != nil && err != redis.ErrNil {
+		return nil, fmt.Errorf("error sampling members of key %s: %w", key, err)
+	}
+	return members, nil
+}
@@ -0,0 +1,162 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Script wraps a redis.Script, called by its SHA1 with EVALSHA. When the server does not
+// know the script, for example after a restart or a failover, it is sent once with EVAL,
+// which also loads it for the following calls. Unlike redis.Script it runs on a
+// RedisDatabase, so calls go through the same limits, timeouts and metrics as every other
+// command, and keys and arguments are passed separately.
+type Script struct {
+	script *redis.Script
+}
+
+// NewScript registers the Lua body src. It is usually assigned to a package variable.
+func NewScript(src string) *Script {
+	return &Script{script: redis.NewScript(-1, src)}
+}
+
+// Redis returns the underlying redis.Script, for APIs taking one such as EvalCached. Its
+// key count is not fixed, so the number of keys is the first of keysAndArgs.
+func (s *Script) Redis() *redis.Script {
+	return s.script
+}
+
+// Hash returns the SHA1 of the script body.
+func (s *Script) Hash() string {
+	return s.script.Hash()
+}
+
+// Load sends the script with SCRIPT LOAD, so the first call does not need EVAL.
+func (s *Script) Load(d *RedisDatabase) error {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close loading script %s: %v", s.Hash(), err)
+		}
+	}(conn)
+
+	if err := s.script.Load(instrumentedConn{conn, d}); err != nil {
+		return fmt.Errorf("error loading script %s: %w", s.Hash(), err)
+	}
+	return nil
+}
+
+// Run calls the script with keys as KEYS and args as ARGV.
+func (s *Script) Run(d *RedisDatabase, keys []string, args ...interface{}) ScriptResult {
+	return s.RunContext(context.Background(), d, keys, args...)
+}
+
+// RunContext is Run bounded by ctx.
+func (s *Script) RunContext(ctx context.Context, d *RedisDatabase, keys []string, args ...interface{}) ScriptResult {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return ScriptResult{Err: fmt.Errorf("error running script %s: %w", s.Hash(), err)}
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close running script %s: %v", s.Hash(), err)
+		}
+	}(conn)
+
+	keysAndArgs := make([]interface{}, 0, 1+len(keys)+len(args))
+	keysAndArgs = append(keysAndArgs, len(keys))
+	for _, key := range keys {
+		keysAndArgs = append(keysAndArgs, key)
+	}
+	keysAndArgs = append(keysAndArgs, args...)
+
+	reply, err := s.script.DoContext(ctx, instrumentedConn{conn, d}, keysAndArgs...)
+	if err != nil {
+		return ScriptResult{Reply: reply, Err: fmt.Errorf("error running script %s: %w", s.Hash(), err)}
+	}
+	return ScriptResult{Reply: reply}
+}
+
+// ScriptResult is the reply of a script with conversions to Go types. The conversions
+// return redis.ErrNil when the script returned nil.
+type ScriptResult struct {
+	Reply interface{}
+	Err   error
+}
+
+// Int64 converts an integer reply.
+func (r ScriptResult) Int64() (int64, error) {
+	return redis.Int64(r.Reply, r.Err)
+}
+
+// Int converts an integer reply.
+func (r ScriptResult) Int() (int, error) {
+	return redis.Int(r.Reply, r.Err)
+}
+
+// Bool converts an integer reply, where Lua true is 1 and false is nil.
+func (r ScriptResult) Bool() (bool, error) {
+	if r.Err == nil && r.Reply == nil {
+		return false, nil
+	}
+	return redis.Bool(r.Reply, r.Err)
+}
+
+// String converts a bulk or status reply.
+func (r ScriptResult) String() (string, error) {
+	return redis.String(r.Reply, r.Err)
+}
+
+// Bytes converts a bulk or status reply.
+func (r ScriptResult) Bytes() ([]byte, error) {
+	return redis.Bytes(r.Reply, r.Err)
+}
+
+// Values converts an array reply.
+func (r ScriptResult) Values() ([]interface{}, error) {
+	return redis.Values(r.Reply, r.Err)
+}
+
+// Strings converts an array of bulk replies.
+func (r ScriptResult) Strings() ([]string, error) {
+	return redis.Strings(r.Reply, r.Err)
+}
+
+// Int64s converts an array of integer replies.
+func (r ScriptResult) Int64s() ([]int64, error) {
+	return redis.Int64s(r.Reply, r.Err)
+}
+
+// StringMap converts an array of alternating field and value replies, as returned by
+// HGETALL.
+func (r ScriptResult) StringMap() (map[string]string, error) {
+	return redis.StringMap(r.Reply, r.Err)
+}
@@ -0,0 +1,87 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// ScriptCache memoizes the replies of expensive read-only Lua scripts in process, so a
+// burst of identical calls costs one evaluation per ttl. Only use it for scripts whose
+// result depends on nothing but their keys and arguments, and treat cached replies as
+// read-only since they are shared between callers.
+type ScriptCache struct {
+	lru *lruCache
+	ttl time.Duration
+}
+
+// NewScriptCache creates a cache of up to size replies, each kept for ttl.
+func NewScriptCache(size int, ttl time.Duration) *ScriptCache {
+	return &ScriptCache{lru: newLRUCache(size), ttl: ttl}
+}
+
+func (c *ScriptCache) key(script *redis.Script, keysAndArgs []interface{}) string {
+	h := sha1.New()
+	h.Write([]byte(script.Hash()))
+	for _, arg := range keysAndArgs {
+		v := fmt.Sprint(arg)
+		if b, ok := arg.([]byte); ok {
+			v = string(b)
+		}
+		_, _ = fmt.Fprintf(h, "%d:%s", len(v), v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// EvalCached runs script like script.Do, returning a cached reply when the same script was
+// called with the same keys and arguments within the cache ttl. Errors are not cached.
+// Pass Script.Redis for a Script, with the number of keys first in keysAndArgs.
+func (d *RedisDatabase) EvalCached(cache *ScriptCache, script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	key := cache.key(script, keysAndArgs)
+	if reply, ok := cache.lru.get(key); ok {
+		return reply, nil
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close evaluating script %s: %v", script.Hash(), err)
+		}
+	}(conn)
+
+	reply, err := script.Do(instrumentedConn{conn, d}, keysAndArgs...)
+	if err != nil {
+		return reply, fmt.Errorf("error evaluating script %s: %w", script.Hash(), err)
+	}
+	cache.lru.add(key, reply, cache.ttl)
+	return reply, nil
+}
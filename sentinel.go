@@ -0,0 +1,226 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net"
+	"strings"
+	"time"
+)
+
+// SentinelEndpoints is an EndpointSource reporting the address of the current master of
+// masterName as known by the sentinels at sentinelAddrs. It follows +switch-master
+// events for fast failovers and asks the sentinels again every interval [5s] in case an
+// event was missed. dialOptions apply to the sentinel connections, for example their
+// password.
+func SentinelEndpoints(masterName string, sentinelAddrs []string, interval time.Duration, dialOptions ...redis.DialOption) EndpointSource {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &sentinelSource{master: masterName, sentinels: sentinelAddrs, interval: interval, dialOptions: dialOptions, clock: SystemClock}
+}
+
+type sentinelSource struct {
+	master      string
+	sentinels   []string
+	interval    time.Duration
+	dialOptions []redis.DialOption
+	clock       Clock
+}
+
+func (s *sentinelSource) Endpoints(ctx context.Context) (<-chan []string, error) {
+	addr, err := s.masterAddr(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make(chan []string, 1)
+	updates <- []string{addr}
+	switched := make(chan string, 1)
+	go s.watch(ctx, switched)
+	go func() {
+		defer close(updates)
+		ticker := s.clock.NewTicker(s.interval)
+		defer ticker.Stop()
+		last := addr
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case addr = <-switched:
+			case <-ticker.C():
+				if addr, err = s.masterAddr(ctx); err != nil {
+					continue
+				}
+			}
+			if addr == last {
+				continue
+			}
+			last = addr
+			select {
+			case updates <- []string{addr}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// masterAddr asks the sentinels in turn for the master address.
+func (s *sentinelSource) masterAddr(ctx context.Context) (string, error) {
+	err := fmt.Errorf("redis: no sentinel addresses")
+	for _, sentinel := range s.sentinels {
+		var addr string
+		addr, err = s.query(ctx, sentinel)
+		if err == nil {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("error resolving master %s: %w", s.master, err)
+}
+
+func (s *sentinelSource) query(ctx context.Context, sentinel string) (string, error) {
+	conn, err := redis.DialContext(ctx, "tcp", sentinel, s.dialOptions...)
+	if err != nil {
+		return "", err
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close sentinel %s: %v", sentinel, err)
+		}
+	}(conn)
+
+	hostPort, err := redis.Strings(redis.DoContext(conn, ctx, "SENTINEL", "get-master-addr-by-name", s.master))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("redis: sentinel %s does not know master %s", sentinel, s.master)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(hostPort) != 2 {
+		return "", fmt.Errorf("redis: unexpected reply from sentinel %s: %v", sentinel, hostPort)
+	}
+	return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+}
+
+// watch subscribes to +switch-master on the sentinels in turn and sends the new master
+// address of every failover of s.master until ctx is done.
+func (s *sentinelSource) watch(ctx context.Context, switched chan<- string) {
+	for i := 0; ctx.Err() == nil; i++ {
+		if len(s.sentinels) > 0 {
+			s.subscribe(ctx, s.sentinels[i%len(s.sentinels)], switched)
+		}
+		select {
+		case <-ctx.Done():
+		case <-s.clock.After(time.Second):
+		}
+	}
+}
+
+func (s *sentinelSource) subscribe(ctx context.Context, sentinel string, switched chan<- string) {
+	conn, err := redis.DialContext(ctx, "tcp", sentinel, s.dialOptions...)
+	if err != nil {
+		return
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer func() {
+		_ = psc.Close()
+	}()
+	// closing the connection ends the blocking Receive once ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = psc.Close()
+		case <-done:
+		}
+	}()
+
+	if err := psc.Subscribe("+switch-master"); err != nil {
+		return
+	}
+	for {
+		switch m := psc.Receive().(type) {
+		case error:
+			return
+		case redis.Message:
+			// <master name> <old ip> <old port> <new ip> <new port>
+			fields := strings.Fields(string(m.Data))
+			if len(fields) != 5 || fields[0] != s.master {
+				continue
+			}
+			select {
+			case switched <- net.JoinHostPort(fields[3], fields[4]):
+			default:
+			}
+		}
+	}
+}
+
+// WithSentinelDialOptions appends redigo dial options for the sentinel connections of
+// SetupSentinel, for example redis.DialPassword when the sentinels require one.
+func WithSentinelDialOptions(dialOptions ...redis.DialOption) Option {
+	return func(o *options) {
+		o.sentinelDialOptions = append(o.sentinelDialOptions, dialOptions...)
+	}
+}
+
+// SetupSentinel is SetupDatabaseE for the master of masterName, discovered through the
+// sentinels at sentinelAddrs. After a failover new connections are dialed to the new
+// master and idle connections to the old one are dropped, see EndpointResolver. Options
+// such as WithCredentials apply to the master connections. Close the database to stop
+// following the sentinels.
+// noinspection GoUnusedExportedFunction
+func SetupSentinel(masterName string, sentinelAddrs []string, opts ...Option) (*RedisDatabase, error) {
+	o := newOptions(opts)
+	source := SentinelEndpoints(masterName, sentinelAddrs, 0, o.sentinelDialOptions...).(*sentinelSource)
+	source.clock = o.clock
+	r, err := NewEndpointResolver(source)
+	if err != nil {
+		return nil, err
+	}
+	addrs := r.Addresses()
+	if len(addrs) == 0 {
+		r.Close()
+		return nil, fmt.Errorf("redis: sentinels did not report master %s", masterName)
+	}
+
+	d, err := openDatabase("redis://"+addrs[0], append(opts, WithEndpointResolver(r), func(o *options) {
+		o.ownsResolver = true
+	})...)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,159 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// SetOptions are the conditions and expiry of SetWithOptions and SetGet. The zero value
+// is a plain SET that clears any time to live.
+type SetOptions struct {
+	// NX only sets keys that do not exist.
+	NX bool
+	// XX only sets keys that already exist.
+	XX bool
+	// TTL expires the key after the duration.
+	TTL time.Duration
+	// ExpireAt expires the key at the time, it needs Redis 6.2 or later.
+	ExpireAt time.Time
+	// KeepTTL retains the time to live of an existing key.
+	KeepTTL bool
+}
+
+// args returns the SET arguments following key and value.
+func (o SetOptions) args() ([]interface{}, error) {
+	if o.NX && o.XX {
+		return nil, fmt.Errorf("redis: set options NX and XX are exclusive")
+	}
+	expiries := 0
+	for _, set := range []bool{o.TTL != 0, !o.ExpireAt.IsZero(), o.KeepTTL} {
+		if set {
+			expiries++
+		}
+	}
+	if expiries > 1 {
+		return nil, fmt.Errorf("redis: set options TTL, ExpireAt and KeepTTL are exclusive")
+	}
+	if o.TTL < 0 || (o.TTL > 0 && o.TTL < time.Millisecond) {
+		return nil, fmt.Errorf("redis: set ttl must be at least 1ms")
+	}
+
+	var args []interface{}
+	switch {
+	case o.NX:
+		args = append(args, "NX")
+	case o.XX:
+		args = append(args, "XX")
+	}
+	switch {
+	case o.TTL > 0:
+		args = append(args, "PX", o.TTL.Milliseconds())
+	case !o.ExpireAt.IsZero():
+		args = append(args, "PXAT", o.ExpireAt.UnixMilli())
+	case o.KeepTTL:
+		args = append(args, "KEEPTTL")
+	}
+	return args, nil
+}
+
+// SetWithOptions sets key to value in a single SET, so conditions and expiry apply
+// atomically, and reports whether the key was set. It is false when NX or XX prevented
+// the write.
+func (d *RedisDatabase) SetWithOptions(key string, value []byte, opts SetOptions) (bool, error) {
+	return d.SetWithOptionsContext(context.Background(), key, value, opts)
+}
+
+// SetWithOptionsContext is SetWithOptions bounded by ctx.
+func (d *RedisDatabase) SetWithOptionsContext(ctx context.Context, key string, value []byte, opts SetOptions) (bool, error) {
+	args, err := opts.args()
+	if err != nil {
+		return false, err
+	}
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error setting key %s: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close setting key %s: %v", key, err)
+		}
+	}(conn)
+
+	reply, err := d.doContext(ctx, conn, "SET", append([]interface{}{key, value}, args...)...)
+	if err != nil {
+		return false, fmt.Errorf("error setting key %s to %s: %w", key, d.options().redact(value), err)
+	}
+	return reply != nil, nil
+}
+
+// SetGet sets key to value like SetWithOptions and returns the value it replaced, with
+// existed false when the key did not exist before. With NX the key was set exactly when
+// existed is false, with XX exactly when it is true. It uses SET GET on Redis 6.2 and
+// later and a Lua script on older servers or with NX, which SET GET only accepts from
+// Redis 7.
+func (d *RedisDatabase) SetGet(key string, value []byte, opts SetOptions) (old []byte, existed bool, err error) {
+	return d.SetGetContext(context.Background(), key, value, opts)
+}
+
+// SetGetContext is SetGet bounded by ctx.
+func (d *RedisDatabase) SetGetContext(ctx context.Context, key string, value []byte, opts SetOptions) ([]byte, bool, error) {
+	args, err := opts.args()
+	if err != nil {
+		return nil, false, err
+	}
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("error setting key %s: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close setting key %s: %v", key, err)
+		}
+	}(conn)
+
+	var old []byte
+	if !opts.NX && d.supports(FeatureSetGet) {
+		old, err = redis.Bytes(d.doContext(ctx, conn, "SET", append([]interface{}{key, value, "GET"}, args...)...))
+	} else {
+		old, err = redis.Bytes(setGetScript.Do(instrumentedConn{conn, d}, append([]interface{}{key, value}, args...)...))
+	}
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error setting key %s to %s: %w", key, d.options().redact(value), err)
+	}
+	return old, true, nil
+}
@@ -0,0 +1,146 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+// SAdd adds members to the set at key and returns how many were not members yet.
+func (d *RedisDatabase) SAdd(key string, members ...string) (int, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	added, err := redis.Int(d.Do("SADD", redis.Args{key}.AddFlat(members)...))
+	if err != nil {
+		return 0, fmt.Errorf("error adding to set %s: %w", key, err)
+	}
+	return added, nil
+}
+
+// SRem removes members from the set at key and returns how many were members.
+func (d *RedisDatabase) SRem(key string, members ...string) (int, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	removed, err := redis.Int(d.Do("SREM", redis.Args{key}.AddFlat(members)...))
+	if err != nil {
+		return 0, fmt.Errorf("error removing from set %s: %w", key, err)
+	}
+	return removed, nil
+}
+
+// SIsMember reports whether member is in the set at key.
+func (d *RedisDatabase) SIsMember(key string, member string) (bool, error) {
+	ok, err := redis.Bool(d.Do("SISMEMBER", key, member))
+	if err != nil {
+		return false, fmt.Errorf("error checking member of set %s: %w", key, err)
+	}
+	return ok, nil
+}
+
+// SMembers returns all members of the set at key. Use it for small sets only, it reads
+// the whole set in one reply.
+func (d *RedisDatabase) SMembers(key string) ([]string, error) {
+	members, err := redis.Strings(d.Do("SMEMBERS", key))
+	if err != nil {
+		return nil, fmt.Errorf("error getting members of set %s: %w", key, err)
+	}
+	return members, nil
+}
+
+// SCard returns the number of members of the set at key.
+func (d *RedisDatabase) SCard(key string) (int, error) {
+	n, err := redis.Int(d.Do("SCARD", key))
+	if err != nil {
+		return 0, fmt.Errorf("error counting members of set %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// SPop removes and returns up to count random members of the set at key.
+func (d *RedisDatabase) SPop(key string, count int) ([]string, error) {
+	members, err := redis.Strings(d.Do("SPOP", key, count))
+	if err != nil && err != redis.ErrNil {
+		return nil, fmt.Errorf("error popping from set %s: %w", key, err)
+	}
+	return members, nil
+}
+
+// SInter returns the members present in every set of keys.
+func (d *RedisDatabase) SInter(keys ...string) ([]string, error) {
+	return d.setAlgebra("SINTER", keys)
+}
+
+// SUnion returns the members present in any set of keys.
+func (d *RedisDatabase) SUnion(keys ...string) ([]string, error) {
+	return d.setAlgebra("SUNION", keys)
+}
+
+// SDiff returns the members of the first set of keys that are in none of the others.
+func (d *RedisDatabase) SDiff(keys ...string) ([]string, error) {
+	return d.setAlgebra("SDIFF", keys)
+}
+
+// SInterStore is SInter storing the result in the set at destination, replacing it, and
+// returning its size.
+func (d *RedisDatabase) SInterStore(destination string, keys ...string) (int, error) {
+	return d.setAlgebraStore("SINTERSTORE", destination, keys)
+}
+
+// SUnionStore is SUnion storing the result in the set at destination.
+func (d *RedisDatabase) SUnionStore(destination string, keys ...string) (int, error) {
+	return d.setAlgebraStore("SUNIONSTORE", destination, keys)
+}
+
+// SDiffStore is SDiff storing the result in the set at destination.
+func (d *RedisDatabase) SDiffStore(destination string, keys ...string) (int, error) {
+	return d.setAlgebraStore("SDIFFSTORE", destination, keys)
+}
+
+func (d *RedisDatabase) setAlgebra(command string, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("redis: at least one key is required")
+	}
+	members, err := redis.Strings(d.Do(command, redis.Args{}.AddFlat(keys)...))
+	if err != nil {
+		return nil, fmt.Errorf("error running %s on %v: %w", command, keys, err)
+	}
+	return members, nil
+}
+
+func (d *RedisDatabase) setAlgebraStore(command string, destination string, keys []string) (int, error) {
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("redis: at least one key is required")
+	}
+	n, err := redis.Int(d.Do(command, redis.Args{destination}.AddFlat(keys)...))
+	if err != nil {
+		return 0, fmt.Errorf("error running %s into %s: %w", command, destination, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,157 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// ShardedCounter spreads increments of one logical counter across several sub-keys, so
+// a very hot counter is not limited by a single key or cluster shard. Reads sum the
+// sub-keys and a rollup key that Rollup periodically folds them into.
+//
+// Sub-keys are named "<key>:shard:<n>" and the rollup key "<key>:total". Give key a hash
+// tag only if the sub-keys should stay on one cluster shard.
+type ShardedCounter struct {
+	d      *RedisDatabase
+	key    string
+	shards int
+}
+
+// NewShardedCounter returns a counter spread over shards sub-keys.
+func NewShardedCounter(d *RedisDatabase, key string, shards int) *ShardedCounter {
+	if shards <= 0 {
+		shards = 1
+	}
+	return &ShardedCounter{d: d, key: key, shards: shards}
+}
+
+func (c *ShardedCounter) shardKey(n int) string {
+	return c.key + ":shard:" + strconv.Itoa(n)
+}
+
+func (c *ShardedCounter) totalKey() string {
+	return c.key + ":total"
+}
+
+// IncrBy adds delta to a random sub-key.
+func (c *ShardedCounter) IncrBy(delta int64) error {
+	shard := c.shardKey(rand.Intn(c.shards))
+	if _, err := redis.Int64(c.d.Do("INCRBY", shard, delta)); err != nil {
+		return fmt.Errorf("error incrementing counter %s: %w", c.key, err)
+	}
+	return nil
+}
+
+// Incr adds one to the counter.
+func (c *ShardedCounter) Incr() error {
+	return c.IncrBy(1)
+}
+
+// Value returns the sum of the rollup key and all sub-keys.
+func (c *ShardedCounter) Value() (int64, error) {
+	conn := c.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reading counter %s: %v", c.key, err)
+		}
+	}(conn)
+
+	keys := []string{c.totalKey()}
+	for n := 0; n < c.shards; n++ {
+		keys = append(keys, c.shardKey(n))
+	}
+	for _, key := range keys {
+		if err := conn.Send("GET", key); err != nil {
+			return 0, fmt.Errorf("error reading counter %s: %w", c.key, err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return 0, fmt.Errorf("error reading counter %s: %w", c.key, err)
+	}
+
+	var sum int64
+	for _, key := range keys {
+		v, err := redis.Int64(conn.Receive())
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error reading counter %s: %w", key, err)
+		}
+		sum += v
+	}
+	return sum, nil
+}
+
+// Rollup moves the value of every sub-key into the rollup key, keeping the number of
+// non-zero sub-keys small for readers. Each sub-key is swapped to zero atomically, but
+// a process dying between the swap and the addition to the rollup key loses that share.
+func (c *ShardedCounter) Rollup() error {
+	conn := c.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close rolling up counter %s: %v", c.key, err)
+		}
+	}(conn)
+
+	for n := 0; n < c.shards; n++ {
+		shard := c.shardKey(n)
+		v, err := redis.Int64(c.d.do(conn, "GETSET", shard, 0))
+		if err == redis.ErrNil || (err == nil && v == 0) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error rolling up counter %s: %w", shard, err)
+		}
+		if _, err := c.d.do(conn, "INCRBY", c.totalKey(), v); err != nil {
+			// give the share back so it is not lost
+			_, _ = c.d.Do("INCRBY", shard, v)
+			return fmt.Errorf("error rolling up counter %s: %w", c.key, err)
+		}
+	}
+	return nil
+}
+
+// StartRollup runs Rollup every interval until the returned stop function is called,
+// which waits for a rollup in progress. Errors are passed to onError, which may be nil.
+func (c *ShardedCounter) StartRollup(interval time.Duration, onError func(err error)) (stop func()) {
+	return startLoop(c.d.options().clock.NewTicker(interval), func() {
+		if err := c.Rollup(); err != nil && onError != nil {
+			_ = c.d.options().call("sharded counter rollup error callback", func() error {
+				onError(err)
+				return nil
+			})
+		}
+	})
+}
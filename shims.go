@@ -0,0 +1,141 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// Scripts emulating commands that older servers lack.
+var (
+	getDelScript = redis.NewScript(1, `
+local v = redis.call('GET', KEYS[1])
+if v then
+  redis.call('DEL', KEYS[1])
+end
+return v`)
+
+	getExScript = redis.NewScript(1, `
+local v = redis.call('GET', KEYS[1])
+if v then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return v`)
+
+	setGetScript = redis.NewScript(1, `
+local v = redis.call('GET', KEYS[1])
+redis.call('SET', KEYS[1], unpack(ARGV))
+return v`)
+)
+
+// supports reports whether the server provides f. When the server can not be probed it
+// assumes the feature is missing so the portable fallback is used.
+func (d *RedisDatabase) supports(f Feature) bool {
+	c, err := d.Capabilities()
+	return err == nil && c.Supports(f)
+}
+
+// Unlink removes key, reclaiming memory in the background with UNLINK on Redis 4 and later
+// and falling back to DEL on older servers.
+func (d *RedisDatabase) Unlink(key string) error {
+	command := "DEL"
+	if d.supports(FeatureUnlink) {
+		command = "UNLINK"
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close unlinking key %s: %v", key, err)
+		}
+	}(conn)
+
+	_, err := d.do(conn, command, key)
+	if err != nil {
+		return fmt.Errorf("error unlinking key %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetDel returns the value of key and deletes it atomically, with GETDEL on Redis 6.2 and
+// later and a Lua script on older servers. It fails with ErrKeyNotFound when key does not
+// exist.
+func (d *RedisDatabase) GetDel(key string) ([]byte, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close getting and deleting key %s: %v", key, err)
+		}
+	}(conn)
+
+	var data []byte
+	var err error
+	if d.supports(FeatureGetDel) {
+		data, err = redis.Bytes(d.do(conn, "GETDEL", key))
+	} else {
+		data, err = redis.Bytes(getDelScript.Do(instrumentedConn{conn, d}, key))
+	}
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("error getting and deleting key %s: %w", key, ErrKeyNotFound)
+	}
+	if err != nil {
+		return data, fmt.Errorf("error getting and deleting key %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// GetEx returns the value of key and sets its time to live, with GETEX on Redis 6.2 and
+// later and a Lua script on older servers. It fails with ErrKeyNotFound when key does not
+// exist.
+func (d *RedisDatabase) GetEx(key string, ttl time.Duration) ([]byte, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close getting key %s: %v", key, err)
+		}
+	}(conn)
+
+	var data []byte
+	var err error
+	if d.supports(FeatureGetEx) {
+		data, err = redis.Bytes(d.do(conn, "GETEX", key, "PX", ttl.Milliseconds()))
+	} else {
+		data, err = redis.Bytes(getExScript.Do(instrumentedConn{conn, d}, key, ttl.Milliseconds()))
+	}
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("error getting key %s: %w", key, ErrKeyNotFound)
+	}
+	if err != nil {
+		return data, fmt.Errorf("error getting key %s: %w", key, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,143 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+// copyHashScript copies the hash KEYS[1] to KEYS[2] with a TTL of ARGV[1] milliseconds on
+// servers without COPY.
+var copyHashScript = redis.NewScript(2, `
+local flat = redis.call('HGETALL', KEYS[1])
+redis.call('DEL', KEYS[2])
+if #flat == 0 then
+  return 0
+end
+for i = 1, #flat, 2000 do
+  redis.call('HMSET', KEYS[2], unpack(flat, i, math.min(i + 1999, #flat)))
+end
+redis.call('PEXPIRE', KEYS[2], ARGV[1])
+return 1`)
+
+// HashSnapshot is a point in time copy of a hash. Reads through the snapshot are consistent
+// with each other while writers keep changing the original.
+type HashSnapshot struct {
+	d *RedisDatabase
+	// Source is the snapshotted hash and Key the temporary copy.
+	Source string
+	Key    string
+}
+
+// SnapshotHash atomically copies the hash at key to a temporary key that expires after
+// ttl, with COPY on Redis 6.2 and later and a Lua script on older servers. The copy lives
+// in the same cluster slot as key. Release the snapshot when done to free it early.
+func (d *RedisDatabase) SnapshotHash(key string, ttl time.Duration) (*HashSnapshot, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("redis: snapshot ttl must be positive")
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	s := &HashSnapshot{d: d, Source: key, Key: sameSlotKey(key, ":snapshot:"+hex.EncodeToString(suffix))}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close snapshotting key %s: %v", key, err)
+		}
+	}(conn)
+
+	if d.supports(FeatureCopy) {
+		if err := conn.Send("MULTI"); err != nil {
+			return nil, fmt.Errorf("error snapshotting key %s: %w", key, err)
+		}
+		if err := conn.Send("COPY", key, s.Key); err != nil {
+			return nil, fmt.Errorf("error snapshotting key %s: %w", key, err)
+		}
+		if err := conn.Send("PEXPIRE", s.Key, ttl.Milliseconds()); err != nil {
+			return nil, fmt.Errorf("error snapshotting key %s: %w", key, err)
+		}
+		replies, err := redis.Values(d.do(conn, "EXEC"))
+		if err != nil {
+			return nil, fmt.Errorf("error snapshotting key %s: %w", key, err)
+		}
+		for _, reply := range replies {
+			if e, ok := reply.(redis.Error); ok {
+				return nil, fmt.Errorf("error snapshotting key %s: %v", key, e)
+			}
+		}
+		return s, nil
+	}
+
+	if _, err := copyHashScript.Do(instrumentedConn{conn, d}, key, s.Key, ttl.Milliseconds()); err != nil {
+		return nil, fmt.Errorf("error snapshotting key %s: %w", key, err)
+	}
+	return s, nil
+}
+
+// GetAll returns every field of the snapshot, decrypted with the WithFieldEncryption
+// policy of Source.
+func (s *HashSnapshot) GetAll() map[string]string {
+	values, _ := s.d.hmGetAll(context.Background(), s.Key, s.Source)
+	return values
+}
+
+// Fields returns the values of fields that exist in the snapshot and the fields that
+// do not, decrypted with the WithFieldEncryption policy of Source.
+func (s *HashSnapshot) Fields(fields ...string) (map[string]string, []string, error) {
+	return s.d.hmGetFields(context.Background(), s.Key, s.Source, fields)
+}
+
+// Keys returns the field names of the snapshot.
+func (s *HashSnapshot) Keys() []string {
+	return s.d.HMGetKeys(s.Key)
+}
+
+// Release deletes the snapshot before its TTL expires.
+func (s *HashSnapshot) Release() error {
+	return s.d.Delete(s.Key)
+}
+
+// sameSlotKey derives a key from key that hashes to the same cluster slot by reusing its
+// hash tag, or by making the whole key the hash tag when it has none.
+func sameSlotKey(key string, suffix string) string {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if end := strings.IndexByte(key[open+1:], '}'); end > 0 {
+			return key + suffix
+		}
+	}
+	return "{" + key + "}" + suffix
+}
@@ -0,0 +1,169 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrMemberNotFound is matched by errors.Is when a member is not in a sorted set.
+var ErrMemberNotFound = errors.New("redis: member not found")
+
+// ScoredMember is a member of a sorted set and its score.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// ZAdd adds members to the sorted set at key, updating the scores of existing ones, and
+// returns the number of members added.
+func (d *RedisDatabase) ZAdd(key string, members ...ScoredMember) (int, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	args := redis.Args{key}
+	for _, m := range members {
+		args = args.Add(m.Score, m.Member)
+	}
+	added, err := redis.Int(d.Do("ZADD", args...))
+	if err != nil {
+		return 0, fmt.Errorf("error adding to sorted set %s: %w", key, err)
+	}
+	return added, nil
+}
+
+// ZIncrBy adds delta to the score of member, adding it when needed, and returns the new
+// score.
+func (d *RedisDatabase) ZIncrBy(key string, member string, delta float64) (float64, error) {
+	score, err := redis.Float64(d.Do("ZINCRBY", key, delta, member))
+	if err != nil {
+		return 0, fmt.Errorf("error incrementing %s in sorted set %s: %w", member, key, err)
+	}
+	return score, nil
+}
+
+// ZScore returns the score of member, failing with ErrMemberNotFound when it is not in the
+// set.
+func (d *RedisDatabase) ZScore(key string, member string) (float64, error) {
+	score, err := redis.Float64(d.Do("ZSCORE", key, member))
+	if err == redis.ErrNil {
+		return 0, fmt.Errorf("error getting score of %s in sorted set %s: %w", member, key, ErrMemberNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error getting score of %s in sorted set %s: %w", member, key, err)
+	}
+	return score, nil
+}
+
+// ZRangeWithScores returns the members ranked start to stop, lowest score first. Negative
+// ranks count from the end, so 0 and -1 return the whole set.
+func (d *RedisDatabase) ZRangeWithScores(key string, start int, stop int) ([]ScoredMember, error) {
+	members, err := scoredMembers(d.Do("ZRANGE", key, start, stop, "WITHSCORES"))
+	if err != nil {
+		return nil, fmt.Errorf("error getting range of sorted set %s: %w", key, err)
+	}
+	return members, nil
+}
+
+// ZRevRangeWithScores is ZRangeWithScores with the highest score first.
+func (d *RedisDatabase) ZRevRangeWithScores(key string, start int, stop int) ([]ScoredMember, error) {
+	members, err := scoredMembers(d.Do("ZREVRANGE", key, start, stop, "WITHSCORES"))
+	if err != nil {
+		return nil, fmt.Errorf("error getting range of sorted set %s: %w", key, err)
+	}
+	return members, nil
+}
+
+// ZRevRangeByScore returns the members with scores from max down to min, highest first,
+// skipping offset members and returning at most count when count is positive. Use
+// math.Inf for open ends.
+func (d *RedisDatabase) ZRevRangeByScore(key string, max float64, min float64, offset int, count int) ([]ScoredMember, error) {
+	args := redis.Args{key, max, min, "WITHSCORES"}
+	if count > 0 {
+		args = args.Add("LIMIT", offset, count)
+	}
+	members, err := scoredMembers(d.Do("ZREVRANGEBYSCORE", args...))
+	if err != nil {
+		return nil, fmt.Errorf("error getting score range of sorted set %s: %w", key, err)
+	}
+	return members, nil
+}
+
+// ZRank returns the 0 based rank of member, lowest score first, failing with
+// ErrMemberNotFound when it is not in the set.
+func (d *RedisDatabase) ZRank(key string, member string) (int64, error) {
+	return d.zrank("ZRANK", key, member)
+}
+
+// ZRevRank is ZRank with the highest score first.
+func (d *RedisDatabase) ZRevRank(key string, member string) (int64, error) {
+	return d.zrank("ZREVRANK", key, member)
+}
+
+func (d *RedisDatabase) zrank(command string, key string, member string) (int64, error) {
+	rank, err := redis.Int64(d.Do(command, key, member))
+	if err == redis.ErrNil {
+		return 0, fmt.Errorf("error getting rank of %s in sorted set %s: %w", member, key, ErrMemberNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error getting rank of %s in sorted set %s: %w", member, key, err)
+	}
+	return rank, nil
+}
+
+// ZRemRangeByRank removes the members ranked start to stop, lowest score first, and
+// returns how many were removed.
+func (d *RedisDatabase) ZRemRangeByRank(key string, start int, stop int) (int, error) {
+	removed, err := redis.Int(d.Do("ZREMRANGEBYRANK", key, start, stop))
+	if err != nil {
+		return 0, fmt.Errorf("error removing range of sorted set %s: %w", key, err)
+	}
+	return removed, nil
+}
+
+// scoredMembers parses a WITHSCORES reply.
+func scoredMembers(reply interface{}, err error) ([]ScoredMember, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]ScoredMember, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		member, err := redis.String(values[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		score, err := redis.Float64(values[i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, ScoredMember{Member: member, Score: score})
+	}
+	return members, nil
+}
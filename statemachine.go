@@ -0,0 +1,256 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrVersionConflict is returned when a transition is based on an outdated version.
+	ErrVersionConflict = errors.New("redis: state machine version conflict")
+	// ErrInvalidTransition is returned for a transition not allowed from the current state.
+	ErrInvalidTransition = errors.New("redis: invalid state transition")
+)
+
+// stateTransitionScript moves the state hash KEYS[1] to state ARGV[2] with data ARGV[3]
+// at ARGV[4] when its version is ARGV[1], and records the transition in the history list
+// KEYS[2] trimmed to ARGV[5] entries. Both keys expire after ARGV[6] milliseconds unless it
+// is 0. When ARGV[7] is 1 an existing machine must be in one of the states ARGV[8..]. It
+// returns the outcome (1 applied, 0 version conflict, -1 invalid transition), the
+// version and the previous state.
+var stateTransitionScript = redis.NewScript(2, `
+local current = redis.call('HMGET', KEYS[1], 'version', 'state')
+local version = tonumber(current[1]) or 0
+local from = current[2] or ''
+if version ~= tonumber(ARGV[1]) then
+  return {0, version, from}
+end
+if ARGV[7] == '1' and version > 0 then
+  local allowed = false
+  for i = 8, #ARGV do
+    if ARGV[i] == from then
+      allowed = true
+      break
+    end
+  end
+  if not allowed then
+    return {-1, version, from}
+  end
+end
+version = version + 1
+redis.call('HSET', KEYS[1], 'state', ARGV[2], 'version', version, 'data', ARGV[3], 'updated', ARGV[4])
+redis.call('LPUSH', KEYS[2], cjson.encode({from = from, to = ARGV[2], version = version, at = tonumber(ARGV[4])}))
+redis.call('LTRIM', KEYS[2], 0, tonumber(ARGV[5]) - 1)
+if tonumber(ARGV[6]) > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[6])
+  redis.call('PEXPIRE', KEYS[2], ARGV[6])
+end
+return {1, version, from}`)
+
+// StateMachineOptions configures a StateMachineStore. Zero values select the defaults in
+// brackets.
+type StateMachineOptions struct {
+	// Prefix is prepended to the machine id to form the key ["workflow:"].
+	Prefix string
+	// HistoryLength bounds the transitions kept per machine [100].
+	HistoryLength int
+	// TTL expires a machine and its history this long after its last transition [never].
+	TTL time.Duration
+	// Transitions maps a state to the states it may move to. Any transition is allowed
+	// when it is nil.
+	Transitions map[string][]string
+}
+
+// MachineState is the persisted state of one machine.
+type MachineState struct {
+	ID      string
+	State   string
+	Version int64
+	Data    []byte
+	Updated time.Time
+}
+
+// StateTransition is a history entry of a machine.
+type StateTransition struct {
+	From    string
+	To      string
+	Version int64
+	At      time.Time
+}
+
+// StateMachineStore persists the current step of lightweight workflows, such as sagas,
+// in a hash per machine. Every transition names the version it is based on, so two
+// workers racing on the same machine can not both advance it.
+type StateMachineStore struct {
+	d    *RedisDatabase
+	opts StateMachineOptions
+}
+
+// NewStateMachineStore creates a store on d.
+func NewStateMachineStore(d *RedisDatabase, opts StateMachineOptions) *StateMachineStore {
+	if opts.Prefix == "" {
+		opts.Prefix = "workflow:"
+	}
+	if opts.HistoryLength <= 0 {
+		opts.HistoryLength = 100
+	}
+	return &StateMachineStore{d: d, opts: opts}
+}
+
+func (s *StateMachineStore) keys(id string) (string, string) {
+	key := s.opts.Prefix + id
+	return key, sameSlotKey(key, ":history")
+}
+
+// Create starts machine id in state initial, failing with ErrVersionConflict when it
+// exists.
+func (s *StateMachineStore) Create(id string, initial string, data []byte) (MachineState, error) {
+	return s.Transition(id, 0, initial, data)
+}
+
+// Transition moves machine id from version to state to, replacing its data. It fails with
+// ErrVersionConflict when the machine is at another version and with ErrInvalidTransition
+// when Transitions does not allow the move.
+func (s *StateMachineStore) Transition(id string, version int64, to string, data []byte) (MachineState, error) {
+	now := s.d.options().clock.Now()
+	state := MachineState{ID: id, State: to, Data: data, Updated: now}
+
+	conn := s.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close transition of machine %s: %v", id, err)
+		}
+	}(conn)
+
+	key, historyKey := s.keys(id)
+	args := redis.Args{key, historyKey, version, to, data, now.UnixMilli(), s.opts.HistoryLength, s.opts.TTL.Milliseconds()}
+	if s.opts.Transitions != nil {
+		args = append(args, 1)
+		for from, targets := range s.opts.Transitions {
+			for _, target := range targets {
+				if target == to {
+					args = append(args, from)
+					break
+				}
+			}
+		}
+	} else {
+		args = append(args, 0)
+	}
+
+	values, err := redis.Values(stateTransitionScript.Do(instrumentedConn{conn, s.d}, args...))
+	if err != nil {
+		return state, fmt.Errorf("error transitioning machine %s to %s: %w", id, to, err)
+	}
+	var outcome int64
+	var from string
+	if _, err := redis.Scan(values, &outcome, &state.Version, &from); err != nil {
+		return state, fmt.Errorf("error transitioning machine %s to %s: %w", id, to, err)
+	}
+	switch outcome {
+	case 0:
+		return state, fmt.Errorf("error transitioning machine %s from version %d, it is at version %d: %w", id, version, state.Version, ErrVersionConflict)
+	case -1:
+		return state, fmt.Errorf("error transitioning machine %s from %s to %s: %w", id, from, to, ErrInvalidTransition)
+	}
+	return state, nil
+}
+
+// Get returns the state of machine id, failing with ErrKeyNotFound when it does not exist.
+func (s *StateMachineStore) Get(id string) (MachineState, error) {
+	state := MachineState{ID: id}
+
+	conn := s.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close getting machine %s: %v", id, err)
+		}
+	}(conn)
+
+	key, _ := s.keys(id)
+	values, err := redis.Values(s.d.do(conn, "HMGET", key, "state", "version", "data", "updated"))
+	if err != nil {
+		return state, fmt.Errorf("error getting machine %s: %w", id, err)
+	}
+	if values[1] == nil {
+		return state, fmt.Errorf("error getting machine %s: %w", id, ErrKeyNotFound)
+	}
+	var updated int64
+	if _, err := redis.Scan(values, &state.State, &state.Version, &state.Data, &updated); err != nil {
+		return state, fmt.Errorf("error getting machine %s: %w", id, err)
+	}
+	state.Updated = time.UnixMilli(updated)
+	return state, nil
+}
+
+// History returns up to n transitions of machine id, newest first.
+func (s *StateMachineStore) History(id string, n int) ([]StateTransition, error) {
+	_, historyKey := s.keys(id)
+	entries, err := redis.ByteSlices(s.d.Do("LRANGE", historyKey, 0, n-1))
+	if err != nil {
+		return nil, fmt.Errorf("error getting history of machine %s: %w", id, err)
+	}
+
+	transitions := make([]StateTransition, 0, len(entries))
+	for _, entry := range entries {
+		var t struct {
+			From    string      `json:"from"`
+			To      string      `json:"to"`
+			Version json.Number `json:"version"`
+			At      json.Number `json:"at"`
+		}
+		if err := json.Unmarshal(entry, &t); err != nil {
+			return transitions, fmt.Errorf("error parsing history of machine %s: %w", id, err)
+		}
+		version, _ := strconv.ParseFloat(string(t.Version), 64)
+		at, _ := strconv.ParseFloat(string(t.At), 64)
+		transitions = append(transitions, StateTransition{
+			From:    t.From,
+			To:      t.To,
+			Version: int64(version),
+			At:      time.UnixMilli(int64(at)),
+		})
+	}
+	return transitions, nil
+}
+
+// Delete removes machine id and its history.
+func (s *StateMachineStore) Delete(id string) error {
+	key, historyKey := s.keys(id)
+	if _, err := s.d.Do("DEL", key, historyKey); err != nil {
+		return fmt.Errorf("error deleting machine %s: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+// StreamEntry is an entry of a stream. Fields is nil for entries deleted while pending in
+// a consumer group.
+type StreamEntry struct {
+	ID     string
+	Fields map[string]string
+}
+
+// XAdd appends an entry with fields to stream and returns its id. A positive maxLen trims
+// the stream to about that many entries, using the efficient approximate form of MAXLEN.
+func (d *RedisDatabase) XAdd(stream string, maxLen int64, fields map[string]string) (string, error) {
+	args := redis.Args{stream}
+	if maxLen > 0 {
+		args = args.Add("MAXLEN", "~", maxLen)
+	}
+	args = args.Add("*")
+	for field, value := range fields {
+		args = args.Add(field, value)
+	}
+
+	id, err := redis.String(d.Do("XADD", args...))
+	if err != nil {
+		return "", fmt.Errorf("error adding to stream %s: %w", stream, err)
+	}
+	return id, nil
+}
+
+// XRead returns up to count entries of stream after id, waiting up to block for new
+// entries when there are none, or not at all when block is 0. Pass "$" to only wait for
+// entries added from now on and the id of the last entry to continue reading.
+func (d *RedisDatabase) XRead(stream string, id string, count int, block time.Duration) ([]StreamEntry, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reading stream %s: %v", stream, err)
+		}
+	}(conn)
+
+	args := redis.Args{"COUNT", count}
+	if block > 0 {
+		args = args.Add("BLOCK", block.Milliseconds())
+	}
+	args = args.Add("STREAMS", stream, id)
+	var reply interface{}
+	var err error
+	if block > 0 {
+		reply, err = d.doBlocking(conn, block, "XREAD", args...)
+	} else {
+		reply, err = d.do(conn, "XREAD", args...)
+	}
+	entries, err := parseStreams(reply, err)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stream %s: %w", stream, err)
+	}
+	return entries, nil
+}
+
+// XRange returns up to count entries of stream with IDs from start to end, both
+// inclusive. "-" and "+" stand for the first and last entry.
+func (d *RedisDatabase) XRange(stream string, start string, end string, count int) ([]StreamEntry, error) {
+	reply, err := d.Do("XRANGE", stream, start, end, "COUNT", count)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stream %s: %w", stream, err)
+	}
+	return parseStreamEntries(reply), nil
+}
+
+// XLen returns the number of entries in stream, 0 when it does not exist.
+func (d *RedisDatabase) XLen(stream string) (int64, error) {
+	n, err := redis.Int64(d.Do("XLEN", stream))
+	if err != nil {
+		return 0, fmt.Errorf("error reading length of stream %s: %w", stream, err)
+	}
+	return n, nil
+}
+
+// XTrim removes the oldest entries of stream until at most maxLen are left and returns
+// the number removed. Consumer groups are kept.
+func (d *RedisDatabase) XTrim(stream string, maxLen int64) (int64, error) {
+	n, err := redis.Int64(d.Do("XTRIM", stream, "MAXLEN", maxLen))
+	if err != nil {
+		return 0, fmt.Errorf("error trimming stream %s: %w", stream, err)
+	}
+	return n, nil
+}
+
+// StreamGroupInfo describes a consumer group of a stream.
+type StreamGroupInfo struct {
+	Name      string
+	Consumers int64
+	// Pending is the number of entries delivered to a consumer and not acknowledged.
+	Pending         int64
+	LastDeliveredID string
+	// Lag is the number of entries not delivered to any consumer yet, -1 when the
+	// server does not report it (before Redis 7).
+	Lag int64
+}
+
+// XInfoGroups returns the consumer groups of stream.
+func (d *RedisDatabase) XInfoGroups(stream string) ([]StreamGroupInfo, error) {
+	values, err := redis.Values(d.Do("XINFO", "GROUPS", stream))
+	if err != nil {
+		return nil, fmt.Errorf("error reading groups of stream %s: %w", stream, err)
+	}
+	groups := make([]StreamGroupInfo, 0, len(values))
+	for _, v := range values {
+		fields, err := redis.Values(v, nil)
+		if err != nil {
+			continue
+		}
+		info := StreamGroupInfo{Lag: -1}
+		for i := 0; i+1 < len(fields); i += 2 {
+			name, _ := redis.String(fields[i], nil)
+			switch name {
+			case "name":
+				info.Name, _ = redis.String(fields[i+1], nil)
+			case "consumers":
+				info.Consumers, _ = redis.Int64(fields[i+1], nil)
+			case "pending":
+				info.Pending, _ = redis.Int64(fields[i+1], nil)
+			case "last-delivered-id":
+				info.LastDeliveredID, _ = redis.String(fields[i+1], nil)
+			case "lag":
+				// nil when the server cannot tell, for example after entries were deleted
+				if lag, err := redis.Int64(fields[i+1], nil); err == nil {
+					info.Lag = lag
+				}
+			}
+		}
+		groups = append(groups, info)
+	}
+	return groups, nil
+}
+
+// doBlocking runs a command that waits up to block on the server with a read timeout
+// covering the wait, so it does not fail on the dial read timeout of the connection.
+func (d *RedisDatabase) doBlocking(conn redis.Conn, block time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := redis.DoWithTimeout(conn, block+blockingReadMargin, commandName, args...)
+	d.options().observe(commandName, args, reply, time.Since(start), err)
+	return reply, err
+}
+
+// parseStreams parses the entries of an XREAD or XREADGROUP reply for a single stream.
+func parseStreams(reply interface{}, err error) ([]StreamEntry, error) {
+	streams, err := redis.Values(reply, err)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []StreamEntry
+	for _, s := range streams {
+		stream, err := redis.Values(s, nil)
+		if err != nil || len(stream) != 2 {
+			continue
+		}
+		entries = append(entries, parseStreamEntries(stream[1])...)
+	}
+	return entries, nil
+}
+
+func parseStreamEntries(reply interface{}) []StreamEntry {
+	values, _ := redis.Values(reply, nil)
+	entries := make([]StreamEntry, 0, len(values))
+	for _, e := range values {
+		entry, err := redis.Values(e, nil)
+		if err != nil || len(entry) != 2 {
+			continue
+		}
+		var se StreamEntry
+		se.ID, _ = redis.String(entry[0], nil)
+		se.Fields, _ = redis.StringMap(entry[1], nil)
+		entries = append(entries, se)
+	}
+	return entries
+}
+
+// ConsumerGroupOptions configures a ConsumerGroup. Zero values select the defaults in
+// brackets.
+type ConsumerGroupOptions struct {
+	Stream   string
+	Group    string
+	Consumer string
+	// StartID is where a newly created group starts reading ["$", new entries only].
+	StartID string
+	// BatchSize is the number of entries read at once [10].
+	BatchSize int
+	// Block is how long a read waits for new entries [5s].
+	Block time.Duration
+	// ClaimIdle is how long an entry stays pending before Run claims it from a crashed or
+	// failing consumer with XAUTOCLAIM, on Redis 6.2 and later [5m, negative disables].
+	ClaimIdle time.Duration
+	// MaxLen trims the stream to about that many entries on Add [0, unbounded].
+	MaxLen int64
+	// Backoff is the wait after a failed read [500ms].
+	Backoff time.Duration
+}
+
+// ConsumerGroup reads a stream as one consumer of a consumer group, so each entry is
+// handled by one consumer and stays pending until it is acknowledged.
+type ConsumerGroup struct {
+	d    *RedisDatabase
+	opts ConsumerGroupOptions
+}
+
+// NewConsumerGroup returns a consumer group; call Run to consume it.
+func NewConsumerGroup(d *RedisDatabase, opts ConsumerGroupOptions) *ConsumerGroup {
+	if opts.StartID == "" {
+		opts.StartID = "$"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 10
+	}
+	if opts.Block <= 0 {
+		opts.Block = 5 * time.Second
+	}
+	if opts.ClaimIdle == 0 {
+		opts.ClaimIdle = 5 * time.Minute
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 500 * time.Millisecond
+	}
+	return &ConsumerGroup{d: d, opts: opts}
+}
+
+// Create creates the group and the stream unless they exist.
+func (g *ConsumerGroup) Create() error {
+	if g.opts.Stream == "" || g.opts.Group == "" || g.opts.Consumer == "" {
+		return fmt.Errorf("redis: consumer group needs a stream, group and consumer")
+	}
+	_, err := g.d.Do("XGROUP", "CREATE", g.opts.Stream, g.opts.Group, g.opts.StartID, "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("error creating group %s on stream %s: %w", g.opts.Group, g.opts.Stream, err)
+	}
+	return nil
+}
+
+// Add appends an entry to the stream, trimming it to MaxLen.
+func (g *ConsumerGroup) Add(fields map[string]string) (string, error) {
+	return g.d.XAdd(g.opts.Stream, g.opts.MaxLen, fields)
+}
+
+// Read returns entries after id for this consumer: "0", or the ID of a pending entry,
+// reads the entries pending on it after that ID, ">" waits up to Block for entries not
+// delivered to any consumer yet.
+func (g *ConsumerGroup) Read(id string) ([]StreamEntry, error) {
+	conn := g.d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reading stream %s: %v", g.opts.Stream, err)
+		}
+	}(conn)
+
+	args := redis.Args{"GROUP", g.opts.Group, g.opts.Consumer, "COUNT", g.opts.BatchSize}
+	if id == ">" {
+		args = args.Add("BLOCK", g.opts.Block.Milliseconds())
+	}
+	args = args.Add("STREAMS", g.opts.Stream, id)
+	var reply interface{}
+	var err error
+	if id == ">" {
+		reply, err = g.d.doBlocking(conn, g.opts.Block, "XREADGROUP", args...)
+	} else {
+		reply, err = g.d.do(conn, "XREADGROUP", args...)
+	}
+	entries, err := parseStreams(reply, err)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stream %s: %w", g.opts.Stream, err)
+	}
+	return entries, nil
+}
+
+// Ack acknowledges entries, removing them from the pending entries of the group.
+func (g *ConsumerGroup) Ack(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := g.d.Do("XACK", redis.Args{g.opts.Stream, g.opts.Group}.AddFlat(ids)...); err != nil {
+		return fmt.Errorf("error acknowledging %d entries of stream %s: %w", len(ids), g.opts.Stream, err)
+	}
+	return nil
+}
+
+// Claim moves up to BatchSize entries pending longer than ClaimIdle to this consumer,
+// scanning the pending entries from cursor. It returns the claimed entries and the cursor
+// to continue from, which is "0-0" once the scan wrapped around.
+func (g *ConsumerGroup) Claim(cursor string) ([]StreamEntry, string, error) {
+	reply, err := redis.Values(g.d.Do("XAUTOCLAIM", g.opts.Stream, g.opts.Group, g.opts.Consumer,
+		g.opts.ClaimIdle.Milliseconds(), cursor, "COUNT", g.opts.BatchSize))
+	if err != nil {
+		return nil, cursor, fmt.Errorf("error claiming entries of stream %s: %w", g.opts.Stream, err)
+	}
+	if len(reply) < 2 {
+		return nil, cursor, fmt.Errorf("error claiming entries of stream %s: unexpected reply %v", g.opts.Stream, reply)
+	}
+	next, _ := redis.String(reply[0], nil)
+	return parseStreamEntries(reply[1]), next, nil
+}
+
+// Run creates the group if needed and calls handle with every entry until ctx is done.
+// Entries are acknowledged when handle returns nil; entries it fails on stay pending and
+// are handled again once claimed after ClaimIdle. Entries deleted from the stream while
+// pending are acknowledged without calling handle. Entries left pending by a previous
+// run of the same consumer are handled first.
+func (g *ConsumerGroup) Run(ctx context.Context, handle func(entry StreamEntry) error) error {
+	if err := g.Create(); err != nil {
+		return err
+	}
+
+	o := g.d.options()
+	claim := g.opts.ClaimIdle > 0 && g.d.supports(FeatureXAutoClaim)
+	cursor := "0-0"
+	lastClaim := o.clock.Now()
+	// "0" reads this consumer's pending entries, ">" new ones once none are left
+	id := "0"
+	for ctx.Err() == nil {
+		backoff := func() {
+			select {
+			case <-ctx.Done():
+			case <-o.clock.After(g.opts.Backoff):
+			}
+		}
+		var entries []StreamEntry
+		var err error
+		pending := false
+		if claim && o.clock.Now().Sub(lastClaim) >= g.opts.ClaimIdle {
+			entries, cursor, err = g.Claim(cursor)
+			if cursor == "0-0" {
+				lastClaim = o.clock.Now()
+			}
+		} else {
+			entries, err = g.Read(id)
+			pending = id != ">"
+			if err == nil && pending && len(entries) == 0 {
+				id = ">"
+				continue
+			}
+		}
+		if err != nil {
+			o.logger.Printf("consumer group %s on stream %s: %v", g.opts.Group, g.opts.Stream, err)
+			backoff()
+			continue
+		}
+
+		failed := 0
+		for _, entry := range entries {
+			if entry.Fields != nil {
+				err := o.call("consumer group handler", func() error {
+					return handle(entry)
+				})
+				if err != nil {
+					o.logger.Printf("consumer group %s failed on entry %s of stream %s: %v", g.opts.Group, entry.ID, g.opts.Stream, err)
+					failed++
+					continue
+				}
+			}
+			if err := g.Ack(entry.ID); err != nil {
+				return err
+			}
+		}
+		if pending && len(entries) > 0 {
+			// failed entries stay pending, continue the pending list after them
+			id = entries[len(entries)-1].ID
+		}
+		if failed > 0 && failed == len(entries) {
+			backoff()
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,497 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Publish sends payload to channel and returns the number of clients that received it.
+func (d *RedisDatabase) Publish(channel string, payload []byte) (int, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close publishing to %s: %v", channel, err)
+		}
+	}(conn)
+
+	receivers, err := redis.Int(d.do(conn, "PUBLISH", channel, payload))
+	if err != nil {
+		return 0, fmt.Errorf("error publishing to %s: %w", channel, err)
+	}
+	return receivers, nil
+}
+
+// Message is a message received by a Subscriber. Pattern is set for messages matched by
+// a pattern handler.
+type Message struct {
+	Channel string
+	Pattern string
+	Data    []byte
+}
+
+// OverflowPolicy selects what a Subscriber does with a message received while its buffer
+// is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops reading the connection until a handler makes room. No message
+	// is lost, but the server disconnects the subscriber once its output buffer limit for
+	// pub/sub clients is reached.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest buffered message to make room, so the
+	// connection keeps being read and handlers see the most recent messages.
+	OverflowDropOldest
+)
+
+// SubscriberOptions configures a Subscriber. Zero values select the defaults in brackets.
+type SubscriberOptions struct {
+	// HealthInterval is how often the subscription is checked with PING, a subscription
+	// silent for twice as long is reconnected [30s].
+	HealthInterval time.Duration
+	// MaxBackoff caps the wait between reconnection attempts [5s].
+	MaxBackoff time.Duration
+	// BufferSize is how many received messages wait for their handler [1024].
+	BufferSize int
+	// Overflow selects what happens when the buffer is full [OverflowBlock].
+	Overflow OverflowPolicy
+}
+
+// SubscriberStats counts the messages of a Subscriber since it was created.
+type SubscriberStats struct {
+	Received  uint64
+	Delivered uint64
+	// Dropped counts messages discarded by OverflowDropOldest.
+	Dropped  uint64
+	Buffered int
+	// Lag is how long the last delivered message waited in the buffer.
+	Lag time.Duration
+}
+
+type bufferedMessage struct {
+	msg      redis.Message
+	received time.Time
+}
+
+// Subscriber dispatches pub/sub messages to handlers registered per channel or pattern on
+// a dedicated connection. Received messages are buffered and handed to the handlers by a
+// separate goroutine, so a slow handler does not stop the connection from being read and
+// its health checks from being answered. When the connection is lost it reconnects with
+// backoff and subscribes again to everything that has a handler; messages published in
+// between are lost, as pub/sub does not buffer them. On databases created with
+// SetupSentinel, SetupCluster or WithEndpointResolver it also subscribes again on a new
+// connection when the topology changes, so a failover moves the subscription.
+//
+// With a GaugeMetrics configured, the lag of every delivered message is reported as
+// subscriber_lag_seconds and the number of dropped messages as subscriber_dropped, both
+// labelled with the normalized channel.
+type Subscriber struct {
+	d    *RedisDatabase
+	opts SubscriberOptions
+
+	queue     chan bufferedMessage
+	received  atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+	lag       atomic.Int64
+
+	mu       sync.Mutex
+	channels map[string]func(msg Message)
+	patterns map[string]func(msg Message)
+	psc      *redis.PubSubConn
+	started  bool
+	stopped  bool
+	aborted  bool
+
+	wake       chan struct{}
+	stop       chan struct{}
+	abort      chan struct{}
+	done       chan struct{}
+	dispatched chan struct{}
+}
+
+// NewSubscriber creates a subscriber on d. Register handlers and call Start.
+func NewSubscriber(d *RedisDatabase, opts SubscriberOptions) *Subscriber {
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = 30 * time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Second
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1024
+	}
+	return &Subscriber{
+		d:          d,
+		opts:       opts,
+		queue:      make(chan bufferedMessage, opts.BufferSize),
+		channels:   map[string]func(msg Message){},
+		patterns:   map[string]func(msg Message){},
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		abort:      make(chan struct{}),
+		done:       make(chan struct{}),
+		dispatched: make(chan struct{}),
+	}
+}
+
+// Handle calls fn with every message published to channel, replacing an earlier handler
+// of the channel. Handlers run one at a time, in the order the messages were received.
+func (s *Subscriber) Handle(channel string, fn func(msg Message)) error {
+	return s.register(s.channels, channel, fn, func(psc *redis.PubSubConn) error {
+		return psc.Subscribe(channel)
+	})
+}
+
+// HandlePattern calls fn with every message published to a channel matching pattern.
+func (s *Subscriber) HandlePattern(pattern string, fn func(msg Message)) error {
+	return s.register(s.patterns, pattern, fn, func(psc *redis.PubSubConn) error {
+		return psc.PSubscribe(pattern)
+	})
+}
+
+// Unhandle removes the handler of channel.
+func (s *Subscriber) Unhandle(channel string) error {
+	return s.unregister(s.channels, channel, func(psc *redis.PubSubConn) error {
+		return psc.Unsubscribe(channel)
+	})
+}
+
+// UnhandlePattern removes the handler of pattern.
+func (s *Subscriber) UnhandlePattern(pattern string) error {
+	return s.unregister(s.patterns, pattern, func(psc *redis.PubSubConn) error {
+		return psc.PUnsubscribe(pattern)
+	})
+}
+
+func (s *Subscriber) register(handlers map[string]func(msg Message), name string, fn func(msg Message), subscribe func(psc *redis.PubSubConn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, subscribed := handlers[name]
+	handlers[name] = fn
+	if subscribed {
+		return nil
+	}
+	if s.psc == nil {
+		s.signal()
+		return nil
+	}
+	if err := subscribe(s.psc); err != nil {
+		return fmt.Errorf("error subscribing to %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *Subscriber) unregister(handlers map[string]func(msg Message), name string, unsubscribe func(psc *redis.PubSubConn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := handlers[name]; !ok {
+		return nil
+	}
+	delete(handlers, name)
+	if s.psc == nil {
+		return nil
+	}
+	if err := unsubscribe(s.psc); err != nil {
+		return fmt.Errorf("error unsubscribing from %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *Subscriber) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts receiving in the background.
+func (s *Subscriber) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started && !s.stopped {
+		s.started = true
+		go s.run()
+		go s.dispatch()
+	}
+}
+
+// Stats returns the message counters and the current lag.
+func (s *Subscriber) Stats() SubscriberStats {
+	return SubscriberStats{
+		Received:  s.received.Load(),
+		Delivered: s.delivered.Load(),
+		Dropped:   s.dropped.Load(),
+		Buffered:  len(s.queue),
+		Lag:       time.Duration(s.lag.Load()),
+	}
+}
+
+// enqueue buffers a received message according to the overflow policy.
+func (s *Subscriber) enqueue(msg redis.Message) {
+	s.received.Add(1)
+	m := bufferedMessage{msg: msg, received: s.d.options().clock.Now()}
+	if s.opts.Overflow != OverflowDropOldest {
+		select {
+		case s.queue <- m:
+		case <-s.abort:
+		}
+		return
+	}
+	for {
+		select {
+		case s.queue <- m:
+			return
+		default:
+		}
+		select {
+		case old := <-s.queue:
+			dropped := s.dropped.Add(1)
+			if g, ok := s.d.options().metrics.(GaugeMetrics); ok {
+				g.ObserveGauge("subscriber_dropped", s.d.options().keyNormalizer.Normalize(old.msg.Channel), float64(dropped))
+			}
+		default:
+		}
+	}
+}
+
+// dispatch hands buffered messages to their handlers until Stop, or until receiving
+// ended and the buffer is empty after Drain.
+func (s *Subscriber) dispatch() {
+	defer close(s.dispatched)
+	for {
+		select {
+		case <-s.abort:
+			return
+		case m := <-s.queue:
+			s.deliver(m)
+		case <-s.done:
+			for {
+				select {
+				case <-s.abort:
+					return
+				case m := <-s.queue:
+					s.deliver(m)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Subscriber) deliver(m bufferedMessage) {
+	o := s.d.options()
+	s.mu.Lock()
+	fn, ok := s.channels[m.msg.Channel]
+	if m.msg.Pattern != "" {
+		fn, ok = s.patterns[m.msg.Pattern]
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	lag := o.clock.Now().Sub(m.received)
+	s.lag.Store(int64(lag))
+	if g, ok := o.metrics.(GaugeMetrics); ok {
+		g.ObserveGauge("subscriber_lag_seconds", o.keyNormalizer.Normalize(m.msg.Channel), lag.Seconds())
+	}
+	msg := Message{Channel: m.msg.Channel, Pattern: m.msg.Pattern, Data: m.msg.Data}
+	_ = o.call("subscriber handler", func() error {
+		fn(msg)
+		return nil
+	})
+	s.delivered.Add(1)
+}
+
+func (s *Subscriber) run() {
+	defer close(s.done)
+
+	backoff := 100 * time.Millisecond
+	for {
+		err := s.receive()
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		if err == nil {
+			backoff = 100 * time.Millisecond
+			continue
+		}
+		s.d.options().logger.Printf("subscriber lost subscription: %v", err)
+
+		select {
+		case <-s.stop:
+			return
+		case <-s.d.options().clock.After(backoff):
+		}
+		if backoff *= 2; backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+	}
+}
+
+// receive waits until there is a handler, subscribes to everything that has one and
+// dispatches messages until the subscription fails or every handler was removed.
+func (s *Subscriber) receive() error {
+	s.mu.Lock()
+	for len(s.channels) == 0 && len(s.patterns) == 0 {
+		s.mu.Unlock()
+		select {
+		case <-s.stop:
+			return nil
+		case <-s.wake:
+		}
+		s.mu.Lock()
+	}
+	if s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+
+	changed := s.d.topologyChanged()
+	psc := redis.PubSubConn{Conn: s.d.redisPool.Get()}
+	defer func() {
+		s.mu.Lock()
+		s.psc = nil
+		s.mu.Unlock()
+		_ = psc.Close()
+	}()
+
+	var err error
+	if len(s.channels) > 0 {
+		err = psc.Subscribe(redis.Args{}.AddFlat(keysOf(s.channels))...)
+	}
+	if err == nil && len(s.patterns) > 0 {
+		err = psc.PSubscribe(redis.Args{}.AddFlat(keysOf(s.patterns))...)
+	}
+	if err == nil {
+		s.psc = &psc
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	pinged := make(chan struct{})
+	defer close(pinged)
+	go func() {
+		ticker := s.d.options().clock.NewTicker(s.opts.HealthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pinged:
+				return
+			case <-ticker.C():
+				s.mu.Lock()
+				_ = psc.Ping("")
+				s.mu.Unlock()
+			case <-changed:
+				// unsubscribing ends receive, which subscribes again on a new connection
+				s.d.options().logger.Printf("subscriber resubscribing after a topology change")
+				changed = nil
+				s.mu.Lock()
+				_ = psc.Unsubscribe()
+				_ = psc.PUnsubscribe()
+				s.mu.Unlock()
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * s.opts.HealthInterval).(type) {
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case redis.Message:
+			s.enqueue(v)
+		case error:
+			return v
+		}
+	}
+}
+
+func keysOf(m map[string]func(msg Message)) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Close stops receiving.
+func (s *Subscriber) Close() {
+	_ = s.Stop(context.Background())
+}
+
+// Stop stops receiving, waiting for a handler in progress until ctx is done. Messages
+// still buffered are discarded.
+func (s *Subscriber) Stop(ctx context.Context) error {
+	return s.shutdown(ctx, true)
+}
+
+// Drain stops accepting messages, unsubscribes from everything and waits until the
+// handlers processed the messages received before, or until ctx is done. Stop discards
+// what is left when Drain did not finish in time.
+func (s *Subscriber) Drain(ctx context.Context) error {
+	return s.shutdown(ctx, false)
+}
+
+func (s *Subscriber) shutdown(ctx context.Context, abort bool) error {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+		if s.psc != nil {
+			_ = s.psc.Unsubscribe()
+			_ = s.psc.PUnsubscribe()
+		}
+	}
+	if abort && !s.aborted {
+		s.aborted = true
+		close(s.abort)
+	}
+	started := s.started
+	s.mu.Unlock()
+
+	if !started {
+		return nil
+	}
+	if err := waitDone(ctx, s.done); err != nil {
+		return err
+	}
+	return waitDone(ctx, s.dispatched)
+}
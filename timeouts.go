@@ -0,0 +1,126 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdaptiveTimeouts derives per command deadlines from observed latencies. Zero values
+// select the defaults in brackets.
+type AdaptiveTimeouts struct {
+	// Percentile of recent latencies the deadline is based on [0.99].
+	Percentile float64
+	// Multiplier applied to the percentile [2].
+	Multiplier float64
+	// Min and Max bound the deadline [10ms, 5s]. Max is also used until a command has
+	// enough samples.
+	Min time.Duration
+	Max time.Duration
+	// Window is the number of recent latencies kept per command [1000].
+	Window int
+}
+
+// minTimeoutSamples is the number of latencies needed before a deadline is derived.
+const minTimeoutSamples = 20
+
+// blockingCommands wait on the server by design and are never given adaptive deadlines.
+var blockingCommands = map[string]bool{
+	"BLPOP": true, "BRPOP": true, "BRPOPLPUSH": true, "BLMOVE": true, "BLMPOP": true,
+	"BZPOPMIN": true, "BZPOPMAX": true, "BZMPOP": true, "XREAD": true, "XREADGROUP": true,
+	"WAIT": true, "WAITAOF": true, "SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"MONITOR": true,
+}
+
+// WithAdaptiveTimeouts gives every command a deadline of a latency percentile times a
+// multiplier, tracked per command and bounded by Min and Max, so deadlines follow the
+// server instead of being either too tight during incidents or too loose normally.
+// Blocking commands such as BLPOP are exempt.
+func WithAdaptiveTimeouts(t AdaptiveTimeouts) Option {
+	if t.Percentile <= 0 || t.Percentile > 1 {
+		t.Percentile = 0.99
+	}
+	if t.Multiplier <= 0 {
+		t.Multiplier = 2
+	}
+	if t.Min <= 0 {
+		t.Min = 10 * time.Millisecond
+	}
+	if t.Max <= 0 {
+		t.Max = 5 * time.Second
+	}
+	if t.Window <= 0 {
+		t.Window = 1000
+	}
+	return func(o *options) {
+		o.timeouts = &adaptiveTimeouts{config: t, windows: map[string]*latencyWindow{}}
+	}
+}
+
+type adaptiveTimeouts struct {
+	config AdaptiveTimeouts
+
+	mu      sync.Mutex
+	windows map[string]*latencyWindow
+}
+
+func (a *adaptiveTimeouts) window(commandName string) *latencyWindow {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	w, ok := a.windows[commandName]
+	if !ok {
+		w = newLatencyWindow(a.config.Window)
+		a.windows[commandName] = w
+	}
+	return w
+}
+
+// timeout returns the deadline for commandName, zero for commands without deadline.
+func (a *adaptiveTimeouts) timeout(commandName string) time.Duration {
+	commandName = strings.ToUpper(commandName)
+	if blockingCommands[commandName] {
+		return 0
+	}
+
+	w := a.window(commandName)
+	if w.count() < minTimeoutSamples {
+		return a.config.Max
+	}
+	timeout := time.Duration(float64(w.percentile(a.config.Percentile)) * a.config.Multiplier)
+	return minDuration(maxDuration(timeout, a.config.Min), a.config.Max)
+}
+
+func (a *adaptiveTimeouts) observe(commandName string, elapsed time.Duration) {
+	commandName = strings.ToUpper(commandName)
+	if blockingCommands[commandName] {
+		return
+	}
+	a.window(commandName).add(elapsed)
+}
@@ -0,0 +1,115 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"os"
+	"strings"
+)
+
+// WithCredentials authenticates connections as an ACL user, or with the requirepass
+// password when Username is empty. Credentials in the URL take precedence.
+func WithCredentials(c Credentials) Option {
+	var dialOptions []redis.DialOption
+	if c.Username != "" {
+		dialOptions = append(dialOptions, redis.DialUsername(c.Username))
+	}
+	if c.Password != "" {
+		dialOptions = append(dialOptions, redis.DialPassword(c.Password))
+	}
+	return WithDialOptions(dialOptions...)
+}
+
+// TLSOptions describes the TLS setup of managed offerings such as ElastiCache or Azure
+// Cache, build the tls.Config for WithTLS with Config.
+type TLSOptions struct {
+	// CAFile or CAPEM hold the PEM encoded CA certificates to verify the server with,
+	// the system roots are used when both are empty.
+	CAFile string
+	CAPEM  []byte
+	// CertFile and KeyFile hold a client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the host name verified against the server certificate.
+	ServerName string
+	// InsecureSkipVerify disables server certificate verification, for development only.
+	InsecureSkipVerify bool
+}
+
+// Config builds the tls.Config, reading the certificate files.
+func (t TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.InsecureSkipVerify}
+
+	pem := t.CAPEM
+	if t.CAFile != "" {
+		data, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file %s: %w", t.CAFile, err)
+		}
+		pem = append(pem[:len(pem):len(pem)], data...)
+	}
+	if len(pem) > 0 {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("redis: no CA certificates found")
+		}
+		config.RootCAs = roots
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate %s: %w", t.CertFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// WithTLS connects over TLS with config, or the defaults when config is nil. A redis://
+// URL is dialed as rediss://, since the URL scheme otherwise decides whether TLS is used.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.useTLS = true
+		o.dialOptions = append(o.dialOptions, redis.DialUseTLS(true))
+		if config != nil {
+			o.dialOptions = append(o.dialOptions, redis.DialTLSConfig(config))
+		}
+	}
+}
+
+// tlsURL switches redisURL to the rediss scheme when TLS was requested with WithTLS.
+func tlsURL(redisURL string, o *options) string {
+	if o.useTLS && strings.HasPrefix(redisURL, "redis://") {
+		return "rediss://" + strings.TrimPrefix(redisURL, "redis://")
+	}
+	return redisURL
+}
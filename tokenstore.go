@@ -0,0 +1,148 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// ErrStateExists is matched by errors.Is when SaveState is called with a state that is
+// already pending.
+var ErrStateExists = errors.New("redis: state already exists")
+
+// TokenStoreOptions configures a TokenStore. Zero values select the defaults in brackets.
+type TokenStoreOptions struct {
+	// Prefix is prepended to the keys ["oauth:"].
+	Prefix string
+	// EncryptionKey is the 16, 24 or 32 byte AES key that refresh tokens are encrypted
+	// with.
+	EncryptionKey []byte
+}
+
+// TokenStore keeps the short lived state of OAuth authorization flows and the refresh
+// tokens obtained with them. States are single use: ConsumeState returns and deletes a
+// state atomically, so a replayed callback finds nothing. Refresh tokens are encrypted
+// with AES-GCM before they are stored.
+type TokenStore struct {
+	d      *RedisDatabase
+	prefix string
+	sealer *sealer
+}
+
+// NewTokenStore creates a store on d, failing when the encryption key is invalid.
+func NewTokenStore(d *RedisDatabase, opts TokenStoreOptions) (*TokenStore, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = "oauth:"
+	}
+	sealer, err := newSealer(opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenStore{d: d, prefix: opts.Prefix, sealer: sealer}, nil
+}
+
+func (s *TokenStore) stateKey(state string) string {
+	return s.prefix + "state:" + state
+}
+
+func (s *TokenStore) refreshKey(subject string) string {
+	return s.prefix + "refresh:" + subject
+}
+
+// SaveState stores payload, such as the PKCE verifier and return URL, under state until
+// ttl passes. It fails with ErrStateExists when state is already pending.
+func (s *TokenStore) SaveState(state string, payload []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("redis: state ttl must be positive")
+	}
+	reply, err := s.d.Do("SET", s.stateKey(state), payload, "NX", "PX", ttl.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("error saving state %s: %w", state, err)
+	}
+	if reply == nil {
+		return fmt.Errorf("error saving state %s: %w", state, ErrStateExists)
+	}
+	return nil
+}
+
+// ConsumeState returns the payload of state and deletes it, failing with ErrKeyNotFound
+// when the state expired, was consumed already or never existed.
+func (s *TokenStore) ConsumeState(state string) ([]byte, error) {
+	payload, err := s.d.GetDel(s.stateKey(state))
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, fmt.Errorf("error consuming state %s: %w", state, ErrKeyNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error consuming state %s: %w", state, err)
+	}
+	return payload, nil
+}
+
+// SaveRefreshToken stores the refresh token of subject encrypted, replacing the previous
+// one. A ttl of zero keeps it until deleted.
+func (s *TokenStore) SaveRefreshToken(subject string, token string, ttl time.Duration) error {
+	key := s.refreshKey(subject)
+	sealed, err := s.sealer.seal(key, []byte(token))
+	if err != nil {
+		return fmt.Errorf("error encrypting refresh token of %s: %w", subject, err)
+	}
+
+	args := redis.Args{key, sealed}
+	if ttl > 0 {
+		args = args.Add("PX", ttl.Milliseconds())
+	}
+	if _, err := s.d.Do("SET", args...); err != nil {
+		return fmt.Errorf("error saving refresh token of %s: %w", subject, err)
+	}
+	return nil
+}
+
+// RefreshToken returns the decrypted refresh token of subject, failing with
+// ErrKeyNotFound when there is none and ErrDecrypt when it can not be decrypted.
+func (s *TokenStore) RefreshToken(subject string) (string, error) {
+	key := s.refreshKey(subject)
+	sealed, err := s.d.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("error getting refresh token of %s: %w", subject, err)
+	}
+	token, err := s.sealer.open(key, sealed)
+	if err != nil {
+		return "", fmt.Errorf("error getting refresh token of %s: %w", subject, err)
+	}
+	return string(token), nil
+}
+
+// DeleteRefreshToken removes the refresh token of subject, for example on logout.
+func (s *TokenStore) DeleteRefreshToken(subject string) error {
+	if err := s.d.Delete(s.refreshKey(subject)); err != nil {
+		return fmt.Errorf("error deleting refresh token of %s: %w", subject, err)
+	}
+	return nil
+}
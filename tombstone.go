@@ -0,0 +1,100 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+var (
+	// ErrKeyNotFound is matched by errors.Is when a key does not exist.
+	ErrKeyNotFound = errors.New("redis: key not found")
+	// ErrDeleted is matched by errors.Is when a key was deleted with DeleteSoft and its
+	// tombstone has not expired yet.
+	ErrDeleted = errors.New("redis: key deleted")
+)
+
+// tombstone is the value DeleteSoft stores in place of a deleted value.
+var tombstone = []byte("\x00redisdb:tombstone\x00")
+
+// IsTombstone reports whether value is the marker written by DeleteSoft, for callers
+// reading keys through Do.
+func IsTombstone(value []byte) bool {
+	return bytes.Equal(value, tombstone)
+}
+
+var setIfNotDeletedScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1`)
+
+// DeleteSoft replaces the value of key with a tombstone that expires after tombstoneTTL.
+// Until then Get reports ErrDeleted instead of ErrKeyNotFound, so readers can tell a
+// fresh delete from a cache miss and do not repopulate the key from a stale upstream.
+func (d *RedisDatabase) DeleteSoft(key string, tombstoneTTL time.Duration) error {
+	if tombstoneTTL <= 0 {
+		return fmt.Errorf("redis: tombstone ttl must be positive")
+	}
+
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close soft deleting key %s: %v", key, err)
+		}
+	}(conn)
+
+	_, err := d.do(conn, "SET", key, tombstone, "PX", tombstoneTTL.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("error soft deleting key %s: %w", key, err)
+	}
+	return nil
+}
+
+// SetIfNotDeleted sets key unless it holds a tombstone, and reports whether it was set.
+// Use it to repopulate a cache from an upstream read that may predate a DeleteSoft.
+func (d *RedisDatabase) SetIfNotDeleted(key string, value []byte) (bool, error) {
+	conn := d.redisPool.Get()
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close setting key %s: %v", key, err)
+		}
+	}(conn)
+
+	set, err := redis.Bool(setIfNotDeletedScript.Do(instrumentedConn{conn, d}, key, tombstone, value))
+	if err != nil {
+		return false, fmt.Errorf("error setting key %s to %s: %w", key, d.options().redact(value), err)
+	}
+	return set, nil
+}
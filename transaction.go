@@ -0,0 +1,245 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// ErrTxConflict is returned when EXEC aborts a transaction because a watched key changed,
+// and by Watch when every attempt conflicted.
+var ErrTxConflict = errors.New("redis: transaction aborted, watched key changed")
+
+// watchAttempts bounds how often Watch runs its function before giving up.
+const watchAttempts = 10
+
+// Tx queues the commands of a MULTI/EXEC transaction. Queued commands are sent when the
+// function passed to Transaction or Watch returns, Read runs a command immediately.
+type Tx struct {
+	ctx  context.Context
+	conn redis.Conn
+	p    Pipeline
+}
+
+// Read runs a command immediately on the connection of the transaction, typically to
+// read watched keys before queuing the updates that depend on them.
+func (tx *Tx) Read(commandName string, args ...interface{}) (interface{}, error) {
+	return tx.p.d.doContext(tx.ctx, tx.conn, commandName, args...)
+}
+
+// Get reads key immediately, failing with ErrKeyNotFound when it does not exist.
+func (tx *Tx) Get(key string) ([]byte, error) {
+	data, err := redis.Bytes(tx.Read("GET", key))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("error getting key %s: %w", key, ErrKeyNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// Do queues an arbitrary command.
+func (tx *Tx) Do(commandName string, args ...interface{}) {
+	tx.p.Do(commandName, args...)
+}
+
+// Set queues a SET of key.
+func (tx *Tx) Set(key string, value []byte) {
+	tx.p.Set(key, value)
+}
+
+// SetWithTTL queues a SET of key expiring after ttl.
+func (tx *Tx) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	tx.p.SetWithTTL(key, value, ttl)
+}
+
+// HSet queues a HSET of field in the hash at key.
+func (tx *Tx) HSet(key string, field string, value []byte) {
+	tx.p.HSet(key, field, value)
+}
+
+// Delete queues a DEL of key.
+func (tx *Tx) Delete(key string) {
+	tx.p.Delete(key)
+}
+
+// Expire queues a PEXPIRE of key.
+func (tx *Tx) Expire(key string, ttl time.Duration) {
+	tx.p.Expire(key, ttl)
+}
+
+// Incr queues an INCR of key.
+func (tx *Tx) Incr(key string) {
+	tx.p.Incr(key)
+}
+
+// Transaction runs fn and executes the commands it queued atomically with MULTI/EXEC,
+// returning their results in the order they were queued. Nothing is sent when fn fails.
+// Commands failing at runtime, such as WRONGTYPE, only fail their own result, while a
+// command rejected when queued aborts the whole transaction.
+func (d *RedisDatabase) Transaction(fn func(tx *Tx) error) ([]PipelineResult, error) {
+	return d.TransactionContext(context.Background(), fn)
+}
+
+// TransactionContext is Transaction bounded by ctx.
+func (d *RedisDatabase) TransactionContext(ctx context.Context, fn func(tx *Tx) error) ([]PipelineResult, error) {
+	return d.WatchContext(ctx, nil, fn)
+}
+
+// Watch is Transaction with keys watched before fn runs, for check-and-set updates: fn
+// reads the keys with Tx.Read and queues the update, and when another client changes a
+// key before EXEC the transaction is dropped and fn runs again, up to 10 times before
+// Watch fails with ErrTxConflict.
+func (d *RedisDatabase) Watch(keys []string, fn func(tx *Tx) error) ([]PipelineResult, error) {
+	return d.WatchContext(context.Background(), keys, fn)
+}
+
+// WatchContext is Watch bounded by ctx.
+func (d *RedisDatabase) WatchContext(ctx context.Context, keys []string, fn func(tx *Tx) error) ([]PipelineResult, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close transaction: %v", err)
+		}
+	}(conn)
+
+	for attempt := 1; ; attempt++ {
+		if len(keys) > 0 {
+			if _, err := d.doContext(ctx, conn, "WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+				return nil, fmt.Errorf("error watching %d keys: %w", len(keys), err)
+			}
+		}
+
+		tx := &Tx{ctx: ctx, conn: conn, p: Pipeline{d: d}}
+		if err := fn(tx); err != nil {
+			if len(keys) > 0 {
+				_, _ = d.doContext(ctx, conn, "UNWATCH")
+			}
+			return nil, err
+		}
+		if tx.p.Len() == 0 {
+			if len(keys) > 0 {
+				_, _ = d.doContext(ctx, conn, "UNWATCH")
+			}
+			return nil, nil
+		}
+
+		results, err := tx.exec()
+		if !errors.Is(err, ErrTxConflict) || attempt >= watchAttempts {
+			return results, err
+		}
+	}
+}
+
+// exec sends MULTI, the queued commands and EXEC in one round trip.
+func (tx *Tx) exec() ([]PipelineResult, error) {
+	o := tx.p.d.options()
+	commands := tx.p.commands
+	results := make([]PipelineResult, len(commands))
+	for i, c := range commands {
+		results[i] = PipelineResult{Command: c.name, Key: commandKey(c.name, c.args)}
+	}
+	failed := func(err error) ([]PipelineResult, error) {
+		err = fmt.Errorf("error executing transaction of %d commands: %w", len(commands), err)
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = err
+			}
+		}
+		return results, err
+	}
+
+	start := time.Now()
+	if err := tx.conn.Send("MULTI"); err != nil {
+		return failed(err)
+	}
+	for _, c := range commands {
+		if err := tx.conn.Send(c.name, c.args...); err != nil {
+			return failed(err)
+		}
+	}
+	if err := tx.conn.Send("EXEC"); err != nil {
+		return failed(err)
+	}
+	if err := tx.conn.Flush(); err != nil {
+		return failed(err)
+	}
+
+	if _, err := redis.ReceiveContext(tx.conn, tx.ctx); err != nil {
+		return failed(err)
+	}
+	for i := range commands {
+		if _, err := redis.ReceiveContext(tx.conn, tx.ctx); err != nil {
+			if tx.conn.Err() != nil {
+				return failed(err)
+			}
+			// rejected while queuing, EXEC will abort the transaction
+			results[i].Err = err
+		}
+	}
+	reply, err := redis.ReceiveContext(tx.conn, tx.ctx)
+	elapsed := time.Since(start)
+	if err == nil && reply == nil {
+		err = ErrTxConflict
+	}
+	if err != nil {
+		for _, c := range commands {
+			o.observe(c.name, c.args, nil, elapsed, err)
+		}
+		return failed(err)
+	}
+
+	replies, _ := reply.([]interface{})
+	for i, c := range commands {
+		var reply interface{}
+		var err error
+		if i < len(replies) {
+			reply = replies[i]
+		}
+		if e, ok := reply.(redis.Error); ok {
+			reply, err = nil, e
+		} else {
+			err = o.checkResponseSize(c.name, c.args, reply)
+		}
+		o.observe(c.name, c.args, reply, elapsed, err)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Reply = reply
+	}
+	return results, nil
+}
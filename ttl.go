@@ -0,0 +1,189 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// NoExpiry is returned by TTL for keys that exist without a time to live.
+const NoExpiry time.Duration = -1
+
+// SetWithTTL sets key to value, expiring after ttl.
+func (d *RedisDatabase) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return d.SetWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// SetWithTTLContext is SetWithTTL bounded by ctx.
+func (d *RedisDatabase) SetWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return fmt.Errorf("redis: ttl of key %s must be at least 1ms", key)
+	}
+
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error setting key %s: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close setting key %s: %v", key, err)
+		}
+	}(conn)
+
+	_, err = d.doContext(ctx, conn, "SET", key, value, "PX", ttl.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("error setting key %s to %s: %w", key, d.options().redact(value), err)
+	}
+	return nil
+}
+
+// Expire sets the time to live of an existing key, failing with ErrKeyNotFound when it
+// does not exist.
+func (d *RedisDatabase) Expire(key string, ttl time.Duration) error {
+	return d.ExpireContext(context.Background(), key, ttl)
+}
+
+// ExpireContext is Expire bounded by ctx.
+func (d *RedisDatabase) ExpireContext(ctx context.Context, key string, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return fmt.Errorf("redis: ttl of key %s must be at least 1ms", key)
+	}
+	return d.expire(ctx, key, "PEXPIRE", ttl.Milliseconds())
+}
+
+// ExpireAt makes an existing key expire at t, failing with ErrKeyNotFound when it does
+// not exist. A t in the past deletes the key.
+func (d *RedisDatabase) ExpireAt(key string, t time.Time) error {
+	return d.ExpireAtContext(context.Background(), key, t)
+}
+
+// ExpireAtContext is ExpireAt bounded by ctx.
+func (d *RedisDatabase) ExpireAtContext(ctx context.Context, key string, t time.Time) error {
+	return d.expire(ctx, key, "PEXPIREAT", t.UnixMilli())
+}
+
+func (d *RedisDatabase) expire(ctx context.Context, key string, command string, ms int64) error {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error expiring key %s: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close expiring key %s: %v", key, err)
+		}
+	}(conn)
+
+	ok, err := redis.Bool(d.doContext(ctx, conn, command, key, ms))
+	if err != nil {
+		return fmt.Errorf("error expiring key %s: %w", key, err)
+	}
+	if !ok {
+		return fmt.Errorf("error expiring key %s: %w", key, ErrKeyNotFound)
+	}
+	return nil
+}
+
+// TTL returns the remaining time to live of key, NoExpiry when it has none and
+// ErrKeyNotFound when it does not exist.
+func (d *RedisDatabase) TTL(key string) (time.Duration, error) {
+	return d.TTLContext(context.Background(), key)
+}
+
+// TTLContext is TTL bounded by ctx.
+func (d *RedisDatabase) TTLContext(ctx context.Context, key string) (time.Duration, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error reading ttl of key %s: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close reading ttl of key %s: %v", key, err)
+		}
+	}(conn)
+
+	ms, err := redis.Int64(d.doContext(ctx, conn, "PTTL", key))
+	if err != nil {
+		return 0, fmt.Errorf("error reading ttl of key %s: %w", key, err)
+	}
+	switch ms {
+	case -2:
+		return 0, fmt.Errorf("error reading ttl of key %s: %w", key, ErrKeyNotFound)
+	case -1:
+		return NoExpiry, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Persist removes the time to live of key and reports whether it had one. It fails with
+// ErrKeyNotFound when the key does not exist.
+func (d *RedisDatabase) Persist(key string) (bool, error) {
+	return d.PersistContext(context.Background(), key)
+}
+
+// PersistContext is Persist bounded by ctx.
+func (d *RedisDatabase) PersistContext(ctx context.Context, key string) (bool, error) {
+	conn, err := d.redisPool.GetContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error persisting key %s: %w", key, err)
+	}
+	defer func(conn redis.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Printf("failed to close persisting key %s: %v", key, err)
+		}
+	}(conn)
+
+	// PERSIST replies 0 for missing keys and keys without a ttl alike, EXISTS in the same
+	// transaction tells them apart
+	if err := conn.Send("MULTI"); err != nil {
+		return false, fmt.Errorf("error persisting key %s: %w", key, err)
+	}
+	if err := conn.Send("PERSIST", key); err != nil {
+		return false, fmt.Errorf("error persisting key %s: %w", key, err)
+	}
+	if err := conn.Send("EXISTS", key); err != nil {
+		return false, fmt.Errorf("error persisting key %s: %w", key, err)
+	}
+	replies, err := redis.Values(d.doContext(ctx, conn, "EXEC"))
+	if err != nil {
+		return false, fmt.Errorf("error persisting key %s: %w", key, err)
+	}
+	var persisted, exists bool
+	if _, err := redis.Scan(replies, &persisted, &exists); err != nil {
+		return false, fmt.Errorf("error persisting key %s: %w", key, err)
+	}
+	if !exists {
+		return false, fmt.Errorf("error persisting key %s: %w", key, ErrKeyNotFound)
+	}
+	return persisted, nil
+}
@@ -0,0 +1,278 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageAccountantOptions configures a UsageAccountant. Zero values select the defaults in
+// brackets.
+type UsageAccountantOptions struct {
+	// Tenant maps a key to the tenant it is charged to [the longest of Prefixes the key
+	// starts with]. Keys, and commands without a key, that map to no tenant are charged
+	// to the empty tenant.
+	Tenant func(key string) string
+	// Prefixes are the tenants of the default Tenant func, and are always reported.
+	Prefixes []string
+	// Interval between reports when started [1m].
+	Interval time.Duration
+	// MemorySamples is the number of random keys sampled for the memory of every report
+	// [1000], negative to skip memory sampling.
+	MemorySamples int
+	// OnReport receives every periodic report.
+	OnReport func(report UsageReport)
+	// OnError receives report errors and may be nil.
+	OnError func(err error)
+}
+
+// TenantUsage is the usage charged to one tenant over a report period.
+type TenantUsage struct {
+	Tenant        string
+	Ops           int64
+	OpsPerSecond  float64
+	BytesSent     int64
+	BytesReceived int64
+	// Memory is the estimated memory held by the tenant's keys at the end of the
+	// period, with MemoryLow and MemoryHigh bounding its 95% confidence interval.
+	Memory     int64
+	MemoryLow  int64
+	MemoryHigh int64
+}
+
+// UsageReport is the usage per tenant between Start and End, sorted by tenant.
+type UsageReport struct {
+	Start   time.Time
+	End     time.Time
+	Tenants []TenantUsage
+}
+
+type tenantCounters struct {
+	ops      int64
+	sent     int64
+	received int64
+}
+
+// UsageAccountant charges the commands of the pools it is installed on with
+// WithUsageAccountant to tenants by key, and periodically reports ops per second,
+// bandwidth and sampled memory per tenant, so the cost of a shared server can be
+// allocated to its users.
+type UsageAccountant struct {
+	opts UsageAccountantOptions
+
+	mu       sync.Mutex
+	start    time.Time
+	counters map[string]*tenantCounters
+
+	stop func()
+}
+
+// NewUsageAccountant creates an accountant, install it with WithUsageAccountant.
+func NewUsageAccountant(opts UsageAccountantOptions) *UsageAccountant {
+	if opts.Tenant == nil {
+		opts.Tenant = longestPrefix(opts.Prefixes)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.MemorySamples == 0 {
+		opts.MemorySamples = 1000
+	}
+	return &UsageAccountant{opts: opts, counters: map[string]*tenantCounters{}}
+}
+
+// WithUsageAccountant charges every command to a tenant of a. One accountant may be
+// shared by several pools.
+func WithUsageAccountant(a *UsageAccountant) Option {
+	return func(o *options) {
+		o.usage = a
+	}
+}
+
+func longestPrefix(prefixes []string) func(key string) string {
+	return func(key string) string {
+		tenant := ""
+		for _, prefix := range prefixes {
+			if len(prefix) > len(tenant) && strings.HasPrefix(key, prefix) {
+				tenant = prefix
+			}
+		}
+		return tenant
+	}
+}
+
+func (a *UsageAccountant) observe(clock Clock, key string, sent int, received int) {
+	tenant := a.opts.Tenant(key)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.start.IsZero() {
+		a.start = clock.Now()
+	}
+	c, ok := a.counters[tenant]
+	if !ok {
+		c = &tenantCounters{}
+		a.counters[tenant] = c
+	}
+	c.ops++
+	c.sent += int64(sent)
+	c.received += int64(received)
+}
+
+// Start reports every Interval to OnReport and as gauges to a GaugeMetrics
+// implementation of d, sampling memory from d, until Close or Stop.
+func (a *UsageAccountant) Start(d *RedisDatabase) {
+	o := d.options()
+	a.mu.Lock()
+	if a.start.IsZero() {
+		a.start = o.clock.Now()
+	}
+	a.mu.Unlock()
+
+	a.stop = startLoop(o.clock.NewTicker(a.opts.Interval), func() {
+		report, err := a.Report(d)
+		if err != nil && a.opts.OnError != nil {
+			_ = o.call("usage accountant error callback", func() error {
+				a.opts.OnError(err)
+				return nil
+			})
+		}
+		if g, ok := o.metrics.(GaugeMetrics); ok {
+			for _, t := range report.Tenants {
+				g.ObserveGauge("usage_ops_per_second", t.Tenant, t.OpsPerSecond)
+				g.ObserveGauge("usage_bytes_sent", t.Tenant, float64(t.BytesSent))
+				g.ObserveGauge("usage_bytes_received", t.Tenant, float64(t.BytesReceived))
+				if a.opts.MemorySamples > 0 {
+					g.ObserveGauge("usage_memory_bytes", t.Tenant, float64(t.Memory))
+				}
+			}
+		}
+		if a.opts.OnReport != nil {
+			_ = o.call("usage accountant report callback", func() error {
+				a.opts.OnReport(report)
+				return nil
+			})
+		}
+	})
+}
+
+// Close stops reporting.
+func (a *UsageAccountant) Close() {
+	_ = a.Stop(context.Background())
+}
+
+// Stop stops reporting, waiting for a report in progress until ctx is done.
+func (a *UsageAccountant) Stop(ctx context.Context) error {
+	if a.stop == nil {
+		return nil
+	}
+	stop := a.stop
+	a.stop = nil
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+	return waitDone(ctx, done)
+}
+
+// Report ends the current period and returns its usage, with the memory of every
+// tenant sampled from d. The counters are reset even when memory sampling fails, in
+// which case the report is returned without memory together with the error.
+func (a *UsageAccountant) Report(d *RedisDatabase) (UsageReport, error) {
+	now := d.options().clock.Now()
+
+	a.mu.Lock()
+	counters := a.counters
+	report := UsageReport{Start: a.start, End: now}
+	a.counters = map[string]*tenantCounters{}
+	a.start = now
+	a.mu.Unlock()
+
+	if report.Start.IsZero() {
+		report.Start = now
+	}
+	for _, prefix := range a.opts.Prefixes {
+		if _, ok := counters[prefix]; !ok {
+			counters[prefix] = &tenantCounters{}
+		}
+	}
+
+	seconds := report.End.Sub(report.Start).Seconds()
+	tenants := make([]string, 0, len(counters))
+	for tenant := range counters {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		c := counters[tenant]
+		usage := TenantUsage{Tenant: tenant, Ops: c.ops, BytesSent: c.sent, BytesReceived: c.received}
+		if seconds > 0 {
+			usage.OpsPerSecond = float64(c.ops) / seconds
+		}
+		report.Tenants = append(report.Tenants, usage)
+	}
+
+	if a.opts.MemorySamples < 0 {
+		return report, nil
+	}
+	estimates, err := d.sampleMemory(tenants, a.opts.MemorySamples, func(key string, j int) bool {
+		return a.opts.Tenant(key) == tenants[j]
+	})
+	if err != nil {
+		return report, fmt.Errorf("error sampling tenant memory: %w", err)
+	}
+	for i, e := range estimates {
+		report.Tenants[i].Memory = e.Bytes
+		report.Tenants[i].MemoryLow = e.Low
+		report.Tenants[i].MemoryHigh = e.High
+	}
+	return report, nil
+}
+
+// WriteTo prints the report as a text table.
+func (r UsageReport) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "usage %s - %s\n", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+	fmt.Fprintf(&b, "  %-24s %10s %10s %12s %12s %12s\n", "tenant", "ops", "ops/s", "sent", "received", "memory")
+	for _, t := range r.Tenants {
+		tenant := t.Tenant
+		if tenant == "" {
+			tenant = "(none)"
+		}
+		fmt.Fprintf(&b, "  %-24s %10d %10.1f %12d %12d %12d\n", tenant, t.Ops, t.OpsPerSecond, t.BytesSent, t.BytesReceived, t.Memory)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,85 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// warmInterval is how often the pool is topped up to its minimum of idle connections.
+const warmInterval = 10 * time.Second
+
+// WithMinIdle keeps at least n idle connections dialed and validated in the background,
+// so the first burst of traffic after a quiet period does not pay for dials and TLS
+// handshakes. n is capped by the pool's MaxIdle.
+func WithMinIdle(n int) Option {
+	return func(o *options) {
+		o.minIdle = n
+	}
+}
+
+// warmPool tops pool up to minIdle idle connections every warmInterval until the pool
+// is closed.
+func warmPool(pool *redis.Pool, minIdle int) {
+	if minIdle > pool.MaxIdle {
+		minIdle = pool.MaxIdle
+	}
+	for {
+		if closed := fillIdle(pool, minIdle); closed {
+			return
+		}
+		time.Sleep(warmInterval)
+	}
+}
+
+// fillIdle borrows minIdle connections at once, which hands out the idle ones and dials
+// the rest, PINGs them and returns them all to the idle list. Broken connections are
+// discarded by the pool when they are returned. It reports whether the pool was closed.
+func fillIdle(pool *redis.Pool, minIdle int) bool {
+	if pool.IdleCount() >= minIdle {
+		return false
+	}
+
+	conns := make([]redis.Conn, 0, minIdle)
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+	for i := 0; i < minIdle; i++ {
+		conn := pool.Get()
+		if err := conn.Err(); err != nil {
+			_ = conn.Close()
+			// redigo does not export the error of a closed pool
+			return err.Error() == "redigo: get on closed pool"
+		}
+		_, _ = conn.Do("PING")
+		conns = append(conns, conn)
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+// **********************************************************************
+//    Copyright (c) 2018 Henry Seurer
+//
+//   Permission is hereby granted, free of charge, to any person
+//    obtaining a copy of this software and associated documentation
+//    files (the "Software"), to deal in the Software without
+//    restriction, including without limitation the rights to use,
+//    copy, modify, merge, publish, distribute, sublicense, and/or sell
+//    copies of the Software, and to permit persons to whom the
+//    Software is furnished to do so, subject to the following
+//    conditions:
+//
+//   The above copyright notice and this permission notice shall be
+//   included in all copies or substantial portions of the Software.
+//
+//    THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+//    EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES
+//    OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+//    NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT
+//    HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+//    WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//    FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+//    OTHER DEALINGS IN THE SOFTWARE.
+//
+// **********************************************************************
+
+package redisdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"time"
+)
+
+// WebhookBridgeOptions configures a WebhookBridge. Zero values select the defaults in
+// brackets.
+type WebhookBridgeOptions struct {
+	Stream   string
+	Group    string
+	Consumer string
+	// URL receives every entry as a JSON POST.
+	URL string
+	// Client sends the requests [http.Client with a 10s timeout].
+	Client *http.Client
+	// Header is added to every request, for example for authentication.
+	Header http.Header
+	// BatchSize is the number of entries read at once [10].
+	BatchSize int
+	// Block is how long a read waits for new entries [5s].
+	Block time.Duration
+	// MaxAttempts is the number of deliveries before an entry is dead lettered [5].
+	MaxAttempts int
+	// Backoff is the wait after the first failed delivery, doubled for every retry [500ms].
+	Backoff time.Duration
+	// DeadLetterStream receives entries that could not be delivered [<Stream>:dlq].
+	DeadLetterStream string
+}
+
+// WebhookEvent is the JSON body posted for a stream entry.
+type WebhookEvent struct {
+	Stream string            `json:"stream"`
+	ID     string            `json:"id"`
+	Fields map[string]string `json:"fields"`
+}
+
+// WebhookBridge consumes a stream through a consumer group and POSTs every entry to an
+// HTTP endpoint. Entries are acknowledged once the endpoint answers 2xx; entries that
+// still fail after MaxAttempts are added to the dead letter stream with the last error
+// and then acknowledged. Entries left pending by a previous run of the same consumer are
+// delivered first.
+type WebhookBridge struct {
+	d     *RedisDatabase
+	opts  WebhookBridgeOptions
+	group *ConsumerGroup
+}
+
+// NewWebhookBridge returns a bridge; call Run to start it.
+func NewWebhookBridge(d *RedisDatabase, opts WebhookBridgeOptions) *WebhookBridge {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 10
+	}
+	if opts.Block <= 0 {
+		opts.Block = 5 * time.Second
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 500 * time.Millisecond
+	}
+	if opts.DeadLetterStream == "" {
+		opts.DeadLetterStream = opts.Stream + ":dlq"
+	}
+	group := NewConsumerGroup(d, ConsumerGroupOptions{
+		Stream:    opts.Stream,
+		Group:     opts.Group,
+		Consumer:  opts.Consumer,
+		BatchSize: opts.BatchSize,
+		Block:     opts.Block,
+		ClaimIdle: -1,
+	})
+	return &WebhookBridge{d: d, opts: opts, group: group}
+}
+
+// Run creates the consumer group if needed and delivers entries until ctx is done.
+func (b *WebhookBridge) Run(ctx context.Context) error {
+	if b.opts.Stream == "" || b.opts.Group == "" || b.opts.Consumer == "" || b.opts.URL == "" {
+		return fmt.Errorf("redis: webhook bridge needs a stream, group, consumer and url")
+	}
+	if err := b.group.Create(); err != nil {
+		return err
+	}
+
+	// "0" reads this consumer's pending entries, ">" new ones once none are left
+	id := "0"
+	for ctx.Err() == nil {
+		events, err := b.read(id)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case <-b.d.options().clock.After(b.opts.Backoff):
+			}
+			continue
+		}
+		if id != ">" && len(events) == 0 {
+			id = ">"
+			continue
+		}
+		for _, event := range events {
+			if err := b.deliver(ctx, event); err != nil {
+				return err
+			}
+		}
+		if id != ">" {
+			// continue the pending list after the entries just delivered
+			id = events[len(events)-1].ID
+		}
+	}
+	return ctx.Err()
+}
+
+func (b *WebhookBridge) read(id string) ([]WebhookEvent, error) {
+	entries, err := b.group.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]WebhookEvent, len(entries))
+	for i, entry := range entries {
+		// entries deleted while pending have no fields
+		events[i] = WebhookEvent{Stream: b.opts.Stream, ID: entry.ID, Fields: entry.Fields}
+	}
+	return events, nil
+}
+
+// deliver posts event with retries, dead letters it when it keeps failing and then
+// acknowledges it. Entries deleted while pending have nothing to post and are only
+// acknowledged. Only errors writing to Redis are returned.
+func (b *WebhookBridge) deliver(ctx context.Context, event WebhookEvent) error {
+	if event.Fields == nil {
+		return b.group.Ack(event.ID)
+	}
+
+	var lastErr error
+	backoff := b.opts.Backoff
+	for attempt := 1; attempt <= b.opts.MaxAttempts; attempt++ {
+		if lastErr = b.post(ctx, event); lastErr == nil {
+			break
+		}
+		if attempt == b.opts.MaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			// leave the entry pending, it is delivered again on the next run
+			return nil
+		case <-b.d.options().clock.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	if lastErr != nil && ctx.Err() != nil {
+		// canceled during the last attempt, leave the entry pending for the next run
+		return nil
+	}
+	if lastErr != nil {
+		args := redis.Args{b.opts.DeadLetterStream, "*", "source_id", event.ID, "error", lastErr.Error()}
+		for field, value := range event.Fields {
+			args = args.Add(field, value)
+		}
+		if _, err := b.d.Do("XADD", args...); err != nil {
+			return fmt.Errorf("error dead lettering entry %s of stream %s: %w", event.ID, b.opts.Stream, err)
+		}
+	}
+	return b.group.Ack(event.ID)
+}
+
+// RequeueDeadLetters moves up to count of the oldest entries of a dead letter stream
+// written by WebhookBridge back to stream, without the source_id and error fields, and
+// returns the number moved. Entries are removed from the dead letter stream only after
+// they were added to stream; dead letters of entries deleted while pending carry no
+// fields and are removed without being requeued.
+func (d *RedisDatabase) RequeueDeadLetters(deadLetterStream string, stream string, count int) (int, error) {
+	entries, err := d.XRange(deadLetterStream, "-", "+", count)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, entry := range entries {
+		fields := make(map[string]string, len(entry.Fields))
+		for field, value := range entry.Fields {
+			if field != "source_id" && field != "error" {
+				fields[field] = value
+			}
+		}
+		if len(fields) > 0 {
+			if _, err := d.XAdd(stream, 0, fields); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+		if _, err := d.Do("XDEL", deadLetterStream, entry.ID); err != nil {
+			return moved, fmt.Errorf("error deleting entry %s of stream %s: %w", entry.ID, deadLetterStream, err)
+		}
+	}
+	return moved, nil
+}
+
+func (b *WebhookBridge) post(ctx context.Context, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range b.opts.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}